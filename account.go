@@ -1,14 +1,22 @@
 package priv
 
-import "database/sql"
+import (
+	"database/sql"
+	"time"
+)
 
 type Account interface {
 	Repository() Repository
+	Limits() (*Limits, error)
+	CustomLimits() (*CustomLimits, error)
+	UpdateCustomLimits(custom *CustomLimits) error
+	Usage(from time.Time, to time.Time) ([]DailyUsage, error)
 }
 
 type AccountImpl struct {
-	db *sql.DB
-	id int
+	db      *sql.DB
+	service *ServiceImpl
+	id      int
 }
 
 func (account *AccountImpl) Repository() Repository {
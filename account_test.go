@@ -8,7 +8,7 @@ import (
 	"testing"
 )
 
-func getTestAccount(t *testing.T, db *sql.DB) Account {
+func getTestAccount(t testing.TB, db *sql.DB) Account {
 	service := NewService(db)
 	account, err := service.GetAccount(fmt.Sprintf("test:%s", t.Name()))
 	require.NoError(t, err)
@@ -1,16 +1,25 @@
 package priv
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"github.com/acoustid/go-acoustid/chromaprint"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/satori/go.uuid"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
 type Error struct {
@@ -24,21 +33,41 @@ type ErrorResponse struct {
 }
 
 type API struct {
-	service Service
-	router  *mux.Router
-	Auth    Authenticator
-	status  int32
+	service      Service
+	router       *mux.Router
+	Auth         Authenticator
+	AdminAuth    Authenticator    // admin endpoints are disabled if nil
+	SearchTokens *SearchTokenKeys // search tokens can't be created if nil
+	Nodes        *SearchNodes
+	// SearchNodeSecret is shared by all API nodes and authenticates searches fanned out to them. The
+	// node search endpoint is disabled if it's empty.
+	SearchNodeSecret string
+	Audit            AuditLog // changes are not audited if nil
+	// TrustForwardedFor uses the X-Forwarded-For header as the client's IP address, it
+	// should only be enabled behind a proxy that sets the header.
+	TrustForwardedFor bool
+	rateLimiter       *RateLimiter
+	status            int32
 }
 
 func NewAPI(service Service) *API {
-	s := &API{service: service}
+	s := &API{service: service, rateLimiter: NewRateLimiter()}
 	s.router = s.createRouter()
 	s.Auth = &NoAuth{}
 	s.SetHealthStatus(true)
 	return s
 }
 
+// maxRequestIDLength is the maximum length of request IDs sent by clients, longer IDs are replaced.
+const maxRequestIDLength = 128
+
 func (s *API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	requestID := req.Header.Get("X-Request-Id")
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		requestID = uuid.NewV4().String()
+		req.Header.Set("X-Request-Id", requestID)
+	}
+	w.Header().Set("X-Request-Id", requestID)
 	s.router.ServeHTTP(w, req)
 }
 
@@ -49,15 +78,29 @@ func (s *API) createRouter() *mux.Router {
 	router.HandleFunc("/_health", s.HealthHandler)
 	router.Handle("/_metrics", promhttp.Handler())
 	v1 := router.PathPrefix("/v1/priv").Subrouter()
-	v1.Methods(http.MethodGet).Path("").HandlerFunc(s.wrapHandler(s.ListCatalogsHandler))
-	v1.Methods(http.MethodGet).Path("/{catalog}").HandlerFunc(s.wrapCatalogHandler(s.GetCatalogHandler))
-	v1.Methods(http.MethodPut).Path("/{catalog}").HandlerFunc(s.wrapCatalogHandler(s.CreateCatalogHandler))
-	v1.Methods(http.MethodDelete).Path("/{catalog}").HandlerFunc(s.wrapCatalogHandler(s.DeleteCatalogHandler))
-	v1.Methods(http.MethodPost).Path("/{catalog}").HandlerFunc(s.wrapCatalogHandler(s.CreateAnonymousTrackHandler))
-	v1.Methods(http.MethodPost).Path("/{catalog}/_search").HandlerFunc(s.wrapCatalogHandler(s.SearchHandler))
-	v1.Methods(http.MethodGet).Path("/{catalog}/{track}").HandlerFunc(s.wrapTrackHandler(s.GetTrackHandler))
-	v1.Methods(http.MethodPut).Path("/{catalog}/{track}").HandlerFunc(s.wrapTrackHandler(s.CreateTrackHandler))
-	v1.Methods(http.MethodDelete).Path("/{catalog}/{track}").HandlerFunc(s.wrapTrackHandler(s.DeleteTrackHandler))
+	v1.Methods(http.MethodGet).Path("").HandlerFunc(s.wrapHandler(ScopeCatalogRead, s.ListCatalogsHandler))
+	v1.Methods(http.MethodGet).Path("/_audit").HandlerFunc(s.wrapHandler(ScopeCatalogRead, s.GetAuditLogHandler))
+	v1.Methods(http.MethodGet).Path("/_usage").HandlerFunc(s.wrapHandler(ScopeCatalogRead, s.GetUsageHandler))
+	v1.Methods(http.MethodPost).Path("/_search_tokens").HandlerFunc(s.wrapHandler(ScopeSearch, s.CreateSearchTokenHandler))
+	v1.Methods(http.MethodGet).Path("/_admin/accounts/{account}/api_keys").HandlerFunc(s.wrapAdminHandler(s.ListAPIKeysHandler))
+	v1.Methods(http.MethodPost).Path("/_admin/accounts/{account}/api_keys").HandlerFunc(s.wrapAdminHandler(s.CreateAPIKeyHandler))
+	v1.Methods(http.MethodPost).Path("/_admin/accounts/{account}/api_keys/{id}/_rotate").HandlerFunc(s.wrapAdminHandler(s.RotateAPIKeyHandler))
+	v1.Methods(http.MethodDelete).Path("/_admin/accounts/{account}/api_keys/{id}").HandlerFunc(s.wrapAdminHandler(s.RevokeAPIKeyHandler))
+	v1.Methods(http.MethodGet).Path("/_admin/accounts/{account}/limits").HandlerFunc(s.wrapAdminHandler(s.GetAccountLimitsHandler))
+	v1.Methods(http.MethodPut).Path("/_admin/accounts/{account}/limits").HandlerFunc(s.wrapAdminHandler(s.UpdateAccountLimitsHandler))
+	v1.Methods(http.MethodGet).Path("/_admin/accounts/{account}/_purge").HandlerFunc(s.wrapAdminHandler(s.GetAccountPurgeHandler))
+	v1.Methods(http.MethodPost).Path("/_admin/accounts/{account}/_purge").HandlerFunc(s.wrapAdminHandler(s.PurgeAccountHandler))
+	v1.Methods(http.MethodGet).Path("/{catalog}").HandlerFunc(s.wrapCatalogHandler(ScopeCatalogRead, s.GetCatalogHandler))
+	v1.Methods(http.MethodPut).Path("/{catalog}").HandlerFunc(s.wrapCatalogHandler(ScopeCatalogWrite, s.CreateCatalogHandler))
+	v1.Methods(http.MethodDelete).Path("/{catalog}").HandlerFunc(s.wrapCatalogHandler(ScopeCatalogWrite, s.DeleteCatalogHandler))
+	v1.Methods(http.MethodPost).Path("/{catalog}").HandlerFunc(s.wrapCatalogHandler(ScopeCatalogWrite, s.CreateAnonymousTrackHandler))
+	v1.Methods(http.MethodPost).Path("/{catalog}/_search").HandlerFunc(s.wrapCatalogHandler(ScopeSearch, s.SearchHandler))
+	v1.Methods(http.MethodPost).Path("/{catalog}/_node_search").HandlerFunc(s.wrapSearchNodeHandler(s.wrapCatalogHandler(ScopeSearch, s.NodeSearchHandler)))
+	v1.Methods(http.MethodGet).Path("/{catalog}/_stop_list").HandlerFunc(s.wrapCatalogHandler(ScopeCatalogRead, s.GetStopListHandler))
+	v1.Methods(http.MethodPost).Path("/{catalog}/_stop_list").HandlerFunc(s.wrapCatalogHandler(ScopeCatalogWrite, s.UpdateStopListHandler))
+	v1.Methods(http.MethodGet).Path("/{catalog}/{track}").HandlerFunc(s.wrapTrackHandler(ScopeCatalogRead, s.GetTrackHandler))
+	v1.Methods(http.MethodPut).Path("/{catalog}/{track}").HandlerFunc(s.wrapTrackHandler(ScopeCatalogWrite, s.CreateTrackHandler))
+	v1.Methods(http.MethodDelete).Path("/{catalog}/{track}").HandlerFunc(s.wrapTrackHandler(ScopeCatalogWrite, s.DeleteTrackHandler))
 	return router
 }
 
@@ -69,43 +112,171 @@ func (s *API) MethodNotAllowedHandler(w http.ResponseWriter, request *http.Reque
 	writeResponseError(w, http.StatusNotFound, Error{"method_not_allowed", "Method not allowed"})
 }
 
-func (s *API) wrapHandler(handler func(w http.ResponseWriter, req *http.Request, repo Repository)) http.HandlerFunc {
+// authenticate checks the request's credentials and writes an error response if they are not valid.
+func authenticate(w http.ResponseWriter, req *http.Request, auth Authenticator) *Principal {
+	principal, err := auth.Authenticate(req)
+	if err != nil {
+		if errors.Cause(err) == ErrNotAuthorized {
+			reason := fmt.Sprintf("Not authorized: %s", err)
+			writeResponseError(w, http.StatusUnauthorized, Error{"unauthorized", reason})
+			return nil
+		}
+		log.Printf("Failed to authenticate account: %v", err)
+		writeResponseInternalError(w)
+		return nil
+	}
+	return principal
+}
+
+func writeMissingScope(w http.ResponseWriter, scope string) {
+	reason := fmt.Sprintf("Missing permission %q", scope)
+	writeResponseError(w, http.StatusForbidden, Error{"forbidden", reason})
+}
+
+func writeAccountDeleted(w http.ResponseWriter) {
+	writeResponseError(w, http.StatusForbidden, Error{"account_deleted", "Account was deleted"})
+}
+
+// checkRateLimit makes a request with the key and writes an error response if it's over the limit.
+func (s *API) checkRateLimit(w http.ResponseWriter, key string, limit int, interval time.Duration) bool {
+	status := s.rateLimiter.Take(key, limit, interval)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(status.Reset.Seconds()))))
+	if !status.Allowed {
+		writeResponseError(w, http.StatusTooManyRequests, Error{"rate_limited", "Rate limit exceeded"})
+		return false
+	}
+	return true
+}
+
+// checkAccountRateLimit applies the account's limit of search or write requests.
+func (s *API) checkAccountRateLimit(w http.ResponseWriter, scope string, principal *Principal, account Account) bool {
+	if scope != ScopeSearch && scope != ScopeCatalogWrite {
+		return true
+	}
+	limits, err := account.Limits()
+	if err != nil {
+		log.Printf("Failed to get limits of account %s: %v", principal.Account, err)
+		writeResponseInternalError(w)
+		return false
+	}
+	limit := limits.SearchRate
+	if scope == ScopeCatalogWrite {
+		limit = limits.WriteRate
+	}
+	if limit == 0 {
+		return true
+	}
+	return s.checkRateLimit(w, scope+":account:"+principal.Account, limit, time.Second)
+}
+
+func writeQuotaError(w http.ResponseWriter, err error) bool {
+	quotaErr, ok := errors.Cause(err).(*QuotaError)
+	if !ok {
+		return false
+	}
+	reason := fmt.Sprintf("Quota exceeded, the maximum number of %s is %d", quotaErr.Quota, quotaErr.Limit)
+	writeResponseError(w, http.StatusForbidden, Error{"quota_exceeded", reason})
+	return true
+}
+
+type contextKey int
+
+// principalContextKey is the key of the authenticated principal in request contexts.
+const principalContextKey contextKey = 0
+
+// clientIP returns the IP address of the client which made the request.
+func (s *API) clientIP(req *http.Request) string {
+	if s.TrustForwardedFor {
+		forwardedFor := req.Header.Get("X-Forwarded-For")
+		if forwardedFor != "" {
+			return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// audit records a change made by the request in the audit log. The change was already
+// made, so failures are only logged.
+func (s *API) audit(req *http.Request, action string, catalog string, object string) {
+	if s.Audit == nil {
+		return
+	}
+	principal, ok := req.Context().Value(principalContextKey).(*Principal)
+	if !ok {
+		return
+	}
+	entry := &AuditEntry{
+		Account:   principal.Account,
+		Principal: principal.auditName(),
+		IP:        s.clientIP(req),
+		RequestID: req.Header.Get("X-Request-Id"),
+		Action:    action,
+		Catalog:   catalog,
+		Object:    object,
+	}
+	err := s.Audit.Record(entry)
+	if err != nil {
+		log.Printf("Failed to record %s of account %s in audit log: %v", action, principal.Account, err)
+		auditErrorCount.Inc()
+	}
+}
+
+func (s *API) wrapHandler(scope string, handler func(w http.ResponseWriter, req *http.Request, principal *Principal, repo Repository)) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		externalAccountID, err := s.Auth.Authenticate(req)
+		principal := authenticate(w, req, s.Auth)
+		if principal == nil {
+			return
+		}
+		if !principal.HasScope(scope) {
+			writeMissingScope(w, scope)
+			return
+		}
+		if principal.RateLimit > 0 && !s.checkRateLimit(w, principal.rateLimitKey(), principal.RateLimit, time.Minute) {
+			return
+		}
+		account, err := s.service.GetAccount(principal.Account)
 		if err != nil {
-			if errors.Cause(err) == ErrNotAuthorized {
-				reason := fmt.Sprintf("Not authorized: %s", err)
-				writeResponseError(w, http.StatusUnauthorized, Error{"unauthorized", reason})
+			if errors.Cause(err) == ErrAccountDeleted {
+				writeAccountDeleted(w)
 				return
 			}
-			log.Printf("Failed to authenticate account: %v", err)
+			log.Printf("Failed to get account: %v", err)
 			writeResponseInternalError(w)
 			return
 		}
-		account, err := s.service.GetAccount(externalAccountID)
-		if err != nil {
-			log.Printf("Failed to get account: %v", err)
-			writeResponseInternalError(w)
+		if !s.checkAccountRateLimit(w, scope, principal, account) {
 			return
 		}
-		handler(w, req, account.Repository())
+		req = req.WithContext(context.WithValue(req.Context(), principalContextKey, principal))
+		handler(w, req, principal, account.Repository())
 	}
 }
 
-func (s *API) wrapCatalogHandler(handler func(w http.ResponseWriter, req *http.Request, catalog Catalog)) http.HandlerFunc {
-	return s.wrapHandler(func(w http.ResponseWriter, req *http.Request, repo Repository) {
+func (s *API) wrapCatalogHandler(scope string, handler func(w http.ResponseWriter, req *http.Request, catalog Catalog)) http.HandlerFunc {
+	return s.wrapHandler(scope, func(w http.ResponseWriter, req *http.Request, principal *Principal, repo Repository) {
 		vars := mux.Vars(req)
 		catalogName := vars["catalog"]
 		if !IsValidCatalogName(catalogName) {
 			writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid catalog name"})
 			return
 		}
+		if !principal.CanAccessCatalog(catalogName) {
+			reason := fmt.Sprintf("Access to catalog %s is not allowed", catalogName)
+			writeResponseError(w, http.StatusForbidden, Error{"forbidden", reason})
+			return
+		}
 		handler(w, req, repo.Catalog(catalogName))
 	})
 }
 
-func (s *API) wrapTrackHandler(handler func(w http.ResponseWriter, req *http.Request, catalog Catalog, trackID string)) http.HandlerFunc {
-	return s.wrapCatalogHandler(func(w http.ResponseWriter, req *http.Request, catalog Catalog) {
+func (s *API) wrapTrackHandler(scope string, handler func(w http.ResponseWriter, req *http.Request, catalog Catalog, trackID string)) http.HandlerFunc {
+	return s.wrapCatalogHandler(scope, func(w http.ResponseWriter, req *http.Request, catalog Catalog) {
 		vars := mux.Vars(req)
 		trackID := vars["track"]
 		if !IsValidTrackID(trackID) {
@@ -116,6 +287,45 @@ func (s *API) wrapTrackHandler(handler func(w http.ResponseWriter, req *http.Req
 	})
 }
 
+func (s *API) wrapAdminHandler(handler func(w http.ResponseWriter, req *http.Request, account string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.AdminAuth == nil {
+			writeResponseError(w, http.StatusForbidden, Error{"forbidden", "Admin API is disabled"})
+			return
+		}
+		principal := authenticate(w, req, s.AdminAuth)
+		if principal == nil {
+			return
+		}
+		if !principal.HasScope(ScopeAdmin) {
+			writeMissingScope(w, ScopeAdmin)
+			return
+		}
+		vars := mux.Vars(req)
+		account := vars["account"]
+		if account == "" {
+			writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid account"})
+			return
+		}
+		// Changes made with the admin API are audited as changes of the account.
+		adminPrincipal := &Principal{Account: account, Credential: "admin"}
+		req = req.WithContext(context.WithValue(req.Context(), principalContextKey, adminPrincipal))
+		handler(w, req, account)
+	}
+}
+
+// wrapSearchNodeHandler only accepts requests from other API nodes, which send the search node secret.
+func (s *API) wrapSearchNodeHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		secret := req.Header.Get(searchNodeSecretHeader)
+		if s.SearchNodeSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.SearchNodeSecret)) != 1 {
+			writeResponseError(w, http.StatusForbidden, Error{"forbidden", "Only search nodes can use this endpoint"})
+			return
+		}
+		handler(w, req)
+	}
+}
+
 func (s *API) SetHealthStatus(status bool) {
 	var value int32
 	if status {
@@ -147,7 +357,7 @@ type ListCatalogsResponseCatalog struct {
 	Catalog string `json:"catalog"`
 }
 
-func (s *API) ListCatalogsHandler(w http.ResponseWriter, req *http.Request, repo Repository) {
+func (s *API) ListCatalogsHandler(w http.ResponseWriter, req *http.Request, principal *Principal, repo Repository) {
 	catalogs, err := repo.ListCatalogs()
 	if err != nil {
 		log.Printf("Failed to list catalogs: %v", err)
@@ -156,9 +366,11 @@ func (s *API) ListCatalogsHandler(w http.ResponseWriter, req *http.Request, repo
 	}
 
 	var resp ListCatalogsResponse
-	resp.Catalogs = make([]ListCatalogsResponseCatalog, len(catalogs))
-	for i, catalog := range catalogs {
-		resp.Catalogs[i].Catalog = catalog.Name()
+	resp.Catalogs = make([]ListCatalogsResponseCatalog, 0, len(catalogs))
+	for _, catalog := range catalogs {
+		if principal.CanAccessCatalog(catalog.Name()) {
+			resp.Catalogs = append(resp.Catalogs, ListCatalogsResponseCatalog{Catalog: catalog.Name()})
+		}
 	}
 	writeResponseOK(w, &resp)
 }
@@ -167,6 +379,49 @@ type CatalogResponse struct {
 	Catalog string `json:"catalog"`
 }
 
+type CatalogStatsResponse struct {
+	Catalog string                    `json:"catalog"`
+	Stats   CatalogStatsResponseStats `json:"stats"`
+}
+
+type CatalogStatsResponseStats struct {
+	Tracks      int                              `json:"tracks"`
+	MemoryIndex *CatalogStatsResponseMemoryIndex `json:"memory_index,omitempty"`
+	Reindex     *CatalogStatsResponseReindex     `json:"reindex,omitempty"`
+}
+
+type CatalogStatsResponseMemoryIndex struct {
+	Loaded       bool    `json:"loaded"`
+	Tracks       int     `json:"tracks"`
+	Hashes       int     `json:"hashes"`
+	MemoryUsage  int64   `json:"memory_bytes"`
+	LoadDuration float64 `json:"load_duration"`
+}
+
+type CatalogStatsResponseReindex struct {
+	IndexType     string  `json:"index_type"`
+	Tracks        int     `json:"tracks"`
+	IndexedTracks int     `json:"indexed_tracks"`
+	Progress      float64 `json:"progress"`
+	Started       string  `json:"started"`
+}
+
+type UpdateCatalogRequest struct {
+	MemoryIndex         *bool   `json:"memory_index"`
+	IndexType           *string `json:"index_type"`
+	FingerprintVersions *[]int  `json:"fingerprint_versions"`
+}
+
+type StopListResponse struct {
+	Catalog  string                  `json:"catalog"`
+	StopList []StopListResponseValue `json:"stop_list"`
+}
+
+type StopListResponseValue struct {
+	Value  int32 `json:"value"`
+	Tracks int   `json:"tracks"`
+}
+
 type ListTracksResponse struct {
 	Catalog string                    `json:"catalog"`
 	Tracks  []ListTracksResponseTrack `json:"tracks"`
@@ -175,9 +430,11 @@ type ListTracksResponse struct {
 }
 
 type ListTracksResponseTrack struct {
-	ID          string   `json:"id"`
-	Metadata    Metadata `json:"metadata,omitempty"`
-	Fingerprint string   `json:"fingerprint,omitempty"`
+	ID                 string   `json:"id"`
+	Metadata           Metadata `json:"metadata,omitempty"`
+	Fingerprint        string   `json:"fingerprint,omitempty"`
+	FingerprintVersion int      `json:"fingerprint_version,omitempty"`
+	Duration           float64  `json:"duration,omitempty"`
 }
 
 func (s *API) GetCatalogHandler(w http.ResponseWriter, request *http.Request, catalog Catalog) {
@@ -193,6 +450,10 @@ func (s *API) GetCatalogHandler(w http.ResponseWriter, request *http.Request, ca
 	}
 
 	query := request.URL.Query()
+	if len(query["stats"]) != 0 {
+		s.writeCatalogStats(w, catalog)
+		return
+	}
 	if len(query["tracks"]) == 0 {
 		writeResponseOK(w, &CatalogResponse{catalog.Name()})
 		return
@@ -219,18 +480,125 @@ func (s *API) GetCatalogHandler(w http.ResponseWriter, request *http.Request, ca
 	for i, track := range results.Tracks {
 		response.Tracks[i].ID = track.ID
 		response.Tracks[i].Metadata = track.Metadata
+		response.Tracks[i].FingerprintVersion = track.FingerprintVersion
+		response.Tracks[i].Duration = track.Duration.Seconds()
+	}
+
+	writeResponseOK(w, response)
+}
+
+func (s *API) writeCatalogStats(w http.ResponseWriter, catalog Catalog) {
+	stats, err := catalog.Stats()
+	if err != nil {
+		log.Printf("Failed to get stats of catalog %s: %v", catalog.Name(), err)
+		writeResponseInternalError(w)
+		return
 	}
 
+	response := &CatalogStatsResponse{Catalog: catalog.Name()}
+	response.Stats.Tracks = stats.NumTracks
+	if stats.MemoryIndex != nil {
+		response.Stats.MemoryIndex = &CatalogStatsResponseMemoryIndex{
+			Loaded:       stats.MemoryIndex.Ready,
+			Tracks:       stats.MemoryIndex.NumTracks,
+			Hashes:       stats.MemoryIndex.NumHashes,
+			MemoryUsage:  stats.MemoryIndex.MemoryUsage,
+			LoadDuration: stats.MemoryIndex.LoadDuration.Seconds(),
+		}
+	}
+	if stats.Reindex != nil {
+		response.Stats.Reindex = &CatalogStatsResponseReindex{
+			IndexType:     stats.Reindex.IndexType,
+			Tracks:        stats.Reindex.NumTracks,
+			IndexedTracks: stats.Reindex.NumIndexed,
+			Started:       stats.Reindex.Started.UTC().Format(time.RFC3339),
+		}
+		if stats.Reindex.NumTracks > 0 {
+			response.Stats.Reindex.Progress = float64(stats.Reindex.NumIndexed) / float64(stats.Reindex.NumTracks)
+		}
+	}
 	writeResponseOK(w, response)
 }
 
 func (s *API) CreateCatalogHandler(w http.ResponseWriter, request *http.Request, catalog Catalog) {
+	var data UpdateCatalogRequest
+	if request.Body != nil {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+			return
+		}
+		if len(bytes.TrimSpace(body)) != 0 {
+			err = json.Unmarshal(body, &data)
+			if err != nil {
+				writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+				return
+			}
+		}
+	}
+
+	if data.IndexType != nil && !IsValidIndexType(*data.IndexType) {
+		message := fmt.Sprintf("Invalid index type %q", *data.IndexType)
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return
+	}
+
+	if data.FingerprintVersions != nil {
+		for _, version := range *data.FingerprintVersions {
+			if !IsValidFingerprintVersion(version) {
+				message := fmt.Sprintf("Invalid fingerprint version %d", version)
+				writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+				return
+			}
+		}
+	}
+
 	err := catalog.CreateCatalog()
+	if writeQuotaError(w, err) {
+		return
+	}
+	if errors.Cause(err) == ErrAccountDeleted {
+		writeAccountDeleted(w)
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to create catalog %s: %v", catalog.Name(), err)
 		writeResponseInternalError(w)
 		return
 	}
+
+	if data.MemoryIndex != nil || data.IndexType != nil || data.FingerprintVersions != nil {
+		settings, err := catalog.Settings()
+		if err == nil && settings == nil {
+			err = errors.New("catalog does not exist")
+		}
+		if err != nil {
+			log.Printf("Failed to get settings of catalog %s: %v", catalog.Name(), err)
+			writeResponseInternalError(w)
+			return
+		}
+		if data.MemoryIndex != nil {
+			settings.MemoryIndex = *data.MemoryIndex
+		}
+		if data.IndexType != nil {
+			settings.IndexType = *data.IndexType
+		}
+		if data.FingerprintVersions != nil {
+			settings.FingerprintVersions = *data.FingerprintVersions
+		}
+		err = catalog.UpdateSettings(settings)
+		if errors.Cause(err) == ErrCatalogBusy {
+			writeResponseError(w, http.StatusConflict, Error{"catalog_busy", "Catalog is being converted, try again later"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to update catalog %s: %v", catalog.Name(), err)
+			writeResponseInternalError(w)
+			return
+		}
+	}
+
+	s.audit(request, AuditCatalogPut, catalog.Name(), "")
 	writeResponseOK(w, &CatalogResponse{catalog.Name()})
 }
 
@@ -241,17 +609,21 @@ func (s *API) DeleteCatalogHandler(w http.ResponseWriter, request *http.Request,
 		writeResponseInternalError(w)
 		return
 	}
+	s.audit(request, AuditCatalogDelete, catalog.Name(), "")
 	writeResponseOK(w, &CatalogResponse{catalog.Name()})
 }
 
 type TrackResponse struct {
-	Catalog  string   `json:"catalog"`
-	ID       string   `json:"id"`
-	Metadata Metadata `json:"metadata,omitempty"`
+	Catalog            string   `json:"catalog"`
+	ID                 string   `json:"id"`
+	Metadata           Metadata `json:"metadata,omitempty"`
+	FingerprintVersion int      `json:"fingerprint_version,omitempty"`
+	Duration           float64  `json:"duration,omitempty"`
 }
 
 type CreateTrackRequest struct {
 	Fingerprint    string            `json:"fingerprint"`
+	Duration       float64           `json:"duration"`
 	Metadata       map[string]string `json:"metadata"`
 	AllowDuplicate bool              `json:"allow_duplicate"`
 }
@@ -266,6 +638,44 @@ func unmarshalRequestJSON(req *http.Request, v interface{}) error {
 	return json.Unmarshal(body, v)
 }
 
+func (s *API) GetStopListHandler(w http.ResponseWriter, request *http.Request, catalog Catalog) {
+	values, err := catalog.StopList()
+	if err != nil {
+		log.Printf("Failed to get stop list of catalog %s: %v", catalog.Name(), err)
+		writeResponseInternalError(w)
+		return
+	}
+	writeStopList(w, catalog, values)
+}
+
+func (s *API) UpdateStopListHandler(w http.ResponseWriter, request *http.Request, catalog Catalog) {
+	values, err := catalog.UpdateStopList()
+	if err != nil {
+		log.Printf("Failed to update stop list of catalog %s: %v", catalog.Name(), err)
+		writeResponseInternalError(w)
+		return
+	}
+	if values != nil {
+		s.audit(request, AuditStopListUpdate, catalog.Name(), "")
+	}
+	writeStopList(w, catalog, values)
+}
+
+func writeStopList(w http.ResponseWriter, catalog Catalog, values []StopValue) {
+	if values == nil {
+		writeResponseError(w, http.StatusNotFound, Error{"not_found", "Catalog not found"})
+		return
+	}
+	response := &StopListResponse{
+		Catalog:  catalog.Name(),
+		StopList: make([]StopListResponseValue, len(values)),
+	}
+	for i, value := range values {
+		response.StopList[i] = StopListResponseValue{Value: value.Value, Tracks: value.NumTracks}
+	}
+	writeResponseOK(w, response)
+}
+
 func (s *API) CreateAnonymousTrackHandler(w http.ResponseWriter, request *http.Request, catalog Catalog) {
 	s.CreateTrackHandler(w, request, catalog, catalog.NewTrackID())
 }
@@ -285,7 +695,34 @@ func (s *API) CreateTrackHandler(w http.ResponseWriter, request *http.Request, c
 		return
 	}
 
-	created, err := catalog.CreateTrack(trackID, fingerprint, data.Metadata, data.AllowDuplicate)
+	if !IsValidFingerprintVersion(fingerprint.Version) {
+		message := fmt.Sprintf("Unsupported fingerprint version %d", fingerprint.Version)
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_fingerprint_version", message})
+		return
+	}
+
+	if data.Duration < 0 {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Duration must not be negative"})
+		return
+	}
+	duration := secondsToDuration(data.Duration)
+	if duration == 0 {
+		duration = FingerprintDuration(fingerprint)
+	}
+
+	created, err := catalog.CreateTrack(trackID, fingerprint, duration, data.Metadata, data.AllowDuplicate)
+	if errors.Cause(err) == ErrFingerprintVersionNotAllowed {
+		message := fmt.Sprintf("Fingerprint version %d is not allowed in catalog %s", fingerprint.Version, catalog.Name())
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_fingerprint_version", message})
+		return
+	}
+	if writeQuotaError(w, err) {
+		return
+	}
+	if errors.Cause(err) == ErrAccountDeleted {
+		writeAccountDeleted(w)
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to create track %s/%s: %v", catalog.Name(), trackID, err)
 		writeResponseInternalError(w)
@@ -298,7 +735,8 @@ func (s *API) CreateTrackHandler(w http.ResponseWriter, request *http.Request, c
 		return
 	}
 
-	writeResponseOK(w, &TrackResponse{Catalog: catalog.Name(), ID: trackID})
+	s.audit(request, AuditTrackPut, catalog.Name(), trackID)
+	writeResponseOK(w, &TrackResponse{Catalog: catalog.Name(), ID: trackID, FingerprintVersion: fingerprint.Version, Duration: duration.Seconds()})
 }
 
 func (s *API) DeleteTrackHandler(w http.ResponseWriter, request *http.Request, catalog Catalog, trackID string) {
@@ -309,6 +747,7 @@ func (s *API) DeleteTrackHandler(w http.ResponseWriter, request *http.Request, c
 		return
 	}
 
+	s.audit(request, AuditTrackDelete, catalog.Name(), trackID)
 	writeResponseOK(w, &TrackResponse{Catalog: catalog.Name(), ID: trackID})
 }
 
@@ -326,29 +765,126 @@ func (s *API) GetTrackHandler(w http.ResponseWriter, request *http.Request, cata
 		return
 	}
 
-	writeResponseOK(w, &TrackResponse{Catalog: catalog.Name(), ID: trackID, Metadata: results.Results[0].Metadata})
+	result := results.Results[0]
+	writeResponseOK(w, &TrackResponse{Catalog: catalog.Name(), ID: trackID, Metadata: result.Metadata, FingerprintVersion: result.FingerprintVersion, Duration: result.Duration.Seconds()})
 }
 
 type SearchRequest struct {
-	Fingerprint string `json:"fingerprint"`
-	Stream      bool   `json:"stream"`
+	Fingerprint     string  `json:"fingerprint"`
+	Stream          bool    `json:"stream"`
+	Probes          int     `json:"probes"`
+	Mode            string  `json:"mode"`
+	Duration        float64 `json:"duration,omitempty"`
+	MaxDurationDiff float64 `json:"max_duration_diff,omitempty"`
 }
 
 type SearchResponse struct {
 	Catalog string                  `json:"catalog"`
 	Results []*SearchResponseResult `json:"results"`
+	Partial bool                    `json:"partial,omitempty"`
 }
 
 type SearchResponseResult struct {
-	ID       string                    `json:"id"`
-	Match    SearchResponseResultMatch `json:"match"`
-	Metadata Metadata                  `json:"metadata,omitempty"`
+	ID                 string                    `json:"id"`
+	Match              SearchResponseResultMatch `json:"match"`
+	Metadata           Metadata                  `json:"metadata,omitempty"`
+	FingerprintVersion int                       `json:"fingerprint_version,omitempty"`
+	Duration           float64                   `json:"duration,omitempty"`
 }
 
 type SearchResponseResultMatch struct {
-	Position float64 `json:"position"`
+	Position        float64 `json:"position"`
 	PositionInQuery float64 `json:"position_in_query"`
-	Duration float64 `json:"duration"`
+	Duration        float64 `json:"duration"`
+}
+
+// NodeSearchRequest is sent by a node that fans out a search to the search nodes, see SearchOptions.
+type NodeSearchRequest struct {
+	SearchRequest
+	Hits       bool  `json:"hits,omitempty"`
+	Candidates []int `json:"candidates,omitempty"`
+}
+
+type NodeSearchResponse struct {
+	SearchResponse
+	Hits []NodeSearchHit `json:"hits,omitempty"`
+}
+
+type NodeSearchHit struct {
+	TrackID int `json:"track_id"`
+	Count   int `json:"count"`
+}
+
+// parseSearchRequest validates the request and writes an error response if it's not valid.
+func parseSearchRequest(w http.ResponseWriter, data *SearchRequest) (*chromaprint.Fingerprint, *SearchOptions, bool) {
+	fingerprint, err := chromaprint.ParseFingerprintString(data.Fingerprint)
+	if err != nil {
+		message := fmt.Sprintf("Invalid request: %v", err)
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return nil, nil, false
+	}
+
+	if data.Stream && len(fingerprint.Hashes) > 300 {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Fingerprint too long for stream search"})
+		return nil, nil, false
+	}
+
+	if data.Probes < 0 || data.Probes > MaxProbes {
+		message := fmt.Sprintf("Number of probes must be between 0 and %d", MaxProbes)
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return nil, nil, false
+	}
+
+	if data.Mode != "" && data.Mode != "normal" && data.Mode != "thorough" {
+		message := fmt.Sprintf("Invalid search mode %q", data.Mode)
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return nil, nil, false
+	}
+
+	if data.Stream && data.Mode == "thorough" {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Thorough mode is not supported for stream search"})
+		return nil, nil, false
+	}
+
+	if data.Duration < 0 || data.MaxDurationDiff < 0 {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Duration must not be negative"})
+		return nil, nil, false
+	}
+
+	if data.Stream && data.MaxDurationDiff > 0 {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Duration filter is not supported for stream search"})
+		return nil, nil, false
+	}
+
+	opts := &SearchOptions{
+		Stream:          data.Stream,
+		Probes:          data.Probes,
+		Thorough:        data.Mode == "thorough",
+		Duration:        secondsToDuration(data.Duration),
+		MaxDurationDiff: secondsToDuration(data.MaxDurationDiff),
+	}
+	return fingerprint, opts, true
+}
+
+func newSearchResponse(catalog Catalog, results *SearchResults) *SearchResponse {
+	response := &SearchResponse{
+		Catalog: catalog.Name(),
+		Results: make([]*SearchResponseResult, len(results.Results)),
+	}
+	for i, result := range results.Results {
+		response.Results[i] = &SearchResponseResult{
+			ID:                 result.ID,
+			Metadata:           result.Metadata,
+			FingerprintVersion: result.FingerprintVersion,
+			Duration:           result.Duration.Seconds(),
+			Match: SearchResponseResultMatch{
+				Position:        result.Match.MasterOffset().Seconds(),
+				PositionInQuery: result.Match.QueryOffset().Seconds(),
+				Duration:        result.Match.MatchingDuration().Seconds(),
+			},
+		}
+	}
+	return response
 }
 
 func (s *API) SearchHandler(w http.ResponseWriter, request *http.Request, catalog Catalog) {
@@ -359,19 +895,58 @@ func (s *API) SearchHandler(w http.ResponseWriter, request *http.Request, catalo
 		return
 	}
 
-	fingerprint, err := chromaprint.ParseFingerprintString(data.Fingerprint)
+	fingerprint, opts, ok := parseSearchRequest(w, &data)
+	if !ok {
+		return
+	}
+
+	if s.Nodes != nil {
+		response, err := s.Nodes.Search(request.Context(), catalog.Name(), request.Header.Get("Authorization"), &data)
+		if err != nil {
+			log.Printf("Failed to search in %s on search nodes: %v", catalog.Name(), err)
+			writeResponseInternalError(w)
+			return
+		}
+		writeResponseOK(w, response)
+		return
+	}
+
+	results, err := catalog.Search(fingerprint, opts)
 	if err != nil {
-		message := fmt.Sprintf("Invalid request: %v", err)
-		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		log.Printf("Failed to search in %s: %v", catalog.Name(), err)
+		writeResponseInternalError(w)
 		return
 	}
+	writeResponseOK(w, newSearchResponse(catalog, results))
+}
 
-	if data.Stream && len(fingerprint.Hashes) > 300 {
-		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Fingerprint too long for stream search"})
+// NodeSearchHandler searches the node's partition of tracks for a node that fans out searches.
+func (s *API) NodeSearchHandler(w http.ResponseWriter, request *http.Request, catalog Catalog) {
+	var data NodeSearchRequest
+	err := unmarshalRequestJSON(request, &data)
+	if err != nil {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
 		return
 	}
 
-	opts := &SearchOptions{Stream: data.Stream}
+	fingerprint, opts, ok := parseSearchRequest(w, &data.SearchRequest)
+	if !ok {
+		return
+	}
+
+	if data.Hits && data.Candidates != nil {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Hits and candidates can't be requested together"})
+		return
+	}
+
+	if len(data.Candidates) > MaxSearchNodeCandidates {
+		message := fmt.Sprintf("Number of candidates must be at most %d", MaxSearchNodeCandidates)
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return
+	}
+
+	opts.Hits = data.Hits
+	opts.Candidates = data.Candidates
 	results, err := catalog.Search(fingerprint, opts)
 	if err != nil {
 		log.Printf("Failed to search in %s: %v", catalog.Name(), err)
@@ -379,24 +954,560 @@ func (s *API) SearchHandler(w http.ResponseWriter, request *http.Request, catalo
 		return
 	}
 
-	response := &SearchResponse{
-		Catalog: catalog.Name(),
-		Results: make([]*SearchResponseResult, len(results.Results)),
+	response := &NodeSearchResponse{SearchResponse: *newSearchResponse(catalog, results)}
+	for trackID, count := range results.Hits {
+		response.Hits = append(response.Hits, NodeSearchHit{TrackID: trackID, Count: count})
 	}
-	for i, result := range results.Results {
-		response.Results[i] = &SearchResponseResult{
-			ID:       result.ID,
-			Metadata: result.Metadata,
-			Match: SearchResponseResultMatch{
-				Position: result.Match.MasterOffset().Seconds(),
-				PositionInQuery: result.Match.QueryOffset().Seconds(),
-				Duration: result.Match.MatchingDuration().Seconds(),
-			},
+	writeResponseOK(w, response)
+}
+
+type CreateSearchTokenRequest struct {
+	Catalogs  []string `json:"catalogs"`
+	TTL       float64  `json:"ttl"`
+	RateLimit int      `json:"rate_limit"`
+}
+
+type SearchTokenResponse struct {
+	Token     string   `json:"token"`
+	Catalogs  []string `json:"catalogs"`
+	Expires   string   `json:"expires"`
+	RateLimit int      `json:"rate_limit,omitempty"`
+}
+
+func (s *API) CreateSearchTokenHandler(w http.ResponseWriter, request *http.Request, principal *Principal, repo Repository) {
+	if s.SearchTokens == nil {
+		writeResponseError(w, http.StatusForbidden, Error{"forbidden", "Search tokens are disabled"})
+		return
+	}
+	if principal.TokenID != "" {
+		writeResponseError(w, http.StatusForbidden, Error{"forbidden", "Search tokens can't be used to create search tokens"})
+		return
+	}
+
+	var data CreateSearchTokenRequest
+	err := unmarshalRequestJSON(request, &data)
+	if err != nil {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+		return
+	}
+
+	if len(data.Catalogs) == 0 {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Missing catalogs"})
+		return
+	}
+	permissions := Permissions{Catalogs: data.Catalogs}
+	if permissions.Validate() != nil {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid catalog name"})
+		return
+	}
+	for _, catalogName := range data.Catalogs {
+		if !IsValidCatalogName(catalogName) {
+			writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid catalog name"})
+			return
+		}
+		if !principal.CanAccessCatalog(catalogName) {
+			reason := fmt.Sprintf("Access to catalog %s is not allowed", catalogName)
+			writeResponseError(w, http.StatusForbidden, Error{"forbidden", reason})
+			return
+		}
+	}
+
+	ttl := DefaultSearchTokenTTL
+	if data.TTL != 0 {
+		ttl = secondsToDuration(data.TTL)
+	}
+	if ttl < time.Second || ttl > MaxSearchTokenTTL {
+		message := fmt.Sprintf("TTL must be between 1 and %v seconds", MaxSearchTokenTTL.Seconds())
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return
+	}
+	if data.RateLimit < 0 {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Rate limit must not be negative"})
+		return
+	}
+
+	token, err := NewSearchToken(principal.Account, data.Catalogs, data.RateLimit, ttl)
+	if err != nil {
+		log.Printf("Failed to create search token: %v", err)
+		writeResponseInternalError(w)
+		return
+	}
+	signedToken, err := s.SearchTokens.Sign(token)
+	if err != nil {
+		log.Printf("Failed to sign search token: %v", err)
+		writeResponseInternalError(w)
+		return
+	}
+
+	response := &SearchTokenResponse{
+		Token:     signedToken,
+		Catalogs:  token.Catalogs,
+		Expires:   token.Expires.UTC().Format(time.RFC3339),
+		RateLimit: token.RateLimit,
+	}
+	writeResponseOK(w, response)
+}
+
+// maxUsageDays is the maximum number of days returned by one usage request.
+const maxUsageDays = 366
+
+type UsageResponse struct {
+	Account string       `json:"account"`
+	From    string       `json:"from"`
+	To      string       `json:"to"`
+	Days    []DailyUsage `json:"days"`
+}
+
+// parseUsageDate parses a date in the YYYY-MM-DD format, or returns the default value if it's empty.
+func parseUsageDate(s string, defaultValue time.Time) (time.Time, bool) {
+	if s == "" {
+		return defaultValue, true
+	}
+	t, err := time.Parse(usageDayFormat, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func (s *API) GetUsageHandler(w http.ResponseWriter, request *http.Request, principal *Principal, repo Repository) {
+	if len(principal.Catalogs) > 0 {
+		writeResponseError(w, http.StatusForbidden, Error{"forbidden", "Usage is only available with access to all catalogs"})
+		return
+	}
+
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	query := request.URL.Query()
+	to, ok := parseUsageDate(query.Get("to"), today)
+	if !ok {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid date in to, expected YYYY-MM-DD"})
+		return
+	}
+	from, ok := parseUsageDate(query.Get("from"), to.AddDate(0, 0, 1-to.Day()))
+	if !ok {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid date in from, expected YYYY-MM-DD"})
+		return
+	}
+	if from.After(to) {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "The from date must not be after the to date"})
+		return
+	}
+	if to.Sub(from) >= maxUsageDays*24*time.Hour {
+		message := fmt.Sprintf("Usage can be requested for at most %d days", maxUsageDays)
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return
+	}
+
+	days, err := repo.Account().Usage(from, to)
+	if err != nil {
+		log.Printf("Failed to get usage of account %s: %v", principal.Account, err)
+		writeResponseInternalError(w)
+		return
+	}
+
+	response := &UsageResponse{
+		Account: principal.Account,
+		From:    from.Format(usageDayFormat),
+		To:      to.Format(usageDayFormat),
+		Days:    days,
+	}
+	writeResponseOK(w, response)
+}
+
+type AuditLogResponse struct {
+	Account string       `json:"account"`
+	Entries []AuditEntry `json:"entries"`
+	HasMore bool         `json:"has_more"`
+	Cursor  string       `json:"cursor,omitempty"`
+}
+
+// parseAuditFilter parses filters of the audit log from the query string, or returns a description of the invalid parameter.
+func parseAuditFilter(req *http.Request) (*AuditFilter, string) {
+	query := req.URL.Query()
+	filter := &AuditFilter{
+		Action:  query.Get("action"),
+		Catalog: query.Get("catalog"),
+		Object:  query.Get("object"),
+		Limit:   DefaultAuditQueryLimit,
+	}
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		s := query.Get(param.name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Sprintf("Invalid time in %s, expected RFC 3339 format", param.name)
+		}
+		*param.value = t
+	}
+	if s := query.Get("cursor"); s != "" {
+		cursor, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || cursor <= 0 {
+			return nil, "Invalid cursor"
+		}
+		filter.Before = cursor
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxAuditQueryLimit {
+			return nil, fmt.Sprintf("Limit must be between 1 and %d", MaxAuditQueryLimit)
 		}
+		filter.Limit = limit
+	}
+	return filter, ""
+}
+
+func (s *API) GetAuditLogHandler(w http.ResponseWriter, request *http.Request, principal *Principal, repo Repository) {
+	if s.Audit == nil {
+		writeResponseError(w, http.StatusForbidden, Error{"forbidden", "Audit log is disabled"})
+		return
+	}
+	if len(principal.Catalogs) > 0 {
+		writeResponseError(w, http.StatusForbidden, Error{"forbidden", "Audit log is only available with access to all catalogs"})
+		return
+	}
+
+	filter, message := parseAuditFilter(request)
+	if filter == nil {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return
+	}
+
+	// One more entry is fetched to find out if there are more.
+	limit := filter.Limit
+	filter.Limit++
+	entries, err := s.Audit.Query(principal.Account, filter)
+	if err != nil {
+		log.Printf("Failed to get audit log of account %s: %v", principal.Account, err)
+		writeResponseInternalError(w)
+		return
+	}
+
+	response := &AuditLogResponse{Account: principal.Account, Entries: entries}
+	if len(entries) > limit {
+		response.Entries = entries[:limit]
+		response.HasMore = true
+		response.Cursor = strconv.FormatInt(entries[limit-1].ID, 10)
 	}
 	writeResponseOK(w, response)
 }
 
+type CreateAPIKeyRequest struct {
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Catalogs []string `json:"catalogs"`
+}
+
+type APIKeyResponse struct {
+	ID       int        `json:"id"`
+	Account  string     `json:"account"`
+	Name     string     `json:"name"`
+	Key      string     `json:"key,omitempty"`
+	Prefix   string     `json:"prefix"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+	Scopes   []string   `json:"scopes,omitempty"`
+	Catalogs []string   `json:"catalogs,omitempty"`
+}
+
+type ListAPIKeysResponse struct {
+	Account string           `json:"account"`
+	APIKeys []APIKeyResponse `json:"api_keys"`
+}
+
+type RevokeAPIKeyResponse struct {
+	ID      int    `json:"id"`
+	Account string `json:"account"`
+}
+
+func newAPIKeyResponse(apiKey *APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:       apiKey.ID,
+		Account:  apiKey.Account,
+		Name:     apiKey.Name,
+		Key:      apiKey.Key,
+		Prefix:   apiKey.Prefix,
+		Created:  apiKey.Created,
+		LastUsed: apiKey.LastUsed,
+		Revoked:  apiKey.Revoked,
+		Scopes:   apiKey.Scopes,
+		Catalogs: apiKey.Catalogs,
+	}
+}
+
+func parseAPIKeyID(req *http.Request) (int, bool) {
+	vars := mux.Vars(req)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *API) ListAPIKeysHandler(w http.ResponseWriter, request *http.Request, account string) {
+	apiKeys, err := s.service.ListAPIKeys(account)
+	if err != nil {
+		log.Printf("Failed to list API keys of account %s: %v", account, err)
+		writeResponseInternalError(w)
+		return
+	}
+	response := &ListAPIKeysResponse{
+		Account: account,
+		APIKeys: make([]APIKeyResponse, len(apiKeys)),
+	}
+	for i := range apiKeys {
+		response.APIKeys[i] = newAPIKeyResponse(&apiKeys[i])
+	}
+	writeResponseOK(w, response)
+}
+
+func (s *API) CreateAPIKeyHandler(w http.ResponseWriter, request *http.Request, account string) {
+	var data CreateAPIKeyRequest
+	if request.Body != nil {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+			return
+		}
+		if len(bytes.TrimSpace(body)) != 0 {
+			err = json.Unmarshal(body, &data)
+			if err != nil {
+				writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+				return
+			}
+		}
+	}
+
+	permissions := Permissions{Scopes: data.Scopes, Catalogs: data.Catalogs}
+	err := permissions.Validate()
+	if err != nil {
+		message := fmt.Sprintf("Invalid permissions: %v", err)
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return
+	}
+
+	apiKey, err := s.service.CreateAPIKey(account, data.Name, permissions)
+	if err != nil {
+		if errors.Cause(err) == ErrAccountDeleted {
+			writeAccountDeleted(w)
+			return
+		}
+		log.Printf("Failed to create API key for account %s: %v", account, err)
+		writeResponseInternalError(w)
+		return
+	}
+	s.audit(request, AuditAPIKeyCreate, "", strconv.Itoa(apiKey.ID))
+	writeResponseOK(w, newAPIKeyResponse(apiKey))
+}
+
+func (s *API) RotateAPIKeyHandler(w http.ResponseWriter, request *http.Request, account string) {
+	id, ok := parseAPIKeyID(request)
+	if !ok {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid API key ID"})
+		return
+	}
+	apiKey, err := s.service.RotateAPIKey(account, id)
+	if err != nil {
+		if errors.Cause(err) == ErrAPIKeyNotFound {
+			writeResponseError(w, http.StatusNotFound, Error{"not_found", "API key not found"})
+			return
+		}
+		log.Printf("Failed to rotate API key %d of account %s: %v", id, account, err)
+		writeResponseInternalError(w)
+		return
+	}
+	s.audit(request, AuditAPIKeyRotate, "", strconv.Itoa(id))
+	writeResponseOK(w, newAPIKeyResponse(apiKey))
+}
+
+func (s *API) RevokeAPIKeyHandler(w http.ResponseWriter, request *http.Request, account string) {
+	id, ok := parseAPIKeyID(request)
+	if !ok {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid API key ID"})
+		return
+	}
+	err := s.service.RevokeAPIKey(account, id)
+	if err != nil {
+		if errors.Cause(err) == ErrAPIKeyNotFound {
+			writeResponseError(w, http.StatusNotFound, Error{"not_found", "API key not found"})
+			return
+		}
+		log.Printf("Failed to revoke API key %d of account %s: %v", id, account, err)
+		writeResponseInternalError(w)
+		return
+	}
+	s.audit(request, AuditAPIKeyRevoke, "", strconv.Itoa(id))
+	writeResponseOK(w, &RevokeAPIKeyResponse{ID: id, Account: account})
+}
+
+type AccountLimitsResponse struct {
+	Account      string       `json:"account"`
+	Limits       Limits       `json:"limits"`
+	CustomLimits CustomLimits `json:"custom_limits"`
+}
+
+func (s *API) writeAccountLimits(w http.ResponseWriter, externalID string, account Account) {
+	custom, err := account.CustomLimits()
+	if err != nil {
+		log.Printf("Failed to get custom limits of account %s: %v", externalID, err)
+		writeResponseInternalError(w)
+		return
+	}
+	limits, err := account.Limits()
+	if err != nil {
+		log.Printf("Failed to get limits of account %s: %v", externalID, err)
+		writeResponseInternalError(w)
+		return
+	}
+	writeResponseOK(w, &AccountLimitsResponse{Account: externalID, Limits: *limits, CustomLimits: *custom})
+}
+
+func (s *API) GetAccountLimitsHandler(w http.ResponseWriter, request *http.Request, externalID string) {
+	account, err := s.service.GetAccount(externalID)
+	if err != nil {
+		if errors.Cause(err) == ErrAccountDeleted {
+			writeAccountDeleted(w)
+			return
+		}
+		log.Printf("Failed to get account %s: %v", externalID, err)
+		writeResponseInternalError(w)
+		return
+	}
+	s.writeAccountLimits(w, externalID, account)
+}
+
+func (s *API) UpdateAccountLimitsHandler(w http.ResponseWriter, request *http.Request, externalID string) {
+	var data CustomLimits
+	if request.Body == nil {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+		return
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+		return
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+		return
+	}
+	err = data.Validate()
+	if err != nil {
+		message := fmt.Sprintf("Invalid limits: %v", err)
+		writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", message})
+		return
+	}
+
+	account, err := s.service.GetAccount(externalID)
+	if err != nil {
+		if errors.Cause(err) == ErrAccountDeleted {
+			writeAccountDeleted(w)
+			return
+		}
+		log.Printf("Failed to get account %s: %v", externalID, err)
+		writeResponseInternalError(w)
+		return
+	}
+	err = account.UpdateCustomLimits(&data)
+	if err != nil {
+		log.Printf("Failed to update limits of account %s: %v", externalID, err)
+		writeResponseInternalError(w)
+		return
+	}
+	s.audit(request, AuditAccountLimitsUpdate, "", "")
+	s.writeAccountLimits(w, externalID, account)
+}
+
+type AccountPurgeResponse struct {
+	Account         string          `json:"account"`
+	Policy          PurgePolicy     `json:"policy"`
+	Status          string          `json:"status"`
+	Started         time.Time       `json:"started"`
+	Finished        *time.Time      `json:"finished,omitempty"`
+	Catalogs        int             `json:"catalogs"`
+	Tracks          int64           `json:"tracks"`
+	APIKeys         int64           `json:"api_keys"`
+	UsageRecords    int64           `json:"usage_records"`
+	AuditLogEntries int64           `json:"audit_log_entries"`
+	Report          json.RawMessage `json:"report,omitempty"`
+}
+
+func newAccountPurgeResponse(purge *AccountPurge) *AccountPurgeResponse {
+	response := &AccountPurgeResponse{
+		Account:         purge.Account,
+		Policy:          purge.Policy,
+		Status:          "running",
+		Started:         purge.Started,
+		Finished:        purge.Finished,
+		Catalogs:        purge.Catalogs,
+		Tracks:          purge.Tracks,
+		APIKeys:         purge.APIKeys,
+		UsageRecords:    purge.UsageRecords,
+		AuditLogEntries: purge.AuditLogEntries,
+		Report:          json.RawMessage(purge.Report),
+	}
+	if purge.Finished != nil {
+		response.Status = "finished"
+	}
+	return response
+}
+
+func (s *API) GetAccountPurgeHandler(w http.ResponseWriter, request *http.Request, externalID string) {
+	purge, err := s.service.GetAccountPurge(externalID)
+	if err != nil {
+		log.Printf("Failed to get purge of account %s: %v", externalID, err)
+		writeResponseInternalError(w)
+		return
+	}
+	if purge == nil {
+		writeResponseError(w, http.StatusNotFound, Error{"not_found", "Account was not purged"})
+		return
+	}
+	writeResponseOK(w, newAccountPurgeResponse(purge))
+}
+
+// PurgeAccountHandler starts deleting all data of the account. If the account is already
+// being purged, the purge is resumed with its original policy.
+func (s *API) PurgeAccountHandler(w http.ResponseWriter, request *http.Request, externalID string) {
+	var policy PurgePolicy
+	if request.Body != nil {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+			return
+		}
+		if len(bytes.TrimSpace(body)) != 0 {
+			err = json.Unmarshal(body, &policy)
+			if err != nil {
+				writeResponseError(w, http.StatusBadRequest, Error{"invalid_request", "Invalid request body"})
+				return
+			}
+		}
+	}
+
+	purge, err := s.service.StartAccountPurge(externalID, policy)
+	if err != nil {
+		switch errors.Cause(err) {
+		case ErrAccountNotFound:
+			writeResponseError(w, http.StatusNotFound, Error{"not_found", "Account not found"})
+		case ErrPurgeReportKeyMissing:
+			writeResponseError(w, http.StatusForbidden, Error{"forbidden", "Purging accounts is disabled"})
+		default:
+			log.Printf("Failed to purge account %s: %v", externalID, err)
+			writeResponseInternalError(w)
+		}
+		return
+	}
+	writeResponse(w, http.StatusAccepted, newAccountPurgeResponse(purge))
+}
+
 func writeResponseOK(w http.ResponseWriter, response interface{}) {
 	writeResponse(w, http.StatusOK, response)
 }
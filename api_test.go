@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/acoustid/go-acoustid/chromaprint"
 	"github.com/acoustid/priv"
@@ -19,6 +21,15 @@ import (
 
 const testFingerprint = "AQAAZFKYSFKYofGJj0IOUTRy_AgTch1axYidILR0mFENmcdxfEiL9jiuH8089EJ7-B3yQexzVFWOboeI60h_HHWMHiZ3hCwLXTzy4JTxRsfX4cqI45IpInTCIL1x9EZEbcd7tJVhDfrxwzt8HD3-D9p2XDq0D0cY0agV_EKL78dPPBeC7byQv0IdHUdzdD_wO8g5QeOPtBX66EFn2Jpx5Ucz_Th2ovkMPrgaycgOGVtjI19x_DiR_gAAyHFGUJGgUAAw4JQBQDAHCUIKEIKQEBA4gpFyyEiEACSgEQCIMVYyIwBQwiiBBDFIG0QIEY4AQAAAGgkEnHFXaCQA"
 
+// principalAuth authenticates all requests as the same principal.
+type principalAuth struct {
+	principal *priv.Principal
+}
+
+func (a *principalAuth) Authenticate(r *http.Request) (*priv.Principal, error) {
+	return a.principal, nil
+}
+
 func makeRequest(t *testing.T, s *priv.API, method string, path string, body io.Reader) (int, string) {
 	w := httptest.NewRecorder()
 	req, err := http.NewRequest(method, path, body)
@@ -68,6 +79,7 @@ func createMockCatalogService(ctrl *gomock.Controller) (*mock.MockService, *mock
 
 	account := mock.NewMockAccount(ctrl)
 	account.EXPECT().Repository().Return(repo)
+	account.EXPECT().Limits().AnyTimes().Return(&priv.Limits{}, nil)
 
 	service := mock.NewMockService(ctrl)
 	service.EXPECT().GetAccount(gomock.Any()).Return(account, nil)
@@ -100,6 +112,32 @@ func TestApi_ListCatalogs(t *testing.T) {
 	assert.JSONEq(t, `{"catalogs": [{"catalog": "cat1"}, {"catalog": "cat2"}]}`, body)
 }
 
+func TestApi_ListCatalogs_RestrictedCatalogs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	catalog1 := mock.NewMockCatalog(ctrl)
+	catalog1.EXPECT().Name().AnyTimes().Return("cat1")
+
+	catalog2 := mock.NewMockCatalog(ctrl)
+	catalog2.EXPECT().Name().AnyTimes().Return("cat2")
+
+	repo := mock.NewMockRepository(ctrl)
+	repo.EXPECT().ListCatalogs().Return([]priv.Catalog{catalog1, catalog2}, nil)
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().Return(repo)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("acc1").Return(account, nil)
+
+	api := priv.NewAPI(service)
+	api.Auth = &principalAuth{&priv.Principal{Account: "acc1", Permissions: priv.Permissions{Catalogs: []string{"cat2"}}}}
+	status, body := makeRequest(t, api, "GET", "/v1/priv", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalogs": [{"catalog": "cat2"}]}`, body)
+}
+
 func TestApi_ListCatalogs_Empty(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -157,6 +195,102 @@ func TestApi_CreateCatalog(t *testing.T) {
 	assert.JSONEq(t, `{"catalog": "cat1"}`, body)
 }
 
+func TestApi_CreateCatalog_Settings(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateCatalog().Return(nil)
+	catalog.EXPECT().Settings().Return(&priv.CatalogSettings{}, nil)
+	catalog.EXPECT().UpdateSettings(&priv.CatalogSettings{MemoryIndex: true}).Return(nil)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1", bytes.NewReader([]byte(`{"memory_index": true}`)))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1"}`, body)
+}
+
+func TestApi_CreateCatalog_IndexType(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateCatalog().Return(nil)
+	catalog.EXPECT().Settings().Return(&priv.CatalogSettings{MemoryIndex: true, IndexType: priv.IndexTypeGIN}, nil)
+	catalog.EXPECT().UpdateSettings(&priv.CatalogSettings{MemoryIndex: true, IndexType: priv.IndexTypeBTree}).Return(nil)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1", bytes.NewReader([]byte(`{"index_type": "btree"}`)))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1"}`, body)
+}
+
+func TestApi_CreateCatalog_Busy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateCatalog().Return(nil)
+	catalog.EXPECT().Settings().Return(&priv.CatalogSettings{MemoryIndex: true, IndexType: priv.IndexTypeGIN}, nil)
+	catalog.EXPECT().UpdateSettings(&priv.CatalogSettings{MemoryIndex: true, IndexType: priv.IndexTypeBTree}).Return(priv.ErrCatalogBusy)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1", bytes.NewReader([]byte(`{"index_type": "btree"}`)))
+	assert.Equal(t, http.StatusConflict, status)
+	assert.JSONEq(t, `{"error": {"type": "catalog_busy", "reason": "Catalog is being converted, try again later"}, "status": 409}`, body)
+}
+
+func TestApi_CreateCatalog_FingerprintVersions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateCatalog().Return(nil)
+	catalog.EXPECT().Settings().Return(&priv.CatalogSettings{IndexType: priv.IndexTypeGIN}, nil)
+	catalog.EXPECT().UpdateSettings(&priv.CatalogSettings{IndexType: priv.IndexTypeGIN, FingerprintVersions: []int{1}}).Return(nil)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1", bytes.NewReader([]byte(`{"fingerprint_versions": [1]}`)))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1"}`, body)
+}
+
+func TestApi_CreateCatalog_InvalidFingerprintVersion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, _ := createMockCatalogService(ctrl)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1", bytes.NewReader([]byte(`{"fingerprint_versions": [1, 99]}`)))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Invalid fingerprint version 99"}}`, body)
+}
+
+func TestApi_CreateCatalog_InvalidIndexType(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, _ := createMockCatalogService(ctrl)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1", bytes.NewReader([]byte(`{"index_type": "hash"}`)))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Invalid index type \"hash\""}}`, body)
+}
+
+func TestApi_CreateCatalog_InvalidSettings(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, _ := createMockCatalogService(ctrl)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1", bytes.NewReader([]byte(`{"memory_index": "yes"}`)))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Invalid request body"}}`, body)
+}
+
 func TestApi_CreateCatalog_Error(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -175,7 +309,7 @@ func TestApi_CreateAnonymousTrack(t *testing.T) {
 
 	service, catalog := createMockCatalogService(ctrl)
 	catalog.EXPECT().NewTrackID().Return("track100")
-	catalog.EXPECT().CreateTrack("track100", gomock.Any(), gomock.Any(), false).Return(true, nil)
+	catalog.EXPECT().CreateTrack("track100", gomock.Any(), gomock.Any(), gomock.Any(), false).Return(true, nil)
 
 	request := priv.CreateTrackRequest{Fingerprint: testFingerprint}
 	requestBody, err := json.Marshal(request)
@@ -184,7 +318,7 @@ func TestApi_CreateAnonymousTrack(t *testing.T) {
 	api := priv.NewAPI(service)
 	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1", bytes.NewReader(requestBody))
 	assert.Equal(t, http.StatusOK, status)
-	assert.JSONEq(t, `{"catalog": "cat1", "id": "track100"}`, body)
+	assert.JSONEq(t, `{"catalog": "cat1", "id": "track100", "fingerprint_version": 1, "duration": 14.98099}`, body)
 }
 
 func TestApi_CreateTrack(t *testing.T) {
@@ -192,7 +326,7 @@ func TestApi_CreateTrack(t *testing.T) {
 	defer ctrl.Finish()
 
 	service, catalog := createMockCatalogService(ctrl)
-	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), false).Return(true, nil)
+	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), gomock.Any(), false).Return(true, nil)
 
 	request := priv.CreateTrackRequest{Fingerprint: testFingerprint}
 	requestBody, err := json.Marshal(request)
@@ -201,7 +335,40 @@ func TestApi_CreateTrack(t *testing.T) {
 	api := priv.NewAPI(service)
 	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1/track1", bytes.NewReader(requestBody))
 	assert.Equal(t, http.StatusOK, status)
-	assert.JSONEq(t, `{"catalog": "cat1", "id": "track1"}`, body)
+	assert.JSONEq(t, `{"catalog": "cat1", "id": "track1", "fingerprint_version": 1, "duration": 14.98099}`, body)
+}
+
+func TestApi_CreateTrack_Duration(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateTrack("track1", gomock.Any(), 180500*time.Millisecond, gomock.Any(), false).Return(true, nil)
+
+	request := priv.CreateTrackRequest{Fingerprint: testFingerprint, Duration: 180.5}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1/track1", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1", "id": "track1", "fingerprint_version": 1, "duration": 180.5}`, body)
+}
+
+func TestApi_CreateTrack_NegativeDuration(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, _ := createMockCatalogService(ctrl)
+
+	request := priv.CreateTrackRequest{Fingerprint: testFingerprint, Duration: -1}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1/track1", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Duration must not be negative"}}`, body)
 }
 
 func TestApi_CreateTrack_Conflict(t *testing.T) {
@@ -209,7 +376,7 @@ func TestApi_CreateTrack_Conflict(t *testing.T) {
 	defer ctrl.Finish()
 
 	service, catalog := createMockCatalogService(ctrl)
-	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), false).Return(false, nil)
+	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), gomock.Any(), false).Return(false, nil)
 
 	request := priv.CreateTrackRequest{Fingerprint: testFingerprint}
 	requestBody, err := json.Marshal(request)
@@ -226,7 +393,7 @@ func TestApi_CreateTrack_AllowDuplicate(t *testing.T) {
 	defer ctrl.Finish()
 
 	service, catalog := createMockCatalogService(ctrl)
-	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), true).Return(true, nil)
+	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), gomock.Any(), true).Return(true, nil)
 
 	request := priv.CreateTrackRequest{Fingerprint: testFingerprint, AllowDuplicate: true}
 	requestBody, err := json.Marshal(request)
@@ -235,7 +402,7 @@ func TestApi_CreateTrack_AllowDuplicate(t *testing.T) {
 	api := priv.NewAPI(service)
 	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1/track1", bytes.NewReader(requestBody))
 	assert.Equal(t, http.StatusOK, status)
-	assert.JSONEq(t, `{"catalog": "cat1", "id": "track1"}`, body)
+	assert.JSONEq(t, `{"catalog": "cat1", "id": "track1", "fingerprint_version": 1, "duration": 14.98099}`, body)
 }
 
 func TestApi_CreateTrack_Error(t *testing.T) {
@@ -243,7 +410,7 @@ func TestApi_CreateTrack_Error(t *testing.T) {
 	defer ctrl.Finish()
 
 	service, catalog := createMockCatalogService(ctrl)
-	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), false).Return(false, errors.New("failed"))
+	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), gomock.Any(), false).Return(false, errors.New("failed"))
 
 	request := priv.CreateTrackRequest{Fingerprint: testFingerprint}
 	requestBody, err := json.Marshal(request)
@@ -254,6 +421,43 @@ func TestApi_CreateTrack_Error(t *testing.T) {
 	assertHTTPInternalError(t, status, body)
 }
 
+func TestApi_CreateTrack_InvalidFingerprintVersion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fp, err := chromaprint.ParseFingerprintString(testFingerprint)
+	require.NoError(t, err)
+	fp.Version = 99
+
+	service, _ := createMockCatalogService(ctrl)
+
+	request := priv.CreateTrackRequest{Fingerprint: chromaprint.EncodeFingerprintToString(chromaprint.CompressFingerprint(*fp))}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1/track1", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_fingerprint_version","reason":"Unsupported fingerprint version 99"}}`, body)
+}
+
+func TestApi_CreateTrack_FingerprintVersionNotAllowed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), gomock.Any(), false).Return(false, priv.ErrFingerprintVersionNotAllowed)
+
+	request := priv.CreateTrackRequest{Fingerprint: testFingerprint}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1/track1", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_fingerprint_version","reason":"Fingerprint version 1 is not allowed in catalog cat1"}}`, body)
+}
+
 func TestApi_DeleteTrack(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -284,14 +488,14 @@ func TestApi_GetTrack(t *testing.T) {
 	defer ctrl.Finish()
 
 	service, catalog := createMockCatalogService(ctrl)
-	catalog.EXPECT().GetTrack("track1").Return(&priv.SearchResults{[]priv.SearchResult{
-		{ID: "track1", Metadata: priv.Metadata{"title": "Song title"}},
+	catalog.EXPECT().GetTrack("track1").Return(&priv.SearchResults{Results: []priv.SearchResult{
+		{ID: "track1", Metadata: priv.Metadata{"title": "Song title"}, FingerprintVersion: 1, Duration: 180 * time.Second},
 	}}, nil)
 
 	api := priv.NewAPI(service)
 	status, body := makeRequest(t, api, "GET", "/v1/priv/cat1/track1", nil)
 	assert.Equal(t, http.StatusOK, status)
-	assert.JSONEq(t, `{"catalog":"cat1","id":"track1","metadata":{"title":"Song title"}}`, body)
+	assert.JSONEq(t, `{"catalog":"cat1","id":"track1","metadata":{"title":"Song title"},"fingerprint_version":1,"duration":180}`, body)
 }
 
 func TestApi_GetTrack_NoMetadata(t *testing.T) {
@@ -299,7 +503,7 @@ func TestApi_GetTrack_NoMetadata(t *testing.T) {
 	defer ctrl.Finish()
 
 	service, catalog := createMockCatalogService(ctrl)
-	catalog.EXPECT().GetTrack("track1").Return(&priv.SearchResults{[]priv.SearchResult{
+	catalog.EXPECT().GetTrack("track1").Return(&priv.SearchResults{Results: []priv.SearchResult{
 		{ID: "track1"},
 	}}, nil)
 
@@ -335,6 +539,29 @@ func TestApi_GetCatalog_DoesNotExist(t *testing.T) {
 	assert.JSONEq(t, `{"status":404,"error":{"type":"not_found","reason":"Catalog not found"}}`, body)
 }
 
+func TestApi_GetCatalog_Stats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().Exists().Return(true, nil)
+	catalog.EXPECT().Stats().Return(&priv.CatalogStats{
+		NumTracks: 10,
+		MemoryIndex: &priv.MemoryIndexStats{
+			Ready:        true,
+			NumTracks:    10,
+			NumHashes:    1000,
+			MemoryUsage:  12345,
+			LoadDuration: time.Millisecond * 1500,
+		},
+	}, nil)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "GET", "/v1/priv/cat1?stats", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog":"cat1","stats":{"tracks":10,"memory_index":{"loaded":true,"tracks":10,"hashes":1000,"memory_bytes":12345,"load_duration":1.5}}}`, body)
+}
+
 func TestApi_GetCatalog_ListTracks(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -408,8 +635,9 @@ func TestApi_Search(t *testing.T) {
 		results := &priv.SearchResults{
 			Results: []priv.SearchResult{
 				{
-					ID:       "track1",
-					Metadata: priv.Metadata{"name": "Track 1"},
+					ID:                 "track1",
+					Metadata:           priv.Metadata{"name": "Track 1"},
+					FingerprintVersion: 1,
 					Match: &chromaprint.MatchResult{
 						Version:      1,
 						Config:       chromaprint.FingerprintConfigs[1],
@@ -432,7 +660,40 @@ func TestApi_Search(t *testing.T) {
 	api := priv.NewAPI(service)
 	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
 	assert.Equal(t, http.StatusOK, status)
-	assert.JSONEq(t, `{"catalog": "cat1", "results": [{"id": "track1", "metadata": {"name": "Track 1"}, "match": {"position": 0, "position_in_query": 0, "duration": 17.580979}}]}`, body)
+	assert.JSONEq(t, `{"catalog": "cat1", "results": [{"id": "track1", "metadata": {"name": "Track 1"}, "match": {"position": 0, "position_in_query": 0, "duration": 17.580979}, "fingerprint_version": 1}]}`, body)
+}
+
+func TestApi_Search_MaxDurationDiff(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().Search(gomock.Any(), &priv.SearchOptions{Duration: 180 * time.Second, MaxDurationDiff: 7 * time.Second}).Return(&priv.SearchResults{}, nil)
+
+	request := priv.SearchRequest{Fingerprint: testFingerprint, Duration: 180, MaxDurationDiff: 7}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1", "results": []}`, body)
+}
+
+func TestApi_Search_Stream_MaxDurationDiff(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, _ := createMockCatalogService(ctrl)
+
+	request := priv.SearchRequest{Fingerprint: testFingerprint, Stream: true, MaxDurationDiff: 7}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Duration filter is not supported for stream search"}}`, body)
 }
 
 func TestApi_Search_Stream(t *testing.T) {
@@ -471,7 +732,1116 @@ func TestApi_Search_Stream(t *testing.T) {
 	assert.JSONEq(t, `{"catalog": "cat1", "results": [{"id": "track1", "metadata": {"name": "Track 1"}, "match": {"position": 0, "position_in_query": 0, "duration": 17.580979}}]}`, body)
 }
 
+func TestApi_Search_Probes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().Search(gomock.Any(), &priv.SearchOptions{Stream: true, Probes: 4}).Return(&priv.SearchResults{}, nil)
+
+	request := priv.SearchRequest{Fingerprint: testFingerprint, Stream: true, Probes: 4}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1", "results": []}`, body)
+}
+
+func TestApi_Search_InvalidProbes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, _ := createMockCatalogService(ctrl)
+
+	request := priv.SearchRequest{Fingerprint: testFingerprint, Probes: priv.MaxProbes + 1}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"error": {"type": "invalid_request", "reason": "Number of probes must be between 0 and 8"}, "status": 400}`, body)
+}
+
+func TestApi_Search_Thorough(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().Search(gomock.Any(), &priv.SearchOptions{Thorough: true}).Return(&priv.SearchResults{}, nil)
+
+	request := priv.SearchRequest{Fingerprint: testFingerprint, Mode: "thorough"}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1", "results": []}`, body)
+}
+
+func TestApi_Search_InvalidMode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, _ := createMockCatalogService(ctrl)
+
+	request := priv.SearchRequest{Fingerprint: testFingerprint, Mode: "fast"}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"error": {"type": "invalid_request", "reason": "Invalid search mode \"fast\""}, "status": 400}`, body)
+}
+
+func TestApi_GetStopList(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().StopList().Return([]priv.StopValue{{Value: 123, NumTracks: 1000}}, nil)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "GET", "/v1/priv/cat1/_stop_list", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1", "stop_list": [{"value": 123, "tracks": 1000}]}`, body)
+}
+
+func TestApi_GetStopList_CatalogDoesNotExist(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().StopList().Return(nil, nil)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "GET", "/v1/priv/cat1/_stop_list", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"error": {"type": "not_found", "reason": "Catalog not found"}, "status": 404}`, body)
+}
+
+func TestApi_UpdateStopList(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().UpdateStopList().Return([]priv.StopValue{}, nil)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_stop_list", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1", "stop_list": []}`, body)
+}
+
 func assertHTTPInternalError(t *testing.T, status int, body string) {
 	assert.Equal(t, http.StatusInternalServerError, status)
 	assert.JSONEq(t, `{"error": {"type": "internal_error", "reason": "Internal error"}, "status": 500}`, body)
 }
+
+// createSearchNode creates a search node that finds the hits, or the thorough hits in the thorough mode,
+// and returns a match for each candidate, as long as its number of hits.
+func createSearchNode(ctrl *gomock.Controller, delay time.Duration, hits map[int]int, thoroughHits map[int]int) *httptest.Server {
+	catalog := mock.NewMockCatalog(ctrl)
+	catalog.EXPECT().Name().AnyTimes().Return("cat1")
+
+	repo := mock.NewMockRepository(ctrl)
+	repo.EXPECT().Catalog("cat1").AnyTimes().Return(catalog)
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().AnyTimes().Return(repo)
+	account.EXPECT().Limits().AnyTimes().Return(&priv.Limits{}, nil)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount(gomock.Any()).AnyTimes().Return(account, nil)
+
+	catalog.EXPECT().Search(gomock.Any(), gomock.Any()).DoAndReturn(func(query *chromaprint.Fingerprint, opts *priv.SearchOptions) (*priv.SearchResults, error) {
+		time.Sleep(delay)
+		if opts.Hits && opts.Thorough {
+			return &priv.SearchResults{Hits: thoroughHits}, nil
+		}
+		if opts.Hits {
+			return &priv.SearchResults{Hits: hits}, nil
+		}
+		results := &priv.SearchResults{}
+		for _, trackID := range opts.Candidates {
+			count := hits[trackID]
+			if thoroughHits[trackID] > count {
+				count = thoroughHits[trackID]
+			}
+			results.Results = append(results.Results, createSearchResult(fmt.Sprintf("track%d", trackID), count))
+		}
+		return results, nil
+	}).AnyTimes()
+	api := priv.NewAPI(service)
+	api.SearchNodeSecret = testSearchNodeSecret
+	return httptest.NewServer(api)
+}
+
+const testSearchNodeSecret = "s3cr3t"
+
+func newTestSearchNodes(urls ...string) *priv.SearchNodes {
+	nodes := priv.NewSearchNodes(urls)
+	nodes.Secret = testSearchNodeSecret
+	return nodes
+}
+
+func makeNodeSearchRequest(t *testing.T, api *priv.API, secret string, request priv.NodeSearchRequest) (int, string) {
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/v1/priv/cat1/_node_search", bytes.NewReader(requestBody))
+	require.NoError(t, err)
+	if secret != "" {
+		req.Header.Set("X-Search-Node-Secret", secret)
+	}
+	api.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+func createSearchResult(id string, end int) priv.SearchResult {
+	return priv.SearchResult{
+		ID: id,
+		Match: &chromaprint.MatchResult{
+			Version:      1,
+			Config:       chromaprint.FingerprintConfigs[1],
+			MasterLength: 1,
+			QueryLength:  1,
+			Sections: []chromaprint.MatchingSection{
+				{Offset: 0, Start: 0, End: end},
+			},
+		},
+	}
+}
+
+func searchNodes(t *testing.T, api *priv.API, request priv.SearchRequest) *priv.SearchResponse {
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
+	require.Equal(t, http.StatusOK, status)
+
+	var response priv.SearchResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &response))
+	return &response
+}
+
+func searchResultIDs(response *priv.SearchResponse) []string {
+	var ids []string
+	for _, result := range response.Results {
+		ids = append(ids, result.ID)
+	}
+	return ids
+}
+
+func TestApi_Search_Nodes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Track 1 would be a candidate on its own node, but not with the hits of the other node.
+	node1 := createSearchNode(ctrl, 0, map[int]int{1: 5, 2: 20}, nil)
+	defer node1.Close()
+	node2 := createSearchNode(ctrl, 0, map[int]int{3: 100, 4: 40}, nil)
+	defer node2.Close()
+
+	service, _ := createMockCatalogService(ctrl)
+	api := priv.NewAPI(service)
+	api.Nodes = newTestSearchNodes(node1.URL, node2.URL)
+
+	response := searchNodes(t, api, priv.SearchRequest{Fingerprint: testFingerprint})
+	assert.False(t, response.Partial)
+	assert.Equal(t, []string{"track3", "track4", "track2"}, searchResultIDs(response))
+}
+
+func TestApi_Search_Nodes_Thorough(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// The normal mode finds too few hits for any candidates.
+	node1 := createSearchNode(ctrl, 0, map[int]int{1: 1}, map[int]int{1: 30})
+	defer node1.Close()
+	node2 := createSearchNode(ctrl, 0, nil, map[int]int{2: 2})
+	defer node2.Close()
+
+	service, _ := createMockCatalogService(ctrl)
+	api := priv.NewAPI(service)
+	api.Nodes = newTestSearchNodes(node1.URL, node2.URL)
+
+	response := searchNodes(t, api, priv.SearchRequest{Fingerprint: testFingerprint, Mode: "thorough"})
+	assert.Equal(t, []string{"track1"}, searchResultIDs(response))
+}
+
+func TestApi_Search_Nodes_Partial(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	node1 := createSearchNode(ctrl, 0, map[int]int{1: 10}, nil)
+	defer node1.Close()
+	node2 := createSearchNode(ctrl, time.Millisecond*500, map[int]int{2: 20}, nil)
+	defer node2.Close()
+
+	service, _ := createMockCatalogService(ctrl)
+	api := priv.NewAPI(service)
+	api.Nodes = newTestSearchNodes(node1.URL, node2.URL)
+	api.Nodes.Timeout = time.Millisecond * 100
+
+	response := searchNodes(t, api, priv.SearchRequest{Fingerprint: testFingerprint})
+	assert.True(t, response.Partial)
+	assert.Equal(t, []string{"track1"}, searchResultIDs(response))
+}
+
+func TestApi_Search_Hits(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().Search(gomock.Any(), &priv.SearchOptions{Hits: true}).Return(&priv.SearchResults{Hits: map[int]int{7: 42}}, nil)
+	api := priv.NewAPI(service)
+	api.SearchNodeSecret = testSearchNodeSecret
+
+	request := priv.NodeSearchRequest{SearchRequest: priv.SearchRequest{Fingerprint: testFingerprint}, Hits: true}
+	status, body := makeNodeSearchRequest(t, api, testSearchNodeSecret, request)
+	require.Equal(t, http.StatusOK, status)
+
+	var response priv.NodeSearchResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &response))
+	assert.Equal(t, []priv.NodeSearchHit{{TrackID: 7, Count: 42}}, response.Hits)
+	assert.Empty(t, response.Results)
+}
+
+func TestApi_Search_HitsAndCandidates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, _ := createMockCatalogService(ctrl)
+	api := priv.NewAPI(service)
+	api.SearchNodeSecret = testSearchNodeSecret
+
+	request := priv.NodeSearchRequest{SearchRequest: priv.SearchRequest{Fingerprint: testFingerprint}, Hits: true, Candidates: []int{7}}
+	status, _ := makeNodeSearchRequest(t, api, testSearchNodeSecret, request)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestApi_Search_TooManyCandidates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, _ := createMockCatalogService(ctrl)
+	api := priv.NewAPI(service)
+	api.SearchNodeSecret = testSearchNodeSecret
+
+	request := priv.NodeSearchRequest{SearchRequest: priv.SearchRequest{Fingerprint: testFingerprint}, Candidates: make([]int, priv.MaxSearchNodeCandidates+1)}
+	status, _ := makeNodeSearchRequest(t, api, testSearchNodeSecret, request)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestApi_NodeSearch_Forbidden(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	api := priv.NewAPI(service)
+	request := priv.NodeSearchRequest{SearchRequest: priv.SearchRequest{Fingerprint: testFingerprint}, Hits: true}
+
+	// The endpoint is disabled without a secret.
+	status, _ := makeNodeSearchRequest(t, api, "", request)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	api.SearchNodeSecret = testSearchNodeSecret
+
+	status, _ = makeNodeSearchRequest(t, api, "", request)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _ = makeNodeSearchRequest(t, api, "wrong", request)
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestApi_Search_NodeFields(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// The public endpoint ignores the fields of the node protocol.
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().Search(gomock.Any(), &priv.SearchOptions{}).Return(&priv.SearchResults{Hits: map[int]int{7: 42}}, nil)
+	api := priv.NewAPI(service)
+
+	request := priv.NodeSearchRequest{SearchRequest: priv.SearchRequest{Fingerprint: testFingerprint}, Hits: true, Candidates: []int{7}}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+	status, body := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"catalog": "cat1", "results": []}`, body)
+}
+
+func TestApi_Search_Nodes_AllFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	node := httptest.NewServer(http.NotFoundHandler())
+	defer node.Close()
+
+	service, _ := createMockCatalogService(ctrl)
+	api := priv.NewAPI(service)
+	api.Nodes = newTestSearchNodes(node.URL)
+
+	request := priv.SearchRequest{Fingerprint: testFingerprint}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	status, _ := makeRequest(t, api, "POST", "/v1/priv/cat1/_search", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusInternalServerError, status)
+}
+
+func TestApi_AdminDisabled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	api := priv.NewAPI(service)
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_admin/accounts/acc1/api_keys", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Admin API is disabled"}}`, body)
+}
+
+func TestApi_AdminUnauthorized(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.PasswordAuth{Username: "admin", Password: "secret"}
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_admin/accounts/acc1/api_keys", nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.JSONEq(t, `{"status":401,"error":{"type":"unauthorized","reason":"Not authorized: not authorized"}}`, body)
+}
+
+func TestApi_ListAPIKeys(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	created := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	lastUsed := time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().ListAPIKeys("acc1").Return([]priv.APIKey{
+		{ID: 1, Account: "acc1", Name: "app1", Prefix: "abcdefgh", Created: created, LastUsed: &lastUsed, Revoked: &lastUsed},
+		{ID: 2, Account: "acc1", Name: "app1", Prefix: "ijklmnop", Created: lastUsed},
+	}, nil)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_admin/accounts/acc1/api_keys", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"account": "acc1", "api_keys": [
+		{"id": 1, "account": "acc1", "name": "app1", "prefix": "abcdefgh", "created": "2026-10-18T12:00:00Z", "last_used": "2026-10-18T13:00:00Z", "revoked": "2026-10-18T13:00:00Z"},
+		{"id": 2, "account": "acc1", "name": "app1", "prefix": "ijklmnop", "created": "2026-10-18T13:00:00Z", "last_used": null}
+	]}`, body)
+}
+
+func TestApi_CreateAPIKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	created := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().CreateAPIKey("acc1", "app1", priv.Permissions{Scopes: []string{"search"}}).Return(&priv.APIKey{ID: 1, Account: "acc1", Name: "app1", Key: "abcdefghXYZ", Prefix: "abcdefgh", Created: created,
+		Permissions: priv.Permissions{Scopes: []string{"search"}}}, nil)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "POST", "/v1/priv/_admin/accounts/acc1/api_keys", bytes.NewReader([]byte(`{"name": "app1", "scopes": ["search"]}`)))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"id": 1, "account": "acc1", "name": "app1", "key": "abcdefghXYZ", "prefix": "abcdefgh", "created": "2026-10-18T12:00:00Z", "last_used": null, "scopes": ["search"]}`, body)
+}
+
+func TestApi_CreateAPIKey_InvalidScope(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "POST", "/v1/priv/_admin/accounts/acc1/api_keys", bytes.NewReader([]byte(`{"scopes": ["delete"]}`)))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Invalid permissions: invalid scope \"delete\""}}`, body)
+}
+
+func TestApi_RotateAPIKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	created := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().RotateAPIKey("acc1", 1).Return(&priv.APIKey{ID: 2, Account: "acc1", Name: "app1", Key: "abcdefghXYZ", Prefix: "abcdefgh", Created: created}, nil)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "POST", "/v1/priv/_admin/accounts/acc1/api_keys/1/_rotate", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"id": 2, "account": "acc1", "name": "app1", "key": "abcdefghXYZ", "prefix": "abcdefgh", "created": "2026-10-18T12:00:00Z", "last_used": null}`, body)
+}
+
+func TestApi_RevokeAPIKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().RevokeAPIKey("acc1", 1).Return(nil)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "DELETE", "/v1/priv/_admin/accounts/acc1/api_keys/1", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"id": 1, "account": "acc1"}`, body)
+}
+
+func TestApi_RevokeAPIKey_NotFound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().RevokeAPIKey("acc1", 1).Return(priv.ErrAPIKeyNotFound)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "DELETE", "/v1/priv/_admin/accounts/acc1/api_keys/1", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"status":404,"error":{"type":"not_found","reason":"API key not found"}}`, body)
+
+	status, body = makeRequest(t, api, "DELETE", "/v1/priv/_admin/accounts/acc1/api_keys/x", nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Invalid API key ID"}}`, body)
+}
+
+func TestApi_MissingScope(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	api := priv.NewAPI(service)
+	api.Auth = &principalAuth{&priv.Principal{Account: "acc1", Permissions: priv.Permissions{Scopes: []string{"catalog:read", "search"}}}}
+
+	status, body := makeRequest(t, api, "DELETE", "/v1/priv/cat1", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Missing permission \"catalog:write\""}}`, body)
+
+	status, body = makeRequest(t, api, "PUT", "/v1/priv/cat1/track1", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Missing permission \"catalog:write\""}}`, body)
+}
+
+func TestApi_RestrictedCatalog(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	repo := mock.NewMockRepository(ctrl)
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().Return(repo)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("acc1").Return(account, nil)
+
+	api := priv.NewAPI(service)
+	api.Auth = &principalAuth{&priv.Principal{Account: "acc1", Permissions: priv.Permissions{Catalogs: []string{"test-*"}}}}
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/cat1", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Access to catalog cat1 is not allowed"}}`, body)
+}
+
+func TestApi_AdminMissingScope(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	api := priv.NewAPI(service)
+	api.AdminAuth = &principalAuth{&priv.Principal{Account: "acc1", Permissions: priv.Permissions{Scopes: []string{"search"}}}}
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_admin/accounts/acc1/api_keys", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Missing permission \"admin\""}}`, body)
+}
+
+func TestApi_CreateSearchToken(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	catalog := mock.NewMockCatalog(ctrl)
+	catalog.EXPECT().Name().AnyTimes().Return("cat1")
+	catalog.EXPECT().Search(gomock.Any(), gomock.Any()).Return(&priv.SearchResults{}, nil)
+
+	repo := mock.NewMockRepository(ctrl)
+	repo.EXPECT().Catalog("cat1").Return(catalog)
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().AnyTimes().Return(repo)
+	account.EXPECT().Limits().AnyTimes().Return(&priv.Limits{}, nil)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("default").AnyTimes().Return(account, nil)
+
+	keys, err := priv.ParseSearchTokenKeys("k1:0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	api.SearchTokens = keys
+	api.Auth = priv.NewChainAuth(&priv.SearchTokenAuth{Keys: keys}, &priv.NoAuth{})
+
+	status, body := makeRequest(t, api, "POST", "/v1/priv/_search_tokens", bytes.NewReader([]byte(`{"catalogs": ["cat1"], "ttl": 60, "rate_limit": 3}`)))
+	require.Equal(t, http.StatusOK, status, body)
+
+	var response priv.SearchTokenResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &response))
+	assert.Equal(t, []string{"cat1"}, response.Catalogs)
+	assert.Equal(t, 3, response.RateLimit)
+	assert.NotEmpty(t, response.Token)
+
+	makeTokenRequest := func(method string, path string, body string) (int, string) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+response.Token)
+		api.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	searchBody := `{"fingerprint": "` + testFingerprint + `"}`
+
+	status, body = makeTokenRequest("POST", "/v1/priv/cat2/_search", searchBody)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Access to catalog cat2 is not allowed"}}`, body)
+
+	status, body = makeTokenRequest("GET", "/v1/priv/cat1", "")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Missing permission \"catalog:read\""}}`, body)
+
+	status, body = makeTokenRequest("POST", "/v1/priv/_search_tokens", `{"catalogs": ["cat1"]}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Search tokens can't be used to create search tokens"}}`, body)
+
+	status, _ = makeTokenRequest("POST", "/v1/priv/cat1/_search", searchBody)
+	assert.Equal(t, http.StatusOK, status)
+
+	// all three requests with the search scope counted towards the rate limit
+	status, body = makeTokenRequest("POST", "/v1/priv/cat1/_search", searchBody)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.JSONEq(t, `{"status":429,"error":{"type":"rate_limited","reason":"Rate limit exceeded"}}`, body)
+}
+
+func TestApi_CreateSearchToken_Invalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().AnyTimes().Return(mock.NewMockRepository(ctrl))
+	account.EXPECT().Limits().AnyTimes().Return(&priv.Limits{}, nil)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("acc1").AnyTimes().Return(account, nil)
+
+	keys, err := priv.ParseSearchTokenKeys("k1:0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	api.Auth = &principalAuth{&priv.Principal{Account: "acc1", Permissions: priv.Permissions{Catalogs: []string{"cat1"}}}}
+
+	status, body := makeRequest(t, api, "POST", "/v1/priv/_search_tokens", bytes.NewReader([]byte(`{"catalogs": ["cat1"]}`)))
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Search tokens are disabled"}}`, body)
+
+	api.SearchTokens = keys
+
+	testCases := []struct {
+		Request string
+		Status  int
+		Reason  string
+	}{
+		{`{}`, http.StatusBadRequest, "Missing catalogs"},
+		{`{"catalogs": ["_cat1"]}`, http.StatusBadRequest, "Invalid catalog name"},
+		{`{"catalogs": ["cat2"]}`, http.StatusForbidden, "Access to catalog cat2 is not allowed"},
+		{`{"catalogs": ["cat1"], "ttl": 100000}`, http.StatusBadRequest, "TTL must be between 1 and 86400 seconds"},
+		{`{"catalogs": ["cat1"], "rate_limit": -1}`, http.StatusBadRequest, "Rate limit must not be negative"},
+	}
+	for _, testCase := range testCases {
+		status, body := makeRequest(t, api, "POST", "/v1/priv/_search_tokens", bytes.NewReader([]byte(testCase.Request)))
+		assert.Equal(t, testCase.Status, status, testCase.Request)
+		var response priv.ErrorResponse
+		require.NoError(t, json.Unmarshal([]byte(body), &response))
+		assert.Equal(t, testCase.Reason, response.Error.Reason, testCase.Request)
+	}
+}
+
+func TestApi_AccountRateLimit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	catalog := mock.NewMockCatalog(ctrl)
+	catalog.EXPECT().Name().AnyTimes().Return("cat1")
+	catalog.EXPECT().Search(gomock.Any(), gomock.Any()).Times(2).Return(&priv.SearchResults{}, nil)
+
+	repo := mock.NewMockRepository(ctrl)
+	repo.EXPECT().Catalog("cat1").AnyTimes().Return(catalog)
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().AnyTimes().Return(repo)
+	account.EXPECT().Limits().AnyTimes().Return(&priv.Limits{SearchRate: 2}, nil)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("default").AnyTimes().Return(account, nil)
+
+	api := priv.NewAPI(service)
+
+	search := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/v1/priv/cat1/_search", bytes.NewReader([]byte(`{"fingerprint": "`+testFingerprint+`"}`)))
+		require.NoError(t, err)
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	w := search()
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Remaining"))
+
+	w = search()
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+
+	w = search()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Reset"))
+	assert.JSONEq(t, `{"status":429,"error":{"type":"rate_limited","reason":"Rate limit exceeded"}}`, w.Body.String())
+}
+
+func TestApi_CreateCatalog_QuotaExceeded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateCatalog().Return(&priv.QuotaError{Quota: "catalogs", Limit: 10})
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"quota_exceeded","reason":"Quota exceeded, the maximum number of catalogs is 10"}}`, body)
+}
+
+func TestApi_CreateCatalog_AccountDeleted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateCatalog().Return(priv.ErrAccountDeleted)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"account_deleted","reason":"Account was deleted"}}`, body)
+}
+
+func TestApi_CreateTrack_QuotaExceeded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateTrack("track1", gomock.Any(), gomock.Any(), gomock.Any(), false).Return(false, &priv.QuotaError{Quota: "tracks per catalog", Limit: 1000})
+
+	request := priv.CreateTrackRequest{Fingerprint: testFingerprint}
+	requestBody, err := json.Marshal(request)
+	require.NoError(t, err)
+
+	api := priv.NewAPI(service)
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/cat1/track1", bytes.NewReader(requestBody))
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"quota_exceeded","reason":"Quota exceeded, the maximum number of tracks per catalog is 1000"}}`, body)
+}
+
+func TestApi_GetAccountLimits(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	searchRate := 20
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().CustomLimits().Return(&priv.CustomLimits{SearchRate: &searchRate}, nil)
+	account.EXPECT().Limits().Return(&priv.Limits{SearchRate: 20, WriteRate: 5}, nil)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("acc1").Return(account, nil)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_admin/accounts/acc1/limits", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"account": "acc1",
+		"limits": {"search_rate": 20, "write_rate": 5, "max_catalogs": 0, "max_tracks_per_catalog": 0, "max_tracks": 0},
+		"custom_limits": {"search_rate": 20, "write_rate": null, "max_catalogs": null, "max_tracks_per_catalog": null, "max_tracks": null}}`, body)
+}
+
+func TestApi_UpdateAccountLimits(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	maxCatalogs := 3
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().UpdateCustomLimits(&priv.CustomLimits{MaxCatalogs: &maxCatalogs}).Return(nil)
+	account.EXPECT().CustomLimits().Return(&priv.CustomLimits{MaxCatalogs: &maxCatalogs}, nil)
+	account.EXPECT().Limits().Return(&priv.Limits{MaxCatalogs: 3}, nil)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("acc1").Return(account, nil)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/_admin/accounts/acc1/limits", bytes.NewReader([]byte(`{"max_catalogs": 3, "search_rate": null}`)))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"account": "acc1",
+		"limits": {"search_rate": 0, "write_rate": 0, "max_catalogs": 3, "max_tracks_per_catalog": 0, "max_tracks": 0},
+		"custom_limits": {"search_rate": null, "write_rate": null, "max_catalogs": 3, "max_tracks_per_catalog": null, "max_tracks": null}}`, body)
+}
+
+func TestApi_UpdateAccountLimits_Invalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "PUT", "/v1/priv/_admin/accounts/acc1/limits", bytes.NewReader([]byte(`{"write_rate": -1}`)))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Invalid limits: limits can't be negative"}}`, body)
+}
+
+func TestApi_GetUsage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	repo := mock.NewMockRepository(ctrl)
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().Return(repo)
+	repo.EXPECT().Account().Return(account)
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)
+	account.EXPECT().Usage(from, to).Return([]priv.DailyUsage{
+		{Date: "2026-10-02", Searches: map[string]int64{"normal": 10, "stream": 2}, TracksAdded: 5, TracksDeleted: 1, Tracks: 4, StorageBytes: 4096},
+	}, nil)
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("acc1").Return(account, nil)
+
+	api := priv.NewAPI(service)
+	api.Auth = &principalAuth{priv.NewPrincipal("acc1")}
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_usage?from=2026-10-01&to=2026-10-02", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{
+		"account": "acc1",
+		"from": "2026-10-01",
+		"to": "2026-10-02",
+		"days": [
+			{"date": "2026-10-02", "searches": {"normal": 10, "stream": 2}, "tracks_added": 5, "tracks_deleted": 1, "tracks": 4, "storage_bytes": 4096}
+		]
+	}`, body)
+}
+
+func TestApi_GetUsage_Invalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().AnyTimes().Return(mock.NewMockRepository(ctrl))
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount(gomock.Any()).AnyTimes().Return(account, nil)
+
+	api := priv.NewAPI(service)
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_usage?from=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Invalid date in from, expected YYYY-MM-DD"}}`, body)
+
+	status, body = makeRequest(t, api, "GET", "/v1/priv/_usage?from=2026-10-02&to=2026-10-01", nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"The from date must not be after the to date"}}`, body)
+
+	status, body = makeRequest(t, api, "GET", "/v1/priv/_usage?from=2025-01-01&to=2026-10-01", nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Usage can be requested for at most 366 days"}}`, body)
+
+	api.Auth = &principalAuth{&priv.Principal{Account: "acc1", Permissions: priv.Permissions{Catalogs: []string{"cat1"}}}}
+	status, body = makeRequest(t, api, "GET", "/v1/priv/_usage", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Usage is only available with access to all catalogs"}}`, body)
+}
+
+func TestApi_RequestID(t *testing.T) {
+	api := priv.NewAPI(mock.NewMockService(gomock.NewController(t)))
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/does-not-exist", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Request-Id", "req1")
+	api.ServeHTTP(w, req)
+	assert.Equal(t, "req1", w.Header().Get("X-Request-Id"))
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/does-not-exist", nil)
+	require.NoError(t, err)
+	api.ServeHTTP(w, req)
+	assert.NotEmpty(t, w.Header().Get("X-Request-Id"))
+}
+
+func TestApi_Audit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().DeleteTrack("track1").Return(nil)
+
+	auditLog := mock.NewMockAuditLog(ctrl)
+	auditLog.EXPECT().Record(&priv.AuditEntry{
+		Account:   "acc1",
+		Principal: "api_key:1",
+		IP:        "192.0.2.1",
+		RequestID: "req1",
+		Action:    priv.AuditTrackDelete,
+		Catalog:   "cat1",
+		Object:    "track1",
+	}).Return(nil)
+
+	api := priv.NewAPI(service)
+	api.Auth = &principalAuth{&priv.Principal{Account: "acc1", Credential: "api_key:1"}}
+	api.Audit = auditLog
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "/v1/priv/cat1/track1", nil)
+	req.Header.Set("X-Request-Id", "req1")
+	api.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestApi_Audit_ForwardedFor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, catalog := createMockCatalogService(ctrl)
+	catalog.EXPECT().CreateCatalog().Return(nil)
+
+	var entry *priv.AuditEntry
+	auditLog := mock.NewMockAuditLog(ctrl)
+	auditLog.EXPECT().Record(gomock.Any()).Do(func(e *priv.AuditEntry) { entry = e }).Return(nil)
+
+	api := priv.NewAPI(service)
+	api.Audit = auditLog
+	api.TrustForwardedFor = true
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/v1/priv/cat1", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.1")
+	api.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	require.NotNil(t, entry)
+	assert.Equal(t, "198.51.100.7", entry.IP)
+	assert.Equal(t, priv.AuditCatalogPut, entry.Action)
+	assert.Equal(t, "account", entry.Principal)
+	assert.Equal(t, w.Header().Get("X-Request-Id"), entry.RequestID)
+}
+
+func TestApi_GetAuditLog(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().Return(mock.NewMockRepository(ctrl))
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("acc1").Return(account, nil)
+
+	created := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	auditLog := mock.NewMockAuditLog(ctrl)
+	auditLog.EXPECT().Query("acc1", &priv.AuditFilter{Catalog: "cat1", Before: 10, Limit: 3}).Return([]priv.AuditEntry{
+		{ID: 9, Time: created, Principal: "api_key:1", IP: "192.0.2.1", RequestID: "r9", Action: priv.AuditCatalogDelete, Catalog: "cat1"},
+		{ID: 8, Time: created, Principal: "api_key:1", IP: "192.0.2.1", RequestID: "r8", Action: priv.AuditTrackPut, Catalog: "cat1", Object: "t1"},
+		{ID: 7, Time: created, Principal: "account", Action: priv.AuditCatalogPut, Catalog: "cat1"},
+	}, nil)
+
+	api := priv.NewAPI(service)
+	api.Auth = &principalAuth{priv.NewPrincipal("acc1")}
+	api.Audit = auditLog
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_audit?catalog=cat1&cursor=10&limit=2", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{
+		"account": "acc1",
+		"entries": [
+			{"id": 9, "time": "2026-10-18T12:00:00Z", "principal": "api_key:1", "ip": "192.0.2.1", "request_id": "r9", "action": "catalog.delete", "catalog": "cat1"},
+			{"id": 8, "time": "2026-10-18T12:00:00Z", "principal": "api_key:1", "ip": "192.0.2.1", "request_id": "r8", "action": "track.put", "catalog": "cat1", "object": "t1"}
+		],
+		"has_more": true,
+		"cursor": "8"
+	}`, body)
+}
+
+func TestApi_GetAuditLog_Invalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	account := mock.NewMockAccount(ctrl)
+	account.EXPECT().Repository().AnyTimes().Return(mock.NewMockRepository(ctrl))
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount(gomock.Any()).AnyTimes().Return(account, nil)
+
+	api := priv.NewAPI(service)
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_audit", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Audit log is disabled"}}`, body)
+
+	api.Audit = mock.NewMockAuditLog(ctrl)
+
+	status, body = makeRequest(t, api, "GET", "/v1/priv/_audit?from=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Invalid time in from, expected RFC 3339 format"}}`, body)
+
+	status, body = makeRequest(t, api, "GET", "/v1/priv/_audit?limit=5000", nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Limit must be between 1 and 1000"}}`, body)
+}
+
+func TestApi_AccountDeleted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccount("acc1").Return(nil, priv.ErrAccountDeleted)
+
+	api := priv.NewAPI(service)
+	api.Auth = &principalAuth{priv.NewPrincipal("acc1")}
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"account_deleted","reason":"Account was deleted"}}`, body)
+}
+
+func TestApi_PurgeAccount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	started := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().StartAccountPurge("acc1", priv.PurgePolicy{KeepUsage: true}).Return(&priv.AccountPurge{
+		Account:   "acc1",
+		AccountID: 1,
+		Policy:    priv.PurgePolicy{KeepUsage: true},
+		Started:   started,
+	}, nil)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "POST", "/v1/priv/_admin/accounts/acc1/_purge", bytes.NewReader([]byte(`{"keep_usage": true}`)))
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.JSONEq(t, `{
+		"account": "acc1",
+		"policy": {"keep_usage": true, "keep_audit_log": false},
+		"status": "running",
+		"started": "2026-10-18T12:00:00Z",
+		"catalogs": 0,
+		"tracks": 0,
+		"api_keys": 0,
+		"usage_records": 0,
+		"audit_log_entries": 0
+	}`, body)
+}
+
+func TestApi_PurgeAccount_Errors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().StartAccountPurge("acc1", priv.PurgePolicy{}).Return(nil, priv.ErrAccountNotFound)
+	service.EXPECT().StartAccountPurge("acc2", priv.PurgePolicy{}).Return(nil, priv.ErrPurgeReportKeyMissing)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "POST", "/v1/priv/_admin/accounts/acc1/_purge", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"status":404,"error":{"type":"not_found","reason":"Account not found"}}`, body)
+
+	status, body = makeRequest(t, api, "POST", "/v1/priv/_admin/accounts/acc2/_purge", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"status":403,"error":{"type":"forbidden","reason":"Purging accounts is disabled"}}`, body)
+
+	status, body = makeRequest(t, api, "POST", "/v1/priv/_admin/accounts/acc1/_purge", bytes.NewReader([]byte(`{"keep_usage": 1}`)))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"status":400,"error":{"type":"invalid_request","reason":"Invalid request body"}}`, body)
+}
+
+func TestApi_GetAccountPurge(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	started := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	finished := started.Add(time.Minute)
+	service := mock.NewMockService(ctrl)
+	service.EXPECT().GetAccountPurge("acc1").Return(&priv.AccountPurge{
+		Account:         "acc1",
+		AccountID:       1,
+		Started:         started,
+		Finished:        &finished,
+		Catalogs:        2,
+		Tracks:          100,
+		APIKeys:         1,
+		UsageRecords:    10,
+		AuditLogEntries: 5,
+		Report:          []byte(`{"report":{"account":"acc1"},"key_id":"k1","signature":"abc"}`),
+	}, nil)
+	service.EXPECT().GetAccountPurge("acc2").Return(nil, nil)
+
+	api := priv.NewAPI(service)
+	api.AdminAuth = &priv.NoAuth{}
+
+	status, body := makeRequest(t, api, "GET", "/v1/priv/_admin/accounts/acc1/_purge", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{
+		"account": "acc1",
+		"policy": {"keep_usage": false, "keep_audit_log": false},
+		"status": "finished",
+		"started": "2026-10-18T12:00:00Z",
+		"finished": "2026-10-18T12:01:00Z",
+		"catalogs": 2,
+		"tracks": 100,
+		"api_keys": 1,
+		"usage_records": 10,
+		"audit_log_entries": 5,
+		"report": {"report": {"account": "acc1"}, "key_id": "k1", "signature": "abc"}
+	}`, body)
+
+	status, body = makeRequest(t, api, "GET", "/v1/priv/_admin/accounts/acc2/_purge", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"status":404,"error":{"type":"not_found","reason":"Account was not purged"}}`, body)
+}
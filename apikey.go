@@ -0,0 +1,200 @@
+package priv
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKeyPrefixLength is the number of leading characters of a key that are
+// stored in plain text, so that users can tell their keys apart.
+const APIKeyPrefixLength = 8
+
+type APIKey struct {
+	ID       int
+	Account  string
+	Name     string
+	Key      string // only set when the key was just generated
+	Prefix   string
+	Created  time.Time
+	LastUsed *time.Time
+	Revoked  *time.Time
+	Permissions
+}
+
+func generateAPIKey() (string, error) {
+	data := make([]byte, 24)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// stringArray returns the value to be stored in a nullable text array column,
+// empty lists are stored as NULL.
+func stringArray(values []string) pq.StringArray {
+	if len(values) == 0 {
+		return nil
+	}
+	return pq.StringArray(values)
+}
+
+func insertAPIKey(tx *sql.Tx, accountID int, name string, permissions Permissions) (*APIKey, error) {
+	key, err := generateAPIKey()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to generate API key")
+	}
+	apiKey := &APIKey{Name: name, Key: key, Prefix: key[:APIKeyPrefixLength], Permissions: permissions}
+	query := "" +
+		"INSERT INTO api_key (account_id, name, key_prefix, key_hash, scopes, catalogs) " +
+		"VALUES ($1, $2, $3, digest($4, 'sha256'), $5, $6) " +
+		"RETURNING id, created"
+	err = tx.QueryRow(query, accountID, name, apiKey.Prefix, key, stringArray(permissions.Scopes), stringArray(permissions.Catalogs)).Scan(&apiKey.ID, &apiKey.Created)
+	if err != nil {
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+// CreateAPIKey generates a new API key for the account. The key itself is only
+// returned here, the database only stores its hash.
+func (s *ServiceImpl) CreateAPIKey(externalAccountID string, name string, permissions Permissions) (*APIKey, error) {
+	err := permissions.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := s.GetAccount(externalAccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	apiKey, err := insertAPIKey(tx, account.(*AccountImpl).id, name, permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey.Account = externalAccountID
+	return apiKey, nil
+}
+
+// ListAPIKeys returns all keys of the account, including revoked ones.
+func (s *ServiceImpl) ListAPIKeys(externalAccountID string) ([]APIKey, error) {
+	query := "" +
+		"SELECT k.id, k.name, k.key_prefix, k.created, k.last_used, k.revoked, k.scopes, k.catalogs " +
+		"FROM api_key k JOIN account a ON a.id = k.account_id " +
+		"WHERE a.external_id = $1 " +
+		"ORDER BY k.id"
+	rows, err := s.db.Query(query, externalAccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apiKeys []APIKey
+	for rows.Next() {
+		apiKey := APIKey{Account: externalAccountID}
+		err = rows.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Prefix, &apiKey.Created, &apiKey.LastUsed, &apiKey.Revoked,
+			(*pq.StringArray)(&apiKey.Scopes), (*pq.StringArray)(&apiKey.Catalogs))
+		if err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return apiKeys, nil
+}
+
+// RotateAPIKey revokes the key and generates a new one with the same name and permissions.
+func (s *ServiceImpl) RotateAPIKey(externalAccountID string, id int) (*APIKey, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var accountID int
+	var name string
+	var permissions Permissions
+	err = tx.QueryRow(revokeAPIKeyQuery, externalAccountID, id).Scan(&accountID, &name,
+		(*pq.StringArray)(&permissions.Scopes), (*pq.StringArray)(&permissions.Catalogs))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	apiKey, err := insertAPIKey(tx, accountID, name, permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey.Account = externalAccountID
+	return apiKey, nil
+}
+
+const revokeAPIKeyQuery = "" +
+	"UPDATE api_key k SET revoked = now() " +
+	"FROM account a " +
+	"WHERE a.id = k.account_id AND a.external_id = $1 AND k.id = $2 AND k.revoked IS NULL " +
+	"RETURNING k.account_id, k.name, k.scopes, k.catalogs"
+
+// RevokeAPIKey makes the key unusable. Revoked keys are kept for reference.
+func (s *ServiceImpl) RevokeAPIKey(externalAccountID string, id int) error {
+	var accountID int
+	var name string
+	var permissions Permissions
+	err := s.db.QueryRow(revokeAPIKeyQuery, externalAccountID, id).Scan(&accountID, &name,
+		(*pq.StringArray)(&permissions.Scopes), (*pq.StringArray)(&permissions.Catalogs))
+	if err == sql.ErrNoRows {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+// ValidateAPIKey returns the account that owns the key with the key's permissions
+// and records that the key was used. Unknown and revoked keys return ErrNotAuthorized.
+func (s *ServiceImpl) ValidateAPIKey(key string) (*Principal, error) {
+	query := "" +
+		"UPDATE api_key k SET last_used = now() " +
+		"FROM account a " +
+		"WHERE a.id = k.account_id AND k.key_hash = digest($1, 'sha256') AND k.revoked IS NULL " +
+		"RETURNING a.external_id, k.id, k.scopes, k.catalogs"
+	var principal Principal
+	var id int
+	err := s.db.QueryRow(query, key).Scan(&principal.Account, &id,
+		(*pq.StringArray)(&principal.Scopes), (*pq.StringArray)(&principal.Catalogs))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotAuthorized
+	} else if err != nil {
+		return nil, err
+	}
+	principal.Credential = fmt.Sprintf("api_key:%d", id)
+	return &principal, nil
+}
@@ -0,0 +1,76 @@
+package priv
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+func TestService_APIKeys(t *testing.T) {
+	service := NewService(connectToDB(t))
+	account := fmt.Sprintf("test:%d", rand.Uint32())
+
+	permissions := Permissions{Scopes: []string{ScopeCatalogRead, ScopeSearch}, Catalogs: []string{"prod-*"}}
+	apiKey, err := service.CreateAPIKey(account, "app1", permissions)
+	require.NoError(t, err)
+	assert.Equal(t, account, apiKey.Account)
+	assert.Equal(t, "app1", apiKey.Name)
+	assert.Len(t, apiKey.Key, 32)
+	assert.Equal(t, apiKey.Key[:APIKeyPrefixLength], apiKey.Prefix)
+
+	principal, err := service.ValidateAPIKey(apiKey.Key)
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Account: account, Credential: fmt.Sprintf("api_key:%d", apiKey.ID), Permissions: permissions}, principal)
+
+	_, err = service.ValidateAPIKey("invalid")
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	apiKeys, err := service.ListAPIKeys(account)
+	require.NoError(t, err)
+	if assert.Len(t, apiKeys, 1) {
+		assert.Equal(t, apiKey.ID, apiKeys[0].ID)
+		assert.Equal(t, "", apiKeys[0].Key)
+		assert.Equal(t, apiKey.Prefix, apiKeys[0].Prefix)
+		assert.NotNil(t, apiKeys[0].LastUsed)
+		assert.Nil(t, apiKeys[0].Revoked)
+		assert.Equal(t, permissions, apiKeys[0].Permissions)
+	}
+
+	newAPIKey, err := service.RotateAPIKey(account, apiKey.ID)
+	require.NoError(t, err)
+	assert.NotEqual(t, apiKey.ID, newAPIKey.ID)
+	assert.NotEqual(t, apiKey.Key, newAPIKey.Key)
+	assert.Equal(t, "app1", newAPIKey.Name)
+	assert.Equal(t, permissions, newAPIKey.Permissions)
+
+	_, err = service.ValidateAPIKey(apiKey.Key)
+	assert.Equal(t, ErrNotAuthorized, err)
+	principal, err = service.ValidateAPIKey(newAPIKey.Key)
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Account: account, Credential: fmt.Sprintf("api_key:%d", newAPIKey.ID), Permissions: permissions}, principal)
+
+	_, err = service.RotateAPIKey(account, apiKey.ID)
+	assert.Equal(t, ErrAPIKeyNotFound, err)
+	err = service.RevokeAPIKey("other", newAPIKey.ID)
+	assert.Equal(t, ErrAPIKeyNotFound, err)
+
+	err = service.RevokeAPIKey(account, newAPIKey.ID)
+	require.NoError(t, err)
+	_, err = service.ValidateAPIKey(newAPIKey.Key)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	apiKeys, err = service.ListAPIKeys(account)
+	require.NoError(t, err)
+	if assert.Len(t, apiKeys, 2) {
+		assert.NotNil(t, apiKeys[0].Revoked)
+		assert.NotNil(t, apiKeys[1].Revoked)
+	}
+}
+
+func TestService_CreateAPIKey_InvalidPermissions(t *testing.T) {
+	service := NewService(nil)
+	_, err := service.CreateAPIKey("test", "", Permissions{Scopes: []string{"delete"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,192 @@
+package priv
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultAuditRetention = time.Hour * 24 * 365
+const AuditCleanupInterval = time.Hour
+
+const (
+	DefaultAuditQueryLimit = 100
+	MaxAuditQueryLimit     = 1000
+)
+
+// Audited actions. Put actions create the object, or update it if it already exists.
+const (
+	AuditCatalogPut          = "catalog.put"
+	AuditCatalogDelete       = "catalog.delete"
+	AuditStopListUpdate      = "stop_list.update"
+	AuditTrackPut            = "track.put"
+	AuditTrackDelete         = "track.delete"
+	AuditAPIKeyCreate        = "api_key.create"
+	AuditAPIKeyRotate        = "api_key.rotate"
+	AuditAPIKeyRevoke        = "api_key.revoke"
+	AuditAccountLimitsUpdate = "account_limits.update"
+)
+
+// AuditEntry records one change of an account's data.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Account   string    `json:"-"`
+	Principal string    `json:"principal"`
+	IP        string    `json:"ip,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Action    string    `json:"action"`
+	Catalog   string    `json:"catalog,omitempty"`
+	Object    string    `json:"object,omitempty"`
+}
+
+// AuditFilter selects entries of the audit log. Empty fields match all entries.
+type AuditFilter struct {
+	From    time.Time
+	To      time.Time
+	Action  string
+	Catalog string
+	Object  string
+	Before  int64 // only entries with a lower ID, for paging
+	Limit   int
+}
+
+type AuditLog interface {
+	Record(entry *AuditEntry) error
+	Query(account string, filter *AuditFilter) ([]AuditEntry, error)
+}
+
+// AuditLogImpl stores the audit log in the database. Entries older than the retention
+// period are deleted in the background, they are kept forever if the retention is zero.
+type AuditLogImpl struct {
+	db        *sql.DB
+	Retention time.Duration
+	quit      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewAuditLog(db *sql.DB) *AuditLogImpl {
+	return &AuditLogImpl{db: db, Retention: DefaultAuditRetention}
+}
+
+func (l *AuditLogImpl) Record(entry *AuditEntry) error {
+	query := "" +
+		"INSERT INTO audit_log (account_id, principal, ip, request_id, action, catalog, object) " +
+		"SELECT id, $2, $3, $4, $5, $6, $7 FROM account WHERE external_id = $1 " +
+		"RETURNING id, created"
+	row := l.db.QueryRow(query, entry.Account, entry.Principal, entry.IP, entry.RequestID, entry.Action, entry.Catalog, entry.Object)
+	err := row.Scan(&entry.ID, &entry.Time)
+	if err == sql.ErrNoRows {
+		return errors.Errorf("account %s does not exist", entry.Account)
+	} else if err != nil {
+		return errors.WithMessage(err, "failed to insert audit log entry")
+	}
+	return nil
+}
+
+// Query returns the account's entries matching the filter, newest first.
+func (l *AuditLogImpl) Query(account string, filter *AuditFilter) ([]AuditEntry, error) {
+	conditions := []string{"a.external_id = $1"}
+	args := []interface{}{account}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if !filter.From.IsZero() {
+		addCondition("l.created >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("l.created < $%d", filter.To)
+	}
+	if filter.Action != "" {
+		addCondition("l.action = $%d", filter.Action)
+	}
+	if filter.Catalog != "" {
+		addCondition("l.catalog = $%d", filter.Catalog)
+	}
+	if filter.Object != "" {
+		addCondition("l.object = $%d", filter.Object)
+	}
+	if filter.Before != 0 {
+		addCondition("l.id < $%d", filter.Before)
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultAuditQueryLimit
+	}
+	args = append(args, limit)
+
+	query := "" +
+		"SELECT l.id, l.created, l.principal, l.ip, l.request_id, l.action, l.catalog, l.object " +
+		"FROM audit_log l JOIN account a ON a.id = l.account_id " +
+		"WHERE " + strings.Join(conditions, " AND ") + " " +
+		fmt.Sprintf("ORDER BY l.id DESC LIMIT $%d", len(args))
+	rows, err := l.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to query audit log")
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry := AuditEntry{Account: account}
+		err = rows.Scan(&entry.ID, &entry.Time, &entry.Principal, &entry.IP, &entry.RequestID, &entry.Action, &entry.Catalog, &entry.Object)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to query audit log")
+		}
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to query audit log")
+	}
+	return entries, nil
+}
+
+// DeleteExpired deletes entries older than the retention period.
+func (l *AuditLogImpl) DeleteExpired() (int64, error) {
+	if l.Retention == 0 {
+		return 0, nil
+	}
+	result, err := l.db.Exec("DELETE FROM audit_log WHERE created < now() - $1 * interval '1 second'", l.Retention.Seconds())
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to delete expired audit log entries")
+	}
+	return result.RowsAffected()
+}
+
+// Start periodically deletes expired entries in the background.
+func (l *AuditLogImpl) Start(interval time.Duration) {
+	l.quit = make(chan struct{})
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := l.DeleteExpired()
+				if err != nil {
+					log.Printf("Failed to clean up audit log: %v", err)
+				} else if deleted > 0 {
+					log.Printf("Deleted %d expired audit log entries", deleted)
+				}
+			case <-l.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (l *AuditLogImpl) Close() {
+	if l.quit != nil {
+		close(l.quit)
+		l.wg.Wait()
+		l.quit = nil
+	}
+}
@@ -0,0 +1,82 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_Query(t *testing.T) {
+	db := connectToDB(t)
+	account := getTestAccount(t, db)
+	accountID := account.(*AccountImpl).id
+	externalID := "test:" + t.Name()
+	_, err := db.Exec("DELETE FROM audit_log WHERE account_id = $1", accountID)
+	require.NoError(t, err)
+
+	auditLog := NewAuditLog(db)
+	for _, entry := range []*AuditEntry{
+		{Account: externalID, Principal: "api_key:1", IP: "192.0.2.1", RequestID: "r1", Action: AuditCatalogPut, Catalog: "cat1"},
+		{Account: externalID, Principal: "api_key:1", IP: "192.0.2.1", RequestID: "r2", Action: AuditTrackPut, Catalog: "cat1", Object: "t1"},
+		{Account: externalID, Principal: "api_key:2", IP: "192.0.2.2", RequestID: "r3", Action: AuditTrackDelete, Catalog: "cat1", Object: "t1"},
+	} {
+		require.NoError(t, auditLog.Record(entry))
+		assert.NotZero(t, entry.ID)
+	}
+	assert.Error(t, auditLog.Record(&AuditEntry{Account: "test:does-not-exist", Principal: "account", Action: AuditCatalogPut}))
+
+	entries, err := auditLog.Query(externalID, &AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, []string{"r3", "r2", "r1"}, []string{entries[0].RequestID, entries[1].RequestID, entries[2].RequestID})
+	assert.Equal(t, AuditEntry{ID: entries[0].ID, Time: entries[0].Time, Account: externalID, Principal: "api_key:2", IP: "192.0.2.2",
+		RequestID: "r3", Action: AuditTrackDelete, Catalog: "cat1", Object: "t1"}, entries[0])
+
+	entries, err = auditLog.Query(externalID, &AuditFilter{Object: "t1", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "r3", entries[0].RequestID)
+
+	entries, err = auditLog.Query(externalID, &AuditFilter{Object: "t1", Before: entries[0].ID})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "r2", entries[0].RequestID)
+
+	entries, err = auditLog.Query(externalID, &AuditFilter{Action: AuditCatalogPut})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "r1", entries[0].RequestID)
+
+	entries, err = auditLog.Query(externalID, &AuditFilter{From: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestAuditLog_DeleteExpired(t *testing.T) {
+	db := connectToDB(t)
+	getTestAccount(t, db)
+	externalID := "test:" + t.Name()
+
+	auditLog := NewAuditLog(db)
+	auditLog.Retention = time.Hour
+	old := &AuditEntry{Account: externalID, Principal: "account", Action: AuditCatalogDelete, Catalog: "old"}
+	require.NoError(t, auditLog.Record(old))
+	_, err := db.Exec("UPDATE audit_log SET created = now() - interval '2 hours' WHERE id = $1", old.ID)
+	require.NoError(t, err)
+	recent := &AuditEntry{Account: externalID, Principal: "account", Action: AuditCatalogDelete, Catalog: "recent"}
+	require.NoError(t, auditLog.Record(recent))
+
+	deleted, err := auditLog.DeleteExpired()
+	require.NoError(t, err)
+	assert.True(t, deleted >= 1)
+
+	entries, err := auditLog.Query(externalID, &AuditFilter{Action: AuditCatalogDelete})
+	require.NoError(t, err)
+	var catalogs []string
+	for _, entry := range entries {
+		catalogs = append(catalogs, entry.Catalog)
+	}
+	assert.Contains(t, catalogs, "recent")
+	assert.NotContains(t, catalogs, "old")
+}
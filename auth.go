@@ -1,28 +1,33 @@
 package priv
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 var ErrNotAuthorized = errors.New("not authorized")
 
 type Authenticator interface {
-	Authenticate(r *http.Request) (account string, err error)
+	Authenticate(r *http.Request) (principal *Principal, err error)
 }
 
 type NoAuth struct {
 }
 
-func (a *NoAuth) Authenticate(r *http.Request) (account string, err error) {
-	return "default", nil
+func (a *NoAuth) Authenticate(r *http.Request) (principal *Principal, err error) {
+	return NewPrincipal("default"), nil
 }
 
 type PasswordAuth struct {
@@ -30,74 +35,253 @@ type PasswordAuth struct {
 	Password string
 }
 
-func (a *PasswordAuth) Authenticate(r *http.Request) (account string, err error) {
+func (a *PasswordAuth) Authenticate(r *http.Request) (principal *Principal, err error) {
 	username, password := ParseBasicAuth(r)
-	if username == a.Username && password == a.Password {
-		return "default", nil
+	// The password is compared in constant time, so that it can't be guessed from the response times.
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(a.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+	if usernameOK && passwordOK {
+		return NewPrincipal("default"), nil
 	}
-	return "", ErrNotAuthorized
+	return nil, ErrNotAuthorized
 }
 
+// ChainAuth tries several authenticators in order and uses the first one that accepts the request.
+type ChainAuth struct {
+	Authenticators []Authenticator
+}
+
+func NewChainAuth(authenticators ...Authenticator) *ChainAuth {
+	return &ChainAuth{Authenticators: authenticators}
+}
+
+func (a *ChainAuth) Authenticate(r *http.Request) (principal *Principal, err error) {
+	var lastErr, internalErr error
+	for _, auth := range a.Authenticators {
+		principal, err := auth.Authenticate(r)
+		if err == nil {
+			return principal, nil
+		}
+		if errors.Cause(err) == ErrNotAuthorized {
+			lastErr = err
+		} else if internalErr == nil {
+			internalErr = err
+		}
+	}
+	// A failure of one method should not look like invalid credentials if another
+	// method could not check them.
+	if internalErr != nil {
+		return nil, internalErr
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrNotAuthorized
+}
+
+const (
+	DefaultAcoustidBizEndpoint = "https://acoustid.biz/internal/validate-api-key"
+	DefaultAcoustidBizTimeout  = time.Second * 5
+)
+
+const (
+	// acoustidBizBreakerThreshold is the number of consecutive failed checks after
+	// which acoustid.biz is not contacted for acoustidBizBreakerCooldown.
+	acoustidBizBreakerThreshold = 5
+	acoustidBizBreakerCooldown  = time.Second * 30
+)
+
+var errAcoustidBizUnavailable = errors.New("acoustid.biz is unavailable")
+
+// errAcoustidBizCheckCanceled is returned to requests waiting for a check that was cancelled by the request that started it.
+var errAcoustidBizCheckCanceled = errors.New("acoustid.biz check was cancelled")
+
+// AcoustidBizAuth checks API keys with acoustid.biz. Valid keys are checked again
+// after FreshTTL, but until StaleTTL the previous result is used while the key is
+// being checked in the background, so valid keys keep working when acoustid.biz
+// is slow or down.
 type AcoustidBizAuth struct {
-	Cache    Cache
-	Endpoint string
-	Username string
-	Tag      string
+	Cache      Cache
+	Client     *http.Client
+	Endpoint   string
+	Username   string
+	Tag        string
+	Retries    int // number of retries of failed checks
+	FreshTTL   time.Duration
+	StaleTTL   time.Duration
+	InvalidTTL time.Duration
+	now        func() time.Time
+
+	group singleflight.Group
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+type acoustidBizCacheEntry struct {
+	account string // empty for invalid keys
+	checked time.Time
 }
 
 func NewAcoustidBizAuth(tag string) *AcoustidBizAuth {
 	auth := &AcoustidBizAuth{}
-	auth.Endpoint = "https://acoustid.biz/internal/validate-api-key"
+	auth.Client = &http.Client{Timeout: DefaultAcoustidBizTimeout}
+	auth.Endpoint = DefaultAcoustidBizEndpoint
 	auth.Username = "x-acoustid-api-key"
 	auth.Tag = tag
+	auth.Retries = 1
+	auth.FreshTTL = time.Hour
+	auth.StaleTTL = time.Hour * 24
+	auth.InvalidTTL = time.Minute
+	auth.now = time.Now
 	return auth
 }
 
-func (a *AcoustidBizAuth) Authenticate(r *http.Request) (account string, err error) {
+func (a *AcoustidBizAuth) Authenticate(r *http.Request) (principal *Principal, err error) {
 	username, password := ParseBasicAuth(r)
 	if strings.ToLower(username) == a.Username && password != "" {
-		return a.check(password)
+		account, err := a.check(r.Context(), password)
+		if err != nil {
+			return nil, err
+		}
+		return NewPrincipal(account), nil
 	}
-	return "", ErrNotAuthorized
+	return nil, ErrNotAuthorized
 }
 
-func (a *AcoustidBizAuth) check(apiKey string) (account string, err error) {
-	cacheKey := fmt.Sprintf("acoustid-biz-api-key:%s", apiKey)
+func (a *AcoustidBizAuth) cacheKey(apiKey string) string {
+	return fmt.Sprintf("acoustid-biz-api-key:%s", apiKey)
+}
+
+func (a *AcoustidBizAuth) check(ctx context.Context, apiKey string) (account string, err error) {
 	if a.Cache != nil {
-		result, found := a.Cache.Get(cacheKey)
+		result, found := a.Cache.Get(a.cacheKey(apiKey))
 		if found {
-			account = result.(string)
-			if account == "" {
+			entry := result.(*acoustidBizCacheEntry)
+			if entry.account == "" {
 				return "", ErrNotAuthorized
 			}
-			return account, nil
+			if a.now().Sub(entry.checked) >= a.FreshTTL {
+				// The key is checked in the background, unless a check of it is already running.
+				a.group.DoChan(apiKey, func() (interface{}, error) {
+					account, err := a.update(context.Background(), apiKey)
+					if err != nil {
+						log.Printf("Failed to check remote API key, using previous result: %v", err)
+					}
+					return account, err
+				})
+			}
+			return entry.account, nil
 		}
 	}
 
-	account, err = a.validateApiKey(apiKey)
+	account, err = a.refresh(ctx, apiKey)
 	if err != nil {
+		if errors.Cause(err) == ErrNotAuthorized {
+			return "", ErrNotAuthorized
+		}
 		return "", errors.WithMessage(err, "failed to check remote API key")
 	}
+	return account, nil
+}
+
+// refresh checks the API key with acoustid.biz and updates the cache. Concurrent checks of the same key
+// are merged into one, which is cancelled with the request that started it. The other requests then start
+// a new check.
+func (a *AcoustidBizAuth) refresh(ctx context.Context, apiKey string) (account string, err error) {
+	for {
+		ch := a.group.DoChan(apiKey, func() (interface{}, error) {
+			return a.update(ctx, apiKey)
+		})
+		var result singleflight.Result
+		select {
+		case result = <-ch:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if result.Err == errAcoustidBizCheckCanceled && ctx.Err() == nil {
+			continue
+		}
+		if result.Err != nil {
+			return "", result.Err
+		}
+		account = result.Val.(string)
+		if account == "" {
+			return "", ErrNotAuthorized
+		}
+		return account, nil
+	}
+}
 
+// update checks the API key with acoustid.biz and caches the result. The account is empty for invalid keys.
+func (a *AcoustidBizAuth) update(ctx context.Context, apiKey string) (string, error) {
+	account, err := a.validateApiKey(ctx, apiKey)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", errAcoustidBizCheckCanceled
+		}
+		return "", err
+	}
 	if a.Cache != nil {
-		var expiration time.Duration
+		entry := &acoustidBizCacheEntry{account: account, checked: a.now()}
 		if account == "" {
-			expiration = time.Minute
+			a.Cache.Set(a.cacheKey(apiKey), entry, a.InvalidTTL)
 		} else {
-			expiration = time.Hour
+			a.Cache.Set(a.cacheKey(apiKey), entry, a.StaleTTL)
 		}
-		a.Cache.Set(cacheKey, account, expiration)
+	}
+	return account, nil
+}
+
+func (a *AcoustidBizAuth) validateApiKey(ctx context.Context, apiKey string) (account string, err error) {
+	a.mu.Lock()
+	open := a.now().Before(a.openUntil)
+	a.mu.Unlock()
+	if open {
+		acoustidBizErrorCount.WithLabelValues("unavailable").Inc()
+		return "", errAcoustidBizUnavailable
 	}
 
-	if account == "" {
-		return "", ErrNotAuthorized
+	for attempt := 0; attempt <= a.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Millisecond * 100)
+		}
+		started := time.Now()
+		account, err = a.request(ctx, apiKey)
+		acoustidBizDuration.Observe(time.Since(started).Seconds())
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			// Cancelled requests don't count as failures of acoustid.biz.
+			return "", err
+		}
+		acoustidBizErrorCount.WithLabelValues("request").Inc()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.failures++
+		if a.failures >= acoustidBizBreakerThreshold {
+			log.Printf("Not using acoustid.biz for %s after %d failed checks", acoustidBizBreakerCooldown, a.failures)
+			a.openUntil = a.now().Add(acoustidBizBreakerCooldown)
+			a.failures = 0
+		}
+		return "", err
 	}
+	a.failures = 0
 	return account, nil
 }
 
-func (a *AcoustidBizAuth) validateApiKey(apiKey string) (account string, err error) {
+func (a *AcoustidBizAuth) request(ctx context.Context, apiKey string) (account string, err error) {
 	params := url.Values{"api_key": {apiKey}, "tag": {a.Tag}}
-	resp, err := http.Get(a.Endpoint + "?" + params.Encode())
+	req, err := http.NewRequest(http.MethodGet, a.Endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.Client.Do(req.WithContext(ctx))
 	if err != nil {
 		return "", err
 	}
@@ -126,6 +310,52 @@ func (a *AcoustidBizAuth) validateApiKey(apiKey string) (account string, err err
 	return fmt.Sprintf("acoustid-biz:%v", doc.AccountID), nil
 }
 
+// APIKeyAuth checks API keys managed by the service itself. Valid keys are cached
+// for a minute, so revoked keys can still be used for up to a minute.
+type APIKeyAuth struct {
+	Cache    Cache
+	Service  Service
+	Username string
+}
+
+func NewAPIKeyAuth(service Service) *APIKeyAuth {
+	auth := &APIKeyAuth{}
+	auth.Service = service
+	auth.Username = "x-acoustid-api-key"
+	return auth
+}
+
+func (a *APIKeyAuth) Authenticate(r *http.Request) (principal *Principal, err error) {
+	username, password := ParseBasicAuth(r)
+	if strings.ToLower(username) == a.Username && password != "" {
+		return a.check(password)
+	}
+	return nil, ErrNotAuthorized
+}
+
+func (a *APIKeyAuth) check(apiKey string) (principal *Principal, err error) {
+	cacheKey := fmt.Sprintf("api-key:%s", apiKey)
+	if a.Cache != nil {
+		result, found := a.Cache.Get(cacheKey)
+		if found {
+			return result.(*Principal), nil
+		}
+	}
+
+	principal, err = a.Service.ValidateAPIKey(apiKey)
+	if err != nil {
+		if errors.Cause(err) == ErrNotAuthorized {
+			return nil, ErrNotAuthorized
+		}
+		return nil, errors.WithMessage(err, "failed to check API key")
+	}
+
+	if a.Cache != nil {
+		a.Cache.Set(cacheKey, principal, time.Minute)
+	}
+	return principal, nil
+}
+
 func ParseBasicAuth(r *http.Request) (username string, password string) {
 	header := r.Header.Get("Authorization")
 	if header == "" {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha1"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"github.com/acoustid/go-acoustid/chromaprint"
@@ -11,27 +12,53 @@ import (
 	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
 	"log"
-	"sort"
-	"sync"
 	"time"
 )
 
 const SearchConcurrency = 8
+
+// ErrCatalogBusy is returned when settings of a catalog are changed while it's being converted or moved.
+var ErrCatalogBusy = errors.New("catalog is being converted")
+
+// isLockNotAvailable returns true if the error is from a NOWAIT lock of a row that is already locked.
+func isLockNotAvailable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "55P03"
+}
+
+// NumIndexSegments and ValuesPerSegment are the default index parameters of new catalogs.
 const NumIndexSegments = 16
 const ValuesPerSegment = 128
 
 type SearchOptions struct {
 	Stream bool
+	// Probes is the number of variants of each hash with unreliable bits flipped to search for, up to MaxProbes.
+	Probes int
+	// Thorough enables searching with windows from the whole query, if the normal search finds nothing.
+	Thorough bool
+	// Duration is the duration of the query audio, it's derived from the fingerprint if zero.
+	Duration time.Duration
+	// MaxDurationDiff enables skipping tracks whose duration differs from the query's by more than this, except in stream mode.
+	MaxDurationDiff time.Duration
+	// Hits returns the number of hits of tracks in this node's partition instead of matching candidates, so that hits
+	// from all nodes can be merged before selecting candidates. With Thorough, only hits of the thorough windows are returned.
+	Hits bool
+	// Candidates are the IDs of tracks to match, instead of candidates selected from the index.
+	Candidates []int
 }
 
 type SearchResults struct {
 	Results []SearchResult
+	// Hits is the number of hits of each track, only set if requested in SearchOptions.
+	Hits map[int]int
 }
 
 type SearchResult struct {
-	ID       string
-	Metadata Metadata
-	Match    *chromaprint.MatchResult
+	ID                 string
+	Metadata           Metadata
+	Match              *chromaprint.MatchResult
+	FingerprintVersion int
+	Duration           time.Duration
 }
 
 type ListTracksResult struct {
@@ -40,13 +67,91 @@ type ListTracksResult struct {
 }
 
 type TrackDetails struct {
-	ID          string
-	Metadata    Metadata
-	Fingerprint *chromaprint.Fingerprint
+	ID                 string
+	Metadata           Metadata
+	Fingerprint        *chromaprint.Fingerprint
+	FingerprintVersion int
+	Duration           time.Duration
 }
 
 type Metadata map[string]string
 
+type CatalogSettings struct {
+	MemoryIndex bool
+	IndexType   string
+	Layout      string
+	// ShardID is the database holding the catalog's tables. It can only be changed by moving the catalog.
+	ShardID int
+	// IndexParams and IndexGeneration identify the catalog's index tables. They can only be changed by reindexing the catalog.
+	IndexParams     IndexParams
+	IndexGeneration int
+	// FingerprintVersions lists the fingerprint versions new tracks can have, all valid versions are allowed if empty.
+	FingerprintVersions []int
+}
+
+// catalogSettingsColumns lists columns of the catalog table matching CatalogSettings.scanDest.
+const catalogSettingsColumns = "memory_index, index_type, layout, shard_id, " + indexParamsColumns + ", index_generation, fingerprint_versions"
+
+func (s *CatalogSettings) scanDest() []interface{} {
+	dest := []interface{}{&s.MemoryIndex, &s.IndexType, &s.Layout, &s.ShardID}
+	return append(append(dest, s.IndexParams.scanDest()...), &s.IndexGeneration, intArray{&s.FingerprintVersions})
+}
+
+// AllowsFingerprintVersion returns true if tracks with fingerprints of the version can be added to the catalog.
+func (s *CatalogSettings) AllowsFingerprintVersion(version int) bool {
+	if !IsValidFingerprintVersion(version) {
+		return false
+	}
+	if len(s.FingerprintVersions) == 0 {
+		return true
+	}
+	for _, v := range s.FingerprintVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// intArray converts between []int and a PostgreSQL int array, nil is stored as NULL.
+type intArray struct {
+	values *[]int
+}
+
+func (a intArray) Scan(src interface{}) error {
+	var values pq.Int64Array
+	err := values.Scan(src)
+	if err != nil {
+		return err
+	}
+	if values == nil {
+		*a.values = nil
+		return nil
+	}
+	*a.values = make([]int, len(values))
+	for i, value := range values {
+		(*a.values)[i] = int(value)
+	}
+	return nil
+}
+
+func (a intArray) Value() (driver.Value, error) {
+	if *a.values == nil {
+		return nil, nil
+	}
+	values := make(pq.Int64Array, len(*a.values))
+	for i, value := range *a.values {
+		values[i] = int64(value)
+	}
+	return values.Value()
+}
+
+type CatalogStats struct {
+	NumTracks   int
+	MemoryIndex *MemoryIndexStats
+	Reindex     *ReindexProgress
+}
+
 type Catalog interface {
 	Name() string
 
@@ -54,35 +159,66 @@ type Catalog interface {
 	CreateCatalog() error
 	DeleteCatalog() error
 
+	Settings() (*CatalogSettings, error)
+	UpdateSettings(settings *CatalogSettings) error
+	Stats() (*CatalogStats, error)
+
 	NewTrackID() string
 
 	GetTrack(id string) (*SearchResults, error)
-	CreateTrack(id string, fp *chromaprint.Fingerprint, meta Metadata, allowDuplicate bool) (bool, error)
+	CreateTrack(id string, fp *chromaprint.Fingerprint, duration time.Duration, meta Metadata, allowDuplicate bool) (bool, error)
 	DeleteTrack(id string) error
 
 	ListTracks(lastTrackID string, limit int) (*ListTracksResult, error)
 
+	StopList() ([]StopValue, error)
+	UpdateStopList() ([]StopValue, error)
+
 	Search(query *chromaprint.Fingerprint, opts *SearchOptions) (*SearchResults, error)
 }
 
 type CatalogImpl struct {
-	db   *sql.DB
-	repo *RepositoryImpl
-	name string
-	id   int
+	db       *sql.DB
+	repo     *RepositoryImpl
+	name     string
+	id       int
+	settings CatalogSettings
+}
+
+type cachedCatalog struct {
+	id       int
+	settings CatalogSettings
 }
 
 func (c *CatalogImpl) Name() string {
 	return c.name
 }
 
-func (c *CatalogImpl) checkCatalog(tx *sql.Tx) (bool, error) {
+func (c *CatalogImpl) service() *ServiceImpl {
+	return c.repo.account.service
+}
+
+// checkCatalog loads the catalog's ID and settings. Only values read from the primary database are cached,
+// a replica can be behind a change that has already cleared the cache and would fill it with old settings.
+func (c *CatalogImpl) checkCatalog(tx queryer, primary bool) (bool, error) {
 	if c.id != 0 {
 		return true, nil
 	}
 
-	row := tx.QueryRow("SELECT id FROM catalog WHERE account_id = $1 AND name = $2", c.repo.account.id, c.name)
-	err := row.Scan(&c.id)
+	cache := c.service().Cache
+	cacheKey := catalogCacheKey(c.repo.account.id, c.name)
+	if cache != nil {
+		cached, found := cache.Get(cacheKey)
+		if found {
+			c.id = cached.(*cachedCatalog).id
+			c.settings = cached.(*cachedCatalog).settings
+			return true, nil
+		}
+	}
+
+	query := "SELECT id, " + catalogSettingsColumns + " FROM catalog WHERE account_id = $1 AND name = $2"
+	row := tx.QueryRow(query, c.repo.account.id, c.name)
+	err := row.Scan(append([]interface{}{&c.id}, c.settings.scanDest()...)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -91,20 +227,47 @@ func (c *CatalogImpl) checkCatalog(tx *sql.Tx) (bool, error) {
 	}
 
 	if c.id != 0 {
+		if cache != nil && primary {
+			cache.Set(cacheKey, &cachedCatalog{c.id, c.settings}, c.service().cacheTTL())
+		}
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// tables returns the database tables of the catalog. The layout is validated before it's stored, so it's always known.
+func (c *CatalogImpl) tables() catalogTables {
+	return catalogTables{catalogID: c.id, partitioned: c.settings.Layout == LayoutPartitioned}
+}
+
+// shardReadDB returns the database that should be used for reading tracks of the catalog.
+func (c *CatalogImpl) shardReadDB() (*sql.DB, error) {
+	return c.service().shardReadDB(c.settings.ShardID)
+}
+
+func (c *CatalogImpl) index() (fingerprintIndex, error) {
+	return newFingerprintIndex(c.settings.IndexType, c.tables().index(c.settings.IndexGeneration), c.settings.IndexParams)
+}
+
+func (c *CatalogImpl) newChangeEvent(changeType string) *ChangeEvent {
+	return &ChangeEvent{
+		Type:      changeType,
+		AccountID: c.repo.account.id,
+		CatalogID: c.id,
+		Catalog:   c.name,
+	}
+}
+
 func (c *CatalogImpl) Exists() (bool, error) {
-	tx, err := c.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	db := c.service().readDB()
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		return false, errors.WithMessage(err, "failed to open transaction")
 	}
 	defer tx.Rollback()
 
-	exists, err := c.checkCatalog(tx)
+	exists, err := c.checkCatalog(tx, db == c.db)
 	if exists {
 		return true, nil
 	}
@@ -119,87 +282,301 @@ func (c *CatalogImpl) CreateCatalog() error {
 	}
 	defer tx.Rollback()
 
-	exists, err := c.checkCatalog(tx)
+	exists, err := c.checkCatalog(tx, true)
 	if exists {
 		return nil
 	}
 
-	row := tx.QueryRow("INSERT INTO catalog (account_id, name) VALUES ($1, $2) RETURNING id", c.repo.account.id, c.name)
+	err = c.repo.account.lockNotDeleted(tx)
+	if err != nil {
+		return err
+	}
+
+	err = c.repo.account.checkCatalogQuota(tx)
+	if err != nil {
+		return err
+	}
+
+	layout := c.service().newCatalogLayout()
+	shardID, err := c.service().newCatalogShard(tx)
+	if err != nil {
+		return err
+	}
+
+	row := tx.QueryRow("INSERT INTO catalog (account_id, name, index_type, layout, shard_id, "+indexParamsColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+		c.repo.account.id, c.name, DefaultIndexType, layout, shardID, DefaultIndexParams.QueryBits, DefaultIndexParams.Segments, DefaultIndexParams.ValuesPerSegment)
 	var id int
 	err = row.Scan(&id)
 	if err != nil {
 		return errors.WithMessage(err, "failed to create catalog")
 	}
+	err = initTrackCount(tx, c.repo.account.id, id, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	stx, err := c.service().withShard(tx, shardID)
+	if err != nil {
+		return err
+	}
+	defer stx.Rollback()
 
-	_, err = tx.Exec(fmt.Sprintf("CREATE TABLE track_%d (LIKE track_tpl INCLUDING ALL)", id))
+	tables, err := newCatalogTables(layout, id)
+	if err != nil {
+		return err
+	}
+	err = tables.createTable(stx.shardTx, "track")
 	if err != nil {
 		return errors.WithMessage(err, "failed to create track table")
 	}
 
-	for i := 0; i < NumIndexSegments; i++ {
-		_, err = tx.Exec(fmt.Sprintf("CREATE TABLE track_index_%d_%d (LIKE track_index_tpl INCLUDING ALL)", id, i))
-		if err != nil {
-			return errors.WithMessage(err, "failed to create track index table")
-		}
+	idx, err := newFingerprintIndex(DefaultIndexType, tables.index(0), DefaultIndexParams)
+	if err != nil {
+		return err
+	}
+	err = idx.createTables(stx.shardTx)
+	if err != nil {
+		return err
 	}
 
-	err = tx.Commit()
+	event := &ChangeEvent{Type: ChangeCatalogCreated, AccountID: c.repo.account.id, CatalogID: id, Catalog: c.name}
+	err = notifyChange(tx, event)
+	if err != nil {
+		return err
+	}
+
+	err = stx.Commit()
 	if err != nil {
 		return errors.WithMessage(err, "commit failed")
 	}
 
 	c.id = id
+	c.settings = CatalogSettings{IndexType: DefaultIndexType, Layout: layout, ShardID: shardID, IndexParams: DefaultIndexParams}
+	c.service().handleChange(event)
 	log.Printf("Created catalog name=%v account_id=%v", c.name, c.repo.account.id)
 	catalogActionCount.WithLabelValues("insert").Inc()
 	return nil
 }
 
 func (c *CatalogImpl) DeleteCatalog() error {
+	return c.deleteCatalog(nil)
+}
+
+// deleteCatalog deletes the catalog. If onDelete is not nil, it's called in the transaction before the
+// catalog's tables are dropped.
+func (c *CatalogImpl) deleteCatalog(onDelete func(stx *shardedTx, tables catalogTables) error) error {
 	tx, err := c.db.Begin()
 	if err != nil {
 		return errors.WithMessage(err, "failed to open transaction")
 	}
 	defer tx.Rollback()
 
-	row := tx.QueryRow("DELETE FROM catalog WHERE account_id = $1 AND name = $2 RETURNING id", c.repo.account.id, c.name)
-	var id int
-	err = row.Scan(&id)
+	row := tx.QueryRow("DELETE FROM catalog WHERE account_id = $1 AND name = $2 RETURNING id, index_type, layout, shard_id, index_generation, "+indexParamsColumns, c.repo.account.id, c.name)
+	var id, shardID, generation int
+	var indexType, layout string
+	var params IndexParams
+	err = row.Scan(append([]interface{}{&id, &indexType, &layout, &shardID, &generation}, params.scanDest()...)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil
 		}
 		return errors.WithMessage(err, "failed to delete catalog table")
 	}
+	_, err = tx.Exec("DELETE FROM catalog_track_count WHERE catalog_id = $1", id)
+	if err != nil {
+		return errors.WithMessage(err, "failed to delete track count")
+	}
 
-	_, err = tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS track_%d", id))
+	stx, err := c.service().withShard(tx, shardID)
 	if err != nil {
-		return errors.WithMessage(err, "failed to create track table")
+		return err
 	}
+	defer stx.Rollback()
 
-	for i := 0; i < NumIndexSegments; i++ {
-		_, err = tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS track_index_%d_%d", id, i))
+	tables, err := newCatalogTables(layout, id)
+	if err != nil {
+		return err
+	}
+	if onDelete != nil {
+		err = onDelete(stx, tables)
 		if err != nil {
-			return errors.WithMessage(err, "failed to create track index table")
+			return err
 		}
 	}
+	err = tables.dropTable(stx.shardTx, "track")
+	if err != nil {
+		return errors.WithMessage(err, "failed to drop track table")
+	}
 
-	err = tx.Commit()
+	idx, err := newFingerprintIndex(indexType, tables.index(generation), params)
+	if err != nil {
+		return err
+	}
+	err = idx.dropTables(stx.shardTx)
+	if err != nil {
+		return err
+	}
+
+	event := &ChangeEvent{Type: ChangeCatalogDeleted, AccountID: c.repo.account.id, CatalogID: id, Catalog: c.name}
+	err = notifyChange(tx, event)
+	if err != nil {
+		return err
+	}
+
+	err = stx.Commit()
 	if err != nil {
 		return errors.WithMessage(err, "commit failed")
 	}
 
 	c.id = 0
+	c.service().handleChange(event)
 	log.Printf("Deleted catalog name=%v account_id=%v", c.name, c.repo.account.id)
 	catalogActionCount.WithLabelValues("delete").Inc()
 	return nil
 }
 
+func (c *CatalogImpl) Settings() (*CatalogSettings, error) {
+	db := c.service().readDB()
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	exists, err := c.checkCatalog(tx, db == c.db)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	settings := c.settings
+	return &settings, nil
+}
+
+func (c *CatalogImpl) UpdateSettings(settings *CatalogSettings) error {
+	err := c.CreateCatalog()
+	if err != nil {
+		return err
+	}
+
+	if settings.IndexType != "" && !IsValidIndexType(settings.IndexType) {
+		return errors.Errorf("unknown index type %q", settings.IndexType)
+	}
+	if settings.Layout != "" && !IsValidLayout(settings.Layout) {
+		return errors.Errorf("unknown storage layout %q", settings.Layout)
+	}
+	for _, version := range settings.FingerprintVersions {
+		if !IsValidFingerprintVersion(version) {
+			return errors.Errorf("unknown fingerprint version %d", version)
+		}
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	// Conversions and moves keep the catalog locked until they are finished, don't wait for them.
+	var layout, indexType string
+	dest := append([]interface{}{&settings.ShardID, &settings.IndexGeneration, &layout, &indexType}, settings.IndexParams.scanDest()...)
+	err = tx.QueryRow("SELECT shard_id, index_generation, layout, index_type, "+indexParamsColumns+" FROM catalog WHERE id = $1 FOR NO KEY UPDATE NOWAIT", c.id).Scan(dest...)
+	if err != nil {
+		if isLockNotAvailable(err) {
+			return ErrCatalogBusy
+		}
+		return errors.WithMessage(err, "failed to get catalog")
+	}
+
+	// The catalog is converted in the background, it keeps its layout and index type until the conversion is finished.
+	newLayout, newIndexType := settings.Layout, settings.IndexType
+	if newLayout == layout {
+		newLayout = ""
+	}
+	if newIndexType == indexType {
+		newIndexType = ""
+	}
+	settings.Layout, settings.IndexType = layout, indexType
+
+	_, err = tx.Exec("UPDATE catalog SET memory_index = $1, fingerprint_versions = $2 WHERE id = $3", settings.MemoryIndex, intArray{&settings.FingerprintVersions}, c.id)
+	if err != nil {
+		return errors.WithMessage(err, "failed to update catalog")
+	}
+
+	event := c.newChangeEvent(ChangeCatalogUpdated)
+	err = notifyChange(tx, event)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+
+	c.settings = *settings
+	c.service().handleChange(event)
+	log.Printf("Updated catalog name=%v account_id=%v settings=%+v", c.name, c.repo.account.id, *settings)
+	catalogActionCount.WithLabelValues("update").Inc()
+
+	if newLayout != "" || newIndexType != "" {
+		log.Printf("Converting catalog name=%v account_id=%v to layout=%q index_type=%q", c.name, c.repo.account.id, newLayout, newIndexType)
+		c.service().startCatalogConversion(c.id, newLayout, newIndexType)
+	}
+	return nil
+}
+
+func (c *CatalogImpl) Stats() (*CatalogStats, error) {
+	db := c.service().readDB()
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	stats := &CatalogStats{}
+
+	exists, err := c.checkCatalog(tx, db == c.db)
+	if !exists {
+		return stats, nil
+	}
+
+	shardDB, err := c.shardReadDB()
+	if err != nil {
+		return nil, err
+	}
+	row := shardDB.QueryRow("SELECT count(*) FROM " + c.tables().from("track", "t"))
+	err = row.Scan(&stats.NumTracks)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to count tracks")
+	}
+
+	stats.Reindex, err = loadReindexProgress(tx, c.id)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.settings.MemoryIndex {
+		idx := c.service().existingMemoryIndex(c.id)
+		if idx != nil {
+			stats.MemoryIndex = idx.Stats()
+		} else {
+			stats.MemoryIndex = &MemoryIndexStats{}
+		}
+	}
+
+	return stats, nil
+}
+
 func (c *CatalogImpl) NewTrackID() string {
 	return uuid.NewV4().String()
 }
 
 func (c *CatalogImpl) findTrackByFingerprintSHA1(tx *sql.Tx, fingerprintSHA1 []byte) (bool, error) {
-	query := fmt.Sprintf("SELECT count(*) FROM track_%d WHERE fingerprint_sha1 = $1", c.id)
+	tables := c.tables()
+	query := fmt.Sprintf("SELECT count(*) FROM %s WHERE %sfingerprint_sha1 = $1", tables.name("track"), tables.where())
 	row := tx.QueryRow(query, fingerprintSHA1)
 	var count int
 	err := row.Scan(&count)
@@ -209,22 +586,36 @@ func (c *CatalogImpl) findTrackByFingerprintSHA1(tx *sql.Tx, fingerprintSHA1 []b
 	return count > 0, nil
 }
 
-func (c *CatalogImpl) CreateTrack(externalID string, fingerprint *chromaprint.Fingerprint, metadata Metadata, allowDuplicate bool) (bool, error) {
+// CreateTrack adds the track to the catalog, replacing any track with the same ID. If the duration is zero, it's derived from the fingerprint.
+func (c *CatalogImpl) CreateTrack(externalID string, fingerprint *chromaprint.Fingerprint, duration time.Duration, metadata Metadata, allowDuplicate bool) (bool, error) {
 	err := c.CreateCatalog()
 	if err != nil {
 		return false, err
 	}
 
-	tx, err := c.db.Begin()
+	stx, err := c.beginWrite()
 	if err != nil {
-		return false, errors.WithMessage(err, "failed to open transaction")
+		return false, err
+	}
+	defer stx.Rollback()
+	tx := stx.shardTx
+
+	if !c.settings.AllowsFingerprintVersion(fingerprint.Version) {
+		return false, errors.WithMessage(ErrFingerprintVersionNotAllowed, fmt.Sprintf("version %d", fingerprint.Version))
 	}
-	defer tx.Rollback()
 
-	deleted, err := c.deleteTrack(tx, externalID)
+	deletedID, err := c.deleteTrack(tx, externalID)
 	if err != nil {
 		return false, err
 	}
+	deleted := deletedID != 0
+
+	if !deleted {
+		err = c.checkTrackQuota(stx)
+		if err != nil {
+			return false, err
+		}
+	}
 
 	fingerprintBytes := chromaprint.CompressFingerprint(*fingerprint)
 	fingerprintSHA1 := sha1.Sum(fingerprintBytes)
@@ -248,190 +639,246 @@ func (c *CatalogImpl) CreateTrack(externalID string, fingerprint *chromaprint.Fi
 		metadataBytes = &data
 	}
 
-	query := fmt.Sprintf("INSERT INTO track_%d (external_id, fingerprint, fingerprint_sha1, metadata) VALUES ($1, $2, $3, $4) RETURNING id", c.id)
-	row := tx.QueryRow(query, externalID, fingerprintBytes, fingerprintSHA1[:], metadataBytes)
+	if duration == 0 {
+		duration = FingerprintDuration(fingerprint)
+	}
+
+	tables := c.tables()
+	query := fmt.Sprintf("INSERT INTO %s (%sexternal_id, fingerprint, fingerprint_sha1, fingerprint_version, duration, metadata) VALUES (%s$1, $2, $3, $4, $5, $6) RETURNING id",
+		tables.name("track"), tables.insertColumns(), tables.insertValues())
+	row := tx.QueryRow(query, externalID, fingerprintBytes, fingerprintSHA1[:], fingerprint.Version, duration.Seconds(), metadataBytes)
 	var internalID int
 	err = row.Scan(&internalID)
 	if err != nil {
 		return false, errors.WithMessage(err, "failed to insert track")
 	}
 
-	segment := 0
-	values := ExtractQuery(fingerprint)
-	for i := 0; i < len(fingerprint.Hashes); i += ValuesPerSegment {
-		n := ValuesPerSegment
-		if len(fingerprint.Hashes)-i < n {
-			n = len(fingerprint.Hashes) - i
+	stop, err := c.stopList(stx.tx)
+	if err != nil {
+		return false, err
+	}
+
+	idx, err := c.index()
+	if err != nil {
+		return false, err
+	}
+	err = idx.insertTrack(tx, internalID, c.settings.IndexParams.extractQuery(fingerprint), stop)
+	if err != nil {
+		return false, err
+	}
+
+	if !deleted {
+		err = c.updateTrackCount(stx, 1)
+		if err != nil {
+			return false, err
 		}
-		query := fmt.Sprintf("INSERT INTO track_index_%d_%d (track_id, segment, values) VALUES ($1, $2, $3)", c.id, segment%NumIndexSegments)
-		_, err = tx.Exec(query, internalID, segment, pq.Array(values[i:i+n]))
+	}
+
+	var events []*ChangeEvent
+	if deleted {
+		event := c.newChangeEvent(ChangeTrackDeleted)
+		event.TrackID = deletedID
+		events = append(events, event)
+	}
+	event := c.newChangeEvent(ChangeTrackUpdated)
+	event.TrackID = internalID
+	events = append(events, event)
+	for _, event := range events {
+		err = notifyChange(stx.tx, event)
 		if err != nil {
-			return false, errors.WithMessage(err, "failed to insert track index")
+			return false, err
 		}
-		segment += 1
 	}
 
-	err = tx.Commit()
+	err = stx.Commit()
 	if err != nil {
 		return false, errors.WithMessage(err, "commit failed")
 	}
 
+	for _, event := range events {
+		c.service().handleChange(event)
+	}
+
 	if deleted {
 		log.Printf("Updated track id=%v catalog=%s account_id=%v", externalID, c.name, c.repo.account.id)
 		trackActionCount.WithLabelValues("update").Inc()
 	} else {
 		log.Printf("Inserted track id=%v catalog=%s account_id=%v", externalID, c.name, c.repo.account.id)
 		trackActionCount.WithLabelValues("insert").Inc()
+		c.service().Usage.Add(c.repo.account.id, UsageTracksAdded, 1)
 	}
 	return true, nil
 }
 
-func (c *CatalogImpl) deleteTrack(tx *sql.Tx, externalID string) (bool, error) {
-	row := tx.QueryRow(fmt.Sprintf("DELETE FROM track_%d WHERE external_id = $1 RETURNING id", c.id), externalID)
+func (c *CatalogImpl) deleteTrack(tx *sql.Tx, externalID string) (int, error) {
+	tables := c.tables()
+	row := tx.QueryRow(fmt.Sprintf("DELETE FROM %s WHERE %sexternal_id = $1 RETURNING id", tables.name("track"), tables.where()), externalID)
 	var internalID int
 	err := row.Scan(&internalID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return false, nil
+			return 0, nil
 		}
-		return false, errors.WithMessage(err, "failed to delete track")
+		return 0, errors.WithMessage(err, "failed to delete track")
 	}
 
-	for i := 0; i < NumIndexSegments; i++ {
-		query := fmt.Sprintf("DELETE FROM track_index_%d_%d WHERE track_id = $1", c.id, i)
-		_, err = tx.Exec(query, internalID)
-		if err != nil {
-			return false, errors.WithMessage(err, "failed to delete track index")
-		}
+	idx, err := c.index()
+	if err != nil {
+		return 0, err
+	}
+	err = idx.deleteTrack(tx, internalID)
+	if err != nil {
+		return 0, err
 	}
 
-	return true, nil
+	return internalID, nil
 }
 
 func (c *CatalogImpl) DeleteTrack(externalID string) error {
-	tx, err := c.db.Begin()
-	if err != nil {
-		return errors.WithMessage(err, "failed to open transaction")
+	exists, err := c.checkCatalog(c.db, true)
+	if !exists {
+		return err
 	}
-	defer tx.Rollback()
 
-	exists, err := c.checkCatalog(tx)
-	if !exists {
-		return nil
+	stx, err := c.beginWrite()
+	if err != nil {
+		return err
 	}
+	defer stx.Rollback()
 
-	deleted, err := c.deleteTrack(tx, externalID)
+	deletedID, err := c.deleteTrack(stx.shardTx, externalID)
 	if err != nil {
 		return err
 	}
-	if !deleted {
+	if deletedID == 0 {
 		return nil
 	}
+	err = c.updateTrackCount(stx, -1)
+	if err != nil {
+		return err
+	}
 
-	err = tx.Commit()
+	event := c.newChangeEvent(ChangeTrackDeleted)
+	event.TrackID = deletedID
+	err = notifyChange(stx.tx, event)
+	if err != nil {
+		return err
+	}
+
+	err = stx.Commit()
 	if err != nil {
 		return errors.WithMessage(err, "commit failed")
 	}
 
+	c.service().handleChange(event)
+
 	log.Printf("Deleted track id=%v catalog=%s account_id=%v", externalID, c.name, c.repo.account.id)
 	trackActionCount.WithLabelValues("delete").Inc()
+	c.service().Usage.Add(c.repo.account.id, UsageTracksDeleted, 1)
 	return nil
 
 }
 
-func (c *CatalogImpl) searchFingerprintIndexSegment(values []int32, segment int) (map[int]int, error) {
-	queryTpl := "SELECT track_id, icount(values & query) " +
-		"FROM track_index_%d_%d, (SELECT $1::int[] AS query) q " +
-		"WHERE values && query"
-	query := fmt.Sprintf(queryTpl, c.id, segment%NumIndexSegments)
-	rows, err := c.db.Query(query, pq.Array(values))
+// matchFingerprint matches the query against the track. Tracks with a different fingerprint version never match.
+func (c *CatalogImpl) matchFingerprint(db *sql.DB, trackID int, queryFP *chromaprint.Fingerprint) (*chromaprint.MatchResult, error) {
+	tables := c.tables()
+	query := fmt.Sprintf("SELECT fingerprint FROM %s WHERE %sid = $1 AND fingerprint_version = $2", tables.name("track"), tables.where())
+	row := db.QueryRow(query, trackID, queryFP.Version)
+	var data []byte
+	err := row.Scan(&data)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return &chromaprint.MatchResult{}, nil
+		}
 		return nil, err
 	}
-	defer rows.Close()
-
-	hits := make(map[int]int)
-	for rows.Next() {
-		var trackID, count int
-		err = rows.Scan(&trackID, &count)
-		if err != nil {
-			return nil, err
-		}
-		hits[trackID] += count
+	masterFP, err := chromaprint.ParseFingerprint(data)
+	if err != nil {
+		return nil, err
 	}
-
-	return hits, nil
+	return chromaprint.MatchFingerprints(masterFP, queryFP)
 }
 
-func (c *CatalogImpl) searchFingerprintIndex(values []int32, stream bool) (map[int]int, error) {
-	var segmentValues [NumIndexSegments][]int32
-	var segmentHits [NumIndexSegments]map[int]int
-	var segmentErrs [NumIndexSegments]error
+func (c *CatalogImpl) searchIndex(db *sql.DB, segmentHashes [][]queryHash) (map[int]int, string, error) {
+	shardDB, err := c.service().shardDB(c.settings.ShardID)
+	if err != nil {
+		return nil, "", err
+	}
+	memoryIndex := c.service().memoryIndex(shardDB, c.tables(), c.settings.IndexParams, c.settings.MemoryIndex)
+	if memoryIndex != nil {
+		return memoryIndex.Search(segmentHashes), "memory", nil
+	}
+	idx, err := c.index()
+	if err != nil {
+		return nil, "", err
+	}
+	hits, err := idx.search(db, segmentHashes, c.service().Partition)
+	if err != nil {
+		return nil, "", err
+	}
+	return hits, c.settings.IndexType, nil
+}
 
-	if stream {
-		for segment := 0; segment < NumIndexSegments; segment++ {
-			segmentValues[segment] = values
-		}
-	} else {
-		if len(values) < ValuesPerSegment {
-			segmentValues[0] = values
-		} else {
-			segmentValues[0] = values[:ValuesPerSegment]
-			if len(values) < ValuesPerSegment*2 {
-				segmentValues[1] = values[ValuesPerSegment:]
-			} else {
-				segmentValues[1] = values[ValuesPerSegment : ValuesPerSegment*2]
-			}
+// filterHits removes tracks with fingerprints of a different version than the query's, which can't match, and
+// if maxDiff is not zero, tracks whose duration differs from the query's by more than maxDiff. Only tracks with
+// enough hits to become candidates are looked up.
+func (c *CatalogImpl) filterHits(db *sql.DB, hits map[int]int, version int, duration time.Duration, maxDiff time.Duration) (map[int]int, error) {
+	var trackIDs []int
+	for trackID, count := range hits {
+		if count >= MinCandidateScore {
+			trackIDs = append(trackIDs, trackID)
 		}
 	}
-
-	var wg sync.WaitGroup
-	for chunk := 0; chunk < SearchConcurrency; chunk++ {
-		wg.Add(1)
-		go func(chunk int) {
-			defer wg.Done()
-			for segment := 0; segment < NumIndexSegments; segment++ {
-				if segment%SearchConcurrency == chunk {
-					values := segmentValues[segment]
-					if len(values) != 0 {
-						hits, err := c.searchFingerprintIndexSegment(values, segment)
-						segmentHits[segment] = hits
-						segmentErrs[segment] = err
-					}
-				}
-			}
-		}(chunk)
+	filtered := make(map[int]int)
+	if len(trackIDs) == 0 {
+		return filtered, nil
 	}
-	wg.Wait()
 
-	hits := make(map[int]int)
-	for segment := 0; segment < NumIndexSegments; segment++ {
-		err := segmentErrs[segment]
+	tables := c.tables()
+	query := fmt.Sprintf("SELECT id FROM %s WHERE %sid = any($1::int[]) AND fingerprint_version = $2", tables.name("track"), tables.where())
+	args := []interface{}{pq.Array(trackIDs), version}
+	if maxDiff > 0 {
+		query += " AND abs(duration - $3) <= $4"
+		args = append(args, duration.Seconds(), maxDiff.Seconds())
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to filter hits")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var trackID int
+		err = rows.Scan(&trackID)
 		if err != nil {
-			return nil, err
-		}
-		for trackID, count := range segmentHits[segment] {
-			hits[trackID] += count
+			return nil, errors.WithMessage(err, "failed to filter hits")
 		}
+		filtered[trackID] = hits[trackID]
 	}
-
-	return hits, nil
-}
-
-func (c *CatalogImpl) matchFingerprint(trackID int, queryFP *chromaprint.Fingerprint) (*chromaprint.MatchResult, error) {
-	queryTpl := "SELECT fingerprint FROM track_%d WHERE id = $1"
-	query := fmt.Sprintf(queryTpl, c.id)
-	row := c.db.QueryRow(query, trackID)
-	var data []byte
-	err := row.Scan(&data)
+	err = rows.Err()
 	if err != nil {
-		return nil, err
+		return nil, errors.WithMessage(err, "failed to filter hits")
 	}
-	masterFP, err := chromaprint.ParseFingerprint(data)
-	if err != nil {
-		return nil, err
+	return filtered, nil
+}
+
+// matchCandidates matches the query against all candidates that were not tried before, and returns
+// the IDs of the matching tracks. All tried candidates are recorded in matches.
+func (c *CatalogImpl) matchCandidates(db *sql.DB, topHits []topHit, queryFP *chromaprint.Fingerprint, matches map[int]*chromaprint.MatchResult) ([]int, error) {
+	var matchingTrackIDs []int
+	for _, hit := range topHits {
+		_, exists := matches[hit.TrackID]
+		if !exists {
+			match, err := c.matchFingerprint(db, hit.TrackID, queryFP)
+			if err != nil {
+				return nil, errors.WithMessage(err, "matching failed")
+			}
+			matches[hit.TrackID] = match
+			if !match.Empty() {
+				matchingTrackIDs = append(matchingTrackIDs, hit.TrackID)
+			}
+		}
 	}
-	return chromaprint.MatchFingerprints(masterFP, queryFP)
+	return matchingTrackIDs, nil
 }
 
 func (c *CatalogImpl) Search(queryFP *chromaprint.Fingerprint, opts *SearchOptions) (*SearchResults, error) {
@@ -445,9 +892,22 @@ func (c *CatalogImpl) Search(queryFP *chromaprint.Fingerprint, opts *SearchOptio
 	if opts.Stream {
 		searchType = "stream"
 	}
+	if opts.Probes > 0 {
+		searchType += "_multiprobe"
+	}
 	searchCount.WithLabelValues(searchType).Inc()
+	// Hits and candidates are only requested by authenticated search nodes. Searches split across several
+	// nodes are counted once, by the first node in the first round, all other searches are always counted.
+	metered := !opts.Hits && opts.Candidates == nil
+	if opts.Hits && !opts.Thorough {
+		metered = c.service().Partition == nil || c.service().Partition.Index == 0
+	}
+	if metered {
+		c.service().Usage.Add(c.repo.account.id, usageSearchPrefix+searchType, 1)
+	}
 
-	tx, err := c.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	db := c.service().readDB()
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to open transaction")
 	}
@@ -455,84 +915,138 @@ func (c *CatalogImpl) Search(queryFP *chromaprint.Fingerprint, opts *SearchOptio
 
 	results := &SearchResults{}
 
-	exists, err := c.checkCatalog(tx)
+	exists, err := c.checkCatalog(tx, db == c.db)
 	if !exists {
 		return results, nil
 	}
 
-	values := ExtractQuery(queryFP)
+	db, err = c.shardReadDB()
+	if err != nil {
+		return nil, err
+	}
 
-	indexSearchStarted := time.Now()
-	hits, err := c.searchFingerprintIndex(values, opts.Stream)
+	stop, err := c.stopList(tx)
 	if err != nil {
-		return nil, errors.WithMessage(err, "index search failed")
+		return nil, err
 	}
-	indexSearchTook := time.Since(indexSearchStarted)
-	searchDuration.WithLabelValues(searchType, "index").Observe(indexSearchTook.Seconds())
 
-	maxCount := 0
-	for _, count := range hits {
-		if count > maxCount {
-			maxCount = count
-		}
+	params := c.settings.IndexParams
+	values := params.extractQuery(queryFP)
+	var segmentHashes [][]queryHash
+	if opts.Hits && opts.Thorough && !opts.Stream {
+		segmentHashes = params.thoroughSegmentQueries(values)
+	} else {
+		segmentHashes = params.segmentQueries(values, opts.Stream)
 	}
-	countThreshold := maxCount / 10
-	if countThreshold < 2 {
-		countThreshold = 2
+	numProbes := params.addQueryProbes(segmentHashes, opts.Probes)
+	removeStopValues(segmentHashes, stop)
+
+	// Tracks of other fingerprint versions are removed before selecting candidates, so that they don't take
+	// the place of tracks that can match.
+	var maxDurationDiff time.Duration
+	if !opts.Stream {
+		maxDurationDiff = opts.MaxDurationDiff
 	}
-
-	type TopHit struct {
-		TrackID int
-		Count   int
+	queryDuration := opts.Duration
+	if queryDuration == 0 {
+		queryDuration = FingerprintDuration(queryFP)
 	}
 
-	topHits := make([]TopHit, 0, len(hits))
-	for trackID, count := range hits {
-		if count >= countThreshold {
-			topHits = append(topHits, TopHit{trackID, count})
+	var hits map[int]int
+	var candidates []topHit
+	var indexType string
+	var indexSearchTook time.Duration
+	if opts.Candidates != nil {
+		candidates = make([]topHit, len(opts.Candidates))
+		for i, trackID := range opts.Candidates {
+			candidates[i] = topHit{TrackID: trackID}
 		}
+	} else {
+		indexSearchStarted := time.Now()
+		hits, indexType, err = c.searchIndex(db, segmentHashes)
+		if err != nil {
+			return nil, errors.WithMessage(err, "index search failed")
+		}
+		indexSearchTook = time.Since(indexSearchStarted)
+		searchDuration.WithLabelValues(searchType, "index").Observe(indexSearchTook.Seconds())
+
+		hits, err = c.filterHits(db, hits, queryFP.Version, queryDuration, maxDurationDiff)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.Hits {
+			searchProbeCount.Add(float64(numProbes))
+			results.Hits = hits
+			return results, nil
+		}
+		candidates = selectCandidates(hits)
 	}
-	sort.Slice(topHits, func(i, j int) bool { return topHits[i].Count < topHits[j].Count })
 
 	matches := make(map[int]*chromaprint.MatchResult)
-	matchingTrackIDs := make([]int, 0, len(topHits))
 
 	matchingStarted := time.Now()
-	for _, hit := range topHits {
-		_, exists := matches[hit.TrackID]
-		if !exists {
-			match, err := c.matchFingerprint(hit.TrackID, queryFP)
-			if err != nil {
-				return nil, errors.WithMessage(err, "matching failed")
-			}
-			if !match.Empty() {
-				matches[hit.TrackID] = match
-				matchingTrackIDs = append(matchingTrackIDs, hit.TrackID)
-			}
-		}
+	matchingTrackIDs, err := c.matchCandidates(db, candidates, queryFP, matches)
+	if err != nil {
+		return nil, err
 	}
 	matchingTook := time.Since(matchingStarted)
 	searchDuration.WithLabelValues(searchType, "match").Observe(matchingTook.Seconds())
 
+	thorough := opts.Thorough && !opts.Stream && opts.Candidates == nil && len(matchingTrackIDs) == 0
+	if thorough {
+		// The cheap path only looks at the beginning of the query, which is not enough
+		// if the track has a different intro. Try windows from the whole query.
+		segmentHashes = params.thoroughSegmentQueries(values)
+		numProbes += params.addQueryProbes(segmentHashes, opts.Probes)
+		removeStopValues(segmentHashes, stop)
+
+		indexSearchStarted := time.Now()
+		thoroughHits, _, err := c.searchIndex(db, segmentHashes)
+		if err != nil {
+			return nil, errors.WithMessage(err, "index search failed")
+		}
+		thoroughHits, err = c.filterHits(db, thoroughHits, queryFP.Version, queryDuration, maxDurationDiff)
+		if err != nil {
+			return nil, err
+		}
+		indexSearchTook += time.Since(indexSearchStarted)
+		searchDuration.WithLabelValues(searchType, "index_thorough").Observe(time.Since(indexSearchStarted).Seconds())
+
+		matchingStarted := time.Now()
+		thoroughTrackIDs, err := c.matchCandidates(db, selectCandidates(mergeHits(hits, thoroughHits)), queryFP, matches)
+		if err != nil {
+			return nil, err
+		}
+		matchingTrackIDs = append(matchingTrackIDs, thoroughTrackIDs...)
+		matchingTook += time.Since(matchingStarted)
+		searchDuration.WithLabelValues(searchType, "match_thorough").Observe(time.Since(matchingStarted).Seconds())
+	}
+	searchProbeCount.Add(float64(numProbes))
+
 	metadataStarted := time.Now()
-	queryTpl := "SELECT id, external_id, metadata FROM track_%d WHERE id = any($1::int[])"
-	query := fmt.Sprintf(queryTpl, c.id)
-	rows, err := tx.Query(query, pq.Array(matchingTrackIDs))
+	tables := c.tables()
+	query := fmt.Sprintf("SELECT id, external_id, duration, metadata FROM %s WHERE %sid = any($1::int[])", tables.name("track"), tables.where())
+	rows, err := db.Query(query, pq.Array(matchingTrackIDs))
 	if err != nil {
 		return nil, err
 	}
-	results.Results = make([]SearchResult, 0, len(topHits))
+	defer rows.Close()
+	results.Results = make([]SearchResult, 0, len(matchingTrackIDs))
 	for rows.Next() {
 		var trackID int
 		var externalTrackID string
+		var duration float64
 		var metadataBytes json.RawMessage
-		err = rows.Scan(&trackID, &externalTrackID, &metadataBytes)
+		err = rows.Scan(&trackID, &externalTrackID, &duration, &metadataBytes)
 		if err != nil {
 			return nil, err
 		}
 		result := SearchResult{
-			ID:    externalTrackID,
-			Match: matches[trackID],
+			ID:                 externalTrackID,
+			Match:              matches[trackID],
+			FingerprintVersion: queryFP.Version,
+			Duration:           secondsToDuration(duration),
 		}
 		if metadataBytes != nil {
 			err = json.Unmarshal(metadataBytes, &result.Metadata)
@@ -548,13 +1062,14 @@ func (c *CatalogImpl) Search(queryFP *chromaprint.Fingerprint, opts *SearchOptio
 	searchTook := time.Since(started)
 	searchDuration.WithLabelValues(searchType, "all").Observe(searchTook.Seconds())
 
-	log.Printf("Search timing index=%v match=%v metadata=%v all=%v", indexSearchTook, matchingTook, metadataTook, searchTook)
+	log.Printf("Search timing index=%v (%s, %d probes, thorough=%v) match=%v metadata=%v all=%v", indexSearchTook, indexType, numProbes, thorough, matchingTook, metadataTook, searchTook)
 
 	return results, nil
 }
 
 func (c *CatalogImpl) GetTrack(externalID string) (*SearchResults, error) {
-	tx, err := c.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	db := c.service().readDB()
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to open transaction")
 	}
@@ -562,15 +1077,23 @@ func (c *CatalogImpl) GetTrack(externalID string) (*SearchResults, error) {
 
 	results := &SearchResults{}
 
-	exists, err := c.checkCatalog(tx)
+	exists, err := c.checkCatalog(tx, db == c.db)
 	if !exists {
 		return results, nil
 	}
 
-	query := fmt.Sprintf("SELECT metadata FROM track_%d WHERE external_id = $1", c.id)
-	row := tx.QueryRow(query, externalID)
+	shardDB, err := c.shardReadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	tables := c.tables()
+	query := fmt.Sprintf("SELECT fingerprint_version, duration, metadata FROM %s WHERE %sexternal_id = $1", tables.name("track"), tables.where())
+	row := shardDB.QueryRow(query, externalID)
+	result := SearchResult{ID: externalID}
+	var duration float64
 	var metadataBytes json.RawMessage
-	err = row.Scan(&metadataBytes)
+	err = row.Scan(&result.FingerprintVersion, &duration, &metadataBytes)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return results, nil
@@ -578,7 +1101,7 @@ func (c *CatalogImpl) GetTrack(externalID string) (*SearchResults, error) {
 		return nil, errors.WithMessage(err, "failed to fetch track")
 	}
 
-	result := SearchResult{ID: externalID}
+	result.Duration = secondsToDuration(duration)
 	if metadataBytes != nil {
 		err = json.Unmarshal(metadataBytes, &result.Metadata)
 		if err != nil {
@@ -590,7 +1113,8 @@ func (c *CatalogImpl) GetTrack(externalID string) (*SearchResults, error) {
 }
 
 func (c *CatalogImpl) ListTracks(lastTrackID string, limit int) (*ListTracksResult, error) {
-	tx, err := c.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	db := c.service().readDB()
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to open transaction")
 	}
@@ -598,22 +1122,29 @@ func (c *CatalogImpl) ListTracks(lastTrackID string, limit int) (*ListTracksResu
 
 	result := &ListTracksResult{}
 
-	exists, err := c.checkCatalog(tx)
+	exists, err := c.checkCatalog(tx, db == c.db)
 	if !exists {
 		return result, nil
 	}
 
-	query := fmt.Sprintf("SELECT external_id, metadata FROM track_%d WHERE external_id > $1 ORDER BY external_id LIMIT $2", c.id)
-	rows, err := tx.Query(query, lastTrackID, limit+1)
+	shardDB, err := c.shardReadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	tables := c.tables()
+	query := fmt.Sprintf("SELECT external_id, fingerprint_version, duration, metadata FROM %s WHERE %sexternal_id > $1 ORDER BY external_id LIMIT $2", tables.name("track"), tables.where())
+	rows, err := shardDB.Query(query, lastTrackID, limit+1)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to fetch tracks")
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var trackID string
+		var track TrackDetails
+		var duration float64
 		var metadataBytes json.RawMessage
-		err = rows.Scan(&trackID, &metadataBytes)
+		err = rows.Scan(&track.ID, &track.FingerprintVersion, &duration, &metadataBytes)
 		if err != nil {
 			return nil, errors.WithMessage(err, "failed to fetch tracks")
 		}
@@ -621,7 +1152,7 @@ func (c *CatalogImpl) ListTracks(lastTrackID string, limit int) (*ListTracksResu
 			result.HasMore = true
 			break
 		}
-		track := TrackDetails{ID: trackID}
+		track.Duration = secondsToDuration(duration)
 		if metadataBytes != nil {
 			err = json.Unmarshal(metadataBytes, &track.Metadata)
 			if err != nil {
@@ -1,12 +1,17 @@
 package priv
 
 import (
+	"crypto/sha1"
+	"database/sql"
 	"fmt"
 	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"math/rand"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -87,6 +92,347 @@ func TestCatalog_DeleteCatalog_DoesNotExist(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCatalog_UpdateSettings(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	settings, err := catalog.Settings()
+	require.NoError(t, err)
+	assert.Equal(t, &CatalogSettings{IndexType: IndexTypeGIN, Layout: LayoutTablePerCatalog, IndexParams: DefaultIndexParams}, settings)
+
+	settings.MemoryIndex = true
+	err = catalog.UpdateSettings(settings)
+	require.NoError(t, err)
+
+	settings, err = getTestRepository(t, connectToDB(t)).Catalog(catalog.Name()).Settings()
+	require.NoError(t, err)
+	assert.Equal(t, &CatalogSettings{MemoryIndex: true, IndexType: IndexTypeGIN, Layout: LayoutTablePerCatalog, IndexParams: DefaultIndexParams}, settings)
+}
+
+func TestCatalog_UpdateSettings_ConvertIndex(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	masterFP := loadTestFingerprint(t, "calibre_sunrise")
+	_, err := catalog.CreateTrack("t1", masterFP, 0, nil, false)
+	require.NoError(t, err)
+
+	queryFP := loadTestFingerprint(t, "radio1_3_calibre_sunshine")
+	for _, indexType := range []string{IndexTypeBTree, IndexTypeGIN} {
+		err = catalog.UpdateSettings(&CatalogSettings{IndexType: indexType})
+		require.NoError(t, err)
+
+		// The index is converted in the background.
+		for i := 0; ; i++ {
+			settings, err := getTestRepository(t, connectToDB(t)).Catalog(catalog.Name()).Settings()
+			require.NoError(t, err)
+			if settings.IndexType == indexType {
+				break
+			}
+			require.True(t, i < 100, "index was not converted to %s", indexType)
+			time.Sleep(time.Millisecond * 50)
+		}
+
+		results, err := catalog.Search(queryFP, &SearchOptions{Stream: true})
+		require.NoError(t, err)
+		if assert.Len(t, results.Results, 1, "index type %s", indexType) {
+			assert.Equal(t, "t1", results.Results[0].ID)
+		}
+	}
+}
+
+func TestCatalog_UpdateSettings_InvalidIndexType(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	err := catalog.UpdateSettings(&CatalogSettings{IndexType: "hash"})
+	assert.Error(t, err)
+}
+
+func TestCatalog_UpdateSettings_Busy(t *testing.T) {
+	catalog := getTestCatalog(t, true).(*CatalogImpl)
+
+	// Conversions keep the catalog row locked until they are finished.
+	tx, err := catalog.db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	_, err = tx.Exec("SELECT id FROM catalog WHERE id = $1 FOR NO KEY UPDATE", catalog.id)
+	require.NoError(t, err)
+
+	err = catalog.UpdateSettings(&CatalogSettings{MemoryIndex: true})
+	assert.Equal(t, ErrCatalogBusy, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := catalog.CreateTrack("t1", loadTestFingerprint(t, "calibre_sunrise"), 0, nil, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("track was not written while the catalog was being converted")
+	}
+}
+
+func TestService_ConvertCatalogLayout(t *testing.T) {
+	catalog := getTestCatalog(t, true).(*CatalogImpl)
+
+	masterFP := loadTestFingerprint(t, "calibre_sunrise")
+	_, err := catalog.CreateTrack("t1", masterFP, 0, Metadata{"name": "Track 1"}, false)
+	require.NoError(t, err)
+
+	queryFP := loadTestFingerprint(t, "radio1_3_calibre_sunshine")
+	for _, layout := range []string{LayoutPartitioned, LayoutTablePerCatalog} {
+		for _, indexType := range []string{IndexTypeBTree, IndexTypeGIN} {
+			err = catalog.service().ConvertCatalogLayout(catalog.id, layout)
+			require.NoError(t, err)
+			err = catalog.service().ConvertCatalogIndex(catalog.id, indexType)
+			require.NoError(t, err)
+
+			settings, err := getTestRepository(t, connectToDB(t)).Catalog(catalog.Name()).Settings()
+			require.NoError(t, err)
+			assert.Equal(t, layout, settings.Layout)
+			assert.Equal(t, indexType, settings.IndexType)
+
+			results, err := catalog.Search(queryFP, &SearchOptions{Stream: true})
+			require.NoError(t, err)
+			if assert.Len(t, results.Results, 1, "layout %s, index type %s", layout, indexType) {
+				assert.Equal(t, "t1", results.Results[0].ID)
+				assert.Equal(t, Metadata{"name": "Track 1"}, results.Results[0].Metadata)
+			}
+		}
+	}
+
+	stats, err := catalog.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.NumTracks)
+
+	_, err = catalog.CreateTrack("t2", loadTestFingerprint(t, "radio1_3_calibre_sunshine"), 0, nil, false)
+	require.NoError(t, err)
+	stats, err = catalog.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.NumTracks)
+}
+
+func TestCatalog_UpdateSettings_ConvertLayout(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	_, err := catalog.CreateTrack("t1", loadTestFingerprint(t, "calibre_sunrise"), 0, nil, false)
+	require.NoError(t, err)
+
+	err = catalog.UpdateSettings(&CatalogSettings{Layout: LayoutPartitioned})
+	require.NoError(t, err)
+
+	// The layout is converted in the background.
+	for i := 0; ; i++ {
+		settings, err := getTestRepository(t, connectToDB(t)).Catalog(catalog.Name()).Settings()
+		require.NoError(t, err)
+		if settings.Layout == LayoutPartitioned {
+			break
+		}
+		require.True(t, i < 100, "layout was not converted")
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	stats, err := getTestRepository(t, connectToDB(t)).Catalog(catalog.Name()).Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.NumTracks)
+}
+
+func TestService_ConvertCatalogLayout_ConcurrentWrite(t *testing.T) {
+	catalog := getTestCatalog(t, true).(*CatalogImpl)
+
+	_, err := catalog.CreateTrack("t1", loadTestFingerprint(t, "calibre_sunrise"), 0, nil, false)
+	require.NoError(t, err)
+
+	layout := LayoutPartitioned
+	if catalog.settings.Layout == LayoutPartitioned {
+		layout = LayoutTablePerCatalog
+	}
+
+	// Add a track in a write that is still running when the tracks are copied, it must be copied by the final catch-up.
+	stx, err := catalog.beginWrite()
+	require.NoError(t, err)
+	defer stx.Rollback()
+	fingerprint := chromaprint.CompressFingerprint(*loadTestFingerprint(t, "radio1_3_calibre_sunshine"))
+	fingerprintSHA1 := sha1.Sum(fingerprint)
+	tables := catalog.tables()
+	_, err = stx.shardTx.Exec(fmt.Sprintf("INSERT INTO %s (%sexternal_id, fingerprint, fingerprint_sha1, fingerprint_version, duration) VALUES (%s$1, $2, $3, 1, 0)",
+		tables.name("track"), tables.insertColumns(), tables.insertValues()), "t2", fingerprint, fingerprintSHA1[:])
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- catalog.service().ConvertCatalogLayout(catalog.id, layout)
+	}()
+
+	for i := 0; ; i++ {
+		stats, err := catalog.Stats()
+		require.NoError(t, err)
+		if stats.Reindex != nil && stats.Reindex.NumIndexed == 1 {
+			break
+		}
+		require.True(t, i < 100, "tracks were not copied")
+		time.Sleep(time.Millisecond * 50)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("layout was converted while a track was being written: %v", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+	require.NoError(t, stx.Commit())
+	require.NoError(t, <-done)
+
+	repo := getTestRepository(t, connectToDB(t))
+	settings, err := repo.Catalog(catalog.Name()).Settings()
+	require.NoError(t, err)
+	assert.Equal(t, layout, settings.Layout)
+	stats, err := repo.Catalog(catalog.Name()).Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.NumTracks, "track written during the conversion should be in the new tables")
+	assert.Nil(t, stats.Reindex)
+}
+
+func TestCatalog_UpdateSettings_InvalidLayout(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	err := catalog.UpdateSettings(&CatalogSettings{Layout: "sharded"})
+	assert.Error(t, err)
+}
+
+func TestCatalog_PartitionedLayout(t *testing.T) {
+	service := NewService(connectToDB(t))
+	service.Layout = LayoutPartitioned
+	account, err := service.GetAccount(fmt.Sprintf("test:%s", t.Name()))
+	require.NoError(t, err)
+	catalog := account.Repository().Catalog(fmt.Sprintf("cat_%d", rand.Uint32()))
+
+	masterFP := loadTestFingerprint(t, "calibre_sunrise")
+	_, err = catalog.CreateTrack("t1", masterFP, 0, Metadata{"name": "Track 1"}, false)
+	require.NoError(t, err)
+
+	settings, err := catalog.Settings()
+	require.NoError(t, err)
+	assert.Equal(t, LayoutPartitioned, settings.Layout)
+
+	results, err := catalog.Search(loadTestFingerprint(t, "radio1_3_calibre_sunshine"), &SearchOptions{Stream: true})
+	require.NoError(t, err)
+	if assert.Len(t, results.Results, 1) {
+		assert.Equal(t, "t1", results.Results[0].ID)
+	}
+
+	tracks, err := catalog.ListTracks("", 10)
+	require.NoError(t, err)
+	assert.Len(t, tracks.Tracks, 1)
+
+	err = catalog.DeleteTrack("t1")
+	require.NoError(t, err)
+	results, err = catalog.GetTrack("t1")
+	require.NoError(t, err)
+	assert.Empty(t, results.Results)
+
+	err = catalog.DeleteCatalog()
+	require.NoError(t, err)
+	exists, err := catalog.Exists()
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestCatalog_Settings_ReplicaNotCached(t *testing.T) {
+	db := connectToDB(t)
+	service := NewService(db)
+	service.Cache = cache.New(time.Minute, time.Minute)
+	account, err := service.GetAccount(fmt.Sprintf("test:%s", t.Name()))
+	require.NoError(t, err)
+	name := fmt.Sprintf("cat_%d", rand.Uint32())
+	require.NoError(t, account.Repository().Catalog(name).CreateCatalog())
+	cacheKey := catalogCacheKey(account.(*AccountImpl).id, name)
+	service.Cache.Delete(cacheKey)
+
+	url, err := ParseDatabaseEnv(true)
+	require.NoError(t, err)
+	replica, err := sql.Open("postgres", url)
+	require.NoError(t, err)
+	defer replica.Close()
+	service.Replicas = NewReplicaSet(db, []*sql.DB{replica})
+	atomic.StoreInt32(&service.Replicas.replicas[0].healthy, 1)
+
+	_, err = account.Repository().Catalog(name).Settings()
+	require.NoError(t, err)
+	_, found := service.Cache.Get(cacheKey)
+	assert.False(t, found, "catalog read from a replica should not be cached")
+
+	require.NoError(t, account.Repository().Catalog(name).DeleteTrack("t1"))
+	_, found = service.Cache.Get(cacheKey)
+	assert.True(t, found, "catalog read from the primary should be cached")
+}
+
+func TestCatalog_Settings_DoesNotExist(t *testing.T) {
+	catalog := getTestCatalog(t, false)
+
+	settings, err := catalog.Settings()
+	assert.NoError(t, err)
+	assert.Nil(t, settings)
+}
+
+func TestCatalog_Stats(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+	_, err = catalog.CreateTrack("fp1", fp, 0, nil, false)
+	require.NoError(t, err)
+
+	stats, err := catalog.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.NumTracks)
+	assert.Nil(t, stats.MemoryIndex)
+}
+
+func TestCatalog_UpdateStopList(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+	_, err = catalog.CreateTrack("fp1", fp, 0, nil, false)
+	require.NoError(t, err)
+
+	values, err := catalog.UpdateStopList()
+	require.NoError(t, err)
+	assert.Empty(t, values)
+	assert.NotNil(t, values)
+
+	values, err = catalog.StopList()
+	require.NoError(t, err)
+	assert.Empty(t, values)
+	assert.NotNil(t, values)
+}
+
+func TestCatalog_UpdateStopList_DropsOldValues(t *testing.T) {
+	catalog := getTestCatalog(t, true).(*CatalogImpl)
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+	_, err = catalog.CreateTrack("fp1", fp, 0, nil, false)
+	require.NoError(t, err)
+
+	// Values on the stop list that are no longer frequent are dropped, whether the tracks contain them or not.
+	value := catalog.settings.IndexParams.extractQuery(fp)[0]
+	_, err = catalog.db.Exec("INSERT INTO catalog_stop_value (catalog_id, value, num_tracks) VALUES ($1, $2, 1000), ($1, $3, 1000)",
+		catalog.id, value, value+1)
+	require.NoError(t, err)
+
+	values, err := catalog.UpdateStopList()
+	require.NoError(t, err)
+	assert.Empty(t, values)
+}
+
+func TestCatalog_StopList_DoesNotExist(t *testing.T) {
+	catalog := getTestCatalog(t, false)
+
+	values, err := catalog.StopList()
+	assert.NoError(t, err)
+	assert.Nil(t, values)
+}
+
 func getTestCatalog(t *testing.T, create bool) Catalog {
 	repo := getTestRepository(t, connectToDB(t))
 	name := fmt.Sprintf("cat_%d", rand.Uint32())
@@ -103,7 +449,7 @@ func TestCatalog_CreateTrack(t *testing.T) {
 
 	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
 	require.NoError(t, err)
-	changed, err := catalog.CreateTrack("fp1", fp, Metadata{"name": "Track 1"}, false)
+	changed, err := catalog.CreateTrack("fp1", fp, 0, Metadata{"name": "Track 1"}, false)
 	assert.NoError(t, err)
 	assert.Equal(t, true, changed)
 }
@@ -113,11 +459,11 @@ func TestCatalog_CreateTrack_DisallowDuplicate(t *testing.T) {
 
 	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
 	require.NoError(t, err)
-	changed, err := catalog.CreateTrack("fp1", fp, Metadata{"name": "Track 1"}, false)
+	changed, err := catalog.CreateTrack("fp1", fp, 0, Metadata{"name": "Track 1"}, false)
 	assert.NoError(t, err)
 	assert.Equal(t, true, changed)
 
-	changed, err = catalog.CreateTrack("fp2", fp, Metadata{"name": "Track 2"}, false)
+	changed, err = catalog.CreateTrack("fp2", fp, 0, Metadata{"name": "Track 2"}, false)
 	assert.NoError(t, err)
 	assert.Equal(t, false, changed)
 }
@@ -127,11 +473,11 @@ func TestCatalog_CreateTrack_AllowDuplicate(t *testing.T) {
 
 	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
 	require.NoError(t, err)
-	changed, err := catalog.CreateTrack("fp1", fp, Metadata{"name": "Track 1"}, true)
+	changed, err := catalog.CreateTrack("fp1", fp, 0, Metadata{"name": "Track 1"}, true)
 	assert.NoError(t, err)
 	assert.Equal(t, true, changed)
 
-	changed, err = catalog.CreateTrack("fp2", fp, Metadata{"name": "Track 2"}, true)
+	changed, err = catalog.CreateTrack("fp2", fp, 0, Metadata{"name": "Track 2"}, true)
 	assert.NoError(t, err)
 	assert.Equal(t, true, changed)
 }
@@ -141,23 +487,66 @@ func TestCatalog_CreateTrack_Update(t *testing.T) {
 
 	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
 	require.NoError(t, err)
-	changed, err := catalog.CreateTrack("fp1", fp, Metadata{"name": "Track 1"}, false)
+	changed, err := catalog.CreateTrack("fp1", fp, 0, Metadata{"name": "Track 1"}, false)
 	assert.NoError(t, err)
 	assert.Equal(t, true, changed)
 
 	fp2, err := chromaprint.ParseFingerprintString(TestFingerprintQuery)
 	require.NoError(t, err)
-	changed, err = catalog.CreateTrack("fp1", fp2, Metadata{"name": "Track 1.2"}, false)
+	changed, err = catalog.CreateTrack("fp1", fp2, 0, Metadata{"name": "Track 1.2"}, false)
 	assert.NoError(t, err)
 	assert.Equal(t, true, changed)
 }
 
+func TestCatalog_CreateTrack_FingerprintVersion(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+	changed, err := catalog.CreateTrack("fp1", fp, 0, nil, false)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	results, err := catalog.GetTrack("fp1")
+	require.NoError(t, err)
+	if assert.Len(t, results.Results, 1) {
+		assert.Equal(t, 1, results.Results[0].FingerprintVersion)
+	}
+
+	fp.Version = 99
+	_, err = catalog.CreateTrack("fp2", fp, 0, nil, false)
+	assert.Equal(t, ErrFingerprintVersionNotAllowed, errors.Cause(err))
+}
+
+func TestCatalog_CreateTrack_Duration(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+	_, err = catalog.CreateTrack("fp1", fp, 0, nil, false)
+	require.NoError(t, err)
+	_, err = catalog.CreateTrack("fp2", fp, 180500*time.Millisecond, nil, true)
+	require.NoError(t, err)
+
+	results, err := catalog.GetTrack("fp1")
+	require.NoError(t, err)
+	if assert.Len(t, results.Results, 1) {
+		assert.Equal(t, FingerprintDuration(fp), results.Results[0].Duration)
+	}
+
+	list, err := catalog.ListTracks("", 10)
+	require.NoError(t, err)
+	if assert.Len(t, list.Tracks, 2) {
+		assert.Equal(t, 180500*time.Millisecond, list.Tracks[1].Duration)
+	}
+}
+
 func TestCatalog_CreateTrack_CatalogDoesNotExist(t *testing.T) {
 	catalog := getTestCatalog(t, false)
 
 	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
 	require.NoError(t, err)
-	changed, err := catalog.CreateTrack("fp1", fp, nil, false)
+	changed, err := catalog.CreateTrack("fp1", fp, 0, nil, false)
 	assert.NoError(t, err)
 	assert.Equal(t, true, changed)
 }
@@ -167,7 +556,7 @@ func TestCatalog_DeleteTrack(t *testing.T) {
 
 	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
 	require.NoError(t, err)
-	_, err = catalog.CreateTrack("fp1", fp, nil, false)
+	_, err = catalog.CreateTrack("fp1", fp, 0, nil, false)
 	require.NoError(t, err)
 
 	err = catalog.DeleteTrack("fp1")
@@ -195,7 +584,7 @@ func TestCatalog_GetTrack(t *testing.T) {
 
 	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
 	require.NoError(t, err)
-	_, err = catalog.CreateTrack("fp1", fp, metadata, false)
+	_, err = catalog.CreateTrack("fp1", fp, 0, metadata, false)
 	require.NoError(t, err)
 
 	results, err := catalog.GetTrack("fp1")
@@ -229,13 +618,13 @@ func TestCatalog_ListTracks(t *testing.T) {
 	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
 	require.NoError(t, err)
 
-	_, err = catalog.CreateTrack("fp1", fp, Metadata{"name": "Track 1"}, true)
+	_, err = catalog.CreateTrack("fp1", fp, 0, Metadata{"name": "Track 1"}, true)
 	require.NoError(t, err)
 
-	_, err = catalog.CreateTrack("fp2", fp, Metadata{"name": "Track 2"}, true)
+	_, err = catalog.CreateTrack("fp2", fp, 0, Metadata{"name": "Track 2"}, true)
 	require.NoError(t, err)
 
-	_, err = catalog.CreateTrack("fp3", fp, Metadata{"name": "Track 3"}, true)
+	_, err = catalog.CreateTrack("fp3", fp, 0, Metadata{"name": "Track 3"}, true)
 	require.NoError(t, err)
 
 	result, err := catalog.ListTracks("", 2)
@@ -263,7 +652,7 @@ func TestCatalog_Search_NoStream_NoMatch1(t *testing.T) {
 	masterID := "t1"
 	masterFP := loadTestFingerprint(t, "calibre_sunrise")
 	masterMetadata := Metadata{"title": "Sunrise", "artist": "Calibre"}
-	_, err := catalog.CreateTrack(masterID, masterFP, masterMetadata, false)
+	_, err := catalog.CreateTrack(masterID, masterFP, 0, masterMetadata, false)
 	require.NoError(t, err)
 
 	queryFP := loadTestFingerprint(t, "radio1_1_ad")
@@ -275,13 +664,87 @@ func TestCatalog_Search_NoStream_NoMatch1(t *testing.T) {
 	}
 }
 
+func TestCatalog_Search_NoStream_MaxDurationDiff(t *testing.T) {
+	catalog := getTestCatalog(t, true)
+
+	masterFP := loadTestFingerprint(t, "calibre_sunrise")
+	_, err := catalog.CreateTrack("t1", masterFP, 0, nil, false)
+	require.NoError(t, err)
+
+	results, err := catalog.Search(masterFP, &SearchOptions{MaxDurationDiff: time.Second})
+	require.NoError(t, err)
+	if assert.Len(t, results.Results, 1) {
+		assert.Equal(t, "t1", results.Results[0].ID)
+		assert.Equal(t, FingerprintDuration(masterFP), results.Results[0].Duration)
+	}
+
+	duration := FingerprintDuration(masterFP) + time.Minute
+	results, err = catalog.Search(masterFP, &SearchOptions{Duration: duration, MaxDurationDiff: time.Second})
+	require.NoError(t, err)
+	assert.Empty(t, results.Results)
+}
+
+func TestCatalog_Search_FingerprintVersion(t *testing.T) {
+	catalog := getTestCatalog(t, true).(*CatalogImpl)
+
+	masterFP := loadTestFingerprint(t, "calibre_sunrise")
+	for _, id := range []string{"t1", "t2"} {
+		_, err := catalog.CreateTrack(id, masterFP, 0, nil, false)
+		require.NoError(t, err)
+	}
+
+	// Tracks with fingerprints of other versions can't match, so they must not become candidates.
+	db, err := catalog.service().shardDB(catalog.settings.ShardID)
+	require.NoError(t, err)
+	tables := catalog.tables()
+	_, err = db.Exec(fmt.Sprintf("UPDATE %s SET fingerprint_version = 2 WHERE %sexternal_id = 't2'", tables.name("track"), tables.where()))
+	require.NoError(t, err)
+
+	results, err := catalog.Search(masterFP, &SearchOptions{Hits: true})
+	require.NoError(t, err)
+	assert.Len(t, results.Hits, 1)
+
+	results, err = catalog.Search(masterFP, nil)
+	require.NoError(t, err)
+	if assert.Len(t, results.Results, 1) {
+		assert.Equal(t, "t1", results.Results[0].ID)
+	}
+}
+
+func TestCatalog_Search_Partition(t *testing.T) {
+	catalog := getTestCatalog(t, true).(*CatalogImpl)
+
+	masterFP := loadTestFingerprint(t, "calibre_sunrise")
+	for i := 1; i <= 20; i++ {
+		_, err := catalog.CreateTrack(fmt.Sprintf("t%d", i), masterFP, 0, nil, true)
+		require.NoError(t, err)
+	}
+
+	partition := &Partition{Index: 1, Count: 2}
+	catalog.service().Partition = partition
+
+	results, err := catalog.Search(masterFP, &SearchOptions{Hits: true})
+	require.NoError(t, err)
+	assert.Empty(t, results.Results)
+	require.NotEmpty(t, results.Hits)
+	var candidates []int
+	for trackID := range results.Hits {
+		assert.True(t, partition.Contains(trackID), "track %d is not in the partition", trackID)
+		candidates = append(candidates, trackID)
+	}
+
+	results, err = catalog.Search(masterFP, &SearchOptions{Candidates: candidates})
+	require.NoError(t, err)
+	assert.Len(t, results.Results, len(candidates))
+}
+
 func TestCatalog_Search_Stream_NoMatch(t *testing.T) {
 	catalog := getTestCatalog(t, true)
 
 	masterID := "t1"
 	masterFP := loadTestFingerprint(t, "calibre_sunrise")
 	masterMetadata := Metadata{"title": "Sunrise", "artist": "Calibre"}
-	_, err := catalog.CreateTrack(masterID, masterFP, masterMetadata, false)
+	_, err := catalog.CreateTrack(masterID, masterFP, 0, masterMetadata, false)
 	require.NoError(t, err)
 
 	queryFP := loadTestFingerprint(t, "radio1_1_ad")
@@ -299,7 +762,7 @@ func TestCatalog_Search_Stream_PartialMatch(t *testing.T) {
 	masterID := "t1"
 	masterFP := loadTestFingerprint(t, "calibre_sunrise")
 	masterMetadata := Metadata{"title": "Sunrise", "artist": "Calibre"}
-	_, err := catalog.CreateTrack(masterID, masterFP, masterMetadata, false)
+	_, err := catalog.CreateTrack(masterID, masterFP, 0, masterMetadata, false)
 	require.NoError(t, err)
 
 	queryFP := loadTestFingerprint(t, "radio1_2_ad_and_calibre_sunshine")
@@ -322,7 +785,7 @@ func TestCatalog_Search_Stream_FullMatch(t *testing.T) {
 	masterID := "t1"
 	masterFP := loadTestFingerprint(t, "calibre_sunrise")
 	masterMetadata := Metadata{"title": "Sunrise", "artist": "Calibre"}
-	_, err := catalog.CreateTrack(masterID, masterFP, masterMetadata, false)
+	_, err := catalog.CreateTrack(masterID, masterFP, 0, masterMetadata, false)
 	require.NoError(t, err)
 
 	queryFP := loadTestFingerprint(t, "radio1_3_calibre_sunshine")
@@ -339,6 +802,41 @@ func TestCatalog_Search_Stream_FullMatch(t *testing.T) {
 	}
 }
 
+func BenchmarkCatalog_Search(b *testing.B) {
+	for _, indexType := range IndexTypes {
+		b.Run(indexType, func(b *testing.B) {
+			repo := getTestRepository(b, connectToDB(b))
+			catalog := repo.Catalog(fmt.Sprintf("cat_%d", rand.Uint32())).(*CatalogImpl)
+			err := catalog.CreateCatalog()
+			require.NoError(b, err)
+			err = catalog.service().ConvertCatalogIndex(catalog.id, indexType)
+			require.NoError(b, err)
+
+			master := loadTestFingerprint(b, "calibre_sunrise")
+			_, err = catalog.CreateTrack("t1", master, 0, nil, false)
+			require.NoError(b, err)
+
+			// Distractors share the value distribution of the master track, but not its time structure.
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < 100; i++ {
+				fp := *master
+				fp.Hashes = make([]uint32, len(master.Hashes))
+				copy(fp.Hashes, master.Hashes)
+				rnd.Shuffle(len(fp.Hashes), func(i, j int) { fp.Hashes[i], fp.Hashes[j] = fp.Hashes[j], fp.Hashes[i] })
+				_, err = catalog.CreateTrack(fmt.Sprintf("d%d", i), &fp, 0, nil, true)
+				require.NoError(b, err)
+			}
+
+			query := loadTestFingerprint(b, "radio1_3_calibre_sunshine")
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				_, err = catalog.Search(query, &SearchOptions{Stream: true})
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
 func TestMain(m *testing.M) {
 	rand.Seed(time.Now().UTC().UnixNano())
 	os.Exit(m.Run())
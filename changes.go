@@ -0,0 +1,105 @@
+package priv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+// ChangesChannel is the PostgreSQL notification channel used to broadcast changes
+// between all API instances connected to the same database.
+const ChangesChannel = "acoustid_priv_changes"
+
+const (
+	ChangeCatalogCreated = "catalog_created"
+	ChangeCatalogUpdated = "catalog_updated"
+	ChangeCatalogDeleted = "catalog_deleted"
+	ChangeTrackUpdated   = "track_updated"
+	ChangeTrackDeleted   = "track_deleted"
+	ChangeAccountUpdated = "account_updated"
+	ChangeAccountDeleted = "account_deleted"
+)
+
+type ChangeEvent struct {
+	Type      string `json:"type"`
+	AccountID int    `json:"account_id"`
+	Account   string `json:"account,omitempty"` // external ID of the account, only for account changes
+	CatalogID int    `json:"catalog_id"`
+	Catalog   string `json:"catalog"`
+	TrackID   int    `json:"track_id,omitempty"`
+}
+
+// notifyChange queues a change notification, which will be delivered to all listeners
+// when the transaction is committed.
+func notifyChange(tx *sql.Tx, event *ChangeEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode change event")
+	}
+	_, err = tx.Exec("SELECT pg_notify($1, $2)", ChangesChannel, string(payload))
+	if err != nil {
+		return errors.WithMessage(err, "failed to send change notification")
+	}
+	return nil
+}
+
+// ChangeListener receives change notifications sent by all API instances
+// and passes them to the service, so that it can invalidate its local caches.
+type ChangeListener struct {
+	service  *ServiceImpl
+	listener *pq.Listener
+}
+
+func NewChangeListener(databaseURL string, service *ServiceImpl) *ChangeListener {
+	l := &ChangeListener{service: service}
+	l.listener = pq.NewListener(databaseURL, time.Second, time.Minute, l.handleEvent)
+	return l
+}
+
+func (l *ChangeListener) handleEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventConnected:
+		log.Printf("Listening for changes")
+		l.service.setListening(true)
+	case pq.ListenerEventReconnected:
+		log.Printf("Reconnected to the change listener, invalidating caches")
+		l.service.setListening(true)
+	case pq.ListenerEventDisconnected:
+		log.Printf("Change listener disconnected, falling back to short cache TTL: %v", err)
+		l.service.setListening(false)
+	case pq.ListenerEventConnectionAttemptFailed:
+		log.Printf("Failed to connect the change listener: %v", err)
+		l.service.setListening(false)
+	}
+}
+
+// Listen processes change notifications until the listener is closed.
+func (l *ChangeListener) Listen() error {
+	err := l.listener.Listen(ChangesChannel)
+	if err != nil {
+		return errors.WithMessage(err, "failed to listen for changes")
+	}
+	for notification := range l.listener.NotificationChannel() {
+		if notification == nil {
+			// Sent after a reconnect, notifications might have been lost in the meantime.
+			l.service.invalidateAll()
+			continue
+		}
+		var event ChangeEvent
+		err := json.Unmarshal([]byte(notification.Extra), &event)
+		if err != nil {
+			log.Printf("Failed to parse change notification %q: %v", notification.Extra, err)
+			continue
+		}
+		l.service.handleChange(&event)
+	}
+	return nil
+}
+
+func (l *ChangeListener) Close() error {
+	l.service.setListening(false)
+	return l.listener.Close()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/acoustid/priv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runAPIKey creates, lists, rotates or revokes API keys of an account.
+func runAPIKey(args []string) {
+	databaseURL, err := priv.ParseDatabaseEnv(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var account, name, scopes, catalogs string
+	var id int
+
+	flags := flag.NewFlagSet("api-key", flag.ExitOnError)
+	flags.StringVar(&databaseURL, "db", databaseURL, "PostgreSQL URL")
+	flags.StringVar(&account, "account", "", "External ID of the account")
+	flags.StringVar(&name, "name", "", "Name of the new API key")
+	flags.StringVar(&scopes, "scopes", "", "Comma-separated list of scopes of the new API key ("+strings.Join(priv.Scopes, ", ")+"), all scopes if empty")
+	flags.StringVar(&catalogs, "catalogs", "", "Comma-separated list of catalog names or patterns the new API key can access, all catalogs if empty")
+	flags.IntVar(&id, "id", 0, "ID of the API key to rotate or revoke")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s api-key [flags] create|list|rotate|revoke\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if account == "" {
+		log.Printf("Missing account")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	command := flags.Arg(0)
+	if (command == "rotate" || command == "revoke") && id == 0 {
+		log.Printf("Missing API key ID")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatalf("Unable to connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	service := priv.NewService(db)
+	auditLog := priv.NewAuditLog(db)
+	audit := func(action string, id int) {
+		entry := &priv.AuditEntry{Account: account, Principal: "cli", Action: action, Object: strconv.Itoa(id)}
+		err := auditLog.Record(entry)
+		if err != nil {
+			log.Printf("Failed to record %s in audit log: %v", action, err)
+		}
+	}
+
+	switch command {
+	case "create":
+		permissions := priv.Permissions{Scopes: splitList(scopes), Catalogs: splitList(catalogs)}
+		apiKey, err := service.CreateAPIKey(account, name, permissions)
+		if err != nil {
+			log.Fatalf("Failed to create API key: %v", err)
+		}
+		audit(priv.AuditAPIKeyCreate, apiKey.ID)
+		printAPIKey(apiKey)
+	case "list":
+		apiKeys, err := service.ListAPIKeys(account)
+		if err != nil {
+			log.Fatalf("Failed to list API keys: %v", err)
+		}
+		for i := range apiKeys {
+			printAPIKey(&apiKeys[i])
+		}
+	case "rotate":
+		apiKey, err := service.RotateAPIKey(account, id)
+		if err != nil {
+			log.Fatalf("Failed to rotate API key %d: %v", id, err)
+		}
+		audit(priv.AuditAPIKeyRotate, id)
+		printAPIKey(apiKey)
+	case "revoke":
+		err = service.RevokeAPIKey(account, id)
+		if err != nil {
+			log.Fatalf("Failed to revoke API key %d: %v", id, err)
+		}
+		audit(priv.AuditAPIKeyRevoke, id)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+func printAPIKey(apiKey *priv.APIKey) {
+	key := apiKey.Key
+	if key == "" {
+		key = apiKey.Prefix + "..."
+	}
+	lastUsed := "never"
+	if apiKey.LastUsed != nil {
+		lastUsed = apiKey.LastUsed.UTC().Format(time.RFC3339)
+	}
+	state := "active"
+	if apiKey.Revoked != nil {
+		state = "revoked"
+	}
+	scopes := "*"
+	if len(apiKey.Scopes) > 0 {
+		scopes = strings.Join(apiKey.Scopes, ",")
+	}
+	catalogs := "*"
+	if len(apiKey.Catalogs) > 0 {
+		catalogs = strings.Join(apiKey.Catalogs, ",")
+	}
+	fmt.Printf("%d\t%s\t%q\tscopes=%s\tcatalogs=%s\tcreated=%s\tlast_used=%s\t%s\n", apiKey.ID, key, apiKey.Name, scopes, catalogs,
+		apiKey.Created.UTC().Format(time.RFC3339), lastUsed, state)
+}
+
+func splitList(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"github.com/acoustid/priv"
+	"log"
+	"os"
+	"strings"
+)
+
+// runConvertIndex converts fingerprint indexes of existing catalogs to a different index type.
+func runConvertIndex(args []string) {
+	databaseURL, err := priv.ParseDatabaseEnv(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var indexType string
+	var shardURLsStr string
+	var catalogID int
+
+	flags := flag.NewFlagSet("convert-index", flag.ExitOnError)
+	flags.StringVar(&databaseURL, "db", databaseURL, "PostgreSQL URL")
+	flags.StringVar(&shardURLsStr, "db-shard", shardFlag(), shardFlagUsage)
+	flags.StringVar(&indexType, "index-type", "", "Target index type ("+strings.Join(priv.IndexTypes, ", ")+")")
+	flags.IntVar(&catalogID, "catalog-id", 0, "ID of the catalog to convert, all catalogs are converted if not set")
+	flags.Parse(args)
+
+	if !priv.IsValidIndexType(indexType) {
+		log.Printf("Invalid index type %q", indexType)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatalf("Unable to connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	service := priv.NewService(db)
+	addShards(service, shardURLsStr)
+
+	var catalogIDs []int
+	if catalogID != 0 {
+		catalogIDs = []int{catalogID}
+	} else {
+		catalogIDs, err = service.CatalogIDs()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, id := range catalogIDs {
+		log.Printf("Converting index of catalog_id=%v to %v", id, indexType)
+		err = service.ConvertCatalogIndex(id, indexType)
+		if err != nil {
+			log.Fatalf("Failed to convert index of catalog_id=%v: %v", id, err)
+		}
+	}
+}
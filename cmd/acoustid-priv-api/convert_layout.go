@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"github.com/acoustid/priv"
+	"log"
+	"os"
+	"strings"
+)
+
+// runConvertLayout moves existing catalogs to a different storage layout.
+func runConvertLayout(args []string) {
+	databaseURL, err := priv.ParseDatabaseEnv(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var layout string
+	var shardURLsStr string
+	var catalogID int
+
+	flags := flag.NewFlagSet("convert-layout", flag.ExitOnError)
+	flags.StringVar(&databaseURL, "db", databaseURL, "PostgreSQL URL")
+	flags.StringVar(&shardURLsStr, "db-shard", shardFlag(), shardFlagUsage)
+	flags.StringVar(&layout, "layout", "", "Target storage layout ("+strings.Join(priv.Layouts, ", ")+")")
+	flags.IntVar(&catalogID, "catalog-id", 0, "ID of the catalog to convert, all catalogs are converted if not set")
+	flags.Parse(args)
+
+	if !priv.IsValidLayout(layout) {
+		log.Printf("Invalid storage layout %q", layout)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatalf("Unable to connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	service := priv.NewService(db)
+	addShards(service, shardURLsStr)
+
+	var catalogIDs []int
+	if catalogID != 0 {
+		catalogIDs = []int{catalogID}
+	} else {
+		catalogIDs, err = service.CatalogIDs()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, id := range catalogIDs {
+		log.Printf("Converting catalog_id=%v to %v", id, layout)
+		err = service.ConvertCatalogLayout(id, layout)
+		if err != nil {
+			log.Fatalf("Failed to convert catalog_id=%v: %v", id, err)
+		}
+	}
+}
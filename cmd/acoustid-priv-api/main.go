@@ -11,11 +11,42 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "convert-index" {
+		runConvertIndex(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "convert-layout" {
+		runConvertLayout(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "move-catalog" {
+		runMoveCatalog(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		runReindex(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "api-key" {
+		runAPIKey(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "purge-account" {
+		runPurgeAccount(os.Args[2:])
+		return
+	}
+
 	addr := os.Getenv("ACOUSTID_PRIV_BIND")
 	if addr == "" {
 		addr = ":3382"
@@ -26,6 +57,24 @@ func main() {
 		log.Fatal(err)
 	}
 
+	replicaURLs, err := priv.ParseReplicaDatabaseEnv(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	replicaURLsStr := strings.Join(replicaURLs, ",")
+
+	shardURLsStr := shardFlag()
+
+	maxReplicaLag := priv.DefaultMaxReplicaLag
+	maxReplicaLagStr := os.Getenv("ACOUSTID_PRIV_DB_REPLICA_MAX_LAG")
+	if maxReplicaLagStr != "" {
+		d, err := time.ParseDuration(maxReplicaLagStr)
+		if err != nil {
+			log.Fatalf("Error while parsing ACOUSTID_PRIV_DB_REPLICA_MAX_LAG: %v", err)
+		}
+		maxReplicaLag = d
+	}
+
 	auth := os.Getenv("ACOUSTID_PRIV_AUTH")
 	if auth == "" {
 		auth = "disabled"
@@ -33,12 +82,106 @@ func main() {
 
 	authUsername := os.Getenv("ACOUSTID_PRIV_AUTH_USER")
 	authPassword := os.Getenv("ACOUSTID_PRIV_AUTH_PASSWORD")
+	htpasswdPath := os.Getenv("ACOUSTID_PRIV_AUTH_HTPASSWD")
+
+	adminPassword := os.Getenv("ACOUSTID_PRIV_ADMIN_PASSWORD")
+
+	searchTokenKeysStr := os.Getenv("ACOUSTID_PRIV_SEARCH_TOKEN_KEYS")
+
+	purgeReportKeyStr := os.Getenv("ACOUSTID_PRIV_PURGE_REPORT_KEY")
+
+	jwks := os.Getenv("ACOUSTID_PRIV_AUTH_JWKS")
+	jwtIssuer := os.Getenv("ACOUSTID_PRIV_AUTH_JWT_ISSUER")
+	jwtAudience := os.Getenv("ACOUSTID_PRIV_AUTH_JWT_AUDIENCE")
+	jwtAccountClaim := os.Getenv("ACOUSTID_PRIV_AUTH_JWT_ACCOUNT_CLAIM")
+	if jwtAccountClaim == "" {
+		jwtAccountClaim = "sub"
+	}
 
 	authUserTag := os.Getenv("ACOUSTID_PRIV_AUTH_USER_TAG")
 	if authUserTag == "" {
 		authUserTag = "private"
 	}
 
+	acoustidBizURL := os.Getenv("ACOUSTID_PRIV_AUTH_ACOUSTID_BIZ_URL")
+	if acoustidBizURL == "" {
+		acoustidBizURL = priv.DefaultAcoustidBizEndpoint
+	}
+
+	acoustidBizTimeout := priv.DefaultAcoustidBizTimeout
+	acoustidBizTimeoutStr := os.Getenv("ACOUSTID_PRIV_AUTH_ACOUSTID_BIZ_TIMEOUT")
+	if acoustidBizTimeoutStr != "" {
+		d, err := time.ParseDuration(acoustidBizTimeoutStr)
+		if err != nil {
+			log.Fatalf("Error while parsing ACOUSTID_PRIV_AUTH_ACOUSTID_BIZ_TIMEOUT: %v", err)
+		}
+		acoustidBizTimeout = d
+	}
+
+	defaultLimits := priv.Limits{
+		SearchRate:          intEnv("ACOUSTID_PRIV_LIMIT_SEARCH_RATE"),
+		WriteRate:           intEnv("ACOUSTID_PRIV_LIMIT_WRITE_RATE"),
+		MaxCatalogs:         intEnv("ACOUSTID_PRIV_LIMIT_MAX_CATALOGS"),
+		MaxTracksPerCatalog: intEnv("ACOUSTID_PRIV_LIMIT_MAX_TRACKS_PER_CATALOG"),
+		MaxTracks:           intEnv("ACOUSTID_PRIV_LIMIT_MAX_TRACKS"),
+	}
+
+	usageFlushInterval := priv.DefaultUsageFlushInterval
+	usageFlushIntervalStr := os.Getenv("ACOUSTID_PRIV_USAGE_FLUSH_INTERVAL")
+	if usageFlushIntervalStr != "" {
+		d, err := time.ParseDuration(usageFlushIntervalStr)
+		if err != nil {
+			log.Fatalf("Error while parsing ACOUSTID_PRIV_USAGE_FLUSH_INTERVAL: %v", err)
+		}
+		usageFlushInterval = d
+	}
+
+	usageStorageInterval := priv.DefaultUsageStorageInterval
+	usageStorageIntervalStr := os.Getenv("ACOUSTID_PRIV_USAGE_STORAGE_INTERVAL")
+	if usageStorageIntervalStr != "" {
+		d, err := time.ParseDuration(usageStorageIntervalStr)
+		if err != nil {
+			log.Fatalf("Error while parsing ACOUSTID_PRIV_USAGE_STORAGE_INTERVAL: %v", err)
+		}
+		usageStorageInterval = d
+	}
+
+	audit := os.Getenv("ACOUSTID_PRIV_AUDIT") != "0"
+
+	auditRetention := priv.DefaultAuditRetention
+	auditRetentionStr := os.Getenv("ACOUSTID_PRIV_AUDIT_RETENTION")
+	if auditRetentionStr != "" {
+		d, err := time.ParseDuration(auditRetentionStr)
+		if err != nil {
+			log.Fatalf("Error while parsing ACOUSTID_PRIV_AUDIT_RETENTION: %v", err)
+		}
+		auditRetention = d
+	}
+
+	trustForwardedFor := os.Getenv("ACOUSTID_PRIV_TRUST_FORWARDED_FOR") == "1"
+
+	memoryIndexPreload := os.Getenv("ACOUSTID_PRIV_MEMORY_INDEX_PRELOAD") != "0"
+
+	layout := os.Getenv("ACOUSTID_PRIV_LAYOUT")
+	if layout == "" {
+		layout = priv.DefaultLayout
+	}
+
+	partitionStr := os.Getenv("ACOUSTID_PRIV_PARTITION")
+
+	searchNodesStr := os.Getenv("ACOUSTID_PRIV_SEARCH_NODES")
+	searchNodeSecret := os.Getenv("ACOUSTID_PRIV_SEARCH_NODE_SECRET")
+
+	searchNodeTimeout := priv.DefaultSearchNodeTimeout
+	searchNodeTimeoutStr := os.Getenv("ACOUSTID_PRIV_SEARCH_NODE_TIMEOUT")
+	if searchNodeTimeoutStr != "" {
+		d, err := time.ParseDuration(searchNodeTimeoutStr)
+		if err != nil {
+			log.Fatalf("Error while parsing ACOUSTID_PRIV_SEARCH_NODE_TIMEOUT: %v", err)
+		}
+		searchNodeTimeout = d
+	}
+
 	shutdownDelay := time.Millisecond * 100
 	shutdownDelayStr := os.Getenv("ACOUSTID_PRIV_SHUTDOWN_DELAY")
 	if shutdownDelayStr != "" {
@@ -51,29 +194,220 @@ func main() {
 
 	flag.StringVar(&addr, "bind", addr, "Address on which the server should listen")
 	flag.StringVar(&databaseURL, "db", databaseURL, "PostgreSQL URL")
-	flag.StringVar(&auth, "auth", auth, "Authentication method (disabled, password, acoustid-biz)")
+	flag.StringVar(&replicaURLsStr, "db-replica", replicaURLsStr, "Comma-separated list of read-only PostgreSQL replica URLs")
+	flag.DurationVar(&maxReplicaLag, "db-replica-max-lag", maxReplicaLag, "Maximum replication lag before a replica is not used")
+	flag.StringVar(&shardURLsStr, "db-shard", shardURLsStr, shardFlagUsage)
+	flag.StringVar(&auth, "auth", auth, "Comma-separated list of authentication methods tried in order (disabled, password, htpasswd, acoustid-biz, api-key, jwt)")
 	flag.StringVar(&authUsername, "user", authUsername, "Username for password authentication")
 	flag.StringVar(&authPassword, "password", authPassword, "Password for password authentication")
+	flag.StringVar(&htpasswdPath, "htpasswd", htpasswdPath, "File with bcrypt password hashes of users for htpasswd authentication, reloaded on SIGHUP")
+	flag.StringVar(&adminPassword, "admin-password", adminPassword, "Password of the admin API, which is disabled if empty")
 	flag.StringVar(&authUserTag, "user-tag", authUserTag, "User tag for acoustid-biz authentication")
+	flag.StringVar(&acoustidBizURL, "acoustid-biz-url", acoustidBizURL, "URL of the API key validation endpoint for acoustid-biz authentication")
+	flag.DurationVar(&acoustidBizTimeout, "acoustid-biz-timeout", acoustidBizTimeout, "Timeout of API key validation requests for acoustid-biz authentication")
+	flag.StringVar(&jwks, "jwks", jwks, "JWKS file, or inline JWKS document, with keys for jwt authentication")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", jwtIssuer, "Required issuer of tokens for jwt authentication")
+	flag.StringVar(&jwtAudience, "jwt-audience", jwtAudience, "Required audience of tokens for jwt authentication")
+	flag.StringVar(&jwtAccountClaim, "jwt-account-claim", jwtAccountClaim, "Claim with the account ID for jwt authentication")
+	flag.StringVar(&searchTokenKeysStr, "search-token-keys", searchTokenKeysStr, "Comma-separated list of id:secret keys for signing search tokens, the first key signs new tokens")
+	flag.StringVar(&purgeReportKeyStr, "purge-report-key", purgeReportKeyStr, "Key for signing reports of purged accounts in the id:secret format, accounts can't be purged if empty")
+	flag.IntVar(&defaultLimits.SearchRate, "limit-search-rate", defaultLimits.SearchRate, "Default maximum number of search requests per second of an account on each API node, unlimited if 0")
+	flag.IntVar(&defaultLimits.WriteRate, "limit-write-rate", defaultLimits.WriteRate, "Default maximum number of write requests per second of an account on each API node, unlimited if 0")
+	flag.IntVar(&defaultLimits.MaxCatalogs, "limit-max-catalogs", defaultLimits.MaxCatalogs, "Default maximum number of catalogs of an account, unlimited if 0")
+	flag.IntVar(&defaultLimits.MaxTracksPerCatalog, "limit-max-tracks-per-catalog", defaultLimits.MaxTracksPerCatalog, "Default maximum number of tracks in a catalog, unlimited if 0")
+	flag.IntVar(&defaultLimits.MaxTracks, "limit-max-tracks", defaultLimits.MaxTracks, "Default maximum number of tracks in all catalogs of an account, unlimited if 0")
+	flag.DurationVar(&usageFlushInterval, "usage-flush-interval", usageFlushInterval, "How often usage of accounts is saved, usage is not metered if 0")
+	flag.DurationVar(&usageStorageInterval, "usage-storage-interval", usageStorageInterval, "How often storage used by accounts is measured, storage is not measured if 0")
+	flag.BoolVar(&audit, "audit", audit, "Record changes in the audit log")
+	flag.DurationVar(&auditRetention, "audit-retention", auditRetention, "How long entries are kept in the audit log, forever if 0")
+	flag.BoolVar(&trustForwardedFor, "trust-forwarded-for", trustForwardedFor, "Use the X-Forwarded-For header as the client's IP address, only if the server is behind a proxy")
+	flag.BoolVar(&memoryIndexPreload, "memory-index-preload", memoryIndexPreload, "Load in-memory catalog indexes on startup, instead of on first use")
 	flag.DurationVar(&shutdownDelay, "shutdown-delay", shutdownDelay, "Delay shutdown")
+	flag.StringVar(&layout, "layout", layout, "Storage layout of new catalogs ("+strings.Join(priv.Layouts, ", ")+")")
+	flag.StringVar(&partitionStr, "partition", partitionStr, "Partition of tracks searched by this node (e.g. 0/3), all tracks if empty")
+	flag.StringVar(&searchNodesStr, "search-nodes", searchNodesStr, "Comma-separated list of API node URLs to which searches are forwarded")
+	flag.StringVar(&searchNodeSecret, "search-node-secret", searchNodeSecret, "Secret shared by all API nodes that authenticates forwarded searches, which are rejected if empty")
+	flag.DurationVar(&searchNodeTimeout, "search-node-timeout", searchNodeTimeout, "Timeout of each round of search requests to API nodes, after which partial results are returned")
 	flag.Parse()
 
+	if !priv.IsValidLayout(layout) {
+		log.Fatalf("Invalid storage layout %q", layout)
+	}
+
 	db, err := sql.Open("postgres", databaseURL)
 	if err != nil {
 		log.Fatalf("Unable to connect to the database: %v", err)
 	}
 
 	service := priv.NewService(db)
+	service.Layout = layout
+	service.DefaultLimits = defaultLimits
+	if partitionStr != "" {
+		partition, err := priv.ParsePartition(partitionStr)
+		if err != nil {
+			log.Fatalf("Invalid partition: %v", err)
+		}
+		log.Printf("Searching only partition %v of tracks", partition)
+		service.Partition = partition
+	}
+	addShards(service, shardURLsStr)
+
+	err = service.CheckSchema()
+	if err != nil {
+		log.Fatalf("Database schema is not up to date: %v", err)
+	}
+
+	replicaURLs = priv.SplitDatabaseURLs(replicaURLsStr)
+	if len(replicaURLs) > 0 {
+		var replicaDBs []*sql.DB
+		for _, replicaURL := range replicaURLs {
+			replicaDB, err := sql.Open("postgres", replicaURL)
+			if err != nil {
+				log.Fatalf("Unable to connect to the replica database: %v", err)
+			}
+			replicaDBs = append(replicaDBs, replicaDB)
+		}
+		log.Printf("Using %d read-only replicas with max lag %s", len(replicaDBs), maxReplicaLag)
+		service.Replicas = priv.NewReplicaSet(db, replicaDBs)
+		service.Replicas.MaxLag = maxReplicaLag
+		service.Replicas.Start(priv.ReplicaCheckInterval)
+	}
+
+	service.Cache = cache.New(priv.CacheTTL, time.Minute*10)
+
+	if purgeReportKeyStr != "" {
+		service.PurgeReportKey, err = priv.ParsePurgeReportKey(purgeReportKeyStr)
+		if err != nil {
+			log.Fatalf("Invalid purge report key: %v", err)
+		}
+	}
+
+	if usageFlushInterval > 0 {
+		service.Usage = priv.NewUsageMeter(service)
+		service.Usage.Start(usageFlushInterval, usageStorageInterval)
+	}
+
+	listener := priv.NewChangeListener(databaseURL, service)
+	go func() {
+		err := listener.Listen()
+		if err != nil {
+			log.Printf("Change listener failed: %v", err)
+		}
+	}()
+
+	if memoryIndexPreload {
+		err = service.LoadMemoryIndexes()
+		if err != nil {
+			log.Printf("Failed to load memory indexes: %v", err)
+		}
+	}
+
 	handler := priv.NewAPI(service)
+	handler.TrustForwardedFor = trustForwardedFor
+	handler.SearchNodeSecret = searchNodeSecret
 
-	if auth == "password" {
-		log.Printf("Using password authentication")
-		handler.Auth = &priv.PasswordAuth{authUsername, authPassword}
-	} else if auth == "acoustid-biz" {
-		log.Printf("Using acoustid.biz authentication with user tag %v", authUserTag)
-		authenticator := priv.NewAcoustidBizAuth(authUserTag)
-		authenticator.Cache = cache.New(time.Hour, time.Minute*10)
-		handler.Auth = authenticator
+	var auditLog *priv.AuditLogImpl
+	if audit {
+		auditLog = priv.NewAuditLog(db)
+		auditLog.Retention = auditRetention
+		auditLog.Start(priv.AuditCleanupInterval)
+		handler.Audit = auditLog
+	}
+
+	searchNodeURLs := priv.SplitDatabaseURLs(searchNodesStr)
+	if len(searchNodeURLs) > 0 {
+		if searchNodeSecret == "" {
+			log.Fatal("Search node secret is required when forwarding searches to API nodes")
+		}
+		log.Printf("Forwarding searches to %d API nodes", len(searchNodeURLs))
+		handler.Nodes = priv.NewSearchNodes(searchNodeURLs)
+		handler.Nodes.Timeout = searchNodeTimeout
+		handler.Nodes.Secret = searchNodeSecret
+	}
+
+	var authenticators []priv.Authenticator
+	var htpasswdAuth *priv.HtpasswdAuth
+	for _, method := range splitList(auth) {
+		switch method {
+		case "disabled":
+			authenticators = append(authenticators, &priv.NoAuth{})
+		case "password":
+			log.Printf("Using password authentication")
+			authenticators = append(authenticators, &priv.PasswordAuth{Username: authUsername, Password: authPassword})
+		case "htpasswd":
+			htpasswdAuth, err = priv.LoadHtpasswdAuth(htpasswdPath)
+			if err != nil {
+				log.Fatalf("Failed to load htpasswd file: %v", err)
+			}
+			htpasswdAuth.Cache = cache.New(time.Minute, time.Minute*10)
+			log.Printf("Using password authentication with users from %s", htpasswdPath)
+			authenticators = append(authenticators, htpasswdAuth)
+		case "acoustid-biz":
+			log.Printf("Using acoustid.biz authentication with user tag %v", authUserTag)
+			authenticator := priv.NewAcoustidBizAuth(authUserTag)
+			authenticator.Endpoint = acoustidBizURL
+			authenticator.Client.Timeout = acoustidBizTimeout
+			authenticator.Cache = cache.New(authenticator.StaleTTL, time.Minute*10)
+			authenticators = append(authenticators, authenticator)
+		case "api-key":
+			log.Printf("Using API key authentication")
+			authenticator := priv.NewAPIKeyAuth(service)
+			authenticator.Cache = cache.New(time.Minute, time.Minute*10)
+			authenticators = append(authenticators, authenticator)
+		case "jwt":
+			var keys *priv.JWKS
+			if strings.HasPrefix(strings.TrimSpace(jwks), "{") {
+				keys, err = priv.ParseJWKS([]byte(jwks))
+			} else {
+				keys, err = priv.LoadJWKS(jwks)
+			}
+			if err != nil {
+				log.Fatalf("Failed to load JWKS: %v", err)
+			}
+			log.Printf("Using JWT authentication with issuer %q and audience %q", jwtIssuer, jwtAudience)
+			authenticator := priv.NewJWTAuth(keys)
+			authenticator.Issuer = jwtIssuer
+			authenticator.Audience = jwtAudience
+			authenticator.AccountClaim = jwtAccountClaim
+			authenticators = append(authenticators, authenticator)
+		default:
+			log.Fatalf("Invalid authentication method %q", method)
+		}
+	}
+
+	if searchTokenKeysStr != "" {
+		searchTokenKeys, err := priv.ParseSearchTokenKeys(searchTokenKeysStr)
+		if err != nil {
+			log.Fatalf("Invalid search token keys: %v", err)
+		}
+		log.Printf("Accepting search tokens signed by %d keys", len(searchTokenKeys.Keys))
+		handler.SearchTokens = searchTokenKeys
+		authenticators = append([]priv.Authenticator{&priv.SearchTokenAuth{Keys: searchTokenKeys}}, authenticators...)
+	}
+
+	if len(authenticators) == 1 {
+		handler.Auth = authenticators[0]
+	} else if len(authenticators) > 1 {
+		handler.Auth = priv.NewChainAuth(authenticators...)
+	}
+
+	if htpasswdAuth != nil {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				err := htpasswdAuth.Reload()
+				if err != nil {
+					log.Printf("Failed to reload htpasswd file: %v", err)
+				} else {
+					log.Printf("Reloaded htpasswd file %s", htpasswdPath)
+				}
+			}
+		}()
+	}
+
+	if adminPassword != "" {
+		handler.AdminAuth = &priv.PasswordAuth{Username: "admin", Password: adminPassword}
 	}
 
 	quit := make(chan os.Signal, 1)
@@ -92,9 +426,35 @@ func main() {
 	time.Sleep(shutdownDelay)
 
 	log.Print("Shutting down")
-	shutdownContext, _ := context.WithTimeout(context.Background(), time.Second*10)
+	shutdownContext, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
 	httpServer.Shutdown(shutdownContext)
 	httpServer.Close()
+	listener.Close()
+	if service.Usage != nil {
+		err = service.Usage.Close()
+		if err != nil {
+			log.Printf("Failed to flush usage: %v", err)
+		}
+	}
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	if service.Replicas != nil {
+		service.Replicas.Close()
+	}
 
 	log.Print("Exit")
 }
+
+func intEnv(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Error while parsing %s: %v", name, err)
+	}
+	return i
+}
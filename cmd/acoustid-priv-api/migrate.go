@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/acoustid/priv"
+	"log"
+	"os"
+)
+
+// runMigrate applies, reverts or lists schema migrations of the central database and the shards.
+func runMigrate(args []string) {
+	databaseURL, err := priv.ParseDatabaseEnv(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var shardURLsStr string
+
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&databaseURL, "db", databaseURL, "PostgreSQL URL")
+	flags.StringVar(&shardURLsStr, "db-shard", shardFlag(), shardFlagUsage)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s migrate [flags] up|down|status\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatalf("Unable to connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	service := priv.NewService(db)
+	addShards(service, shardURLsStr)
+
+	switch flags.Arg(0) {
+	case "up":
+		err = service.MigrateUp()
+		if err != nil {
+			log.Fatalf("Failed to apply migrations: %v", err)
+		}
+	case "down":
+		err = service.MigrateDown()
+		if err != nil {
+			log.Fatalf("Failed to revert migration: %v", err)
+		}
+	case "status":
+		statuses, err := service.MigrationStatus()
+		if err != nil {
+			log.Fatalf("Failed to get migration status: %v", err)
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied"
+			}
+			fmt.Printf("shard=%d\t%d_%s\t%s\n", status.ShardID, status.Version, status.Name, state)
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"github.com/acoustid/priv"
+	"log"
+	"os"
+)
+
+// runMoveCatalog relocates a catalog to a different shard database.
+func runMoveCatalog(args []string) {
+	databaseURL, err := priv.ParseDatabaseEnv(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var shardURLsStr string
+	var catalogID, shardID int
+
+	flags := flag.NewFlagSet("move-catalog", flag.ExitOnError)
+	flags.StringVar(&databaseURL, "db", databaseURL, "PostgreSQL URL")
+	flags.StringVar(&shardURLsStr, "db-shard", shardFlag(), shardFlagUsage)
+	flags.IntVar(&catalogID, "catalog-id", 0, "ID of the catalog to move")
+	flags.IntVar(&shardID, "shard", 0, "ID of the target shard, 0 is the central database")
+	flags.Parse(args)
+
+	if catalogID == 0 {
+		log.Printf("Missing catalog ID")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatalf("Unable to connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	service := priv.NewService(db)
+	addShards(service, shardURLsStr)
+
+	log.Printf("Moving catalog_id=%v to shard %v", catalogID, shardID)
+	err = service.MoveCatalog(catalogID, shardID)
+	if err != nil {
+		log.Fatalf("Failed to move catalog_id=%v: %v", catalogID, err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/acoustid/priv"
+	"log"
+	"os"
+)
+
+// runPurgeAccount deletes all data of an account and prints the signed purge report.
+func runPurgeAccount(args []string) {
+	databaseURL, err := priv.ParseDatabaseEnv(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var shardURLsStr, account string
+	var policy priv.PurgePolicy
+	purgeReportKeyStr := os.Getenv("ACOUSTID_PRIV_PURGE_REPORT_KEY")
+
+	flags := flag.NewFlagSet("purge-account", flag.ExitOnError)
+	flags.StringVar(&databaseURL, "db", databaseURL, "PostgreSQL URL")
+	flags.StringVar(&shardURLsStr, "db-shard", shardFlag(), shardFlagUsage)
+	flags.StringVar(&account, "account", "", "External ID of the account to purge")
+	flags.StringVar(&purgeReportKeyStr, "purge-report-key", purgeReportKeyStr, "Key for signing the purge report in the id:secret format")
+	flags.BoolVar(&policy.KeepUsage, "keep-usage", false, "Keep usage of the account")
+	flags.BoolVar(&policy.KeepAuditLog, "keep-audit-log", false, "Keep audit log of the account")
+	flags.Parse(args)
+
+	if account == "" {
+		log.Printf("Missing account")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	purgeReportKey, err := priv.ParsePurgeReportKey(purgeReportKeyStr)
+	if err != nil {
+		log.Fatalf("Invalid purge report key: %v", err)
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatalf("Unable to connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	service := priv.NewService(db)
+	service.PurgeReportKey = purgeReportKey
+	addShards(service, shardURLsStr)
+
+	log.Printf("Purging account %s", account)
+	purge, err := service.PurgeAccount(account, policy)
+	if err != nil {
+		log.Fatalf("Failed to purge account %s: %v", account, err)
+	}
+	fmt.Println(string(purge.Report))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"github.com/acoustid/priv"
+	"log"
+	"os"
+)
+
+// runReindex rebuilds the index of a catalog with new parameters.
+func runReindex(args []string) {
+	databaseURL, err := priv.ParseDatabaseEnv(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var shardURLsStr string
+	var catalogID int
+	params := priv.DefaultIndexParams
+
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	flags.StringVar(&databaseURL, "db", databaseURL, "PostgreSQL URL")
+	flags.StringVar(&shardURLsStr, "db-shard", shardFlag(), shardFlagUsage)
+	flags.IntVar(&catalogID, "catalog-id", 0, "ID of the catalog to reindex")
+	flags.IntVar(&params.QueryBits, "query-bits", params.QueryBits, "number of indexed bits of each hash")
+	flags.IntVar(&params.Segments, "segments", params.Segments, "number of index segments")
+	flags.IntVar(&params.ValuesPerSegment, "values-per-segment", params.ValuesPerSegment, "number of hashes in each index segment")
+	flags.Parse(args)
+
+	if catalogID == 0 {
+		log.Printf("Missing catalog ID")
+		flags.Usage()
+		os.Exit(2)
+	}
+	err = params.Validate()
+	if err != nil {
+		log.Print(err)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatalf("Unable to connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	service := priv.NewService(db)
+	addShards(service, shardURLsStr)
+
+	log.Printf("Reindexing catalog_id=%v with parameters %+v", catalogID, params)
+	err = service.ReindexCatalog(catalogID, params)
+	if err != nil {
+		log.Fatalf("Failed to reindex catalog_id=%v: %v", catalogID, err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/acoustid/priv"
+	"log"
+	"sort"
+	"strings"
+)
+
+// shardFlag returns the configured shard databases in the format accepted by priv.ParseShardDatabaseURLs.
+func shardFlag() string {
+	shardURLs, err := priv.ParseShardDatabaseEnv(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shardIDs := make([]int, 0, len(shardURLs))
+	for shardID := range shardURLs {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Ints(shardIDs)
+	items := make([]string, len(shardIDs))
+	for i, shardID := range shardIDs {
+		items[i] = fmt.Sprintf("%d=%s", shardID, shardURLs[shardID])
+	}
+	return strings.Join(items, ",")
+}
+
+const shardFlagUsage = "Comma-separated list of ID=URL pairs of PostgreSQL databases holding catalog tables"
+
+func addShards(service *priv.ServiceImpl, shardURLsStr string) {
+	shardURLs, err := priv.ParseShardDatabaseURLs(shardURLsStr)
+	if err != nil {
+		log.Fatalf("Error while parsing shard URLs: %v", err)
+	}
+	for shardID, shardURL := range shardURLs {
+		db, err := sql.Open("postgres", shardURL)
+		if err != nil {
+			log.Fatalf("Unable to connect to the shard database: %v", err)
+		}
+		service.AddShard(shardID, db)
+	}
+	if len(shardURLs) > 0 {
+		log.Printf("Using %d shard databases", len(shardURLs))
+	}
+}
@@ -0,0 +1,208 @@
+package priv
+
+import (
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+// ConvertCatalogIndex moves the fingerprint index of an existing catalog to a different index type. The new
+// index is built like when reindexing the catalog, so the catalog stays available during the conversion.
+func (s *ServiceImpl) ConvertCatalogIndex(catalogID int, indexType string) error {
+	if !IsValidIndexType(indexType) {
+		return errors.Errorf("unknown index type %q", indexType)
+	}
+	return s.rebuildIndex(catalogID, indexType, nil)
+}
+
+// startCatalogConversion converts the catalog in the background, the progress can be followed in the catalog stats.
+// The storage layout is converted first, then the index type. Either can be empty, if it shouldn't be changed.
+func (s *ServiceImpl) startCatalogConversion(catalogID int, layout string, indexType string) {
+	go func() {
+		if layout != "" {
+			err := s.ConvertCatalogLayout(catalogID, layout)
+			if err != nil {
+				log.Printf("Failed to convert storage layout of catalog_id=%v to %v: %v", catalogID, layout, err)
+				return
+			}
+		}
+		if indexType != "" {
+			err := s.ConvertCatalogIndex(catalogID, indexType)
+			if err != nil {
+				log.Printf("Failed to convert index of catalog_id=%v to %v: %v", catalogID, indexType, err)
+			}
+		}
+	}()
+}
+
+// ConvertCatalogLayout moves an existing catalog to a different storage layout. Tracks are copied to the new tables
+// while the catalog stays available, only the final catch-up blocks modifications. Progress can be followed
+// in the catalog stats.
+func (s *ServiceImpl) ConvertCatalogLayout(catalogID int, layout string) error {
+	if !IsValidLayout(layout) {
+		return errors.Errorf("unknown storage layout %q", layout)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	// The catalog can't be changed in any other way until the conversion is finished. The row is not locked
+	// with FOR UPDATE, because that would block the progress updates, which reference the catalog.
+	event := &ChangeEvent{Type: ChangeCatalogUpdated, CatalogID: catalogID}
+	var shardID, generation int
+	var oldLayout, indexType string
+	m := &catalogMove{}
+	err = tx.QueryRow("SELECT account_id, name, shard_id, layout, index_type, index_generation, "+indexParamsColumns+" FROM catalog WHERE id = $1 FOR NO KEY UPDATE", catalogID).
+		Scan(append([]interface{}{&event.AccountID, &event.Catalog, &shardID, &oldLayout, &indexType, &generation}, m.params.scanDest()...)...)
+	if err != nil {
+		return errors.WithMessage(err, "failed to get catalog")
+	}
+	if oldLayout == layout {
+		return nil
+	}
+	db, err := s.shardDB(shardID)
+	if err != nil {
+		return err
+	}
+
+	m.src, err = newCatalogTables(oldLayout, catalogID)
+	if err != nil {
+		return err
+	}
+	m.dst, err = newCatalogTables(layout, catalogID)
+	if err != nil {
+		return err
+	}
+	oldIndex, err := newFingerprintIndex(indexType, m.src.index(generation), m.params)
+	if err != nil {
+		return err
+	}
+	m.index, err = newFingerprintIndex(indexType, m.dst.index(generation), m.params)
+	if err != nil {
+		return err
+	}
+	stopValues, err := loadStopList(tx, catalogID)
+	if err != nil {
+		return err
+	}
+	m.stop = newStopList(stopValues)
+
+	started := time.Now()
+
+	var numTracks int
+	err = db.QueryRow("SELECT count(*) FROM " + m.src.from("track", "t")).Scan(&numTracks)
+	if err != nil {
+		return errors.WithMessage(err, "failed to count tracks")
+	}
+
+	err = m.createTables(db)
+	if err != nil {
+		return err
+	}
+	converted := false
+	defer func() {
+		if !converted {
+			err := dropCatalogTables(db, m.dst, m.index)
+			if err != nil {
+				log.Printf("Failed to clean up new tables of catalog_id=%v: %v", catalogID, err)
+			}
+			_, err = s.db.Exec("DELETE FROM catalog_reindex WHERE catalog_id = $1", catalogID)
+			if err != nil {
+				log.Printf("Failed to clean up reindex progress of catalog_id=%v: %v", catalogID, err)
+			}
+		}
+	}()
+
+	err = s.startReindexProgress(catalogID, layout, indexType, m.params, numTracks)
+	if err != nil {
+		return err
+	}
+
+	err = m.copyBatches(db, db, func(numCopied int) error {
+		log.Printf("Converted %d/%d tracks of catalog_id=%v", numCopied, numTracks, catalogID)
+		return s.updateReindexProgress(catalogID, numCopied)
+	})
+	if err != nil {
+		return err
+	}
+
+	lockTx, err := db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer lockTx.Rollback()
+
+	// Wait for running modifications to finish and block new ones until the catalog is moved to the new tables.
+	_, err = lockTx.Exec("SELECT pg_advisory_xact_lock($1, $2)", catalogLockNamespace, catalogID)
+	if err != nil {
+		return errors.WithMessage(err, "failed to lock catalog")
+	}
+
+	shardTx, err := db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer shardTx.Rollback()
+
+	err = m.catchUp(lockTx, shardTx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE catalog SET layout = $1 WHERE id = $2", layout, catalogID)
+	if err != nil {
+		return errors.WithMessage(err, "failed to update catalog")
+	}
+	_, err = tx.Exec("DELETE FROM catalog_reindex WHERE catalog_id = $1", catalogID)
+	if err != nil {
+		return errors.WithMessage(err, "failed to delete reindex progress")
+	}
+
+	err = notifyChange(tx, event)
+	if err != nil {
+		return err
+	}
+
+	err = shardTx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+	converted = true
+	lockTx.Rollback()
+
+	s.handleChange(event)
+	log.Printf("Converted storage layout of catalog_id=%v from %v to %v in %v", catalogID, oldLayout, layout, time.Since(started))
+
+	return dropCatalogTables(db, m.src, oldIndex)
+}
+
+// CatalogIDs returns IDs of all catalogs.
+func (s *ServiceImpl) CatalogIDs() ([]int, error) {
+	rows, err := s.db.Query("SELECT id FROM catalog ORDER BY id")
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch catalogs")
+	}
+	defer rows.Close()
+
+	var catalogIDs []int
+	for rows.Next() {
+		var catalogID int
+		err = rows.Scan(&catalogID)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to fetch catalogs")
+		}
+		catalogIDs = append(catalogIDs, catalogID)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch catalogs")
+	}
+	return catalogIDs, nil
+}
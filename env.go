@@ -6,6 +6,8 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 )
 
 func ParseDatabaseEnv(test bool) (string, error) {
@@ -86,3 +88,81 @@ func ParseDatabaseEnv(test bool) (string, error) {
 
 	return u.String(), nil
 }
+
+// ParseReplicaDatabaseEnv returns URLs of read-only database replicas, which can be specified as
+// a comma-separated list. It returns an empty list if no replicas are configured.
+func ParseReplicaDatabaseEnv(test bool) ([]string, error) {
+	prefix := "ACOUSTID_PRIV"
+	if test {
+		prefix += "_TEST"
+	}
+
+	dbURLs := os.Getenv(prefix + "_DB_REPLICA_URL")
+	if dbURLs == "" {
+		dbURLsFile := os.Getenv(prefix + "_DB_REPLICA_URL_FILE")
+		if dbURLsFile != "" {
+			data, err := ioutil.ReadFile(dbURLsFile)
+			if err != nil {
+				return nil, errors.WithMessage(err, "Unable to read replica URL file")
+			}
+			dbURLs = string(data)
+		}
+	}
+
+	return SplitDatabaseURLs(dbURLs), nil
+}
+
+// SplitDatabaseURLs parses a comma-separated list of database URLs.
+func SplitDatabaseURLs(s string) []string {
+	var urls []string
+	for _, u := range strings.Split(s, ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// ParseShardDatabaseEnv returns URLs of databases holding catalog tables, keyed by shard ID. They can be
+// specified as a comma-separated list of ID=URL pairs. It returns an empty map if no shards are configured.
+func ParseShardDatabaseEnv(test bool) (map[int]string, error) {
+	prefix := "ACOUSTID_PRIV"
+	if test {
+		prefix += "_TEST"
+	}
+
+	dbURLs := os.Getenv(prefix + "_DB_SHARD_URL")
+	if dbURLs == "" {
+		dbURLsFile := os.Getenv(prefix + "_DB_SHARD_URL_FILE")
+		if dbURLsFile != "" {
+			data, err := ioutil.ReadFile(dbURLsFile)
+			if err != nil {
+				return nil, errors.WithMessage(err, "Unable to read shard URL file")
+			}
+			dbURLs = string(data)
+		}
+	}
+
+	return ParseShardDatabaseURLs(dbURLs)
+}
+
+// ParseShardDatabaseURLs parses a comma-separated list of ID=URL pairs.
+func ParseShardDatabaseURLs(s string) (map[int]string, error) {
+	urls := make(map[int]string)
+	for _, item := range SplitDatabaseURLs(s) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("missing shard ID in %q", item)
+		}
+		shardID, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || shardID <= 0 {
+			return nil, errors.Errorf("invalid shard ID in %q", item)
+		}
+		if _, exists := urls[shardID]; exists {
+			return nil, errors.Errorf("duplicate shard ID %d", shardID)
+		}
+		urls[shardID] = strings.TrimSpace(parts[1])
+	}
+	return urls, nil
+}
@@ -0,0 +1,29 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSplitDatabaseURLs(t *testing.T) {
+	assert.Empty(t, SplitDatabaseURLs(""))
+	assert.Equal(t, []string{"postgresql://db1/x"}, SplitDatabaseURLs("postgresql://db1/x"))
+	assert.Equal(t, []string{"postgresql://db1/x", "postgresql://db2/x"}, SplitDatabaseURLs(" postgresql://db1/x, postgresql://db2/x,"))
+}
+
+func TestParseShardDatabaseURLs(t *testing.T) {
+	urls, err := ParseShardDatabaseURLs("")
+	assert.NoError(t, err)
+	assert.Empty(t, urls)
+
+	urls, err = ParseShardDatabaseURLs(" 1=postgresql://db1/x, 2=postgresql://db2/x?sslmode=disable,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]string{1: "postgresql://db1/x", 2: "postgresql://db2/x?sslmode=disable"}, urls)
+
+	_, err = ParseShardDatabaseURLs("postgresql://db1/x")
+	assert.Error(t, err)
+	_, err = ParseShardDatabaseURLs("0=postgresql://db1/x")
+	assert.Error(t, err)
+	_, err = ParseShardDatabaseURLs("1=postgresql://db1/x,1=postgresql://db2/x")
+	assert.Error(t, err)
+}
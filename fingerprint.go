@@ -2,10 +2,30 @@ package priv
 
 import (
 	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/pkg/errors"
+	"time"
 )
 
 const NumQueryBits = 26
 
+// ErrFingerprintVersionNotAllowed is returned when adding a track with a fingerprint version the catalog doesn't accept.
+var ErrFingerprintVersionNotAllowed = errors.New("fingerprint version not allowed")
+
+// IsValidFingerprintVersion returns true if fingerprints generated by the algorithm version can be matched.
+func IsValidFingerprintVersion(version int) bool {
+	_, exists := chromaprint.FingerprintConfigs[version]
+	return exists
+}
+
+// FingerprintDuration returns the duration of audio the fingerprint was generated from, derived from the number of hashes.
+func FingerprintDuration(fp *chromaprint.Fingerprint) time.Duration {
+	config, exists := chromaprint.FingerprintConfigs[fp.Version]
+	if !exists {
+		return 0
+	}
+	return config.Duration(len(fp.Hashes))
+}
+
 func hashBitMask(nbits int) uint32 {
 	var mask uint32 = 0xaaaaaaaa
 	if nbits <= 16 {
@@ -16,11 +36,26 @@ func hashBitMask(nbits int) uint32 {
 	return mask
 }
 
+// ExtractQuery returns the indexed part of the fingerprint hashes, with the default index parameters.
 func ExtractQuery(fp *chromaprint.Fingerprint) []int32 {
-	mask := hashBitMask(NumQueryBits)
-	query := make([]int32, len(fp.Hashes))
-	for i := 0; i < len(fp.Hashes); i++ {
-		query[i] = int32(fp.Hashes[i] & mask)
+	return DefaultIndexParams.extractQuery(fp)
+}
+
+// MaxProbes is the maximum number of variants of each hash that can be searched for in multi-probe mode.
+const MaxProbes = 8
+
+// probeBits lists the query bits ordered by how often they differ between a clean recording
+// and a noisy radio capture of the same audio, least reliable first.
+var probeBits = [MaxProbes]uint{10, 12, 2, 5, 14, 4, 16, 17}
+
+// probeValues returns variants of the query value with one of the least reliable bits flipped.
+func probeValues(value int32, probes int) []int32 {
+	if probes > MaxProbes {
+		probes = MaxProbes
+	}
+	values := make([]int32, probes)
+	for i := 0; i < probes; i++ {
+		values[i] = value ^ int32(1<<probeBits[i])
 	}
-	return query
+	return values
 }
@@ -4,15 +4,50 @@ import (
 	"io/ioutil"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/acoustid/go-acoustid/chromaprint"
 	"github.com/stretchr/testify/require"
 )
 
-func loadTestFingerprint(t *testing.T, name string) *chromaprint.Fingerprint {
+func loadTestFingerprint(t testing.TB, name string) *chromaprint.Fingerprint {
 	data, err := ioutil.ReadFile(path.Join("test_data", name+".txt"))
 	require.NoError(t, err)
 	fp, err := chromaprint.ParseFingerprintString(string(data))
 	require.NoError(t, err)
 	return fp
 }
+
+func TestProbeValues(t *testing.T) {
+	values := probeValues(0, 2)
+	require.Equal(t, []int32{1 << 10, 1 << 12}, values)
+	mask := int32(hashBitMask(NumQueryBits))
+	for _, value := range probeValues(0, MaxProbes+1) {
+		require.Equal(t, value, value&mask, "probe flips a bit outside of the query mask")
+	}
+	require.Len(t, probeValues(0, MaxProbes+1), MaxProbes)
+}
+
+func TestIsValidFingerprintVersion(t *testing.T) {
+	require.True(t, IsValidFingerprintVersion(1))
+	require.False(t, IsValidFingerprintVersion(0))
+	require.False(t, IsValidFingerprintVersion(99))
+}
+
+func TestCatalogSettings_AllowsFingerprintVersion(t *testing.T) {
+	settings := &CatalogSettings{}
+	require.True(t, settings.AllowsFingerprintVersion(1))
+	require.False(t, settings.AllowsFingerprintVersion(99))
+
+	settings.FingerprintVersions = []int{2}
+	require.False(t, settings.AllowsFingerprintVersion(1))
+	settings.FingerprintVersions = []int{1, 2}
+	require.True(t, settings.AllowsFingerprintVersion(1))
+}
+
+func TestFingerprintDuration(t *testing.T) {
+	fp := &chromaprint.Fingerprint{Version: 1, Hashes: make([]uint32, 100)}
+	require.Equal(t, 14980990*time.Microsecond, FingerprintDuration(fp))
+	fp.Version = 99
+	require.Equal(t, time.Duration(0), FingerprintDuration(fp))
+}
@@ -0,0 +1,134 @@
+package priv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type htpasswdUser struct {
+	hash    []byte
+	account string
+}
+
+func (u *htpasswdUser) principal(username string) *Principal {
+	principal := NewPrincipal(u.account)
+	principal.Credential = "user:" + username
+	return principal
+}
+
+// HtpasswdAuth checks passwords of users listed in an htpasswd file. Only bcrypt
+// hashes are supported (htpasswd -B). Each user has its own account, the account's
+// external ID can be added as a third field (user:hash:account), otherwise the
+// username is used.
+type HtpasswdAuth struct {
+	Path  string
+	Cache Cache
+	mu    sync.RWMutex
+	users map[string]htpasswdUser
+}
+
+// LoadHtpasswdAuth reads the users from the htpasswd file.
+func LoadHtpasswdAuth(path string) (*HtpasswdAuth, error) {
+	auth := &HtpasswdAuth{}
+	auth.Path = path
+	err := auth.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// Reload reads the users from the htpasswd file again. The current users are kept
+// if the file can't be read.
+func (a *HtpasswdAuth) Reload() error {
+	data, err := ioutil.ReadFile(a.Path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("failed to parse htpasswd file %s", a.Path))
+	}
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+func parseHtpasswd(data []byte) (map[string]htpasswdUser, error) {
+	users := make(map[string]htpasswdUser)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid entry on line %d", lineNo)
+		}
+		username, hash := parts[0], parts[1]
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("user %s on line %d does not have a bcrypt password hash", username, lineNo)
+		}
+		account := username
+		if len(parts) == 3 && parts[2] != "" {
+			account = parts[2]
+		}
+		users[username] = htpasswdUser{hash: []byte(hash), account: account}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (a *HtpasswdAuth) Authenticate(r *http.Request) (principal *Principal, err error) {
+	username, password := ParseBasicAuth(r)
+	if username == "" {
+		return nil, ErrNotAuthorized
+	}
+
+	a.mu.RLock()
+	user, found := a.users[username]
+	a.mu.RUnlock()
+	if !found {
+		return nil, ErrNotAuthorized
+	}
+
+	// Checking bcrypt hashes is intentionally slow, so successful checks are cached.
+	// The key includes the stored hash, so changed passwords are not accepted from
+	// the cache after a reload.
+	checkHash := sha256.Sum256([]byte(string(user.hash) + ":" + password))
+	cacheKey := fmt.Sprintf("htpasswd:%s:%s", username, hex.EncodeToString(checkHash[:]))
+	if a.Cache != nil {
+		_, found := a.Cache.Get(cacheKey)
+		if found {
+			return user.principal(username), nil
+		}
+	}
+
+	err = bcrypt.CompareHashAndPassword(user.hash, []byte(password))
+	if err != nil {
+		return nil, ErrNotAuthorized
+	}
+
+	if a.Cache != nil {
+		a.Cache.Set(cacheKey, true, time.Minute)
+	}
+	return user.principal(username), nil
+}
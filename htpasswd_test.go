@@ -0,0 +1,108 @@
+package priv
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func makeTestHtpasswdEntry(t *testing.T, username string, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return fmt.Sprintf("%s:%s", username, hash)
+}
+
+func writeTestHtpasswdFile(t *testing.T, path string, lines ...string) {
+	content := ""
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	require.NoError(t, err)
+}
+
+func authenticateTestHtpasswd(t *testing.T, auth *HtpasswdAuth, username string, password string) (*Principal, error) {
+	r := makeTestRequest(t)
+	r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	return auth.Authenticate(r)
+}
+
+func TestHtpasswdAuth_Authenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	writeTestHtpasswdFile(t, path,
+		"# comment",
+		makeTestHtpasswdEntry(t, "alice", "secret1"),
+		makeTestHtpasswdEntry(t, "bob", "secret2")+":acc2",
+	)
+
+	auth, err := LoadHtpasswdAuth(path)
+	require.NoError(t, err)
+	auth.Cache = cache.New(time.Minute, time.Minute)
+
+	principal, err := authenticateTestHtpasswd(t, auth, "alice", "secret1")
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Account: "alice", Credential: "user:alice"}, principal)
+
+	principal, err = authenticateTestHtpasswd(t, auth, "bob", "secret2")
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Account: "acc2", Credential: "user:bob"}, principal)
+
+	principal, err = authenticateTestHtpasswd(t, auth, "alice", "secret2")
+	assert.Equal(t, ErrNotAuthorized, err)
+	assert.Nil(t, principal)
+
+	principal, err = authenticateTestHtpasswd(t, auth, "carol", "secret1")
+	assert.Equal(t, ErrNotAuthorized, err)
+	assert.Nil(t, principal)
+}
+
+func TestHtpasswdAuth_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	writeTestHtpasswdFile(t, path, makeTestHtpasswdEntry(t, "alice", "secret1"))
+
+	auth, err := LoadHtpasswdAuth(path)
+	require.NoError(t, err)
+	auth.Cache = cache.New(time.Minute, time.Minute)
+
+	_, err = authenticateTestHtpasswd(t, auth, "alice", "secret1")
+	require.NoError(t, err)
+
+	writeTestHtpasswdFile(t, path, makeTestHtpasswdEntry(t, "alice", "secret3"))
+	require.NoError(t, auth.Reload())
+
+	_, err = authenticateTestHtpasswd(t, auth, "alice", "secret1")
+	assert.Equal(t, ErrNotAuthorized, err)
+	_, err = authenticateTestHtpasswd(t, auth, "alice", "secret3")
+	assert.NoError(t, err)
+
+	writeTestHtpasswdFile(t, path, "alice:plaintext")
+	assert.Error(t, auth.Reload())
+
+	_, err = authenticateTestHtpasswd(t, auth, "alice", "secret3")
+	assert.NoError(t, err, "users should be kept after a failed reload")
+}
+
+func TestParseHtpasswd_Invalid(t *testing.T) {
+	_, err := parseHtpasswd([]byte("alice\n"))
+	assert.Error(t, err)
+	_, err = parseHtpasswd([]byte("alice:$apr1$xxx$yyy\n"))
+	assert.Error(t, err)
+	_, err = parseHtpasswd([]byte(":$2y$05$xxx\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,54 @@
+package priv
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+)
+
+const (
+	// IndexTypeGIN stores values of each track segment in an array, indexed by a GIN index.
+	IndexTypeGIN = "gin"
+	// IndexTypeBTree stores one row per value, indexed by a B-tree index.
+	IndexTypeBTree = "btree"
+)
+
+const DefaultIndexType = IndexTypeGIN
+
+var IndexTypes = []string{IndexTypeGIN, IndexTypeBTree}
+
+func IsValidIndexType(indexType string) bool {
+	for _, t := range IndexTypes {
+		if t == indexType {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprintIndex is the database layout used to find candidate tracks for a query.
+type fingerprintIndex interface {
+	createTables(tx *sql.Tx) error
+	dropTables(tx *sql.Tx) error
+
+	// insertTrack indexes the values of the track, except for values on the stop list.
+	insertTrack(tx *sql.Tx, trackID int, values []int32, stop stopList) error
+	deleteTrack(tx *sql.Tx, trackID int) error
+
+	// valuesQuery returns a query listing all indexed values, with track_id, value and position columns.
+	valuesQuery() string
+	// insertValues indexes the values returned by a query with track_id, value and position columns.
+	insertValues(tx *sql.Tx, query string) error
+
+	// search returns the number of hits of tracks in the partition, all tracks if the partition is nil.
+	search(db *sql.DB, segmentHashes [][]queryHash, partition *Partition) (map[int]int, error)
+}
+
+func newFingerprintIndex(indexType string, tables indexTables, params IndexParams) (fingerprintIndex, error) {
+	switch indexType {
+	case IndexTypeGIN, "":
+		return &ginIndex{tables, params}, nil
+	case IndexTypeBTree:
+		return &btreeIndex{tables, params}, nil
+	}
+	return nil, errors.Errorf("unknown index type %q", indexType)
+}
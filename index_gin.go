@@ -0,0 +1,184 @@
+package priv
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+)
+
+// ginIndex splits each track into segments of IndexParams.ValuesPerSegment values, which are stored
+// as arrays in one table per segment, or in one shared table with the partitioned layout. Query values are matched using GIN indexes.
+type ginIndex struct {
+	tables indexTables
+	params IndexParams
+}
+
+// numTables returns the number of tables the segments are spread over. Shared tables hold all segments.
+func (idx *ginIndex) numTables() int {
+	if idx.tables.partitioned {
+		return 1
+	}
+	return idx.params.Segments
+}
+
+// segmentFrom returns a table expression with the catalog's rows for the segment table.
+func (idx *ginIndex) segmentFrom(segment int) string {
+	if idx.tables.partitioned {
+		return fmt.Sprintf("(SELECT * FROM track_index WHERE %ssegment %% %d = %d) i", idx.tables.where(), idx.params.Segments, segment)
+	}
+	return idx.tables.from("track_index", "i", segment)
+}
+
+func (idx *ginIndex) createTables(tx *sql.Tx) error {
+	for i := 0; i < idx.numTables(); i++ {
+		err := idx.tables.createTable(tx, "track_index", i)
+		if err != nil {
+			return errors.WithMessage(err, "failed to create track index table")
+		}
+	}
+	return nil
+}
+
+func (idx *ginIndex) dropTables(tx *sql.Tx) error {
+	for i := 0; i < idx.numTables(); i++ {
+		err := idx.tables.dropTable(tx, "track_index", i)
+		if err != nil {
+			return errors.WithMessage(err, "failed to drop track index table")
+		}
+	}
+	return nil
+}
+
+func (idx *ginIndex) insertTrack(tx *sql.Tx, trackID int, values []int32, stop stopList) error {
+	segment := 0
+	for i := 0; i < len(values); i += idx.params.ValuesPerSegment {
+		n := idx.params.ValuesPerSegment
+		if len(values)-i < n {
+			n = len(values) - i
+		}
+		segmentValues := make([]int32, 0, n)
+		segmentPositions := make([]int32, 0, n)
+		for j := i; j < i+n; j++ {
+			if !stop[values[j]] {
+				segmentValues = append(segmentValues, values[j])
+				segmentPositions = append(segmentPositions, int32(j))
+			}
+		}
+		if len(segmentValues) > 0 {
+			query := fmt.Sprintf("INSERT INTO %s (%strack_id, segment, values, positions) VALUES (%s$1, $2, $3, $4)",
+				idx.tables.name("track_index", segment%idx.params.Segments), idx.tables.insertColumns(), idx.tables.insertValues())
+			_, err := tx.Exec(query, trackID, segment, pq.Array(segmentValues), pq.Array(segmentPositions))
+			if err != nil {
+				return errors.WithMessage(err, "failed to insert track index")
+			}
+		}
+		segment += 1
+	}
+	return nil
+}
+
+func (idx *ginIndex) deleteTrack(tx *sql.Tx, trackID int) error {
+	for i := 0; i < idx.numTables(); i++ {
+		query := fmt.Sprintf("DELETE FROM %s WHERE %strack_id = $1", idx.tables.name("track_index", i), idx.tables.where())
+		_, err := tx.Exec(query, trackID)
+		if err != nil {
+			return errors.WithMessage(err, "failed to delete track index")
+		}
+	}
+	return nil
+}
+
+func (idx *ginIndex) valuesQuery() string {
+	queries := make([]string, idx.numTables())
+	for i := range queries {
+		queries[i] = fmt.Sprintf("SELECT i.track_id, u.value, coalesce(u.position, i.segment * %d + u.n - 1) AS position "+
+			"FROM %s, unnest(i.values, i.positions) WITH ORDINALITY AS u(value, position, n)", idx.params.ValuesPerSegment, idx.tables.from("track_index", "i", i))
+	}
+	return strings.Join(queries, " UNION ALL ")
+}
+
+func (idx *ginIndex) insertValues(tx *sql.Tx, query string) error {
+	for i := 0; i < idx.numTables(); i++ {
+		filter := "true"
+		if !idx.tables.partitioned {
+			filter = fmt.Sprintf("position / %d %% %d = %d", idx.params.ValuesPerSegment, idx.params.Segments, i)
+		}
+		insertQuery := fmt.Sprintf("INSERT INTO %s (%strack_id, segment, values, positions) "+
+			"SELECT %strack_id, position / %d, array_agg(value ORDER BY position), array_agg(position ORDER BY position) "+
+			"FROM (%s) v WHERE %s GROUP BY track_id, position / %d",
+			idx.tables.name("track_index", i), idx.tables.insertColumns(), idx.tables.insertValues(), idx.params.ValuesPerSegment, query, filter, idx.params.ValuesPerSegment)
+		_, err := tx.Exec(insertQuery)
+		if err != nil {
+			return errors.WithMessage(err, "failed to insert track index")
+		}
+	}
+	return nil
+}
+
+func (idx *ginIndex) searchSegment(db *sql.DB, values []int32, segment int, partition *Partition) ([]indexHit, error) {
+	queryTpl := "SELECT i.track_id, u.value, coalesce(u.position, i.segment * %d + u.n - 1) " +
+		"FROM %s, (SELECT $1::int[] AS query) q, " +
+		"unnest(i.values, i.positions) WITH ORDINALITY AS u(value, position, n) " +
+		"WHERE i.values && q.query AND u.value = any(q.query)%s"
+	query := fmt.Sprintf(queryTpl, idx.params.ValuesPerSegment, idx.segmentFrom(segment%idx.params.Segments), partition.condition("i.track_id"))
+	rows, err := db.Query(query, pq.Array(values))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []indexHit
+	for rows.Next() {
+		var hit indexHit
+		err = rows.Scan(&hit.TrackID, &hit.Value, &hit.Position)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, hit)
+	}
+
+	return hits, rows.Err()
+}
+
+func (idx *ginIndex) search(db *sql.DB, segmentHashes [][]queryHash, partition *Partition) (map[int]int, error) {
+	segmentHits := make([][]indexHit, len(segmentHashes))
+	segmentErrs := make([]error, len(segmentHashes))
+	segmentPositions := make([]map[int32][]int, len(segmentHashes))
+
+	for segment, hashes := range segmentHashes {
+		segmentPositions[segment] = queryPositions(hashes)
+	}
+
+	var wg sync.WaitGroup
+	for chunk := 0; chunk < SearchConcurrency; chunk++ {
+		wg.Add(1)
+		go func(chunk int) {
+			defer wg.Done()
+			for segment := range segmentHashes {
+				if segment%SearchConcurrency == chunk {
+					positions := segmentPositions[segment]
+					if len(positions) != 0 {
+						hits, err := idx.searchSegment(db, distinctQueryValues(positions), segment, partition)
+						segmentHits[segment] = hits
+						segmentErrs[segment] = err
+					}
+				}
+			}
+		}(chunk)
+	}
+	wg.Wait()
+
+	votes := make(offsetVotes)
+	for segment := range segmentHashes {
+		err := segmentErrs[segment]
+		if err != nil {
+			return nil, err
+		}
+		votes.addHits(segmentPositions[segment], segmentHits[segment])
+	}
+
+	return votes.scores(), nil
+}
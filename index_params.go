@@ -0,0 +1,59 @@
+package priv
+
+import (
+	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/pkg/errors"
+)
+
+// MaxIndexSegments is the maximum number of segments, which is also the maximum number of index tables of a catalog.
+const MaxIndexSegments = 64
+
+// IndexParams are the parameters a catalog's index was built with. They can only be changed by reindexing the catalog.
+type IndexParams struct {
+	// QueryBits is the number of bits of each fingerprint hash that are indexed.
+	QueryBits int
+	// Segments is the number of index segments the beginning of each track is split into.
+	Segments int
+	// ValuesPerSegment is the number of hashes in each index segment.
+	ValuesPerSegment int
+}
+
+var DefaultIndexParams = IndexParams{QueryBits: NumQueryBits, Segments: NumIndexSegments, ValuesPerSegment: ValuesPerSegment}
+
+// indexParamsColumns lists columns of the catalog table matching IndexParams.scanDest.
+const indexParamsColumns = "index_query_bits, index_segments, index_values_per_segment"
+
+func (p *IndexParams) scanDest() []interface{} {
+	return []interface{}{&p.QueryBits, &p.Segments, &p.ValuesPerSegment}
+}
+
+func (p IndexParams) Validate() error {
+	if p.QueryBits < 1 || p.QueryBits > 32 {
+		return errors.Errorf("number of query bits must be between 1 and 32, got %d", p.QueryBits)
+	}
+	if p.Segments < 1 || p.Segments > MaxIndexSegments {
+		return errors.Errorf("number of index segments must be between 1 and %d, got %d", MaxIndexSegments, p.Segments)
+	}
+	if p.ValuesPerSegment < 1 {
+		return errors.Errorf("number of values per segment must be positive, got %d", p.ValuesPerSegment)
+	}
+	return nil
+}
+
+func (p IndexParams) queryMask() uint32 {
+	return hashBitMask(p.QueryBits)
+}
+
+func (p IndexParams) extractQuery(fp *chromaprint.Fingerprint) []int32 {
+	mask := p.queryMask()
+	query := make([]int32, len(fp.Hashes))
+	for i := 0; i < len(fp.Hashes); i++ {
+		query[i] = int32(fp.Hashes[i] & mask)
+	}
+	return query
+}
+
+// segment returns the index segment holding the value at the position in a track.
+func (p IndexParams) segment(position int) int {
+	return (position / p.ValuesPerSegment) % p.Segments
+}
@@ -0,0 +1,42 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIndexParams_Validate(t *testing.T) {
+	assert.NoError(t, DefaultIndexParams.Validate())
+	assert.NoError(t, IndexParams{QueryBits: 32, Segments: MaxIndexSegments, ValuesPerSegment: 1}.Validate())
+	assert.Error(t, IndexParams{QueryBits: 0, Segments: 16, ValuesPerSegment: 128}.Validate())
+	assert.Error(t, IndexParams{QueryBits: 33, Segments: 16, ValuesPerSegment: 128}.Validate())
+	assert.Error(t, IndexParams{QueryBits: 26, Segments: 0, ValuesPerSegment: 128}.Validate())
+	assert.Error(t, IndexParams{QueryBits: 26, Segments: MaxIndexSegments + 1, ValuesPerSegment: 128}.Validate())
+	assert.Error(t, IndexParams{QueryBits: 26, Segments: 16, ValuesPerSegment: 0}.Validate())
+}
+
+func TestIndexParams_Segment(t *testing.T) {
+	params := IndexParams{QueryBits: 26, Segments: 4, ValuesPerSegment: 10}
+	assert.Equal(t, 0, params.segment(0))
+	assert.Equal(t, 0, params.segment(9))
+	assert.Equal(t, 1, params.segment(10))
+	assert.Equal(t, 3, params.segment(39))
+	assert.Equal(t, 0, params.segment(40))
+}
+
+func TestIndexParams_ExtractQuery(t *testing.T) {
+	fp := loadTestFingerprint(t, "calibre_sunrise")
+	query := IndexParams{QueryBits: 20, Segments: 16, ValuesPerSegment: 128}.extractQuery(fp)
+	assert.Len(t, query, len(fp.Hashes))
+	for i, value := range query {
+		assert.Equal(t, int32(fp.Hashes[i]&hashBitMask(20)), value)
+	}
+}
+
+func TestIndexParams_SegmentQueries(t *testing.T) {
+	params := IndexParams{QueryBits: 26, Segments: 2, ValuesPerSegment: 2}
+	segmentHashes := params.segmentQueries([]int32{1, 2, 3, 4, 5}, false)
+	assert.Len(t, segmentHashes, 2)
+	assert.Equal(t, []queryHash{{1, 0}, {2, 1}}, segmentHashes[0])
+	assert.Equal(t, []queryHash{{3, 2}, {4, 3}}, segmentHashes[1])
+}
@@ -0,0 +1,20 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewFingerprintIndex(t *testing.T) {
+	idx, err := newFingerprintIndex(IndexTypeGIN, catalogTables{catalogID: 1}.index(0), DefaultIndexParams)
+	assert.NoError(t, err)
+	assert.IsType(t, &ginIndex{}, idx)
+
+	idx, err = newFingerprintIndex(IndexTypeBTree, catalogTables{catalogID: 1}.index(0), DefaultIndexParams)
+	assert.NoError(t, err)
+	assert.IsType(t, &btreeIndex{}, idx)
+
+	_, err = newFingerprintIndex("hash", catalogTables{catalogID: 1}.index(0), DefaultIndexParams)
+	assert.Error(t, err)
+	assert.False(t, IsValidIndexType("hash"))
+}
@@ -0,0 +1,316 @@
+package priv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultJWTLeeway is the allowed clock skew when checking the time claims of a token.
+const DefaultJWTLeeway = time.Second * 30
+
+// JWKS is a set of public keys used for verifying signatures of tokens.
+type JWKS struct {
+	keys []jwk
+}
+
+type jwk struct {
+	id  string
+	key crypto.PublicKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads a key set from a JWKS file.
+func LoadJWKS(path string) (*JWKS, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("failed to parse JWKS file %s", path))
+	}
+	return keys, nil
+}
+
+// ParseJWKS parses a key set in the JWKS format. Only RSA, P-256 EC and Ed25519 keys are supported.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	keys := &JWKS{}
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("invalid key %d", i))
+		}
+		keys.keys = append(keys.keys, jwk{id: k.Kid, key: key})
+	}
+	if len(keys.keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+func encodeBase64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(k.N)
+		if err != nil || len(n) == 0 {
+			return nil, errors.New("invalid RSA modulus")
+		}
+		e, err := decodeBase64URL(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBase64URL(k.X)
+		if err != nil {
+			return nil, errors.New("invalid EC point")
+		}
+		y, err := decodeBase64URL(k.Y)
+		if err != nil {
+			return nil, errors.New("invalid EC point")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBase64URL(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verify checks the signature with the keys that match the key ID and the algorithm.
+func (s *JWKS) verify(alg string, kid string, signingInput []byte, signature []byte) bool {
+	for _, k := range s.keys {
+		if kid != "" && k.id != "" && k.id != kid {
+			continue
+		}
+		if verifyJWTSignature(alg, k.key, signingInput, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput []byte, signature []byte) bool {
+	switch alg {
+	case "RS256":
+		key, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		hash := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case "ES256":
+		key, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		hash := sha256.Sum256(signingInput)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, hash[:], r, s)
+	case "EdDSA":
+		key, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(key, signingInput, signature)
+	}
+	return false
+}
+
+// JWTAuth accepts bearer tokens signed by a trusted identity provider.
+type JWTAuth struct {
+	Keys         *JWKS
+	Issuer       string // required "iss" claim, not checked if empty
+	Audience     string // required "aud" claim, not checked if empty
+	AccountClaim string // claim with the account's external ID
+	Leeway       time.Duration
+	now          func() time.Time
+}
+
+func NewJWTAuth(keys *JWKS) *JWTAuth {
+	auth := &JWTAuth{}
+	auth.Keys = keys
+	auth.AccountClaim = "sub"
+	auth.Leeway = DefaultJWTLeeway
+	auth.now = time.Now
+	return auth
+}
+
+func (a *JWTAuth) Authenticate(r *http.Request) (principal *Principal, err error) {
+	header := r.Header.Get("Authorization")
+	headerParts := strings.SplitN(header, " ", 2)
+	if strings.ToLower(headerParts[0]) != "bearer" || len(headerParts) != 2 {
+		return nil, ErrNotAuthorized
+	}
+	claims, err := a.parseToken(strings.TrimSpace(headerParts[1]))
+	if err != nil {
+		return nil, errors.WithMessage(ErrNotAuthorized, err.Error())
+	}
+	account, err := a.account(claims)
+	if err != nil {
+		return nil, errors.WithMessage(ErrNotAuthorized, err.Error())
+	}
+	return NewPrincipal(account), nil
+}
+
+// parseToken verifies the token's signature and claims and returns the claims.
+// Tokens without an expiration time are not accepted.
+func (a *JWTAuth) parseToken(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerData, err := decodeBase64URL(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerData, &header)
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+
+	signature, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	if !a.Keys.verify(header.Alg, header.Kid, signingInput, signature) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claimsData, err := decodeBase64URL(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(claimsData))
+	decoder.UseNumber()
+	err = decoder.Decode(&claims)
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+
+	now := a.now()
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, errors.New("missing or invalid exp claim")
+	}
+	if !now.Before(exp.Add(a.Leeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		t, ok := numericDate(nbf)
+		if !ok {
+			return nil, errors.New("invalid nbf claim")
+		}
+		if now.Add(a.Leeway).Before(t) {
+			return nil, errors.New("token is not valid yet")
+		}
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, errors.New("invalid token issuer")
+	}
+	if a.Audience != "" && !hasAudience(claims["aud"], a.Audience) {
+		return nil, errors.New("invalid token audience")
+	}
+	return claims, nil
+}
+
+func (a *JWTAuth) account(claims map[string]interface{}) (string, error) {
+	switch value := claims[a.AccountClaim].(type) {
+	case string:
+		if value != "" {
+			return value, nil
+		}
+	case json.Number:
+		return value.String(), nil
+	}
+	return "", fmt.Errorf("missing %s claim", a.AccountClaim)
+}
+
+func numericDate(value interface{}) (time.Time, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, 0).Add(secondsToDuration(seconds)), true
+}
+
+func hasAudience(value interface{}, audience string) bool {
+	switch value := value.(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, v := range value {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package priv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testJWTKey struct {
+	alg  string
+	kid  string
+	key  crypto.Signer
+	json map[string]string
+}
+
+func generateTestJWTKeys(t *testing.T) []*testJWTKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	return []*testJWTKey{
+		{alg: "RS256", kid: "rsa1", key: rsaKey, json: map[string]string{
+			"kty": "RSA", "kid": "rsa1",
+			"n": encodeBase64URL(rsaKey.N.Bytes()),
+			"e": encodeBase64URL(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}},
+		{alg: "ES256", kid: "ec1", key: ecKey, json: map[string]string{
+			"kty": "EC", "kid": "ec1", "crv": "P-256",
+			"x": encodeBase64URL(ecKey.X.FillBytes(make([]byte, 32))),
+			"y": encodeBase64URL(ecKey.Y.FillBytes(make([]byte, 32))),
+		}},
+		{alg: "EdDSA", kid: "ed1", key: edKey, json: map[string]string{
+			"kty": "OKP", "kid": "ed1", "crv": "Ed25519",
+			"x": encodeBase64URL(edPublicKey),
+		}},
+	}
+}
+
+func makeTestJWKS(t *testing.T, keys []*testJWTKey) *JWKS {
+	var doc struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for _, key := range keys {
+		doc.Keys = append(doc.Keys, key.json)
+	}
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	jwks, err := ParseJWKS(data)
+	require.NoError(t, err)
+	return jwks
+}
+
+func signTestJWT(t *testing.T, key *testJWTKey, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": key.alg, "kid": key.kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signingInput := encodeBase64URL(header) + "." + encodeBase64URL(payload)
+
+	var signature []byte
+	switch k := key.key.(type) {
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256([]byte(signingInput))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256([]byte(signingInput))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, hash[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signingInput))
+	}
+	require.NoError(t, err)
+	return signingInput + "." + encodeBase64URL(signature)
+}
+
+func authenticateTestJWT(t *testing.T, auth *JWTAuth, token string) (*Principal, error) {
+	r := makeTestRequest(t)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return auth.Authenticate(r)
+}
+
+func TestJWTAuth_Authenticate(t *testing.T) {
+	keys := generateTestJWTKeys(t)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	auth := NewJWTAuth(makeTestJWKS(t, keys))
+	auth.Issuer = "https://id.example.com"
+	auth.Audience = "acoustid-priv"
+	auth.now = func() time.Time { return now }
+
+	for _, key := range keys {
+		t.Run(key.alg, func(t *testing.T) {
+			token := signTestJWT(t, key, map[string]interface{}{
+				"sub": "user1",
+				"iss": "https://id.example.com",
+				"aud": []string{"other", "acoustid-priv"},
+				"exp": now.Add(time.Hour).Unix(),
+				"nbf": now.Add(-time.Hour).Unix(),
+			})
+			principal, err := authenticateTestJWT(t, auth, token)
+			require.NoError(t, err)
+			assert.Equal(t, NewPrincipal("user1"), principal)
+		})
+	}
+}
+
+func TestJWTAuth_Authenticate_AccountClaim(t *testing.T) {
+	keys := generateTestJWTKeys(t)
+	auth := NewJWTAuth(makeTestJWKS(t, keys))
+	auth.AccountClaim = "org_id"
+
+	token := signTestJWT(t, keys[2], map[string]interface{}{
+		"sub":    "user1",
+		"org_id": 123,
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	})
+	principal, err := authenticateTestJWT(t, auth, token)
+	require.NoError(t, err)
+	assert.Equal(t, NewPrincipal("123"), principal)
+
+	token = signTestJWT(t, keys[2], map[string]interface{}{
+		"sub": "user1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	_, err = authenticateTestJWT(t, auth, token)
+	assert.Equal(t, ErrNotAuthorized, errors.Cause(err))
+}
+
+func TestJWTAuth_Authenticate_Invalid(t *testing.T) {
+	keys := generateTestJWTKeys(t)
+	otherKeys := generateTestJWTKeys(t)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	auth := NewJWTAuth(makeTestJWKS(t, keys))
+	auth.Issuer = "https://id.example.com"
+	auth.Audience = "acoustid-priv"
+	auth.now = func() time.Time { return now }
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub": "user1",
+			"iss": "https://id.example.com",
+			"aud": "acoustid-priv",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+	}
+
+	testCases := map[string]func() string{
+		"UnknownKey": func() string {
+			return signTestJWT(t, otherKeys[0], validClaims())
+		},
+		"WrongKeyType": func() string {
+			key := *keys[1]
+			key.alg = "RS256"
+			key.kid = "rsa1"
+			return signTestJWT(t, &key, validClaims())
+		},
+		"Expired": func() string {
+			claims := validClaims()
+			claims["exp"] = now.Add(-time.Minute).Unix()
+			return signTestJWT(t, keys[0], claims)
+		},
+		"MissingExp": func() string {
+			claims := validClaims()
+			delete(claims, "exp")
+			return signTestJWT(t, keys[0], claims)
+		},
+		"NotYetValid": func() string {
+			claims := validClaims()
+			claims["nbf"] = now.Add(time.Minute).Unix()
+			return signTestJWT(t, keys[0], claims)
+		},
+		"WrongIssuer": func() string {
+			claims := validClaims()
+			claims["iss"] = "https://evil.example.com"
+			return signTestJWT(t, keys[0], claims)
+		},
+		"WrongAudience": func() string {
+			claims := validClaims()
+			claims["aud"] = []string{"other"}
+			return signTestJWT(t, keys[0], claims)
+		},
+		"Tampered": func() string {
+			parts := strings.Split(signTestJWT(t, keys[0], validClaims()), ".")
+			claims := validClaims()
+			claims["sub"] = "user2"
+			payload, err := json.Marshal(claims)
+			require.NoError(t, err)
+			return parts[0] + "." + encodeBase64URL(payload) + "." + parts[2]
+		},
+		"Malformed": func() string {
+			return "xxx"
+		},
+	}
+	for name, makeToken := range testCases {
+		t.Run(name, func(t *testing.T) {
+			principal, err := authenticateTestJWT(t, auth, makeToken())
+			assert.Equal(t, ErrNotAuthorized, errors.Cause(err))
+			assert.Nil(t, principal)
+		})
+	}
+}
+
+func TestJWTAuth_Authenticate_NoToken(t *testing.T) {
+	auth := NewJWTAuth(makeTestJWKS(t, generateTestJWTKeys(t)))
+	r := makeTestRequest(t)
+	r.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	principal, err := auth.Authenticate(r)
+	assert.Equal(t, ErrNotAuthorized, err)
+	assert.Nil(t, principal)
+}
+
+func TestParseJWKS_Invalid(t *testing.T) {
+	_, err := ParseJWKS([]byte(`{"keys": []}`))
+	assert.Error(t, err)
+	_, err = ParseJWKS([]byte(`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`))
+	assert.Error(t, err)
+	_, err = ParseJWKS([]byte(`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package priv
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+const (
+	// LayoutTablePerCatalog stores each catalog in its own set of tables.
+	LayoutTablePerCatalog = "table_per_catalog"
+	// LayoutPartitioned stores all catalogs in shared tables, hash-partitioned by catalog_id.
+	LayoutPartitioned = "partitioned"
+)
+
+const DefaultLayout = LayoutTablePerCatalog
+
+var Layouts = []string{LayoutTablePerCatalog, LayoutPartitioned}
+
+func IsValidLayout(layout string) bool {
+	for _, l := range Layouts {
+		if l == layout {
+			return true
+		}
+	}
+	return false
+}
+
+// catalogTables maps the tables of a catalog to database tables, according to the catalog's storage layout.
+type catalogTables struct {
+	catalogID   int
+	partitioned bool
+}
+
+func newCatalogTables(layout string, catalogID int) (catalogTables, error) {
+	switch layout {
+	case LayoutTablePerCatalog, "":
+		return catalogTables{catalogID: catalogID}, nil
+	case LayoutPartitioned:
+		return catalogTables{catalogID: catalogID, partitioned: true}, nil
+	}
+	return catalogTables{}, errors.Errorf("unknown storage layout %q", layout)
+}
+
+// name returns the name of the table, e.g. track_1 or track_index_1_2 if the table belongs only to the catalog.
+func (t catalogTables) name(table string, suffix ...int) string {
+	if t.partitioned {
+		return table
+	}
+	name := fmt.Sprintf("%s_%d", table, t.catalogID)
+	for _, s := range suffix {
+		name += fmt.Sprintf("_%d", s)
+	}
+	return name
+}
+
+// from returns a table expression with only the catalog's rows, which can be used in the FROM clause.
+func (t catalogTables) from(table string, alias string, suffix ...int) string {
+	if t.partitioned {
+		return fmt.Sprintf("(SELECT * FROM %s WHERE catalog_id = %d) %s", table, t.catalogID, alias)
+	}
+	return t.name(table, suffix...) + " " + alias
+}
+
+// where returns a condition limiting modified rows to the catalog, to be prepended to other conditions.
+func (t catalogTables) where() string {
+	if t.partitioned {
+		return fmt.Sprintf("catalog_id = %d AND ", t.catalogID)
+	}
+	return ""
+}
+
+// insertColumns returns the columns identifying the catalog, to be prepended to other columns in INSERT statements.
+func (t catalogTables) insertColumns() string {
+	if t.partitioned {
+		return "catalog_id, "
+	}
+	return ""
+}
+
+// insertValues returns the values matching insertColumns.
+func (t catalogTables) insertValues() string {
+	if t.partitioned {
+		return fmt.Sprintf("%d, ", t.catalogID)
+	}
+	return ""
+}
+
+// createTable creates a table for the catalog, unless the table is shared by all catalogs.
+func (t catalogTables) createTable(tx *sql.Tx, table string, suffix ...int) error {
+	if t.partitioned {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (LIKE %s_tpl INCLUDING ALL)", t.name(table, suffix...), table))
+	return err
+}
+
+// dropTable drops the catalog's table, or deletes the catalog's rows if the table is shared by all catalogs.
+func (t catalogTables) dropTable(tx *sql.Tx, table string, suffix ...int) error {
+	var err error
+	if t.partitioned {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE catalog_id = $1", table), t.catalogID)
+	} else {
+		_, err = tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", t.name(table, suffix...)))
+	}
+	return err
+}
+
+// index returns the index tables of the given generation. Reindexing builds the index
+// under a new generation, so that the old one can still be used in the meantime.
+func (t catalogTables) index(generation int) indexTables {
+	return indexTables{catalogTables: t, generation: generation}
+}
+
+// indexTables maps the index tables of a catalog to database tables. Tables of the first generation
+// have the same names as catalogTables, the others have a version suffix, e.g. track_index_1_2_v3.
+// Shared tables hold all generations, identified by the generation column.
+type indexTables struct {
+	catalogTables
+	generation int
+}
+
+// versionSuffix returns the suffix of the catalog's index table names.
+func (t indexTables) versionSuffix() string {
+	if !t.partitioned && t.generation != 0 {
+		return fmt.Sprintf("_v%d", t.generation)
+	}
+	return ""
+}
+
+func (t indexTables) name(table string, suffix ...int) string {
+	return t.catalogTables.name(table, suffix...) + t.versionSuffix()
+}
+
+func (t indexTables) from(table string, alias string, suffix ...int) string {
+	if t.partitioned {
+		return fmt.Sprintf("(SELECT * FROM %s WHERE %s) %s", table, strings.TrimSuffix(t.where(), " AND "), alias)
+	}
+	return t.name(table, suffix...) + " " + alias
+}
+
+func (t indexTables) where() string {
+	if t.partitioned {
+		return fmt.Sprintf("catalog_id = %d AND generation = %d AND ", t.catalogID, t.generation)
+	}
+	return ""
+}
+
+func (t indexTables) insertColumns() string {
+	if t.partitioned {
+		return "catalog_id, generation, "
+	}
+	return ""
+}
+
+func (t indexTables) insertValues() string {
+	if t.partitioned {
+		return fmt.Sprintf("%d, %d, ", t.catalogID, t.generation)
+	}
+	return ""
+}
+
+func (t indexTables) createTable(tx *sql.Tx, table string, suffix ...int) error {
+	if t.partitioned {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (LIKE %s_tpl INCLUDING ALL)", t.name(table, suffix...), table))
+	return err
+}
+
+func (t indexTables) dropTable(tx *sql.Tx, table string, suffix ...int) error {
+	var err error
+	if t.partitioned {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE catalog_id = $1 AND generation = $2", table), t.catalogID, t.generation)
+	} else {
+		_, err = tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", t.name(table, suffix...)))
+	}
+	return err
+}
+
+// updateTrackSequence makes sure that new tracks don't get IDs of tracks copied to the tables.
+func updateTrackSequence(tx *sql.Tx, tables catalogTables) error {
+	// Catalog tables are created from the template, so they share its sequence.
+	sequence := "track_tpl_id_seq"
+	if tables.partitioned {
+		sequence = "track_id_seq"
+	}
+	_, err := tx.Exec(fmt.Sprintf("SELECT setval('%s', greatest((SELECT max(id) FROM %s), (SELECT last_value FROM %s)))", sequence, tables.name("track"), sequence))
+	if err != nil {
+		return errors.WithMessage(err, "failed to update track ID sequence")
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCatalogTables(t *testing.T) {
+	tables, err := newCatalogTables(LayoutTablePerCatalog, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "track_5", tables.name("track"))
+	assert.Equal(t, "track_index_5_3", tables.name("track_index", 3))
+	assert.Equal(t, "track_5 t", tables.from("track", "t"))
+	assert.Equal(t, "", tables.where())
+	assert.Equal(t, "", tables.insertColumns())
+
+	tables, err = newCatalogTables(LayoutPartitioned, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "track", tables.name("track"))
+	assert.Equal(t, "track_index", tables.name("track_index", 3))
+	assert.Equal(t, "(SELECT * FROM track WHERE catalog_id = 5) t", tables.from("track", "t"))
+	assert.Equal(t, "catalog_id = 5 AND ", tables.where())
+	assert.Equal(t, "catalog_id, ", tables.insertColumns())
+	assert.Equal(t, "5, ", tables.insertValues())
+
+	_, err = newCatalogTables("sharded", 5)
+	assert.Error(t, err)
+	assert.False(t, IsValidLayout("sharded"))
+}
+
+func TestIndexTables(t *testing.T) {
+	tables, err := newCatalogTables(LayoutTablePerCatalog, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "track_index_5_3", tables.index(0).name("track_index", 3))
+	assert.Equal(t, "track_index_5_3_v2", tables.index(2).name("track_index", 3))
+	assert.Equal(t, "track_hash_5_v2 h", tables.index(2).from("track_hash", "h"))
+	assert.Equal(t, "", tables.index(2).where())
+	assert.Equal(t, "", tables.index(2).insertColumns())
+
+	tables, err = newCatalogTables(LayoutPartitioned, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "track_index", tables.index(2).name("track_index", 3))
+	assert.Equal(t, "(SELECT * FROM track_hash WHERE catalog_id = 5 AND generation = 2) h", tables.index(2).from("track_hash", "h"))
+	assert.Equal(t, "catalog_id = 5 AND generation = 2 AND ", tables.index(2).where())
+	assert.Equal(t, "catalog_id, generation, ", tables.index(2).insertColumns())
+	assert.Equal(t, "5, 2, ", tables.index(2).insertValues())
+}
@@ -0,0 +1,343 @@
+package priv
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+)
+
+// accountLockNamespace is the first key of advisory locks taken on account IDs.
+const accountLockNamespace = 3
+
+// Limits restrict how much an account can use the service. Zero means unlimited.
+type Limits struct {
+	SearchRate          int `json:"search_rate"` // search requests per second
+	WriteRate           int `json:"write_rate"`  // write requests per second
+	MaxCatalogs         int `json:"max_catalogs"`
+	MaxTracksPerCatalog int `json:"max_tracks_per_catalog"`
+	MaxTracks           int `json:"max_tracks"` // total number of tracks in all catalogs
+}
+
+// CustomLimits override the default limits of one account. Limits that are nil use the default.
+type CustomLimits struct {
+	SearchRate          *int `json:"search_rate"`
+	WriteRate           *int `json:"write_rate"`
+	MaxCatalogs         *int `json:"max_catalogs"`
+	MaxTracksPerCatalog *int `json:"max_tracks_per_catalog"`
+	MaxTracks           *int `json:"max_tracks"`
+}
+
+// customLimitsColumns lists columns of the account table matching CustomLimits.fields.
+const customLimitsColumns = "search_rate_limit, write_rate_limit, max_catalogs, max_tracks_per_catalog, max_tracks"
+
+func (c *CustomLimits) fields() []**int {
+	return []**int{&c.SearchRate, &c.WriteRate, &c.MaxCatalogs, &c.MaxTracksPerCatalog, &c.MaxTracks}
+}
+
+func (c *CustomLimits) Validate() error {
+	for _, value := range c.fields() {
+		if *value != nil && **value < 0 {
+			return errors.New("limits can't be negative")
+		}
+	}
+	return nil
+}
+
+// Apply returns the limits with the custom limits applied.
+func (l Limits) Apply(custom *CustomLimits) Limits {
+	if custom == nil {
+		return l
+	}
+	values := []*int{&l.SearchRate, &l.WriteRate, &l.MaxCatalogs, &l.MaxTracksPerCatalog, &l.MaxTracks}
+	for i, value := range custom.fields() {
+		if *value != nil {
+			*values[i] = **value
+		}
+	}
+	return l
+}
+
+// QuotaError is returned when a change would make an account exceed one of its quotas.
+type QuotaError struct {
+	Quota string // what is limited, e.g. "catalogs"
+	Limit int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded, maximum number of %s is %d", e.Quota, e.Limit)
+}
+
+func accountLimitsCacheKey(accountID int) string {
+	return fmt.Sprintf("account-limits:%d", accountID)
+}
+
+func (account *AccountImpl) Limits() (*Limits, error) {
+	custom, err := account.CustomLimits()
+	if err != nil {
+		return nil, err
+	}
+	limits := account.service.DefaultLimits.Apply(custom)
+	return &limits, nil
+}
+
+func (account *AccountImpl) CustomLimits() (*CustomLimits, error) {
+	s := account.service
+	cacheKey := accountLimitsCacheKey(account.id)
+	if s.Cache != nil {
+		custom, found := s.Cache.Get(cacheKey)
+		if found {
+			return custom.(*CustomLimits), nil
+		}
+	}
+
+	var values [5]sql.NullInt64
+	row := s.readDB().QueryRow("SELECT "+customLimitsColumns+" FROM account WHERE id = $1", account.id)
+	err := row.Scan(&values[0], &values[1], &values[2], &values[3], &values[4])
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get account limits")
+	}
+	custom := &CustomLimits{}
+	for i, value := range custom.fields() {
+		if values[i].Valid {
+			v := int(values[i].Int64)
+			*value = &v
+		}
+	}
+
+	if s.Cache != nil {
+		s.Cache.Set(cacheKey, custom, s.cacheTTL())
+	}
+	return custom, nil
+}
+
+func (account *AccountImpl) UpdateCustomLimits(custom *CustomLimits) error {
+	err := custom.Validate()
+	if err != nil {
+		return err
+	}
+
+	tx, err := account.db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	var values []interface{}
+	for _, value := range custom.fields() {
+		values = append(values, *value)
+	}
+	_, err = tx.Exec("UPDATE account SET ("+customLimitsColumns+") = ($2, $3, $4, $5, $6) WHERE id = $1", append([]interface{}{account.id}, values...)...)
+	if err != nil {
+		return errors.WithMessage(err, "failed to update account limits")
+	}
+
+	event := &ChangeEvent{Type: ChangeAccountUpdated, AccountID: account.id}
+	err = notifyChange(tx, event)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+
+	account.service.handleChange(event)
+	log.Printf("Updated limits of account_id=%v", account.id)
+	return nil
+}
+
+// lockQuotas serializes changes that count towards the account's quotas until the transaction ends.
+func (account *AccountImpl) lockQuotas(tx *sql.Tx) error {
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock($1, $2)", accountLockNamespace, account.id)
+	if err != nil {
+		return errors.WithMessage(err, "failed to lock account")
+	}
+	return nil
+}
+
+// checkCatalogQuota returns a QuotaError if the account can't have another catalog.
+func (account *AccountImpl) checkCatalogQuota(tx *sql.Tx) error {
+	limits, err := account.Limits()
+	if err != nil {
+		return err
+	}
+	if limits.MaxCatalogs == 0 {
+		return nil
+	}
+	err = account.lockQuotas(tx)
+	if err != nil {
+		return err
+	}
+	var count int
+	err = tx.QueryRow("SELECT count(*) FROM catalog WHERE account_id = $1", account.id).Scan(&count)
+	if err != nil {
+		return errors.WithMessage(err, "failed to count catalogs")
+	}
+	if count >= limits.MaxCatalogs {
+		return &QuotaError{Quota: "catalogs", Limit: limits.MaxCatalogs}
+	}
+	return nil
+}
+
+// Numbers of tracks are kept in the catalog_track_count table and updated in the same transaction as
+// the tracks, so that quotas can be checked without counting the tracks. They are not stored in the
+// catalog row, or linked to it with a foreign key, because the row is locked by conversions and moves
+// while they wait for running writes to finish.
+// Catalogs created before tracks were counted get their count when they are first needed.
+
+// countTracks returns the number of tracks in the catalog.
+func countTracks(q queryer, tables catalogTables) (int64, error) {
+	var count int64
+	err := q.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", tables.from("track", "t"))).Scan(&count)
+	if err != nil {
+		return 0, errors.WithMessage(err, fmt.Sprintf("failed to count tracks in catalog %d", tables.catalogID))
+	}
+	return count, nil
+}
+
+// initTrackCount stores the counted number of tracks of the catalog. If a concurrent transaction stored
+// the count first, it didn't see the changes of this transaction, so only delta is added to it.
+func initTrackCount(tx *sql.Tx, accountID int, catalogID int, count int64, delta int64) error {
+	_, err := tx.Exec(`
+		INSERT INTO catalog_track_count (catalog_id, account_id, tracks) VALUES ($1, $2, $3)
+		ON CONFLICT (catalog_id) DO UPDATE SET tracks = catalog_track_count.tracks + $4`,
+		catalogID, accountID, count, delta)
+	if err != nil {
+		return errors.WithMessage(err, "failed to update track count")
+	}
+	return nil
+}
+
+// updateTrackCount adds delta to the number of tracks in the catalog, after tracks were added or deleted in the transaction.
+func (c *CatalogImpl) updateTrackCount(stx *shardedTx, delta int64) error {
+	result, err := stx.tx.Exec("UPDATE catalog_track_count SET tracks = tracks + $2 WHERE catalog_id = $1", c.id, delta)
+	if err != nil {
+		return errors.WithMessage(err, "failed to update track count")
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithMessage(err, "failed to update track count")
+	}
+	if updated > 0 {
+		return nil
+	}
+	count, err := countTracks(stx.shardTx, c.tables())
+	if err != nil {
+		return err
+	}
+	return initTrackCount(stx.tx, c.repo.account.id, c.id, count, delta)
+}
+
+// trackCount returns the number of tracks in the catalog.
+func (c *CatalogImpl) trackCount(stx *shardedTx) (int64, error) {
+	var count int64
+	err := stx.tx.QueryRow("SELECT tracks FROM catalog_track_count WHERE catalog_id = $1", c.id).Scan(&count)
+	if err == nil {
+		return count, nil
+	} else if err != sql.ErrNoRows {
+		return 0, errors.WithMessage(err, "failed to get track count")
+	}
+	count, err = countTracks(stx.shardTx, c.tables())
+	if err != nil {
+		return 0, err
+	}
+	err = initTrackCount(stx.tx, c.repo.account.id, c.id, count, 0)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// totalTrackCount returns the number of tracks in all catalogs of the account.
+func (account *AccountImpl) totalTrackCount(tx *sql.Tx) (int64, error) {
+	type catalogInfo struct {
+		id, shardID int
+		layout      string
+	}
+	var uncounted []catalogInfo
+	rows, err := tx.Query(`
+		SELECT c.id, c.shard_id, c.layout FROM catalog c
+		LEFT JOIN catalog_track_count n ON n.catalog_id = c.id
+		WHERE c.account_id = $1 AND n.catalog_id IS NULL`, account.id)
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to list catalogs")
+	}
+	for rows.Next() {
+		var catalog catalogInfo
+		err = rows.Scan(&catalog.id, &catalog.shardID, &catalog.layout)
+		if err != nil {
+			rows.Close()
+			return 0, errors.WithMessage(err, "failed to list catalogs")
+		}
+		uncounted = append(uncounted, catalog)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to list catalogs")
+	}
+
+	for _, catalog := range uncounted {
+		tables, err := newCatalogTables(catalog.layout, catalog.id)
+		if err != nil {
+			return 0, err
+		}
+		db, err := account.service.shardDB(catalog.shardID)
+		if err != nil {
+			return 0, err
+		}
+		count, err := countTracks(db, tables)
+		if err != nil {
+			return 0, err
+		}
+		err = initTrackCount(tx, account.id, catalog.id, count, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var total int64
+	err = tx.QueryRow("SELECT coalesce(sum(tracks), 0) FROM catalog_track_count WHERE account_id = $1", account.id).Scan(&total)
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to get track count")
+	}
+	return total, nil
+}
+
+// checkTrackQuota returns a QuotaError if another track can't be added to the catalog.
+func (c *CatalogImpl) checkTrackQuota(stx *shardedTx) error {
+	account := c.repo.account
+	limits, err := account.Limits()
+	if err != nil {
+		return err
+	}
+	if limits.MaxTracksPerCatalog == 0 && limits.MaxTracks == 0 {
+		return nil
+	}
+	err = account.lockQuotas(stx.tx)
+	if err != nil {
+		return err
+	}
+
+	// The catalog is counted in the transaction, which already holds the catalog's write lock.
+	count, err := c.trackCount(stx)
+	if err != nil {
+		return err
+	}
+	if limits.MaxTracksPerCatalog > 0 && count >= int64(limits.MaxTracksPerCatalog) {
+		return &QuotaError{Quota: "tracks per catalog", Limit: limits.MaxTracksPerCatalog}
+	}
+
+	if limits.MaxTracks > 0 {
+		total, err := account.totalTrackCount(stx.tx)
+		if err != nil {
+			return err
+		}
+		if total >= int64(limits.MaxTracks) {
+			return &QuotaError{Quota: "tracks", Limit: limits.MaxTracks}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package priv
+
+import (
+	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func intPtr(value int) *int {
+	return &value
+}
+
+func TestLimits_Apply(t *testing.T) {
+	defaults := Limits{SearchRate: 10, WriteRate: 5, MaxCatalogs: 100}
+	custom := &CustomLimits{SearchRate: intPtr(0), MaxTracks: intPtr(1000)}
+	assert.Equal(t, Limits{SearchRate: 0, WriteRate: 5, MaxCatalogs: 100, MaxTracks: 1000}, defaults.Apply(custom))
+	assert.Equal(t, defaults, defaults.Apply(nil))
+	assert.Equal(t, defaults, defaults.Apply(&CustomLimits{}))
+}
+
+func TestCustomLimits_Validate(t *testing.T) {
+	assert.NoError(t, (&CustomLimits{}).Validate())
+	assert.NoError(t, (&CustomLimits{MaxCatalogs: intPtr(0)}).Validate())
+	assert.Error(t, (&CustomLimits{WriteRate: intPtr(-1)}).Validate())
+}
+
+func TestAccount_UpdateCustomLimits(t *testing.T) {
+	account := getTestAccount(t, connectToDB(t))
+	account.(*AccountImpl).service.DefaultLimits = Limits{SearchRate: 10, MaxCatalogs: 5}
+
+	custom, err := account.CustomLimits()
+	require.NoError(t, err)
+	assert.Equal(t, &CustomLimits{}, custom)
+
+	err = account.UpdateCustomLimits(&CustomLimits{SearchRate: intPtr(20), MaxTracks: intPtr(100)})
+	require.NoError(t, err)
+
+	custom, err = account.CustomLimits()
+	require.NoError(t, err)
+	assert.Equal(t, &CustomLimits{SearchRate: intPtr(20), MaxTracks: intPtr(100)}, custom)
+
+	limits, err := account.Limits()
+	require.NoError(t, err)
+	assert.Equal(t, &Limits{SearchRate: 20, MaxCatalogs: 5, MaxTracks: 100}, limits)
+}
+
+func TestCatalog_CreateCatalog_Quota(t *testing.T) {
+	account := getTestAccount(t, connectToDB(t))
+	err := account.UpdateCustomLimits(&CustomLimits{MaxCatalogs: intPtr(1)})
+	require.NoError(t, err)
+
+	repo := account.Repository()
+	require.NoError(t, repo.Catalog("cat1").CreateCatalog())
+	require.NoError(t, repo.Catalog("cat1").CreateCatalog(), "existing catalog should not count")
+
+	err = repo.Catalog("cat2").CreateCatalog()
+	assert.Equal(t, &QuotaError{Quota: "catalogs", Limit: 1}, err)
+}
+
+func TestCatalog_CreateTrack_Quota(t *testing.T) {
+	account := getTestAccount(t, connectToDB(t))
+	err := account.UpdateCustomLimits(&CustomLimits{MaxTracksPerCatalog: intPtr(2), MaxTracks: intPtr(3)})
+	require.NoError(t, err)
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+
+	repo := account.Repository()
+	cat1 := repo.Catalog("cat1")
+	cat2 := repo.Catalog("cat2")
+
+	for _, id := range []string{"fp1", "fp2"} {
+		_, err = cat1.CreateTrack(id, fp, 0, nil, true)
+		require.NoError(t, err)
+	}
+	_, err = cat1.CreateTrack("fp2", fp, 0, nil, true)
+	assert.NoError(t, err, "replaced track should not count")
+
+	_, err = cat1.CreateTrack("fp3", fp, 0, nil, true)
+	assert.Equal(t, &QuotaError{Quota: "tracks per catalog", Limit: 2}, err)
+
+	_, err = cat2.CreateTrack("fp1", fp, 0, nil, true)
+	require.NoError(t, err)
+	_, err = cat2.CreateTrack("fp2", fp, 0, nil, true)
+	assert.Equal(t, &QuotaError{Quota: "tracks", Limit: 3}, err)
+}
+
+func TestCatalog_TrackCount(t *testing.T) {
+	account := getTestAccount(t, connectToDB(t))
+	accountImpl := account.(*AccountImpl)
+	repo := account.Repository()
+	for _, name := range []string{"cat1", "cat2"} {
+		require.NoError(t, repo.Catalog(name).DeleteCatalog())
+	}
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+
+	cat1 := repo.Catalog("cat1").(*CatalogImpl)
+	for _, id := range []string{"fp1", "fp2", "fp2", "fp3"} {
+		_, err = cat1.CreateTrack(id, fp, 0, nil, true)
+		require.NoError(t, err)
+	}
+	require.NoError(t, cat1.DeleteTrack("fp3"))
+	require.NoError(t, cat1.DeleteTrack("fp4"))
+	_, err = repo.Catalog("cat2").CreateTrack("fp1", fp, 0, nil, true)
+	require.NoError(t, err)
+
+	// Catalogs created before tracks were counted are counted when needed.
+	_, err = accountImpl.db.Exec("DELETE FROM catalog_track_count WHERE account_id = $1", accountImpl.id)
+	require.NoError(t, err)
+
+	tx, err := accountImpl.db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	total, err := accountImpl.totalTrackCount(tx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), total)
+
+	stx := &shardedTx{tx: tx, shardTx: tx}
+	count, err := cat1.trackCount(stx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+}
@@ -0,0 +1,380 @@
+package priv
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/pkg/errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryIndexPosting struct {
+	trackID  int32
+	position int32
+}
+
+// MemoryIndex is an in-memory copy of the catalog's fingerprint index. It maps each
+// query value to the tracks containing it, which makes it possible to search without
+// hitting the database.
+type MemoryIndex struct {
+	catalogID    int
+	db           *sql.DB
+	tables       catalogTables
+	params       IndexParams
+	partition    *Partition
+	mu           sync.RWMutex
+	postings     map[int32][]memoryIndexPosting
+	tracks       map[int32][]int32
+	numPostings  int
+	ready        bool
+	pending      []int
+	loadDuration time.Duration
+	applyMu      sync.Mutex
+}
+
+type MemoryIndexStats struct {
+	Ready        bool
+	NumTracks    int
+	NumHashes    int
+	MemoryUsage  int64
+	LoadDuration time.Duration
+}
+
+func NewMemoryIndex(catalogID int) *MemoryIndex {
+	return &MemoryIndex{
+		catalogID: catalogID,
+		tables:    catalogTables{catalogID: catalogID},
+		params:    DefaultIndexParams,
+		postings:  make(map[int32][]memoryIndexPosting),
+		tracks:    make(map[int32][]int32),
+	}
+}
+
+func (idx *MemoryIndex) Ready() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.ready
+}
+
+// AddTrack adds the track to the index, replacing any previously indexed values.
+func (idx *MemoryIndex) AddTrack(trackID int, values []int32) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeTrack(int32(trackID))
+	idx.addTrack(int32(trackID), values)
+}
+
+func (idx *MemoryIndex) RemoveTrack(trackID int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeTrack(int32(trackID))
+}
+
+func (idx *MemoryIndex) addTrack(trackID int32, values []int32) {
+	distinctValues := make([]int32, 0, len(values))
+	for i, value := range values {
+		postings, exists := idx.postings[value]
+		if !exists || postings[len(postings)-1].trackID != trackID {
+			distinctValues = append(distinctValues, value)
+		}
+		idx.postings[value] = append(postings, memoryIndexPosting{trackID, int32(i)})
+		idx.numPostings++
+	}
+	idx.tracks[trackID] = distinctValues
+}
+
+func (idx *MemoryIndex) removeTrack(trackID int32) {
+	values, exists := idx.tracks[trackID]
+	if !exists {
+		return
+	}
+	for _, value := range values {
+		postings := idx.postings[value]
+		filtered := postings[:0]
+		for _, p := range postings {
+			if p.trackID != trackID {
+				filtered = append(filtered, p)
+			}
+		}
+		idx.numPostings -= len(postings) - len(filtered)
+		if len(filtered) == 0 {
+			delete(idx.postings, value)
+		} else {
+			idx.postings[value] = filtered
+		}
+	}
+	delete(idx.tracks, trackID)
+}
+
+// Search scores tracks by the number of hits agreeing on the same time offset, each slice
+// of segmentHashes is matched against the corresponding index segment.
+func (idx *MemoryIndex) Search(segmentHashes [][]queryHash) map[int]int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	votes := make(offsetVotes)
+	for segment, hashes := range segmentHashes {
+		positions := queryPositions(hashes)
+		for value, queryPositions := range positions {
+			for _, p := range idx.postings[value] {
+				if idx.params.segment(int(p.position)) == segment {
+					for _, position := range queryPositions {
+						votes.add(int(p.trackID), int(p.position)-position)
+					}
+				}
+			}
+		}
+	}
+	return votes.scores()
+}
+
+// MemoryUsage returns an estimate of the memory used by the index, in bytes.
+func (idx *MemoryIndex) MemoryUsage() int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.memoryUsage()
+}
+
+func (idx *MemoryIndex) memoryUsage() int64 {
+	const mapEntryOverhead = 48
+	const postingSize = 8
+	const valueSize = 4
+	size := int64(len(idx.postings)+len(idx.tracks)) * mapEntryOverhead
+	size += int64(idx.numPostings) * (postingSize + valueSize)
+	return size
+}
+
+func (idx *MemoryIndex) Stats() *MemoryIndexStats {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return &MemoryIndexStats{
+		Ready:        idx.ready,
+		NumTracks:    len(idx.tracks),
+		NumHashes:    len(idx.postings),
+		MemoryUsage:  idx.memoryUsage(),
+		LoadDuration: idx.loadDuration,
+	}
+}
+
+func (idx *MemoryIndex) updateMetrics() {
+	memoryIndexBytes.WithLabelValues(strconv.Itoa(idx.catalogID)).Set(float64(idx.MemoryUsage()))
+}
+
+// load reads all tracks from the database. Changes received in the meantime are
+// applied once the initial load is finished.
+func (idx *MemoryIndex) load(db *sql.DB) error {
+	started := time.Now()
+
+	rows, err := db.Query("SELECT t.id, t.fingerprint FROM " + idx.tables.from("track", "t"))
+	if err != nil {
+		return errors.WithMessage(err, "failed to fetch tracks")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var trackID int
+		var data []byte
+		err = rows.Scan(&trackID, &data)
+		if err != nil {
+			return errors.WithMessage(err, "failed to fetch tracks")
+		}
+		if !idx.partition.Contains(trackID) {
+			continue
+		}
+		fp, err := chromaprint.ParseFingerprint(data)
+		if err != nil {
+			return errors.WithMessage(err, "failed to parse fingerprint")
+		}
+		idx.AddTrack(trackID, idx.params.extractQuery(fp))
+	}
+	err = rows.Err()
+	if err != nil {
+		return errors.WithMessage(err, "failed to fetch tracks")
+	}
+
+	idx.applyMu.Lock()
+	defer idx.applyMu.Unlock()
+
+	idx.mu.Lock()
+	idx.ready = true
+	idx.loadDuration = time.Since(started)
+	pending := idx.pending
+	idx.pending = nil
+	idx.mu.Unlock()
+
+	for _, trackID := range pending {
+		err = idx.reloadTrack(db, trackID)
+		if err != nil {
+			return err
+		}
+	}
+
+	memoryIndexLoadDuration.Observe(idx.loadDuration.Seconds())
+	idx.updateMetrics()
+	return nil
+}
+
+// TrackChanged updates the index after a track was inserted, updated or deleted.
+func (idx *MemoryIndex) TrackChanged(db *sql.DB, trackID int) error {
+	idx.mu.Lock()
+	if !idx.ready {
+		idx.pending = append(idx.pending, trackID)
+		idx.mu.Unlock()
+		return nil
+	}
+	idx.mu.Unlock()
+
+	idx.applyMu.Lock()
+	defer idx.applyMu.Unlock()
+	err := idx.reloadTrack(db, trackID)
+	if err != nil {
+		return err
+	}
+	idx.updateMetrics()
+	return nil
+}
+
+func (idx *MemoryIndex) reloadTrack(db *sql.DB, trackID int) error {
+	if !idx.partition.Contains(trackID) {
+		return nil
+	}
+	row := db.QueryRow(fmt.Sprintf("SELECT fingerprint FROM %s WHERE %sid = $1", idx.tables.name("track"), idx.tables.where()), trackID)
+	var data []byte
+	err := row.Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			idx.RemoveTrack(trackID)
+			return nil
+		}
+		return errors.WithMessage(err, "failed to fetch track")
+	}
+	fp, err := chromaprint.ParseFingerprint(data)
+	if err != nil {
+		return errors.WithMessage(err, "failed to parse fingerprint")
+	}
+	idx.AddTrack(trackID, idx.params.extractQuery(fp))
+	return nil
+}
+
+// memoryIndex returns the catalog's in-memory index if it's ready to be used. The index
+// is loaded in the background on first use.
+func (s *ServiceImpl) memoryIndex(db *sql.DB, tables catalogTables, params IndexParams, enabled bool) *MemoryIndex {
+	catalogID := tables.catalogID
+	if !enabled {
+		s.dropMemoryIndex(catalogID)
+		return nil
+	}
+
+	s.memoryIndexesMu.Lock()
+	idx, exists := s.memoryIndexes[catalogID]
+	if !exists {
+		idx = NewMemoryIndex(catalogID)
+		idx.db = db
+		idx.tables = tables
+		idx.params = params
+		idx.partition = s.Partition
+		if s.memoryIndexes == nil {
+			s.memoryIndexes = make(map[int]*MemoryIndex)
+		}
+		s.memoryIndexes[catalogID] = idx
+		go s.loadMemoryIndex(idx)
+	}
+	s.memoryIndexesMu.Unlock()
+
+	if !idx.Ready() {
+		return nil
+	}
+	return idx
+}
+
+func (s *ServiceImpl) existingMemoryIndex(catalogID int) *MemoryIndex {
+	s.memoryIndexesMu.Lock()
+	defer s.memoryIndexesMu.Unlock()
+	return s.memoryIndexes[catalogID]
+}
+
+func (s *ServiceImpl) loadMemoryIndex(idx *MemoryIndex) {
+	log.Printf("Loading memory index for catalog_id=%v", idx.catalogID)
+	err := idx.load(idx.db)
+	if err != nil {
+		log.Printf("Failed to load memory index for catalog_id=%v: %v", idx.catalogID, err)
+		s.memoryIndexesMu.Lock()
+		if s.memoryIndexes[idx.catalogID] == idx {
+			delete(s.memoryIndexes, idx.catalogID)
+		}
+		s.memoryIndexesMu.Unlock()
+		return
+	}
+	stats := idx.Stats()
+	log.Printf("Loaded memory index for catalog_id=%v tracks=%v bytes=%v in %v", idx.catalogID, stats.NumTracks, stats.MemoryUsage, stats.LoadDuration)
+}
+
+func (s *ServiceImpl) dropMemoryIndex(catalogID int) {
+	s.memoryIndexesMu.Lock()
+	defer s.memoryIndexesMu.Unlock()
+	_, exists := s.memoryIndexes[catalogID]
+	if exists {
+		delete(s.memoryIndexes, catalogID)
+		memoryIndexBytes.DeleteLabelValues(strconv.Itoa(catalogID))
+		log.Printf("Dropped memory index for catalog_id=%v", catalogID)
+	}
+}
+
+func (s *ServiceImpl) dropAllMemoryIndexes() {
+	s.memoryIndexesMu.Lock()
+	defer s.memoryIndexesMu.Unlock()
+	if len(s.memoryIndexes) == 0 {
+		return
+	}
+	for catalogID := range s.memoryIndexes {
+		delete(s.memoryIndexes, catalogID)
+		memoryIndexBytes.DeleteLabelValues(strconv.Itoa(catalogID))
+	}
+	log.Printf("Dropped all memory indexes")
+}
+
+// LoadMemoryIndexes starts loading in-memory indexes of all catalogs that have them enabled.
+func (s *ServiceImpl) LoadMemoryIndexes() error {
+	rows, err := s.db.Query("SELECT id, layout, shard_id, " + indexParamsColumns + " FROM catalog WHERE memory_index")
+	if err != nil {
+		return errors.WithMessage(err, "failed to fetch catalogs")
+	}
+	defer rows.Close()
+
+	type memoryIndexCatalog struct {
+		db     *sql.DB
+		tables catalogTables
+		params IndexParams
+	}
+	var catalogs []memoryIndexCatalog
+	for rows.Next() {
+		var catalogID, shardID int
+		var layout string
+		var params IndexParams
+		err = rows.Scan(append([]interface{}{&catalogID, &layout, &shardID}, params.scanDest()...)...)
+		if err != nil {
+			return errors.WithMessage(err, "failed to fetch catalogs")
+		}
+		tables, err := newCatalogTables(layout, catalogID)
+		if err != nil {
+			return err
+		}
+		db, err := s.shardDB(shardID)
+		if err != nil {
+			return err
+		}
+		catalogs = append(catalogs, memoryIndexCatalog{db, tables, params})
+	}
+	err = rows.Err()
+	if err != nil {
+		return errors.WithMessage(err, "failed to fetch catalogs")
+	}
+
+	for _, catalog := range catalogs {
+		s.memoryIndex(catalog.db, catalog.tables, catalog.params, true)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemoryIndex_Search(t *testing.T) {
+	idx := NewMemoryIndex(1)
+	idx.AddTrack(1, []int32{1, 2, 3})
+	idx.AddTrack(2, []int32{3, 9, 9, 9, 9, 2, 9, 9, 9, 9, 1})
+
+	segmentHashes := make([][]queryHash, NumIndexSegments)
+	segmentHashes[0] = makeQueryHashes([]int32{1, 2, 3}, 0)
+	hits := idx.Search(segmentHashes)
+	assert.Equal(t, map[int]int{1: 2}, hits)
+
+	segmentHashes[0] = nil
+	segmentHashes[1] = makeQueryHashes([]int32{1, 2, 3}, 0)
+	hits = idx.Search(segmentHashes)
+	assert.Empty(t, hits)
+}
+
+func TestMemoryIndex_SearchSegments(t *testing.T) {
+	values := make([]int32, ValuesPerSegment*(NumIndexSegments+1))
+	for i := range values {
+		values[i] = int32(i)
+	}
+	idx := NewMemoryIndex(1)
+	idx.AddTrack(1, values)
+
+	segmentHashes := make([][]queryHash, NumIndexSegments)
+	segmentHashes[0] = makeQueryHashes([]int32{0, 1, int32(ValuesPerSegment * NumIndexSegments)}, 0)
+	segmentHashes[1] = makeQueryHashes([]int32{int32(ValuesPerSegment), int32(ValuesPerSegment + 1), 0}, ValuesPerSegment)
+	hits := idx.Search(segmentHashes)
+	assert.Equal(t, map[int]int{1: 3}, hits)
+}
+
+func TestMemoryIndex_RemoveTrack(t *testing.T) {
+	idx := NewMemoryIndex(1)
+	idx.AddTrack(1, []int32{1, 2, 3})
+	idx.AddTrack(2, []int32{3, 4, 5})
+	idx.RemoveTrack(1)
+
+	segmentHashes := make([][]queryHash, NumIndexSegments)
+	segmentHashes[0] = makeQueryHashes([]int32{1, 2, 3, 4, 5}, 0)
+	hits := idx.Search(segmentHashes)
+	assert.Equal(t, map[int]int{2: 2}, hits)
+
+	stats := idx.Stats()
+	assert.Equal(t, 1, stats.NumTracks)
+	assert.Equal(t, 3, stats.NumHashes)
+}
+
+func TestMemoryIndex_AddTrack_Update(t *testing.T) {
+	idx := NewMemoryIndex(1)
+	idx.AddTrack(1, []int32{1, 2, 3})
+	idx.AddTrack(1, []int32{4, 5})
+
+	segmentHashes := make([][]queryHash, NumIndexSegments)
+	segmentHashes[0] = makeQueryHashes([]int32{1, 2, 3, 4, 5}, 0)
+	hits := idx.Search(segmentHashes)
+	assert.Equal(t, map[int]int{1: 1}, hits)
+	assert.Equal(t, 2, idx.Stats().NumHashes)
+}
+
+func TestMemoryIndex_SearchStream(t *testing.T) {
+	idx := NewMemoryIndex(1)
+	idx.AddTrack(1, ExtractQuery(loadTestFingerprint(t, "calibre_sunrise")))
+
+	hits := idx.Search(DefaultIndexParams.segmentQueries(ExtractQuery(loadTestFingerprint(t, "radio1_3_calibre_sunshine")), true))
+	assert.True(t, hits[1] > 10, "expected track 1 to match, got %v", hits)
+
+	hits = idx.Search(DefaultIndexParams.segmentQueries(ExtractQuery(loadTestFingerprint(t, "radio1_1_ad")), true))
+	assert.True(t, hits[1] < 5, "expected track 1 not to match, got %v", hits)
+}
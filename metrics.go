@@ -31,9 +31,91 @@ var searchDuration = prometheus.NewHistogramVec(
 		Buckets:   prometheus.ExponentialBuckets(0.025, 1.5, 10),
 	}, []string{"type", "stage"})
 
+var searchProbeCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "acoustid_priv",
+		Name:      "search_probes_total",
+		Help:      "Number of extra hash variants searched for in multi-probe searches",
+	})
+
+var searchNodeErrorCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "acoustid_priv",
+		Name:      "search_node_errors_total",
+		Help:      "Number of failed or timed out searches on other API nodes partitioned by node",
+	}, []string{"node"})
+
+var replicaLag = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "acoustid_priv",
+		Name:      "replica_lag_seconds",
+		Help:      "Replication lag of read-only database replicas",
+	}, []string{"replica"})
+
+var replicaHealthy = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "acoustid_priv",
+		Name:      "replica_healthy",
+		Help:      "Whether a read-only database replica is used for queries",
+	}, []string{"replica"})
+
+var replicaFallbackCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "acoustid_priv",
+		Name:      "replica_fallback_total",
+		Help:      "Number of read-only queries sent to the primary database because no replica was healthy",
+	})
+
+var memoryIndexBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "acoustid_priv",
+		Name:      "memory_index_bytes",
+		Help:      "Estimated memory used by in-memory catalog indexes",
+	}, []string{"catalog_id"})
+
+var memoryIndexLoadDuration = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "acoustid_priv",
+		Name:      "memory_index_load_duration_seconds",
+		Help:      "Histogram of in-memory catalog index load durations",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+var acoustidBizDuration = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "acoustid_priv",
+		Name:      "acoustid_biz_validation_duration_seconds",
+		Help:      "Histogram of API key validation request durations on acoustid.biz",
+		Buckets:   prometheus.ExponentialBuckets(0.025, 2, 10),
+	})
+
+var acoustidBizErrorCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "acoustid_priv",
+		Name:      "acoustid_biz_validation_errors_total",
+		Help:      "Number of failed API key validations on acoustid.biz partitioned by reason",
+	}, []string{"reason"})
+
+var auditErrorCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "acoustid_priv",
+		Name:      "audit_errors_total",
+		Help:      "Number of changes that could not be recorded in the audit log",
+	})
+
 func init() {
 	prometheus.MustRegister(catalogActionCount)
 	prometheus.MustRegister(trackActionCount)
 	prometheus.MustRegister(searchCount)
 	prometheus.MustRegister(searchDuration)
+	prometheus.MustRegister(searchProbeCount)
+	prometheus.MustRegister(searchNodeErrorCount)
+	prometheus.MustRegister(replicaLag)
+	prometheus.MustRegister(replicaHealthy)
+	prometheus.MustRegister(replicaFallbackCount)
+	prometheus.MustRegister(memoryIndexBytes)
+	prometheus.MustRegister(memoryIndexLoadDuration)
+	prometheus.MustRegister(acoustidBizDuration)
+	prometheus.MustRegister(acoustidBizErrorCount)
+	prometheus.MustRegister(auditErrorCount)
 }
@@ -0,0 +1,380 @@
+package priv
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/template"
+)
+
+//go:embed sql/migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockNamespace is the first key of the advisory lock held while applying migrations.
+const migrationLockNamespace = 2
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(catalog\.)?(up|down)\.sql$`)
+
+// Migration is a schema change. The up and down scripts run on the central database and on every shard.
+// Tables of catalogs with the table_per_catalog layout are changed by the optional catalog scripts, which
+// are templates executed for each such catalog on the database holding its tables. The templates
+// get catalogMigrationData, e.g. track_{{.CatalogID}} is the catalog's track table and
+// track_index_{{.CatalogID}}_0{{.IndexSuffix}} is the first table of its gin index.
+type Migration struct {
+	Version     int64
+	Name        string
+	up          string
+	down        string
+	catalogUp   *template.Template
+	catalogDown *template.Template
+}
+
+type catalogMigrationData struct {
+	CatalogID   int
+	IndexType   string
+	IndexSuffix string
+	Segments    []int
+}
+
+// MigrationStatus says whether a migration was applied to the database of a shard.
+type MigrationStatus struct {
+	ShardID int
+	Version int64
+	Name    string
+	Applied bool
+}
+
+// Migrations returns all migrations embedded in the binary, ordered by version.
+func Migrations() ([]*Migration, error) {
+	entries, err := migrationFiles.ReadDir("sql/migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		m := migrationFileRe.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, errors.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid migration version in %q", entry.Name())
+		}
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, errors.Errorf("migrations %q and %q have the same version", migration.Name, m[2])
+		}
+		data, err := migrationFiles.ReadFile(path.Join("sql/migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if m[3] == "" {
+			if m[4] == "up" {
+				migration.up = string(data)
+			} else {
+				migration.down = string(data)
+			}
+			continue
+		}
+		tpl, err := template.New(entry.Name()).Parse(string(data))
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to parse migration template")
+		}
+		if m[4] == "up" {
+			migration.catalogUp = tpl
+		} else {
+			migration.catalogDown = tpl
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.up == "" || migration.down == "" {
+			return nil, errors.Errorf("migration %d_%s must have both up and down scripts", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// migrationDatabases returns the central database followed by all shards.
+func (s *ServiceImpl) migrationDatabases() []int {
+	shardIDs := []int{CentralShardID}
+	for shardID := range s.shards {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Ints(shardIDs[1:])
+	return shardIDs
+}
+
+// createMigrationsTable creates the table of applied migrations. A database created before migrations
+// were tracked is assumed to have only the initial schema.
+func createMigrationsTable(tx *sql.Tx, initial *Migration) error {
+	var exists, initialized bool
+	err := tx.QueryRow("SELECT to_regclass('schema_migrations') IS NOT NULL, to_regclass('track_tpl') IS NOT NULL").Scan(&exists, &initialized)
+	if err != nil {
+		return errors.WithMessage(err, "failed to check migrations table")
+	}
+	if exists {
+		return nil
+	}
+	_, err = tx.Exec("CREATE TABLE schema_migrations (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now())")
+	if err != nil {
+		return errors.WithMessage(err, "failed to create migrations table")
+	}
+	if initialized {
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", initial.Version, initial.Name)
+		if err != nil {
+			return errors.WithMessage(err, "failed to record initial migration")
+		}
+	}
+	return nil
+}
+
+func appliedMigrations(q queryer) (map[int64]bool, error) {
+	var exists bool
+	err := q.QueryRow("SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to check migrations table")
+	}
+	applied := make(map[int64]bool)
+	if !exists {
+		return applied, nil
+	}
+	rows, err := q.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get applied migrations")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int64
+		err = rows.Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// migrationCatalogs returns the catalogs with tables on the shard that need the migration's catalog script.
+// Columns of the catalog table are read via jsonb, because they might not exist yet in older schema versions.
+func migrationCatalogs(q queryer, shardID int) ([]catalogMigrationData, error) {
+	rows, err := q.Query("SELECT id, coalesce(to_jsonb(c)->>'index_type', $2), "+
+		"coalesce((to_jsonb(c)->>'index_segments')::int, $5), coalesce((to_jsonb(c)->>'index_generation')::int, 0) FROM catalog c "+
+		"WHERE coalesce(to_jsonb(c)->>'layout', $3) = $3 AND coalesce((to_jsonb(c)->>'shard_id')::int, $4) = $1 ORDER BY id",
+		shardID, IndexTypeGIN, LayoutTablePerCatalog, CentralShardID, NumIndexSegments)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get catalogs")
+	}
+	defer rows.Close()
+	var catalogs []catalogMigrationData
+	for rows.Next() {
+		var data catalogMigrationData
+		var numSegments, generation int
+		err = rows.Scan(&data.CatalogID, &data.IndexType, &numSegments, &generation)
+		if err != nil {
+			return nil, err
+		}
+		data.IndexSuffix = catalogTables{catalogID: data.CatalogID}.index(generation).versionSuffix()
+		data.Segments = make([]int, numSegments)
+		for i := range data.Segments {
+			data.Segments[i] = i
+		}
+		catalogs = append(catalogs, data)
+	}
+	return catalogs, rows.Err()
+}
+
+func migrateCatalogTables(tx *sql.Tx, script *template.Template, catalogs []catalogMigrationData) error {
+	for _, catalog := range catalogs {
+		var buf bytes.Buffer
+		err := script.Execute(&buf, catalog)
+		if err != nil {
+			return errors.WithMessage(err, "failed to render catalog migration")
+		}
+		_, err = tx.Exec(buf.String())
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("failed to migrate tables of catalog_id=%v", catalog.CatalogID))
+		}
+	}
+	return nil
+}
+
+// migrate applies or reverts one migration on the database of the shard, unless it was done already.
+func (s *ServiceImpl) migrate(shardID int, migration *Migration, initial *Migration, up bool) error {
+	db, err := s.shardDB(shardID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock($1, 0)", migrationLockNamespace)
+	if err != nil {
+		return errors.WithMessage(err, "failed to lock migrations")
+	}
+	err = createMigrationsTable(tx, initial)
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		return err
+	}
+	if applied[migration.Version] == up {
+		return nil
+	}
+
+	script, catalogScript := migration.up, migration.catalogUp
+	if !up {
+		script, catalogScript = migration.down, migration.catalogDown
+	}
+
+	var catalogs []catalogMigrationData
+	if catalogScript != nil {
+		if shardID == CentralShardID {
+			catalogs, err = migrationCatalogs(tx, shardID)
+		} else {
+			catalogs, err = migrationCatalogs(s.db, shardID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Catalog tables are created from the templates, so they are changed after the templates when applying
+	// the migration and before them when reverting it.
+	if !up {
+		err = migrateCatalogTables(tx, catalogScript, catalogs)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(script)
+	if err != nil {
+		return errors.WithMessage(err, "failed to migrate")
+	}
+
+	if up {
+		err = migrateCatalogTables(tx, catalogScript, catalogs)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+	}
+	if err != nil {
+		return errors.WithMessage(err, "failed to record migration")
+	}
+
+	return tx.Commit()
+}
+
+// MigrateUp applies all pending migrations, first to the central database and then to the shards.
+func (s *ServiceImpl) MigrateUp() error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	for _, shardID := range s.migrationDatabases() {
+		for _, migration := range migrations {
+			err = s.migrate(shardID, migration, migrations[0], true)
+			if err != nil {
+				return errors.WithMessage(err, fmt.Sprintf("migration %d_%s failed on shard %d", migration.Version, migration.Name, shardID))
+			}
+		}
+	}
+	log.Printf("Database schema is at version %d", migrations[len(migrations)-1].Version)
+	return nil
+}
+
+// MigrateDown reverts the latest applied migration, first on the shards and then on the central database.
+func (s *ServiceImpl) MigrateDown() error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(s.db)
+	if err != nil {
+		return err
+	}
+	var latest *Migration
+	for _, migration := range migrations {
+		if applied[migration.Version] {
+			latest = migration
+		}
+	}
+	if latest == nil {
+		return errors.New("no migration to revert")
+	}
+	shardIDs := s.migrationDatabases()
+	for i := len(shardIDs) - 1; i >= 0; i-- {
+		err = s.migrate(shardIDs[i], latest, migrations[0], false)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("reverting migration %d_%s failed on shard %d", latest.Version, latest.Name, shardIDs[i]))
+		}
+	}
+	log.Printf("Reverted migration %d_%s", latest.Version, latest.Name)
+	return nil
+}
+
+// MigrationStatus returns the status of all migrations on the central database and the shards.
+func (s *ServiceImpl) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	for _, shardID := range s.migrationDatabases() {
+		db, err := s.shardDB(shardID)
+		if err != nil {
+			return nil, err
+		}
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("failed to get migrations on shard %d", shardID))
+		}
+		for _, migration := range migrations {
+			statuses = append(statuses, MigrationStatus{
+				ShardID: shardID,
+				Version: migration.Version,
+				Name:    migration.Name,
+				Applied: applied[migration.Version],
+			})
+		}
+	}
+	return statuses, nil
+}
+
+// CheckSchema returns an error if any migration was not applied to the central database or the shards.
+// Migrations unknown to this binary are ignored, so that older versions can run during deployments.
+func (s *ServiceImpl) CheckSchema() error {
+	statuses, err := s.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			return errors.Errorf("database schema of shard %d is missing migration %d_%s, run the migrate up command", status.ShardID, status.Version, status.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package priv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	assert.Equal(t, int64(201711126), migrations[0].Version)
+	assert.Equal(t, "init", migrations[0].Name)
+	for i := 1; i < len(migrations); i++ {
+		assert.True(t, migrations[i-1].Version < migrations[i].Version)
+	}
+}
+
+func TestMigrations_CatalogTemplate(t *testing.T) {
+	migrations, err := Migrations()
+	require.NoError(t, err)
+
+	var migration *Migration
+	for _, m := range migrations {
+		if m.Name == "track_index_positions" {
+			migration = m
+		}
+	}
+	require.NotNil(t, migration)
+	require.NotNil(t, migration.catalogUp)
+	require.NotNil(t, migration.catalogDown)
+
+	var buf bytes.Buffer
+	data := catalogMigrationData{CatalogID: 5, IndexType: IndexTypeGIN, Segments: []int{0, 1}}
+	require.NoError(t, migration.catalogUp.Execute(&buf, data))
+	assert.Contains(t, buf.String(), "ALTER TABLE track_index_5_0 ADD COLUMN positions")
+	assert.Contains(t, buf.String(), "ALTER TABLE track_index_5_1 ADD COLUMN positions")
+
+	buf.Reset()
+	data.IndexType = IndexTypeBTree
+	require.NoError(t, migration.catalogUp.Execute(&buf, data))
+	assert.NotContains(t, buf.String(), "ALTER TABLE")
+}
+
+func TestMigrations_Schema(t *testing.T) {
+	schema, err := ioutil.ReadFile("sql/schema.sql")
+	require.NoError(t, err)
+	migrations, err := Migrations()
+	require.NoError(t, err)
+	for _, migration := range migrations {
+		assert.Contains(t, string(schema), fmt.Sprintf("(%d, '%s')", migration.Version, migration.Name), "schema.sql must record all migrations")
+	}
+}
+
+func TestService_CheckSchema(t *testing.T) {
+	db := connectToDB(t)
+	service := NewService(db)
+	require.NoError(t, service.CheckSchema())
+
+	statuses, err := service.MigrationStatus()
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.True(t, status.Applied, "migration %d_%s", status.Version, status.Name)
+	}
+}
@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/acoustid/priv (interfaces: Catalog,Repository,Account,Service)
+// Source: github.com/acoustid/priv (interfaces: Catalog,Repository,Account,Service,AuditLog)
 
 // Package mock is a generated GoMock package.
 package mock
@@ -9,6 +9,7 @@ import (
 	priv "github.com/acoustid/priv"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
+	time "time"
 )
 
 // MockCatalog is a mock of Catalog interface
@@ -47,16 +48,16 @@ func (mr *MockCatalogMockRecorder) CreateCatalog() *gomock.Call {
 }
 
 // CreateTrack mocks base method
-func (m *MockCatalog) CreateTrack(arg0 string, arg1 *chromaprint.Fingerprint, arg2 priv.Metadata, arg3 bool) (bool, error) {
-	ret := m.ctrl.Call(m, "CreateTrack", arg0, arg1, arg2, arg3)
+func (m *MockCatalog) CreateTrack(arg0 string, arg1 *chromaprint.Fingerprint, arg2 time.Duration, arg3 priv.Metadata, arg4 bool) (bool, error) {
+	ret := m.ctrl.Call(m, "CreateTrack", arg0, arg1, arg2, arg3, arg4)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // CreateTrack indicates an expected call of CreateTrack
-func (mr *MockCatalogMockRecorder) CreateTrack(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateTrack", reflect.TypeOf((*MockCatalog)(nil).CreateTrack), arg0, arg1, arg2, arg3)
+func (mr *MockCatalogMockRecorder) CreateTrack(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateTrack", reflect.TypeOf((*MockCatalog)(nil).CreateTrack), arg0, arg1, arg2, arg3, arg4)
 }
 
 // DeleteCatalog mocks base method
@@ -159,6 +160,70 @@ func (mr *MockCatalogMockRecorder) Search(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Search", reflect.TypeOf((*MockCatalog)(nil).Search), arg0, arg1)
 }
 
+// Settings mocks base method
+func (m *MockCatalog) Settings() (*priv.CatalogSettings, error) {
+	ret := m.ctrl.Call(m, "Settings")
+	ret0, _ := ret[0].(*priv.CatalogSettings)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Settings indicates an expected call of Settings
+func (mr *MockCatalogMockRecorder) Settings() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Settings", reflect.TypeOf((*MockCatalog)(nil).Settings))
+}
+
+// Stats mocks base method
+func (m *MockCatalog) Stats() (*priv.CatalogStats, error) {
+	ret := m.ctrl.Call(m, "Stats")
+	ret0, _ := ret[0].(*priv.CatalogStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stats indicates an expected call of Stats
+func (mr *MockCatalogMockRecorder) Stats() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*MockCatalog)(nil).Stats))
+}
+
+// StopList mocks base method
+func (m *MockCatalog) StopList() ([]priv.StopValue, error) {
+	ret := m.ctrl.Call(m, "StopList")
+	ret0, _ := ret[0].([]priv.StopValue)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StopList indicates an expected call of StopList
+func (mr *MockCatalogMockRecorder) StopList() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StopList", reflect.TypeOf((*MockCatalog)(nil).StopList))
+}
+
+// UpdateSettings mocks base method
+func (m *MockCatalog) UpdateSettings(arg0 *priv.CatalogSettings) error {
+	ret := m.ctrl.Call(m, "UpdateSettings", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateSettings indicates an expected call of UpdateSettings
+func (mr *MockCatalogMockRecorder) UpdateSettings(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateSettings", reflect.TypeOf((*MockCatalog)(nil).UpdateSettings), arg0)
+}
+
+// UpdateStopList mocks base method
+func (m *MockCatalog) UpdateStopList() ([]priv.StopValue, error) {
+	ret := m.ctrl.Call(m, "UpdateStopList")
+	ret0, _ := ret[0].([]priv.StopValue)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateStopList indicates an expected call of UpdateStopList
+func (mr *MockCatalogMockRecorder) UpdateStopList() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateStopList", reflect.TypeOf((*MockCatalog)(nil).UpdateStopList))
+}
+
 // MockRepository is a mock of Repository interface
 type MockRepository struct {
 	ctrl     *gomock.Controller
@@ -242,6 +307,32 @@ func (m *MockAccount) EXPECT() *MockAccountMockRecorder {
 	return m.recorder
 }
 
+// CustomLimits mocks base method
+func (m *MockAccount) CustomLimits() (*priv.CustomLimits, error) {
+	ret := m.ctrl.Call(m, "CustomLimits")
+	ret0, _ := ret[0].(*priv.CustomLimits)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CustomLimits indicates an expected call of CustomLimits
+func (mr *MockAccountMockRecorder) CustomLimits() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CustomLimits", reflect.TypeOf((*MockAccount)(nil).CustomLimits))
+}
+
+// Limits mocks base method
+func (m *MockAccount) Limits() (*priv.Limits, error) {
+	ret := m.ctrl.Call(m, "Limits")
+	ret0, _ := ret[0].(*priv.Limits)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Limits indicates an expected call of Limits
+func (mr *MockAccountMockRecorder) Limits() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Limits", reflect.TypeOf((*MockAccount)(nil).Limits))
+}
+
 // Repository mocks base method
 func (m *MockAccount) Repository() priv.Repository {
 	ret := m.ctrl.Call(m, "Repository")
@@ -254,6 +345,31 @@ func (mr *MockAccountMockRecorder) Repository() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Repository", reflect.TypeOf((*MockAccount)(nil).Repository))
 }
 
+// UpdateCustomLimits mocks base method
+func (m *MockAccount) UpdateCustomLimits(arg0 *priv.CustomLimits) error {
+	ret := m.ctrl.Call(m, "UpdateCustomLimits", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateCustomLimits indicates an expected call of UpdateCustomLimits
+func (mr *MockAccountMockRecorder) UpdateCustomLimits(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateCustomLimits", reflect.TypeOf((*MockAccount)(nil).UpdateCustomLimits), arg0)
+}
+
+// Usage mocks base method
+func (m *MockAccount) Usage(arg0 time.Time, arg1 time.Time) ([]priv.DailyUsage, error) {
+	ret := m.ctrl.Call(m, "Usage", arg0, arg1)
+	ret0, _ := ret[0].([]priv.DailyUsage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Usage indicates an expected call of Usage
+func (mr *MockAccountMockRecorder) Usage(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Usage", reflect.TypeOf((*MockAccount)(nil).Usage), arg0, arg1)
+}
+
 // MockService is a mock of Service interface
 type MockService struct {
 	ctrl     *gomock.Controller
@@ -277,6 +393,19 @@ func (m *MockService) EXPECT() *MockServiceMockRecorder {
 	return m.recorder
 }
 
+// CreateAPIKey mocks base method
+func (m *MockService) CreateAPIKey(arg0 string, arg1 string, arg2 priv.Permissions) (*priv.APIKey, error) {
+	ret := m.ctrl.Call(m, "CreateAPIKey", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*priv.APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateAPIKey indicates an expected call of CreateAPIKey
+func (mr *MockServiceMockRecorder) CreateAPIKey(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAPIKey", reflect.TypeOf((*MockService)(nil).CreateAPIKey), arg0, arg1, arg2)
+}
+
 // GetAccount mocks base method
 func (m *MockService) GetAccount(arg0 string) (priv.Account, error) {
 	ret := m.ctrl.Call(m, "GetAccount", arg0)
@@ -290,6 +419,70 @@ func (mr *MockServiceMockRecorder) GetAccount(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAccount", reflect.TypeOf((*MockService)(nil).GetAccount), arg0)
 }
 
+// GetAccountPurge mocks base method
+func (m *MockService) GetAccountPurge(arg0 string) (*priv.AccountPurge, error) {
+	ret := m.ctrl.Call(m, "GetAccountPurge", arg0)
+	ret0, _ := ret[0].(*priv.AccountPurge)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAccountPurge indicates an expected call of GetAccountPurge
+func (mr *MockServiceMockRecorder) GetAccountPurge(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAccountPurge", reflect.TypeOf((*MockService)(nil).GetAccountPurge), arg0)
+}
+
+// ListAPIKeys mocks base method
+func (m *MockService) ListAPIKeys(arg0 string) ([]priv.APIKey, error) {
+	ret := m.ctrl.Call(m, "ListAPIKeys", arg0)
+	ret0, _ := ret[0].([]priv.APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListAPIKeys indicates an expected call of ListAPIKeys
+func (mr *MockServiceMockRecorder) ListAPIKeys(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListAPIKeys", reflect.TypeOf((*MockService)(nil).ListAPIKeys), arg0)
+}
+
+// RevokeAPIKey mocks base method
+func (m *MockService) RevokeAPIKey(arg0 string, arg1 int) error {
+	ret := m.ctrl.Call(m, "RevokeAPIKey", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeAPIKey indicates an expected call of RevokeAPIKey
+func (mr *MockServiceMockRecorder) RevokeAPIKey(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeAPIKey", reflect.TypeOf((*MockService)(nil).RevokeAPIKey), arg0, arg1)
+}
+
+// RotateAPIKey mocks base method
+func (m *MockService) RotateAPIKey(arg0 string, arg1 int) (*priv.APIKey, error) {
+	ret := m.ctrl.Call(m, "RotateAPIKey", arg0, arg1)
+	ret0, _ := ret[0].(*priv.APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RotateAPIKey indicates an expected call of RotateAPIKey
+func (mr *MockServiceMockRecorder) RotateAPIKey(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateAPIKey", reflect.TypeOf((*MockService)(nil).RotateAPIKey), arg0, arg1)
+}
+
+// StartAccountPurge mocks base method
+func (m *MockService) StartAccountPurge(arg0 string, arg1 priv.PurgePolicy) (*priv.AccountPurge, error) {
+	ret := m.ctrl.Call(m, "StartAccountPurge", arg0, arg1)
+	ret0, _ := ret[0].(*priv.AccountPurge)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StartAccountPurge indicates an expected call of StartAccountPurge
+func (mr *MockServiceMockRecorder) StartAccountPurge(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartAccountPurge", reflect.TypeOf((*MockService)(nil).StartAccountPurge), arg0, arg1)
+}
+
 // Status mocks base method
 func (m *MockService) Status() bool {
 	ret := m.ctrl.Call(m, "Status")
@@ -301,3 +494,64 @@ func (m *MockService) Status() bool {
 func (mr *MockServiceMockRecorder) Status() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Status", reflect.TypeOf((*MockService)(nil).Status))
 }
+
+// ValidateAPIKey mocks base method
+func (m *MockService) ValidateAPIKey(arg0 string) (*priv.Principal, error) {
+	ret := m.ctrl.Call(m, "ValidateAPIKey", arg0)
+	ret0, _ := ret[0].(*priv.Principal)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ValidateAPIKey indicates an expected call of ValidateAPIKey
+func (mr *MockServiceMockRecorder) ValidateAPIKey(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ValidateAPIKey", reflect.TypeOf((*MockService)(nil).ValidateAPIKey), arg0)
+}
+
+// MockAuditLog is a mock of AuditLog interface
+type MockAuditLog struct {
+	ctrl     *gomock.Controller
+	recorder *MockAuditLogMockRecorder
+}
+
+// MockAuditLogMockRecorder is the mock recorder for MockAuditLog
+type MockAuditLogMockRecorder struct {
+	mock *MockAuditLog
+}
+
+// NewMockAuditLog creates a new mock instance
+func NewMockAuditLog(ctrl *gomock.Controller) *MockAuditLog {
+	mock := &MockAuditLog{ctrl: ctrl}
+	mock.recorder = &MockAuditLogMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockAuditLog) EXPECT() *MockAuditLogMockRecorder {
+	return m.recorder
+}
+
+// Query mocks base method
+func (m *MockAuditLog) Query(arg0 string, arg1 *priv.AuditFilter) ([]priv.AuditEntry, error) {
+	ret := m.ctrl.Call(m, "Query", arg0, arg1)
+	ret0, _ := ret[0].([]priv.AuditEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Query indicates an expected call of Query
+func (mr *MockAuditLogMockRecorder) Query(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Query", reflect.TypeOf((*MockAuditLog)(nil).Query), arg0, arg1)
+}
+
+// Record mocks base method
+func (m *MockAuditLog) Record(arg0 *priv.AuditEntry) error {
+	ret := m.ctrl.Call(m, "Record", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Record indicates an expected call of Record
+func (mr *MockAuditLogMockRecorder) Record(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Record", reflect.TypeOf((*MockAuditLog)(nil).Record), arg0)
+}
@@ -0,0 +1,58 @@
+package priv
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// Partition is the part of each catalog's tracks searched by one API node, when the index
+// is split across several nodes. Tracks are assigned to partitions by a multiplicative hash of their ID,
+// which is simple enough to be computed in index queries.
+type Partition struct {
+	Index int
+	Count int
+}
+
+// ParsePartition parses a partition in the INDEX/COUNT format, e.g. 0/4 for the first of four partitions.
+func ParsePartition(s string) (*Partition, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid partition %q, expected INDEX/COUNT", s)
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.Errorf("invalid partition index in %q", s)
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, errors.Errorf("invalid partition count in %q", s)
+	}
+	if count < 1 || index < 0 || index >= count {
+		return nil, errors.Errorf("partition index in %q must be between 0 and the partition count", s)
+	}
+	return &Partition{Index: index, Count: count}, nil
+}
+
+func (p *Partition) String() string {
+	return strconv.Itoa(p.Index) + "/" + strconv.Itoa(p.Count)
+}
+
+// Contains returns true if the track belongs to the partition. All tracks belong to a nil partition.
+func (p *Partition) Contains(trackID int) bool {
+	if p == nil || p.Count <= 1 {
+		return true
+	}
+	h := uint32(trackID) * 2654435761
+	return int((h>>16)%uint32(p.Count)) == p.Index
+}
+
+// condition returns an SQL condition, starting with AND, that matches tracks in the partition. It's
+// the same hash as in Contains, track IDs are positive 32-bit integers so the product fits into a bigint.
+func (p *Partition) condition(column string) string {
+	if p == nil || p.Count <= 1 {
+		return ""
+	}
+	return fmt.Sprintf(" AND %s::bigint * 2654435761 %% 4294967296 / 65536 %% %d = %d", column, p.Count, p.Index)
+}
@@ -0,0 +1,49 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParsePartition(t *testing.T) {
+	p, err := ParsePartition("1/3")
+	require.NoError(t, err)
+	assert.Equal(t, &Partition{Index: 1, Count: 3}, p)
+	assert.Equal(t, "1/3", p.String())
+
+	for _, s := range []string{"", "1", "a/3", "1/b", "3/3", "-1/3", "0/0"} {
+		_, err := ParsePartition(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestPartition_Contains(t *testing.T) {
+	partitions := []*Partition{{Index: 0, Count: 3}, {Index: 1, Count: 3}, {Index: 2, Count: 3}}
+	sizes := make([]int, len(partitions))
+	for trackID := 1; trackID <= 3000; trackID++ {
+		n := 0
+		for i, p := range partitions {
+			if p.Contains(trackID) {
+				sizes[i]++
+				n++
+			}
+		}
+		require.Equal(t, 1, n, "track %d must be in exactly one partition", trackID)
+	}
+	for _, size := range sizes {
+		assert.InDelta(t, 1000, size, 100)
+	}
+
+	var all *Partition
+	assert.True(t, all.Contains(123))
+}
+
+func TestPartition_Condition(t *testing.T) {
+	var all *Partition
+	assert.Equal(t, "", all.condition("track_id"))
+	assert.Equal(t, "", (&Partition{Index: 0, Count: 1}).condition("track_id"))
+
+	p := &Partition{Index: 1, Count: 3}
+	assert.Equal(t, " AND i.track_id::bigint * 2654435761 % 4294967296 / 65536 % 3 = 1", p.condition("i.track_id"))
+}
@@ -0,0 +1,103 @@
+package priv
+
+import (
+	"fmt"
+	"path"
+)
+
+const (
+	ScopeCatalogRead  = "catalog:read"
+	ScopeCatalogWrite = "catalog:write"
+	ScopeSearch       = "search"
+	ScopeAdmin        = "admin"
+)
+
+var Scopes = []string{ScopeCatalogRead, ScopeCatalogWrite, ScopeSearch, ScopeAdmin}
+
+func IsValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions restrict what a principal is allowed to do. Empty lists mean
+// that the principal is not restricted.
+type Permissions struct {
+	Scopes   []string // allowed scopes
+	Catalogs []string // allowed catalog names, can be patterns like "test-*"
+}
+
+func (p *Permissions) Validate() error {
+	for _, scope := range p.Scopes {
+		if !IsValidScope(scope) {
+			return fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+	for _, pattern := range p.Catalogs {
+		_, err := path.Match(pattern, "")
+		if err != nil || pattern == "" {
+			return fmt.Errorf("invalid catalog pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (p *Permissions) HasScope(scope string) bool {
+	if len(p.Scopes) == 0 {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Permissions) CanAccessCatalog(name string) bool {
+	if len(p.Catalogs) == 0 {
+		return true
+	}
+	for _, pattern := range p.Catalogs {
+		matched, err := path.Match(pattern, name)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is an authenticated account together with its permissions.
+type Principal struct {
+	Account    string
+	TokenID    string // ID of the search token, if the principal was authenticated with one
+	Credential string // credential used for authentication, e.g. api_key:1, if it's not shared by the whole account
+	RateLimit  int    // maximum number of requests per minute, unlimited if zero
+	Permissions
+}
+
+// NewPrincipal returns a principal with unrestricted access to the account.
+func NewPrincipal(account string) *Principal {
+	return &Principal{Account: account}
+}
+
+// auditName identifies the principal in the audit log.
+func (p *Principal) auditName() string {
+	if p.Credential != "" {
+		return p.Credential
+	}
+	if p.TokenID != "" {
+		return "search_token:" + p.TokenID
+	}
+	return "account"
+}
+
+func (p *Principal) rateLimitKey() string {
+	if p.TokenID != "" {
+		return "token:" + p.TokenID
+	}
+	return "account:" + p.Account
+}
@@ -0,0 +1,43 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPermissions_Validate(t *testing.T) {
+	assert.NoError(t, (&Permissions{}).Validate())
+	assert.NoError(t, (&Permissions{Scopes: Scopes, Catalogs: []string{"prod", "test-*"}}).Validate())
+	assert.Error(t, (&Permissions{Scopes: []string{"catalog:delete"}}).Validate())
+	assert.Error(t, (&Permissions{Catalogs: []string{"[prod"}}).Validate())
+	assert.Error(t, (&Permissions{Catalogs: []string{""}}).Validate())
+}
+
+func TestPermissions_HasScope(t *testing.T) {
+	unrestricted := &Permissions{}
+	assert.True(t, unrestricted.HasScope(ScopeCatalogWrite))
+	assert.True(t, unrestricted.HasScope(ScopeAdmin))
+
+	readOnly := &Permissions{Scopes: []string{ScopeCatalogRead, ScopeSearch}}
+	assert.True(t, readOnly.HasScope(ScopeCatalogRead))
+	assert.True(t, readOnly.HasScope(ScopeSearch))
+	assert.False(t, readOnly.HasScope(ScopeCatalogWrite))
+	assert.False(t, readOnly.HasScope(ScopeAdmin))
+}
+
+func TestPermissions_CanAccessCatalog(t *testing.T) {
+	unrestricted := &Permissions{}
+	assert.True(t, unrestricted.CanAccessCatalog("prod"))
+
+	restricted := &Permissions{Catalogs: []string{"prod", "test-*"}}
+	assert.True(t, restricted.CanAccessCatalog("prod"))
+	assert.True(t, restricted.CanAccessCatalog("test-1"))
+	assert.False(t, restricted.CanAccessCatalog("prod2"))
+	assert.False(t, restricted.CanAccessCatalog("staging"))
+}
+
+func TestPrincipal_AuditName(t *testing.T) {
+	assert.Equal(t, "account", NewPrincipal("acc1").auditName())
+	assert.Equal(t, "api_key:1", (&Principal{Account: "acc1", Credential: "api_key:1"}).auditName())
+	assert.Equal(t, "search_token:abc", (&Principal{Account: "acc1", TokenID: "abc"}).auditName())
+}
@@ -0,0 +1,411 @@
+package priv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAccountNotFound        = errors.New("account not found")
+	ErrAccountDeleted         = errors.New("account was deleted")
+	ErrPurgeReportKeyMissing  = errors.New("no key for signing purge reports")
+	ErrInvalidPurgeReport     = errors.New("invalid purge report signature")
+	ErrPurgeReportUnsupported = errors.New("unsupported purge report signing key")
+)
+
+// purgeBatchSize is the maximum number of rows deleted in one transaction while purging an account.
+const purgeBatchSize = 10000
+
+// minPurgeReportSecretLength is the minimal length of secrets used for signing purge reports.
+const minPurgeReportSecretLength = 32
+
+// PurgePolicy selects data of a purged account that is kept. The account itself is only
+// deleted if nothing is kept, otherwise it stays marked as deleted.
+type PurgePolicy struct {
+	KeepUsage    bool `json:"keep_usage"`
+	KeepAuditLog bool `json:"keep_audit_log"`
+}
+
+// AccountPurge is the progress of deleting all data of an account.
+type AccountPurge struct {
+	Account         string
+	AccountID       int
+	Policy          PurgePolicy
+	Started         time.Time
+	Finished        *time.Time
+	Catalogs        int
+	Tracks          int64
+	APIKeys         int64
+	UsageRecords    int64
+	AuditLogEntries int64
+	Report          []byte // signed report, when the purge is finished
+}
+
+const accountPurgeColumns = "account_id, external_id, keep_usage, keep_audit_log, started, finished, " +
+	"catalogs, tracks, api_keys, usage_records, audit_log_entries, report"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAccountPurge(row rowScanner) (*AccountPurge, error) {
+	var purge AccountPurge
+	var report sql.NullString
+	err := row.Scan(&purge.AccountID, &purge.Account, &purge.Policy.KeepUsage, &purge.Policy.KeepAuditLog,
+		&purge.Started, &purge.Finished, &purge.Catalogs, &purge.Tracks, &purge.APIKeys,
+		&purge.UsageRecords, &purge.AuditLogEntries, &report)
+	if err != nil {
+		return nil, err
+	}
+	if report.Valid {
+		purge.Report = []byte(report.String)
+	}
+	return &purge, nil
+}
+
+// PurgeReportKey signs purge reports, so that they can be shown as a proof of the deletion.
+type PurgeReportKey struct {
+	ID     string
+	Secret []byte
+}
+
+// ParsePurgeReportKey parses a key in the id:secret format.
+func ParsePurgeReportKey(s string) (*PurgeReportKey, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, errors.New("invalid purge report key, expected id:secret")
+	}
+	if len(parts[1]) < minPurgeReportSecretLength {
+		return nil, fmt.Errorf("secret of purge report key %s is shorter than %d characters", parts[0], minPurgeReportSecretLength)
+	}
+	return &PurgeReportKey{ID: parts[0], Secret: []byte(parts[1])}, nil
+}
+
+// PurgeReport lists what was deleted when an account was purged.
+type PurgeReport struct {
+	Account         string      `json:"account"`
+	Policy          PurgePolicy `json:"policy"`
+	Started         time.Time   `json:"started"`
+	Finished        time.Time   `json:"finished"`
+	Catalogs        int         `json:"catalogs"`
+	Tracks          int64       `json:"tracks"`
+	APIKeys         int64       `json:"api_keys"`
+	UsageRecords    int64       `json:"usage_records"`
+	AuditLogEntries int64       `json:"audit_log_entries"`
+}
+
+// SignedPurgeReport is a purge report with a HMAC-SHA256 signature of the report's JSON encoding.
+type SignedPurgeReport struct {
+	Report    json.RawMessage `json:"report"`
+	KeyID     string          `json:"key_id"`
+	Signature string          `json:"signature"`
+}
+
+func (k *PurgeReportKey) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Sign returns the signed report, encoded as JSON.
+func (k *PurgeReportKey) Sign(report *PurgeReport) ([]byte, error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&SignedPurgeReport{Report: data, KeyID: k.ID, Signature: encodeBase64URL(k.sign(data))})
+}
+
+// Verify checks the signature of the signed report and returns the report.
+func (k *PurgeReportKey) Verify(data []byte) (*PurgeReport, error) {
+	var signed SignedPurgeReport
+	err := json.Unmarshal(data, &signed)
+	if err != nil {
+		return nil, errors.WithMessage(err, "malformed purge report")
+	}
+	if signed.KeyID != k.ID {
+		return nil, ErrPurgeReportUnsupported
+	}
+	signature, err := decodeBase64URL(signed.Signature)
+	if err != nil || !hmac.Equal(signature, k.sign(signed.Report)) {
+		return nil, ErrInvalidPurgeReport
+	}
+	var report PurgeReport
+	err = json.Unmarshal(signed.Report, &report)
+	if err != nil {
+		return nil, errors.WithMessage(err, "malformed purge report")
+	}
+	return &report, nil
+}
+
+// GetAccountPurge returns the last purge of the account, or nil if it was never purged.
+func (s *ServiceImpl) GetAccountPurge(externalID string) (*AccountPurge, error) {
+	row := s.db.QueryRow("SELECT "+accountPurgeColumns+" FROM account_purge WHERE external_id = $1 ORDER BY started DESC LIMIT 1", externalID)
+	purge, err := scanAccountPurge(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "failed to get account purge")
+	}
+	return purge, nil
+}
+
+// lockNotDeleted locks the account until the end of the transaction, so that its purge can't start before
+// the transaction's data is committed, and returns ErrAccountDeleted if the purge already started.
+func (account *AccountImpl) lockNotDeleted(tx *sql.Tx) error {
+	var id int
+	err := tx.QueryRow("SELECT id FROM account WHERE id = $1 AND deleted IS NULL FOR KEY SHARE", account.id).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrAccountDeleted
+	} else if err != nil {
+		return errors.WithMessage(err, "failed to lock account")
+	}
+	return nil
+}
+
+// beginAccountPurge marks the account as deleted, so that it can't be used anymore. If the
+// account is already being purged, the existing purge with its original policy is returned.
+func (s *ServiceImpl) beginAccountPurge(externalID string, policy PurgePolicy) (*AccountPurge, error) {
+	if s.PurgeReportKey == nil {
+		return nil, ErrPurgeReportKeyMissing
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	var id int
+	var deleted bool
+	err = tx.QueryRow("SELECT id, deleted IS NOT NULL FROM account WHERE external_id = $1 FOR UPDATE", externalID).Scan(&id, &deleted)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "failed to get account")
+	}
+
+	if !deleted {
+		_, err = tx.Exec("UPDATE account SET deleted = now() WHERE id = $1", id)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to mark account as deleted")
+		}
+		_, err = tx.Exec("INSERT INTO account_purge (account_id, external_id, keep_usage, keep_audit_log) VALUES ($1, $2, $3, $4)",
+			id, externalID, policy.KeepUsage, policy.KeepAuditLog)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to insert account purge")
+		}
+	}
+
+	purge, err := scanAccountPurge(tx.QueryRow("SELECT "+accountPurgeColumns+" FROM account_purge WHERE account_id = $1", id))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get account purge")
+	}
+
+	event := &ChangeEvent{Type: ChangeAccountDeleted, AccountID: id, Account: externalID}
+	err = notifyChange(tx, event)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.WithMessage(err, "commit failed")
+	}
+
+	s.handleChange(event)
+	if !deleted {
+		log.Printf("Started purge of account_id=%v", id)
+	}
+	return purge, nil
+}
+
+// StartAccountPurge starts deleting all data of the account in the background. Calling it
+// again for the same account resumes the purge, e.g. after the server was restarted.
+func (s *ServiceImpl) StartAccountPurge(externalID string, policy PurgePolicy) (*AccountPurge, error) {
+	purge, err := s.beginAccountPurge(externalID, policy)
+	if err != nil {
+		return nil, err
+	}
+	if purge.Finished == nil {
+		go func() {
+			_, err := s.runAccountPurge(purge)
+			if err != nil {
+				log.Printf("Failed to purge account_id=%v: %v", purge.AccountID, err)
+			}
+		}()
+	}
+	return purge, nil
+}
+
+// PurgeAccount deletes all data of the account and returns the finished purge. If it fails,
+// it can be called again to resume the purge.
+func (s *ServiceImpl) PurgeAccount(externalID string, policy PurgePolicy) (*AccountPurge, error) {
+	purge, err := s.beginAccountPurge(externalID, policy)
+	if err != nil {
+		return nil, err
+	}
+	if purge.Finished != nil {
+		return purge, nil
+	}
+	return s.runAccountPurge(purge)
+}
+
+// runAccountPurge deletes the account's data step by step. Each step is committed together
+// with its counts, so the purge can be interrupted at any point and run again, even concurrently.
+func (s *ServiceImpl) runAccountPurge(purge *AccountPurge) (*AccountPurge, error) {
+	err := s.purgeRows(purge.AccountID, "api_key", "id", "api_keys")
+	if err != nil {
+		return nil, err
+	}
+
+	account := &AccountImpl{db: s.db, service: s, id: purge.AccountID}
+	repo := &RepositoryImpl{db: s.db, account: account}
+	for {
+		var names []string
+		rows, err := s.db.Query("SELECT name FROM catalog WHERE account_id = $1 ORDER BY name", purge.AccountID)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to list catalogs")
+		}
+		for rows.Next() {
+			var name string
+			err = rows.Scan(&name)
+			if err != nil {
+				rows.Close()
+				return nil, errors.WithMessage(err, "failed to list catalogs")
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+		if len(names) == 0 {
+			break
+		}
+		for _, name := range names {
+			catalog := repo.Catalog(name).(*CatalogImpl)
+			err = catalog.deleteCatalog(func(stx *shardedTx, tables catalogTables) error {
+				var tracks int64
+				err := stx.shardTx.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", tables.from("track", "t"))).Scan(&tracks)
+				if err != nil {
+					return errors.WithMessage(err, "failed to count tracks")
+				}
+				_, err = stx.tx.Exec("UPDATE account_purge SET catalogs = catalogs + 1, tracks = tracks + $2 WHERE account_id = $1", purge.AccountID, tracks)
+				if err != nil {
+					return errors.WithMessage(err, "failed to update account purge")
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, errors.WithMessage(err, fmt.Sprintf("failed to delete catalog %s", name))
+			}
+		}
+	}
+
+	if !purge.Policy.KeepUsage {
+		err = s.purgeRows(purge.AccountID, "usage", "ctid", "usage_records")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !purge.Policy.KeepAuditLog {
+		err = s.purgeRows(purge.AccountID, "audit_log", "id", "audit_log_entries")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.finishAccountPurge(purge.AccountID)
+}
+
+// purgeRows deletes the account's rows from the table in batches, and adds their number to the counter.
+func (s *ServiceImpl) purgeRows(accountID int, table string, key string, counter string) error {
+	deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE %s IN (SELECT %s FROM %s WHERE account_id = $1 LIMIT %d)", table, key, key, table, purgeBatchSize)
+	updateQuery := fmt.Sprintf("UPDATE account_purge SET %s = %s + $2 WHERE account_id = $1", counter, counter)
+	for {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return errors.WithMessage(err, "failed to open transaction")
+		}
+		result, err := tx.Exec(deleteQuery, accountID)
+		if err != nil {
+			tx.Rollback()
+			return errors.WithMessage(err, fmt.Sprintf("failed to delete from %s", table))
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return errors.WithMessage(err, fmt.Sprintf("failed to delete from %s", table))
+		}
+		if deleted == 0 {
+			tx.Rollback()
+			return nil
+		}
+		_, err = tx.Exec(updateQuery, accountID, deleted)
+		if err != nil {
+			tx.Rollback()
+			return errors.WithMessage(err, "failed to update account purge")
+		}
+		err = tx.Commit()
+		if err != nil {
+			return errors.WithMessage(err, "commit failed")
+		}
+	}
+}
+
+// finishAccountPurge signs the report. The account itself is kept and stays marked as deleted, so that it's
+// not created again if one of its credentials is still accepted.
+func (s *ServiceImpl) finishAccountPurge(accountID int) (*AccountPurge, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	purge, err := scanAccountPurge(tx.QueryRow("SELECT "+accountPurgeColumns+" FROM account_purge WHERE account_id = $1 FOR UPDATE", accountID))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get account purge")
+	}
+	if purge.Finished != nil {
+		return purge, nil
+	}
+
+	var finished time.Time
+	err = tx.QueryRow("SELECT now()").Scan(&finished)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get current time")
+	}
+	report, err := s.PurgeReportKey.Sign(&PurgeReport{
+		Account:         purge.Account,
+		Policy:          purge.Policy,
+		Started:         purge.Started.UTC(),
+		Finished:        finished.UTC(),
+		Catalogs:        purge.Catalogs,
+		Tracks:          purge.Tracks,
+		APIKeys:         purge.APIKeys,
+		UsageRecords:    purge.UsageRecords,
+		AuditLogEntries: purge.AuditLogEntries,
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to sign purge report")
+	}
+	_, err = tx.Exec("UPDATE account_purge SET finished = $2, report = $3 WHERE account_id = $1", accountID, finished, string(report))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to update account purge")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.WithMessage(err, "commit failed")
+	}
+
+	purge.Finished = &finished
+	purge.Report = report
+	log.Printf("Finished purge of account_id=%v catalogs=%v tracks=%v", accountID, purge.Catalogs, purge.Tracks)
+	return purge, nil
+}
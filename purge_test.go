@@ -0,0 +1,173 @@
+package priv
+
+import (
+	"fmt"
+	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPurgeReportKey = "test:0123456789abcdef0123456789abcdef"
+
+func TestParsePurgeReportKey(t *testing.T) {
+	key, err := ParsePurgeReportKey(testPurgeReportKey)
+	require.NoError(t, err)
+	assert.Equal(t, "test", key.ID)
+	assert.Equal(t, []byte("0123456789abcdef0123456789abcdef"), key.Secret)
+
+	_, err = ParsePurgeReportKey("test:short")
+	assert.Error(t, err)
+	_, err = ParsePurgeReportKey("0123456789abcdef0123456789abcdef")
+	assert.Error(t, err)
+}
+
+func TestPurgeReportKey_Verify(t *testing.T) {
+	key, err := ParsePurgeReportKey(testPurgeReportKey)
+	require.NoError(t, err)
+
+	report := &PurgeReport{Account: "acc1", Catalogs: 2, Tracks: 10}
+	data, err := key.Sign(report)
+	require.NoError(t, err)
+
+	verified, err := key.Verify(data)
+	require.NoError(t, err)
+	assert.Equal(t, report, verified)
+
+	tampered := strings.Replace(string(data), `"tracks":10`, `"tracks":1`, 1)
+	_, err = key.Verify([]byte(tampered))
+	assert.Equal(t, ErrInvalidPurgeReport, err)
+
+	otherKey, err := ParsePurgeReportKey("test:fedcba9876543210fedcba9876543210")
+	require.NoError(t, err)
+	_, err = otherKey.Verify(data)
+	assert.Equal(t, ErrInvalidPurgeReport, err)
+}
+
+func TestService_PurgeAccount(t *testing.T) {
+	db := connectToDB(t)
+	service := NewService(db)
+	key, err := ParsePurgeReportKey(testPurgeReportKey)
+	require.NoError(t, err)
+	service.PurgeReportKey = key
+
+	externalID := fmt.Sprintf("test:%s:%d", t.Name(), time.Now().UnixNano())
+	account, err := service.GetAccount(externalID)
+	require.NoError(t, err)
+	accountID := account.(*AccountImpl).id
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+	for _, name := range []string{"cat1", "cat2"} {
+		catalog := account.Repository().Catalog(name)
+		require.NoError(t, catalog.CreateCatalog())
+		for _, id := range []string{"fp1", "fp2"} {
+			_, err = catalog.CreateTrack(id, fp, 0, nil, true)
+			require.NoError(t, err)
+		}
+	}
+	_, err = service.CreateAPIKey(externalID, "test", Permissions{})
+	require.NoError(t, err)
+	require.NoError(t, NewAuditLog(db).Record(&AuditEntry{Account: externalID, Principal: "test", Action: AuditCatalogPut, Catalog: "cat1"}))
+
+	purge, err := service.GetAccountPurge(externalID)
+	require.NoError(t, err)
+	assert.Nil(t, purge)
+
+	purge, err = service.PurgeAccount(externalID, PurgePolicy{KeepAuditLog: true})
+	require.NoError(t, err)
+	require.NotNil(t, purge.Finished)
+	assert.Equal(t, 2, purge.Catalogs)
+	assert.Equal(t, int64(4), purge.Tracks)
+	assert.Equal(t, int64(1), purge.APIKeys)
+	assert.Equal(t, int64(0), purge.AuditLogEntries)
+
+	report, err := key.Verify(purge.Report)
+	require.NoError(t, err)
+	assert.Equal(t, externalID, report.Account)
+	assert.Equal(t, PurgePolicy{KeepAuditLog: true}, report.Policy)
+	assert.Equal(t, 2, report.Catalogs)
+	assert.Equal(t, int64(4), report.Tracks)
+
+	var catalogs int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM catalog WHERE account_id = $1", accountID).Scan(&catalogs))
+	assert.Equal(t, 0, catalogs)
+
+	_, err = service.GetAccount(externalID)
+	assert.Equal(t, ErrAccountDeleted, err)
+
+	again, err := service.PurgeAccount(externalID, PurgePolicy{})
+	require.NoError(t, err)
+	assert.Equal(t, purge.Report, again.Report, "finished purge should not run again")
+
+	stored, err := service.GetAccountPurge(externalID)
+	require.NoError(t, err)
+	assert.Equal(t, purge.Report, stored.Report)
+}
+
+func TestService_PurgeAccount_Resume(t *testing.T) {
+	db := connectToDB(t)
+	service := NewService(db)
+	key, err := ParsePurgeReportKey(testPurgeReportKey)
+	require.NoError(t, err)
+	service.PurgeReportKey = key
+
+	externalID := fmt.Sprintf("test:%s:%d", t.Name(), time.Now().UnixNano())
+	account, err := service.GetAccount(externalID)
+	require.NoError(t, err)
+	accountID := account.(*AccountImpl).id
+	require.NoError(t, account.Repository().Catalog("cat1").CreateCatalog())
+
+	// Only mark the account as deleted, as if the purge was interrupted.
+	purge, err := service.beginAccountPurge(externalID, PurgePolicy{})
+	require.NoError(t, err)
+	assert.Nil(t, purge.Finished)
+
+	purge, err = service.PurgeAccount(externalID, PurgePolicy{KeepUsage: true})
+	require.NoError(t, err)
+	require.NotNil(t, purge.Finished)
+	assert.Equal(t, PurgePolicy{}, purge.Policy, "resumed purge should keep its original policy")
+	assert.Equal(t, 1, purge.Catalogs)
+
+	_, err = key.Verify(purge.Report)
+	require.NoError(t, err)
+
+	var deleted bool
+	require.NoError(t, db.QueryRow("SELECT deleted IS NOT NULL FROM account WHERE id = $1", accountID).Scan(&deleted))
+	assert.True(t, deleted, "account should be kept marked as deleted")
+
+	_, err = service.GetAccount(externalID)
+	assert.Equal(t, ErrAccountDeleted, err)
+}
+
+func TestService_PurgeAccount_CreateCatalog(t *testing.T) {
+	db := connectToDB(t)
+	service := NewService(db)
+
+	externalID := fmt.Sprintf("test:%s:%d", t.Name(), time.Now().UnixNano())
+	account, err := service.GetAccount(externalID)
+	require.NoError(t, err)
+
+	// The account was loaded before the purge started, like in a request that was already running.
+	_, err = service.beginAccountPurge(externalID, PurgePolicy{})
+	require.NoError(t, err)
+
+	err = account.Repository().Catalog("cat1").CreateCatalog()
+	assert.Equal(t, ErrAccountDeleted, err)
+
+	_, err = account.Repository().Catalog("cat1").CreateTrack("fp1", loadTestFingerprint(t, "calibre_sunrise"), 0, nil, true)
+	assert.Equal(t, ErrAccountDeleted, errors.Cause(err))
+}
+
+func TestService_PurgeAccount_NotFound(t *testing.T) {
+	service := NewService(connectToDB(t))
+	key, err := ParsePurgeReportKey(testPurgeReportKey)
+	require.NoError(t, err)
+	service.PurgeReportKey = key
+
+	_, err = service.PurgeAccount(fmt.Sprintf("test:%s:%d", t.Name(), time.Now().UnixNano()), PurgePolicy{})
+	assert.Equal(t, ErrAccountNotFound, err)
+}
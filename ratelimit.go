@@ -0,0 +1,85 @@
+package priv
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the number of requests per interval for each key. It uses
+// token buckets, so a key can use its whole interval's limit in a burst. The buckets
+// are local to the process, so each API node allows the whole limit.
+type RateLimiter struct {
+	mu          sync.Mutex
+	buckets     map[string]*rateLimitBucket
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+type rateLimitBucket struct {
+	tokens   float64
+	interval time.Duration
+	updated  time.Time
+}
+
+// RateLimitStatus describes a key's limit after a request was made.
+type RateLimitStatus struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration // time until the whole limit is available again
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*rateLimitBucket), now: time.Now}
+}
+
+// Allow returns true if another request can be made with the key.
+func (l *RateLimiter) Allow(key string, perMinute int) bool {
+	return l.Take(key, perMinute, time.Minute).Allowed
+}
+
+// Take makes a request with the key, if it's within the limit of requests per interval.
+func (l *RateLimiter) Take(key string, limit int, interval time.Duration) RateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.cleanup(now)
+
+	capacity := float64(limit)
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &rateLimitBucket{tokens: capacity, interval: interval, updated: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens += float64(now.Sub(bucket.updated)) / float64(interval) * capacity
+		if bucket.tokens > capacity {
+			bucket.tokens = capacity
+		}
+		bucket.interval = interval
+		bucket.updated = now
+	}
+
+	status := RateLimitStatus{Limit: limit}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		status.Allowed = true
+	}
+	status.Remaining = int(math.Floor(bucket.tokens))
+	status.Reset = time.Duration((capacity - bucket.tokens) / capacity * float64(interval))
+	return status
+}
+
+// cleanup removes buckets that have been refilled, they are the same as new buckets.
+func (l *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < time.Minute {
+		return
+	}
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= bucket.interval {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastCleanup = now
+}
@@ -0,0 +1,47 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow("a", 3), "request %d", i)
+	}
+	assert.False(t, limiter.Allow("a", 3))
+	assert.True(t, limiter.Allow("b", 3))
+
+	now = now.Add(time.Second * 20)
+	assert.True(t, limiter.Allow("a", 3))
+	assert.False(t, limiter.Allow("a", 3))
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow("a", 3), "request %d", i)
+	}
+	assert.False(t, limiter.Allow("a", 3))
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestRateLimiter_Take(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return now }
+
+	status := limiter.Take("a", 2, time.Second)
+	assert.Equal(t, RateLimitStatus{Allowed: true, Limit: 2, Remaining: 1, Reset: time.Millisecond * 500}, status)
+	status = limiter.Take("a", 2, time.Second)
+	assert.Equal(t, RateLimitStatus{Allowed: true, Limit: 2, Remaining: 0, Reset: time.Second}, status)
+	status = limiter.Take("a", 2, time.Second)
+	assert.Equal(t, RateLimitStatus{Allowed: false, Limit: 2, Remaining: 0, Reset: time.Second}, status)
+
+	now = now.Add(time.Millisecond * 500)
+	status = limiter.Take("a", 2, time.Second)
+	assert.Equal(t, RateLimitStatus{Allowed: true, Limit: 2, Remaining: 0, Reset: time.Second}, status)
+}
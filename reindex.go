@@ -0,0 +1,373 @@
+package priv
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+// ReindexBatchSize is the number of tracks indexed in one transaction while reindexing a catalog.
+const ReindexBatchSize = 1000
+
+// ReindexProgress is the state of a running reindex or layout conversion of a catalog, Layout, IndexType and
+// IndexParams describe the new index.
+type ReindexProgress struct {
+	Layout      string
+	IndexType   string
+	IndexParams IndexParams
+	NumTracks   int
+	NumIndexed  int
+	Started     time.Time
+	Updated     time.Time
+}
+
+func loadReindexProgress(q queryer, catalogID int) (*ReindexProgress, error) {
+	var progress ReindexProgress
+	dest := append([]interface{}{&progress.Layout, &progress.IndexType}, progress.IndexParams.scanDest()...)
+	dest = append(dest, &progress.NumTracks, &progress.NumIndexed, &progress.Started, &progress.Updated)
+	err := q.QueryRow("SELECT layout, index_type, query_bits, segments, values_per_segment, num_tracks, num_indexed, started, updated "+
+		"FROM catalog_reindex WHERE catalog_id = $1", catalogID).Scan(dest...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.WithMessage(err, "failed to get reindex progress")
+	}
+	return &progress, nil
+}
+
+// startReindexProgress records a new reindex in the catalog stats, replacing leftovers of a failed one.
+func (s *ServiceImpl) startReindexProgress(catalogID int, layout string, indexType string, params IndexParams, numTracks int) error {
+	_, err := s.db.Exec("INSERT INTO catalog_reindex (catalog_id, layout, index_type, query_bits, segments, values_per_segment, num_tracks) VALUES ($1, $2, $3, $4, $5, $6, $7) "+
+		"ON CONFLICT (catalog_id) DO UPDATE SET layout = $2, index_type = $3, query_bits = $4, segments = $5, values_per_segment = $6, num_tracks = $7, num_indexed = 0, started = now(), updated = now()",
+		catalogID, layout, indexType, params.QueryBits, params.Segments, params.ValuesPerSegment, numTracks)
+	if err != nil {
+		return errors.WithMessage(err, "failed to record reindex progress")
+	}
+	return nil
+}
+
+// updateReindexProgress records the number of tracks indexed so far.
+func (s *ServiceImpl) updateReindexProgress(catalogID int, numIndexed int) error {
+	_, err := s.db.Exec("UPDATE catalog_reindex SET num_indexed = $2, updated = now() WHERE catalog_id = $1", catalogID, numIndexed)
+	if err != nil {
+		return errors.WithMessage(err, "failed to record reindex progress")
+	}
+	return nil
+}
+
+// catalogReindex builds a new index of a catalog from the fingerprints of its tracks.
+type catalogReindex struct {
+	tables catalogTables
+	params IndexParams
+	index  fingerprintIndex
+	stop   stopList
+}
+
+// indexTracks indexes the tracks returned by the query, which must select id and fingerprint ordered by ID.
+// It returns the IDs of the indexed tracks.
+func (r *catalogReindex) indexTracks(src queryer, dst *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := src.Query(query, args...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch tracks")
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		var fingerprint []byte
+		err = rows.Scan(&id, &fingerprint)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to fetch tracks")
+		}
+		fp, err := chromaprint.ParseFingerprint(fingerprint)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to parse fingerprint")
+		}
+		err = r.index.insertTrack(dst, id, r.params.extractQuery(fp), r.stop)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch tracks")
+	}
+	return ids, nil
+}
+
+// catchUp indexes tracks that were added since the batches were read and removes tracks that were deleted in the
+// meantime. Updated tracks get a new ID, so comparing the IDs with the indexed ones, which are sorted, is enough.
+func (r *catalogReindex) catchUp(src *sql.Tx, dst *sql.Tx, indexed []int) error {
+	rows, err := src.Query("SELECT t.id FROM " + r.tables.from("track", "t") + " ORDER BY t.id")
+	if err != nil {
+		return errors.WithMessage(err, "failed to fetch track IDs")
+	}
+	defer rows.Close()
+
+	var missing []int
+	i := 0
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return errors.WithMessage(err, "failed to fetch track IDs")
+		}
+		for ; i < len(indexed) && indexed[i] < id; i++ {
+			err = r.index.deleteTrack(dst, indexed[i])
+			if err != nil {
+				return err
+			}
+		}
+		if i < len(indexed) && indexed[i] == id {
+			i++
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return errors.WithMessage(err, "failed to fetch track IDs")
+	}
+	for ; i < len(indexed); i++ {
+		err = r.index.deleteTrack(dst, indexed[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	query := fmt.Sprintf("SELECT t.id, t.fingerprint FROM %s WHERE t.id = any($1::int[]) ORDER BY t.id", r.tables.from("track", "t"))
+	_, err = r.indexTracks(src, dst, query, pq.Array(missing))
+	return err
+}
+
+// createTables creates the tables of the new index. Leftovers of a failed reindex are removed first.
+func (r *catalogReindex) createTables(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer tx.Rollback()
+
+	err = r.index.dropTables(tx)
+	if err != nil {
+		return err
+	}
+	err = r.index.createTables(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func dropIndexTables(db *sql.DB, index fingerprintIndex) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer tx.Rollback()
+
+	err = index.dropTables(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReindexCatalog rebuilds the catalog's index with new parameters.
+func (s *ServiceImpl) ReindexCatalog(catalogID int, params IndexParams) error {
+	err := params.Validate()
+	if err != nil {
+		return err
+	}
+	return s.rebuildIndex(catalogID, "", &params)
+}
+
+// rebuildIndex builds a new index of the catalog, of the given type and with the given parameters, the current ones
+// are kept if they are empty. The new index is built from the fingerprints while the catalog stays available, only
+// the final catch-up blocks modifications. The new index replaces the old one when the catalog is updated, which
+// happens in one transaction. Progress can be followed in the catalog stats.
+func (s *ServiceImpl) rebuildIndex(catalogID int, indexType string, params *IndexParams) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	// The catalog can't be changed in any other way until the new index is swapped in. The row is not locked
+	// with FOR UPDATE, because that would block the progress updates, which reference the catalog.
+	event := &ChangeEvent{Type: ChangeCatalogUpdated, CatalogID: catalogID}
+	var shardID, generation int
+	var layout, oldIndexType string
+	var oldParams IndexParams
+	err = tx.QueryRow("SELECT account_id, name, shard_id, layout, index_type, index_generation, "+indexParamsColumns+" FROM catalog WHERE id = $1 FOR NO KEY UPDATE", catalogID).
+		Scan(append([]interface{}{&event.AccountID, &event.Catalog, &shardID, &layout, &oldIndexType, &generation}, oldParams.scanDest()...)...)
+	if err != nil {
+		return errors.WithMessage(err, "failed to get catalog")
+	}
+	if indexType == "" {
+		indexType = oldIndexType
+	}
+	if params == nil {
+		params = &oldParams
+	}
+	if indexType == oldIndexType && *params == oldParams {
+		log.Printf("Index of catalog_id=%v already is %v with parameters %+v", catalogID, indexType, *params)
+		return nil
+	}
+	db, err := s.shardDB(shardID)
+	if err != nil {
+		return err
+	}
+
+	r := &catalogReindex{params: *params, stop: stopList{}}
+	r.tables, err = newCatalogTables(layout, catalogID)
+	if err != nil {
+		return err
+	}
+	oldIndex, err := newFingerprintIndex(oldIndexType, r.tables.index(generation), oldParams)
+	if err != nil {
+		return err
+	}
+	r.index, err = newFingerprintIndex(indexType, r.tables.index(generation+1), *params)
+	if err != nil {
+		return err
+	}
+
+	// Stop values are query values, so they are only valid with the same number of query bits.
+	if params.QueryBits == oldParams.QueryBits {
+		stopValues, err := loadStopList(tx, catalogID)
+		if err != nil {
+			return err
+		}
+		r.stop = newStopList(stopValues)
+	}
+
+	started := time.Now()
+
+	var numTracks int
+	err = db.QueryRow("SELECT count(*) FROM " + r.tables.from("track", "t")).Scan(&numTracks)
+	if err != nil {
+		return errors.WithMessage(err, "failed to count tracks")
+	}
+
+	err = r.createTables(db)
+	if err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			err := dropIndexTables(db, r.index)
+			if err != nil {
+				log.Printf("Failed to clean up new index of catalog_id=%v: %v", catalogID, err)
+			}
+			_, err = s.db.Exec("DELETE FROM catalog_reindex WHERE catalog_id = $1", catalogID)
+			if err != nil {
+				log.Printf("Failed to clean up reindex progress of catalog_id=%v: %v", catalogID, err)
+			}
+		}
+	}()
+
+	err = s.startReindexProgress(catalogID, layout, indexType, *params, numTracks)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("SELECT t.id, t.fingerprint FROM %s WHERE t.id > $1 ORDER BY t.id LIMIT %d", r.tables.from("track", "t"), ReindexBatchSize)
+	var indexed []int
+	lastID := 0
+	for {
+		shardTx, err := db.Begin()
+		if err != nil {
+			return errors.WithMessage(err, "failed to open shard transaction")
+		}
+		ids, err := r.indexTracks(db, shardTx, query, lastID)
+		if err != nil {
+			shardTx.Rollback()
+			return err
+		}
+		err = shardTx.Commit()
+		if err != nil {
+			return errors.WithMessage(err, "commit failed")
+		}
+		indexed = append(indexed, ids...)
+
+		err = s.updateReindexProgress(catalogID, len(indexed))
+		if err != nil {
+			return err
+		}
+		log.Printf("Reindexed %d/%d tracks of catalog_id=%v", len(indexed), numTracks, catalogID)
+
+		if len(ids) < ReindexBatchSize {
+			break
+		}
+		lastID = ids[len(ids)-1]
+	}
+
+	lockTx, err := db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer lockTx.Rollback()
+
+	// Wait for running modifications to finish and block new ones until the new index is swapped in.
+	_, err = lockTx.Exec("SELECT pg_advisory_xact_lock($1, $2)", catalogLockNamespace, catalogID)
+	if err != nil {
+		return errors.WithMessage(err, "failed to lock catalog")
+	}
+
+	shardTx, err := db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer shardTx.Rollback()
+
+	err = r.catchUp(lockTx, shardTx, indexed)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE catalog SET index_type = $2, index_generation = $3, index_query_bits = $4, index_segments = $5, index_values_per_segment = $6 WHERE id = $1",
+		catalogID, indexType, generation+1, params.QueryBits, params.Segments, params.ValuesPerSegment)
+	if err != nil {
+		return errors.WithMessage(err, "failed to update catalog")
+	}
+	if params.QueryBits != oldParams.QueryBits {
+		_, err = tx.Exec("DELETE FROM catalog_stop_value WHERE catalog_id = $1", catalogID)
+		if err != nil {
+			return errors.WithMessage(err, "failed to delete stop list")
+		}
+	}
+	_, err = tx.Exec("DELETE FROM catalog_reindex WHERE catalog_id = $1", catalogID)
+	if err != nil {
+		return errors.WithMessage(err, "failed to delete reindex progress")
+	}
+
+	err = notifyChange(tx, event)
+	if err != nil {
+		return err
+	}
+
+	err = shardTx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+	swapped = true
+	lockTx.Rollback()
+
+	s.handleChange(event)
+	log.Printf("Reindexed catalog_id=%v as %v with parameters %+v in %v", catalogID, indexType, *params, time.Since(started))
+
+	return dropIndexTables(db, oldIndex)
+}
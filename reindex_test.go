@@ -0,0 +1,59 @@
+package priv
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+func TestService_ReindexCatalog(t *testing.T) {
+	for _, layout := range []string{LayoutTablePerCatalog, LayoutPartitioned} {
+		for _, indexType := range []string{IndexTypeGIN, IndexTypeBTree} {
+			t.Run(fmt.Sprintf("%s/%s", layout, indexType), func(t *testing.T) {
+				service := NewService(connectToDB(t))
+				account, err := service.GetAccount(fmt.Sprintf("test:%s", t.Name()))
+				require.NoError(t, err)
+				catalog := account.Repository().Catalog(fmt.Sprintf("cat_%d", rand.Uint32()))
+				err = catalog.CreateCatalog()
+				require.NoError(t, err)
+				err = service.ConvertCatalogLayout(catalog.(*CatalogImpl).id, layout)
+				require.NoError(t, err)
+				err = service.ConvertCatalogIndex(catalog.(*CatalogImpl).id, indexType)
+				require.NoError(t, err)
+
+				_, err = catalog.CreateTrack("t1", loadTestFingerprint(t, "calibre_sunrise"), 0, nil, false)
+				require.NoError(t, err)
+
+				params := IndexParams{QueryBits: 24, Segments: 8, ValuesPerSegment: 256}
+				for generation, params := range []IndexParams{params, DefaultIndexParams} {
+					err = service.ReindexCatalog(catalog.(*CatalogImpl).id, params)
+					require.NoError(t, err)
+
+					catalog := account.Repository().Catalog(catalog.Name())
+					settings, err := catalog.Settings()
+					require.NoError(t, err)
+					assert.Equal(t, params, settings.IndexParams)
+					assert.Equal(t, generation+1, settings.IndexGeneration)
+
+					stats, err := catalog.Stats()
+					require.NoError(t, err)
+					assert.Nil(t, stats.Reindex)
+
+					results, err := catalog.Search(loadTestFingerprint(t, "radio1_3_calibre_sunshine"), &SearchOptions{Stream: true})
+					require.NoError(t, err)
+					if assert.Len(t, results.Results, 1) {
+						assert.Equal(t, "t1", results.Results[0].ID)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestService_ReindexCatalog_InvalidParams(t *testing.T) {
+	service := NewService(nil)
+	err := service.ReindexCatalog(1, IndexParams{QueryBits: 26, Segments: 0, ValuesPerSegment: 128})
+	assert.Error(t, err)
+}
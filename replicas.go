@@ -0,0 +1,119 @@
+package priv
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultMaxReplicaLag = time.Second * 10
+const ReplicaCheckInterval = time.Second * 5
+
+// replicaLagQuery returns the replication lag in seconds, an idle replica that
+// has replayed everything it received is not considered lagging.
+const replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE coalesce(extract(epoch FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END`
+
+type replica struct {
+	db      *sql.DB
+	name    string
+	healthy int32
+}
+
+// ReplicaSet routes read-only queries to healthy replicas, falling back to the
+// primary database when there is no replica available.
+type ReplicaSet struct {
+	primary  *sql.DB
+	replicas []*replica
+	MaxLag   time.Duration
+	next     uint32
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewReplicaSet(primary *sql.DB, replicas []*sql.DB) *ReplicaSet {
+	rs := &ReplicaSet{primary: primary, MaxLag: DefaultMaxReplicaLag}
+	for i, db := range replicas {
+		rs.replicas = append(rs.replicas, &replica{db: db, name: strconv.Itoa(i)})
+	}
+	return rs
+}
+
+// Reader returns a database connection pool that should be used for read-only queries.
+func (rs *ReplicaSet) Reader() *sql.DB {
+	n := len(rs.replicas)
+	if n == 0 {
+		return rs.primary
+	}
+	start := int(atomic.AddUint32(&rs.next, 1))
+	for i := 0; i < n; i++ {
+		r := rs.replicas[(start+i)%n]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r.db
+		}
+	}
+	replicaFallbackCount.Inc()
+	return rs.primary
+}
+
+// CheckHealth marks replicas that are not reachable or lagging too much as unhealthy.
+func (rs *ReplicaSet) CheckHealth() {
+	for _, r := range rs.replicas {
+		var lag float64
+		err := r.db.QueryRow(replicaLagQuery).Scan(&lag)
+		healthy := err == nil && time.Duration(lag*float64(time.Second)) <= rs.MaxLag
+		if err == nil {
+			replicaLag.WithLabelValues(r.name).Set(lag)
+		}
+		var value int32
+		if healthy {
+			value = 1
+		}
+		old := atomic.SwapInt32(&r.healthy, value)
+		if old != value {
+			if healthy {
+				log.Printf("Replica %s is healthy", r.name)
+			} else if err != nil {
+				log.Printf("Replica %s is unhealthy: %v", r.name, err)
+			} else {
+				log.Printf("Replica %s is unhealthy, lagging %.1fs behind", r.name, lag)
+			}
+		}
+		replicaHealthy.WithLabelValues(r.name).Set(float64(value))
+	}
+}
+
+// Start periodically checks the health of all replicas in the background.
+func (rs *ReplicaSet) Start(interval time.Duration) {
+	rs.CheckHealth()
+	rs.quit = make(chan struct{})
+	rs.wg.Add(1)
+	go func() {
+		defer rs.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rs.CheckHealth()
+			case <-rs.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (rs *ReplicaSet) Close() {
+	if rs.quit != nil {
+		close(rs.quit)
+		rs.wg.Wait()
+		rs.quit = nil
+	}
+}
@@ -0,0 +1,38 @@
+package priv
+
+import (
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+)
+
+func openFakeDB(t *testing.T, name string) *sql.DB {
+	db, err := sql.Open("postgres", "postgresql://localhost/"+name)
+	require.NoError(t, err)
+	return db
+}
+
+func TestReplicaSet_Reader_NoReplicas(t *testing.T) {
+	primary := openFakeDB(t, "primary")
+	rs := NewReplicaSet(primary, nil)
+	assert.Equal(t, primary, rs.Reader())
+}
+
+func TestReplicaSet_Reader(t *testing.T) {
+	primary := openFakeDB(t, "primary")
+	replica1 := openFakeDB(t, "replica1")
+	replica2 := openFakeDB(t, "replica2")
+	rs := NewReplicaSet(primary, []*sql.DB{replica1, replica2})
+
+	assert.Equal(t, primary, rs.Reader(), "unhealthy replicas should not be used")
+
+	atomic.StoreInt32(&rs.replicas[1].healthy, 1)
+	assert.Equal(t, replica2, rs.Reader())
+	assert.Equal(t, replica2, rs.Reader())
+
+	atomic.StoreInt32(&rs.replicas[0].healthy, 1)
+	used := map[*sql.DB]bool{rs.Reader(): true, rs.Reader(): true}
+	assert.Equal(t, map[*sql.DB]bool{replica1: true, replica2: true}, used)
+}
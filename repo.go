@@ -24,20 +24,20 @@ func (repo *RepositoryImpl) Catalog(name string) Catalog {
 }
 
 func (repo *RepositoryImpl) ListCatalogs() ([]Catalog, error) {
-	rows, err := repo.db.Query(`SELECT id, name FROM catalog WHERE account_id = $1 ORDER BY name`, repo.account.id)
+	query := "SELECT id, name, " + catalogSettingsColumns + " FROM catalog WHERE account_id = $1 ORDER BY name"
+	rows, err := repo.account.service.readDB().Query(query, repo.account.id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var id int
-	var name string
 	var catalogs []Catalog
 	for rows.Next() {
-		err = rows.Scan(&id, &name)
+		catalog := &CatalogImpl{db: repo.db, repo: repo}
+		err = rows.Scan(append([]interface{}{&catalog.id, &catalog.name}, catalog.settings.scanDest()...)...)
 		if err != nil {
 			return nil, err
 		}
-		catalogs = append(catalogs, &CatalogImpl{db: repo.db, repo: repo, id: id, name: name})
+		catalogs = append(catalogs, catalog)
 	}
 	return catalogs, nil
 }
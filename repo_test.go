@@ -7,7 +7,7 @@ import (
 	"testing"
 )
 
-func getTestRepository(t *testing.T, db *sql.DB) Repository {
+func getTestRepository(t testing.TB, db *sql.DB) Repository {
 	account := getTestAccount(t, connectToDB(t))
 	return account.Repository()
 }
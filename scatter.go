@@ -0,0 +1,232 @@
+package priv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultSearchNodeTimeout = time.Second * 2
+
+// MaxSearchNodeCandidates is the maximum number of candidates a node is asked to match in one request.
+const MaxSearchNodeCandidates = 1000
+
+const searchNodeSecretHeader = "X-Search-Node-Secret"
+
+// SearchNodes fans out searches to API nodes, each searching its own partition of the catalog's tracks.
+// The hits from all nodes are merged before selecting candidates, and each node then matches the candidates
+// from its partition, so the same candidates are matched as if one node searched all tracks.
+type SearchNodes struct {
+	URLs    []string
+	Timeout time.Duration
+	Client  *http.Client
+	// Secret authenticates the requests on the nodes, it must match their search node secret.
+	Secret string
+}
+
+func NewSearchNodes(urls []string) *SearchNodes {
+	return &SearchNodes{URLs: urls, Timeout: DefaultSearchNodeTimeout, Client: http.DefaultClient}
+}
+
+func (n *SearchNodes) searchNode(ctx context.Context, nodeURL string, catalog string, authorization string, body []byte) (*NodeSearchResponse, error) {
+	endpoint := strings.TrimRight(nodeURL, "/") + "/v1/priv/" + url.PathEscape(catalog) + "/_node_search"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(searchNodeSecretHeader, n.Secret)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var response NodeSearchResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to parse response")
+	}
+	return &response, nil
+}
+
+// Search merges hits from all nodes, selects candidates and sends them to the nodes that found them for
+// matching. Nodes that fail or don't respond in time are skipped and the response is marked as partial.
+// It only fails if no node responded. The timeout applies to each round of requests.
+func (n *SearchNodes) Search(ctx context.Context, catalog string, authorization string, request *SearchRequest) (*SearchResponse, error) {
+	hitsRequest := NodeSearchRequest{SearchRequest: *request, Hits: true}
+	hitsRequest.Mode = ""
+	responses := n.searchAll(ctx, catalog, authorization, n.requestAll(&hitsRequest))
+	hits, owners, ok := mergeNodeHits(responses)
+	if !ok {
+		return nil, errors.New("no search node responded")
+	}
+
+	tried := make(map[int]bool)
+	matchResponses := n.searchAll(ctx, catalog, authorization, n.candidateRequests(request, selectCandidates(hits), owners, tried))
+	responses = append(responses, matchResponses...)
+
+	if request.Mode == "thorough" && !request.Stream && !hasSearchResults(matchResponses) {
+		hitsRequest.Mode = "thorough"
+		thoroughResponses := n.searchAll(ctx, catalog, authorization, n.requestAll(&hitsRequest))
+		responses = append(responses, thoroughResponses...)
+		thoroughHits, thoroughOwners, _ := mergeNodeHits(thoroughResponses)
+		for trackID, i := range thoroughOwners {
+			owners[trackID] = i
+		}
+		candidates := selectCandidates(mergeHits(hits, thoroughHits))
+		responses = append(responses, n.searchAll(ctx, catalog, authorization, n.candidateRequests(request, candidates, owners, tried))...)
+	}
+
+	return mergeSearchResponses(catalog, responses)
+}
+
+// searchAll sends the requests to the nodes at the same positions, nodes without a request are skipped
+// and have an empty response. Responses of nodes that failed are nil.
+func (n *SearchNodes) searchAll(ctx context.Context, catalog string, authorization string, requests []*NodeSearchRequest) []*NodeSearchResponse {
+	ctx, cancel := context.WithTimeout(ctx, n.Timeout)
+	defer cancel()
+
+	responses := make([]*NodeSearchResponse, len(n.URLs))
+	var wg sync.WaitGroup
+	for i, nodeURL := range n.URLs {
+		if requests[i] == nil {
+			responses[i] = &NodeSearchResponse{}
+			continue
+		}
+		body, err := json.Marshal(requests[i])
+		if err != nil {
+			log.Printf("Failed to encode search request for node %d: %v", i, err)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, nodeURL string, body []byte) {
+			defer wg.Done()
+			response, err := n.searchNode(ctx, nodeURL, catalog, authorization, body)
+			if err != nil {
+				log.Printf("Search on node %d failed: %v", i, err)
+				searchNodeErrorCount.WithLabelValues(strconv.Itoa(i)).Inc()
+				return
+			}
+			responses[i] = response
+		}(i, nodeURL, body)
+	}
+	wg.Wait()
+	return responses
+}
+
+func (n *SearchNodes) requestAll(request *NodeSearchRequest) []*NodeSearchRequest {
+	requests := make([]*NodeSearchRequest, len(n.URLs))
+	for i := range requests {
+		requests[i] = request
+	}
+	return requests
+}
+
+// candidateRequests returns requests for matching the candidates on the nodes that found them. Candidates
+// that were already tried are skipped. Candidates are sorted by hits in ascending order, only the best
+// MaxSearchNodeCandidates are sent to each node.
+func (n *SearchNodes) candidateRequests(request *SearchRequest, candidates []topHit, owners map[int]int, tried map[int]bool) []*NodeSearchRequest {
+	requests := make([]*NodeSearchRequest, len(n.URLs))
+	for j := len(candidates) - 1; j >= 0; j-- {
+		hit := candidates[j]
+		if tried[hit.TrackID] {
+			continue
+		}
+		i := owners[hit.TrackID]
+		if requests[i] == nil {
+			requests[i] = &NodeSearchRequest{SearchRequest: *request}
+			requests[i].Mode = ""
+		} else if len(requests[i].Candidates) >= MaxSearchNodeCandidates {
+			continue
+		}
+		tried[hit.TrackID] = true
+		requests[i].Candidates = append(requests[i].Candidates, hit.TrackID)
+	}
+	return requests
+}
+
+// mergeNodeHits merges hits from all nodes that responded and returns the index of the node that found
+// each track. Partitions don't overlap, so each track should only be found by one node. It returns false
+// if no node responded.
+func mergeNodeHits(responses []*NodeSearchResponse) (map[int]int, map[int]int, bool) {
+	hits := make(map[int]int)
+	owners := make(map[int]int)
+	ok := false
+	for i, response := range responses {
+		if response == nil {
+			continue
+		}
+		ok = true
+		for _, hit := range response.Hits {
+			if hit.Count > hits[hit.TrackID] {
+				hits[hit.TrackID] = hit.Count
+				owners[hit.TrackID] = i
+			}
+		}
+	}
+	return hits, owners, ok
+}
+
+func hasSearchResults(responses []*NodeSearchResponse) bool {
+	for _, response := range responses {
+		if response != nil && len(response.Results) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeSearchResponses combines results from all nodes, nil responses are from nodes that failed.
+func mergeSearchResponses(catalog string, responses []*NodeSearchResponse) (*SearchResponse, error) {
+	merged := &SearchResponse{Catalog: catalog, Results: []*SearchResponseResult{}}
+	seen := make(map[string]bool)
+	numResponses := 0
+	for _, response := range responses {
+		if response == nil {
+			merged.Partial = true
+			continue
+		}
+		numResponses++
+		if response.Partial {
+			merged.Partial = true
+		}
+		for _, result := range response.Results {
+			if !seen[result.ID] {
+				seen[result.ID] = true
+				merged.Results = append(merged.Results, result)
+			}
+		}
+	}
+	if numResponses == 0 {
+		return nil, errors.New("no search node responded")
+	}
+
+	sort.SliceStable(merged.Results, func(i, j int) bool {
+		a, b := merged.Results[i], merged.Results[j]
+		if a.Match.Duration != b.Match.Duration {
+			return a.Match.Duration > b.Match.Duration
+		}
+		return a.ID < b.ID
+	})
+	return merged, nil
+}
@@ -0,0 +1,24 @@
+#!/usr/bin/env bash
+# Runs a coordinator on port 3382 and NODES search nodes on ports 3383 and up,
+# each searching one partition of the tracks.
+
+set -e
+
+NODES=${NODES:-2}
+export ACOUSTID_PRIV_SEARCH_NODE_SECRET=${ACOUSTID_PRIV_SEARCH_NODE_SECRET:-$(head -c 16 /dev/urandom | od -An -tx1 | tr -d ' \n')}
+
+trap 'kill $(jobs -p) 2>/dev/null' EXIT
+
+go build -o /tmp/acoustid-priv-api github.com/acoustid/priv/cmd/acoustid-priv-api
+
+urls=()
+for i in $(seq 0 $((NODES - 1)))
+do
+    port=$((3383 + i))
+    /tmp/acoustid-priv-api -bind 127.0.0.1:$port -partition $i/$NODES &
+    urls+=("http://127.0.0.1:$port")
+done
+
+/tmp/acoustid-priv-api -bind 127.0.0.1:3382 -search-nodes "$(IFS=,; echo "${urls[*]}")" &
+
+wait
@@ -0,0 +1,211 @@
+package priv
+
+import "sort"
+
+// queryHash is a value extracted from the query fingerprint, along with its position in the query.
+type queryHash struct {
+	Value    int32
+	Position int
+}
+
+// indexHit is a value found in the index, along with its position in the track.
+type indexHit struct {
+	TrackID  int
+	Value    int32
+	Position int
+}
+
+// segmentQueries splits the query values between the index segments that should be searched.
+func (p IndexParams) segmentQueries(values []int32, stream bool) [][]queryHash {
+	segmentHashes := make([][]queryHash, p.Segments)
+	if stream {
+		hashes := makeQueryHashes(values, 0)
+		for segment := 0; segment < p.Segments; segment++ {
+			segmentHashes[segment] = hashes
+		}
+	} else {
+		n := p.ValuesPerSegment
+		if len(values) < n {
+			segmentHashes[0] = makeQueryHashes(values, 0)
+		} else {
+			segmentHashes[0] = makeQueryHashes(values[:n], 0)
+			if p.Segments > 1 {
+				if len(values) < n*2 {
+					segmentHashes[1] = makeQueryHashes(values[n:], n)
+				} else {
+					segmentHashes[1] = makeQueryHashes(values[n:n*2], n)
+				}
+			}
+		}
+	}
+	return segmentHashes
+}
+
+// addQueryProbes extends each segment's query with variants of its hashes, the variants
+// keep the position of the original hash so that they vote for the same offsets. Variants
+// with bits that are not indexed are skipped.
+func (p IndexParams) addQueryProbes(segmentHashes [][]queryHash, probes int) int {
+	mask := p.queryMask()
+	numProbes := 0
+	for segment, hashes := range segmentHashes {
+		if len(hashes) == 0 || probes <= 0 {
+			continue
+		}
+		extended := make([]queryHash, 0, len(hashes)*(probes+1))
+		extended = append(extended, hashes...)
+		for _, h := range hashes {
+			for _, value := range probeValues(h.Value, probes) {
+				if uint32(value)&^mask == 0 {
+					extended = append(extended, queryHash{value, h.Position})
+				}
+			}
+		}
+		numProbes += len(extended) - len(hashes)
+		segmentHashes[segment] = extended
+	}
+	return numProbes
+}
+
+// ThoroughMaxWindows is the maximum number of query windows searched in thorough mode.
+const ThoroughMaxWindows = 8
+
+// thoroughSegmentQueries samples windows from the whole query. The matching part of the track
+// can be at any offset, so all windows are searched in all index segments.
+func (p IndexParams) thoroughSegmentQueries(values []int32) [][]queryHash {
+	n := p.ValuesPerSegment
+	var hashes []queryHash
+	if len(values) <= ThoroughMaxWindows*n {
+		hashes = makeQueryHashes(values, 0)
+	} else {
+		for i := 0; i < ThoroughMaxWindows; i++ {
+			start := i * (len(values) - n) / (ThoroughMaxWindows - 1)
+			hashes = append(hashes, makeQueryHashes(values[start:start+n], start)...)
+		}
+	}
+	segmentHashes := make([][]queryHash, p.Segments)
+	for segment := 0; segment < p.Segments; segment++ {
+		segmentHashes[segment] = hashes
+	}
+	return segmentHashes
+}
+
+func makeQueryHashes(values []int32, offset int) []queryHash {
+	hashes := make([]queryHash, len(values))
+	for i, value := range values {
+		hashes[i] = queryHash{value, offset + i}
+	}
+	return hashes
+}
+
+// queryPositions maps each distinct query value to all its positions in the query.
+func queryPositions(hashes []queryHash) map[int32][]int {
+	positions := make(map[int32][]int, len(hashes))
+	for _, h := range hashes {
+		positions[h.Value] = append(positions[h.Value], h.Position)
+	}
+	return positions
+}
+
+func distinctQueryValues(positions map[int32][]int) []int32 {
+	values := make([]int32, 0, len(positions))
+	for value := range positions {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
+
+// offsetVotes is a histogram of (track, time offset) pairs. Each value found both in the query and
+// in the track votes for the offset at which the query would be aligned with the track. Hits of a real
+// match agree on the offset, while random collisions are spread over many offsets.
+type offsetVotes map[int]map[int]int
+
+func (v offsetVotes) add(trackID int, offset int) {
+	offsets, exists := v[trackID]
+	if !exists {
+		offsets = make(map[int]int)
+		v[trackID] = offsets
+	}
+	offsets[offset] += 1
+}
+
+func (v offsetVotes) addHits(positions map[int32][]int, hits []indexHit) {
+	for _, hit := range hits {
+		for _, position := range positions[hit.Value] {
+			v.add(hit.TrackID, hit.Position-position)
+		}
+	}
+}
+
+// scores returns the number of coherent votes for the best offset of each track. Random collisions
+// are spread over many offsets and rarely vote for the same one twice, so only the votes after the
+// first one at each offset are counted. Votes for neighboring offsets are included, to tolerate small
+// timing differences between the query and the track.
+func (v offsetVotes) scores() map[int]int {
+	scores := make(map[int]int, len(v))
+	for trackID, offsets := range v {
+		best := 0
+		for offset := range offsets {
+			score := coherentVotes(offsets[offset-1]) + coherentVotes(offsets[offset]) + coherentVotes(offsets[offset+1])
+			if score > best {
+				best = score
+			}
+		}
+		if best > 0 {
+			scores[trackID] = best
+		}
+	}
+	return scores
+}
+
+func coherentVotes(count int) int {
+	if count > 1 {
+		return count - 1
+	}
+	return 0
+}
+
+// mergeHits combines scores from multiple index searches, keeping the best score of each track.
+func mergeHits(hits ...map[int]int) map[int]int {
+	merged := make(map[int]int)
+	for _, h := range hits {
+		for trackID, count := range h {
+			if count > merged[trackID] {
+				merged[trackID] = count
+			}
+		}
+	}
+	return merged
+}
+
+type topHit struct {
+	TrackID int
+	Count   int
+}
+
+// MinCandidateScore is the minimum score of a track to be matched against the full query.
+const MinCandidateScore = 5
+
+// selectCandidates returns tracks with enough hits to be worth matching against the full query,
+// which is at least a tenth of the hits of the best track and at least MinCandidateScore.
+func selectCandidates(hits map[int]int) []topHit {
+	maxCount := 0
+	for _, count := range hits {
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+	countThreshold := maxCount / 10
+	if countThreshold < MinCandidateScore {
+		countThreshold = MinCandidateScore
+	}
+
+	topHits := make([]topHit, 0, len(hits))
+	for trackID, count := range hits {
+		if count >= countThreshold {
+			topHits = append(topHits, topHit{trackID, count})
+		}
+	}
+	sort.Slice(topHits, func(i, j int) bool { return topHits[i].Count < topHits[j].Count })
+	return topHits
+}
@@ -0,0 +1,219 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestOffsetVotes_Scores(t *testing.T) {
+	votes := make(offsetVotes)
+	for i := 0; i < 3; i++ {
+		votes.add(1, 10)
+		votes.add(1, 11)
+	}
+	votes.add(1, 12)
+	votes.add(1, 50)
+	votes.add(1, 50)
+	votes.add(2, 10)
+	votes.add(2, 20)
+	votes.add(2, 21)
+	assert.Equal(t, map[int]int{1: 4}, votes.scores(), "single votes at an offset should not count")
+}
+
+func TestOffsetVotes_AddHits(t *testing.T) {
+	positions := queryPositions(makeQueryHashes([]int32{7, 8, 7}, 100))
+	hits := []indexHit{
+		{TrackID: 1, Value: 7, Position: 0},
+		{TrackID: 1, Value: 8, Position: 1},
+		{TrackID: 1, Value: 9, Position: 2},
+	}
+	votes := make(offsetVotes)
+	votes.addHits(positions, hits)
+	assert.Equal(t, offsetVotes{1: {-100: 2, -102: 1}}, votes)
+}
+
+func TestSelectCandidates(t *testing.T) {
+	candidates := selectCandidates(map[int]int{1: 100, 2: 1, 3: 60, 4: 20, 5: 9})
+	assert.Equal(t, []topHit{{4, 20}, {3, 60}, {1, 100}}, candidates)
+}
+
+func TestThoroughSegmentQueries(t *testing.T) {
+	values := make([]int32, ValuesPerSegment*ThoroughMaxWindows*2)
+	for i := range values {
+		values[i] = int32(i)
+	}
+	segmentHashes := DefaultIndexParams.thoroughSegmentQueries(values)
+	hashes := segmentHashes[0]
+	if assert.Len(t, hashes, ValuesPerSegment*ThoroughMaxWindows) {
+		assert.Equal(t, queryHash{0, 0}, hashes[0])
+		last := len(values) - 1
+		assert.Equal(t, queryHash{int32(last), last}, hashes[len(hashes)-1])
+	}
+	for segment := 1; segment < NumIndexSegments; segment++ {
+		assert.Equal(t, hashes, segmentHashes[segment])
+	}
+
+	segmentHashes = DefaultIndexParams.thoroughSegmentQueries(values[:300])
+	assert.Equal(t, makeQueryHashes(values[:300], 0), segmentHashes[NumIndexSegments-1])
+}
+
+func TestMemoryIndex_SearchThorough(t *testing.T) {
+	master := ExtractQuery(loadTestFingerprint(t, "calibre_sunrise"))
+	idx := NewMemoryIndex(1)
+	idx.AddTrack(1, master)
+
+	// The query has a long intro, which is not in the catalog.
+	rnd := rand.New(rand.NewSource(1))
+	query := ExtractQuery(loadTestFingerprint(t, "radio1_1_ad"))
+	for i := 0; i < ValuesPerSegment*2; i++ {
+		query = append(query, rnd.Int31()&int32(hashBitMask(NumQueryBits)))
+	}
+	query = append(query, master...)
+
+	hits := idx.Search(DefaultIndexParams.segmentQueries(query, false))
+	assert.Empty(t, selectCandidates(hits))
+
+	hits = idx.Search(DefaultIndexParams.thoroughSegmentQueries(query))
+	candidates := selectCandidates(hits)
+	if assert.Len(t, candidates, 1) {
+		assert.Equal(t, 1, candidates[0].TrackID)
+	}
+}
+
+func TestMergeHits(t *testing.T) {
+	assert.Equal(t, map[int]int{1: 5, 2: 3, 3: 1}, mergeHits(map[int]int{1: 5, 2: 1}, map[int]int{1: 2, 2: 3, 3: 1}))
+}
+
+// countHits scores tracks by the number of distinct values they share with the query,
+// which is how the index was searched before the hash positions were stored.
+func countHits(idx *MemoryIndex, segmentHashes [][]queryHash) map[int]int {
+	type trackValue struct {
+		trackID int32
+		value   int32
+	}
+	hits := make(map[int]int)
+	for segment, hashes := range segmentHashes {
+		seen := make(map[trackValue]bool)
+		for value := range queryPositions(hashes) {
+			for _, p := range idx.postings[value] {
+				key := trackValue{p.trackID, value}
+				if DefaultIndexParams.segment(int(p.position)) == segment && !seen[key] {
+					seen[key] = true
+					hits[int(p.trackID)] += 1
+				}
+			}
+		}
+	}
+	return hits
+}
+
+func benchmarkSearch(b *testing.B, search func(idx *MemoryIndex, segmentHashes [][]queryHash) map[int]int) {
+	const numDistractors = 100
+
+	master := ExtractQuery(loadTestFingerprint(b, "calibre_sunrise"))
+	idx := NewMemoryIndex(1)
+	idx.AddTrack(1, master)
+
+	// Distractors share the value distribution of the master track, but not its time structure.
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < numDistractors; i++ {
+		values := make([]int32, len(master))
+		copy(values, master)
+		rnd.Shuffle(len(values), func(i, j int) { values[i], values[j] = values[j], values[i] })
+		idx.AddTrack(i+2, values)
+	}
+
+	queries := []struct {
+		name    string
+		trackID int
+	}{
+		{"radio1_1_ad", 0},
+		{"radio1_2_ad_and_calibre_sunshine", 1},
+		{"radio1_3_calibre_sunshine", 1},
+		{"radio1_4_calibre_sunshine", 1},
+		{"radio1_5_calibre_sunshine", 1},
+	}
+	segmentHashes := make([][][]queryHash, len(queries))
+	for i, query := range queries {
+		segmentHashes[i] = DefaultIndexParams.segmentQueries(ExtractQuery(loadTestFingerprint(b, query.name)), true)
+	}
+
+	var truePositives, falsePositives, falseNegatives int
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		truePositives, falsePositives, falseNegatives = 0, 0, 0
+		for i, query := range queries {
+			found := false
+			for _, candidate := range selectCandidates(search(idx, segmentHashes[i])) {
+				if candidate.TrackID == query.trackID {
+					truePositives++
+					found = true
+				} else {
+					falsePositives++
+				}
+			}
+			if query.trackID != 0 && !found {
+				falseNegatives++
+			}
+		}
+	}
+	b.StopTimer()
+
+	precision := 1.0
+	if truePositives+falsePositives > 0 {
+		precision = float64(truePositives) / float64(truePositives+falsePositives)
+	}
+	recall := float64(truePositives) / float64(truePositives+falseNegatives)
+	b.ReportMetric(precision, "precision")
+	b.ReportMetric(recall, "recall")
+}
+
+func BenchmarkSearch(b *testing.B) {
+	b.Run("Counting", func(b *testing.B) {
+		benchmarkSearch(b, countHits)
+	})
+	b.Run("Voting", func(b *testing.B) {
+		benchmarkSearch(b, (*MemoryIndex).Search)
+	})
+}
+
+func TestAddQueryProbes(t *testing.T) {
+	segmentHashes := make([][]queryHash, NumIndexSegments)
+	segmentHashes[1] = makeQueryHashes([]int32{0}, ValuesPerSegment)
+	numProbes := DefaultIndexParams.addQueryProbes(segmentHashes, 2)
+	assert.Equal(t, 2, numProbes)
+	assert.Empty(t, segmentHashes[0])
+	assert.Equal(t, []queryHash{{0, ValuesPerSegment}, {1 << 10, ValuesPerSegment}, {1 << 12, ValuesPerSegment}}, segmentHashes[1])
+}
+
+func TestAddQueryProbes_QueryBits(t *testing.T) {
+	params := IndexParams{QueryBits: 22, Segments: 1, ValuesPerSegment: ValuesPerSegment}
+	segmentHashes := params.segmentQueries([]int32{0}, false)
+	numProbes := params.addQueryProbes(segmentHashes, 2)
+	assert.Equal(t, 1, numProbes)
+	assert.Equal(t, []queryHash{{0, 0}, {1 << 10, 0}}, segmentHashes[0])
+}
+
+func TestMemoryIndex_SearchMultiProbe(t *testing.T) {
+	master := ExtractQuery(loadTestFingerprint(t, "calibre_sunrise"))
+	idx := NewMemoryIndex(1)
+	idx.AddTrack(1, master)
+
+	// Simulate a noisy capture, where most hashes have one of the unreliable bits flipped.
+	query := make([]int32, 120)
+	for i := range query {
+		query[i] = master[i+200]
+		if i%4 != 0 {
+			query[i] ^= int32(1 << probeBits[i%2])
+		}
+	}
+
+	segmentHashes := DefaultIndexParams.segmentQueries(query, true)
+	hits := idx.Search(segmentHashes)
+	assert.True(t, hits[1] < 40, "expected only the unmodified hashes to match, got %v", hits[1])
+
+	DefaultIndexParams.addQueryProbes(segmentHashes, 2)
+	hits = idx.Search(segmentHashes)
+	assert.True(t, hits[1] >= 100, "expected the modified hashes to match, got %v", hits[1])
+}
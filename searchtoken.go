@@ -0,0 +1,221 @@
+package priv
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSearchTokenTTL = time.Minute * 15
+	MaxSearchTokenTTL     = time.Hour * 24
+)
+
+// searchTokenAudience distinguishes search tokens from tokens issued by identity providers.
+const searchTokenAudience = "acoustid-priv-search"
+
+// minSearchTokenSecretLength is the minimal length of secrets used for signing search tokens.
+const minSearchTokenSecretLength = 32
+
+type SearchTokenKey struct {
+	ID     string
+	Secret []byte
+}
+
+// SearchTokenKeys is a key ring for signing search tokens. New tokens are signed
+// with the first key, tokens signed by any of the keys are accepted. Keys are
+// rotated by adding a new first key, and all tokens signed by a key are revoked
+// by removing the key.
+type SearchTokenKeys struct {
+	Keys []SearchTokenKey
+}
+
+// ParseSearchTokenKeys parses a comma-separated list of keys in the id:secret format.
+func ParseSearchTokenKeys(s string) (*SearchTokenKeys, error) {
+	keys := &SearchTokenKeys{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid search token key %q, expected id:secret", item)
+		}
+		if len(parts[1]) < minSearchTokenSecretLength {
+			return nil, fmt.Errorf("secret of search token key %s is shorter than %d characters", parts[0], minSearchTokenSecretLength)
+		}
+		keys.Keys = append(keys.Keys, SearchTokenKey{ID: parts[0], Secret: []byte(parts[1])})
+	}
+	if len(keys.Keys) == 0 {
+		return nil, errors.New("no search token keys")
+	}
+	return keys, nil
+}
+
+func (k *SearchTokenKeys) find(id string) *SearchTokenKey {
+	for i := range k.Keys {
+		if k.Keys[i].ID == id {
+			return &k.Keys[i]
+		}
+	}
+	return nil
+}
+
+func signSearchToken(key *SearchTokenKey, signingInput string) []byte {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// SearchToken is a short-lived token which allows searching in some catalogs of an account.
+type SearchToken struct {
+	ID        string
+	Account   string
+	Catalogs  []string
+	RateLimit int // maximum number of requests per minute, unlimited if zero
+	Expires   time.Time
+}
+
+type searchTokenClaims struct {
+	ID        string   `json:"jti"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud"`
+	IssuedAt  int64    `json:"iat"`
+	Expires   int64    `json:"exp"`
+	Catalogs  []string `json:"catalogs"`
+	RateLimit int      `json:"rate_limit,omitempty"`
+}
+
+// NewSearchToken returns a token for searching in the catalogs, which expires after the ttl.
+func NewSearchToken(account string, catalogs []string, rateLimit int, ttl time.Duration) (*SearchToken, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	token := &SearchToken{
+		ID:        hex.EncodeToString(id),
+		Account:   account,
+		Catalogs:  catalogs,
+		RateLimit: rateLimit,
+		Expires:   time.Now().Add(ttl).Truncate(time.Second),
+	}
+	return token, nil
+}
+
+// Sign encodes the token as a JWT signed with the first key.
+func (k *SearchTokenKeys) Sign(token *SearchToken) (string, error) {
+	key := &k.Keys[0]
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": key.ID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(&searchTokenClaims{
+		ID:        token.ID,
+		Subject:   token.Account,
+		Audience:  searchTokenAudience,
+		IssuedAt:  time.Now().Unix(),
+		Expires:   token.Expires.Unix(),
+		Catalogs:  token.Catalogs,
+		RateLimit: token.RateLimit,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodeBase64URL(header) + "." + encodeBase64URL(claims)
+	return signingInput + "." + encodeBase64URL(signSearchToken(key, signingInput)), nil
+}
+
+// Verify checks the signature and expiration of the token.
+func (k *SearchTokenKeys) Verify(s string, now time.Time) (*SearchToken, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerData, err := decodeBase64URL(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerData, &header)
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	key := k.find(header.Kid)
+	if header.Alg != "HS256" || key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+
+	signature, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	if !hmac.Equal(signature, signSearchToken(key, parts[0]+"."+parts[1])) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claimsData, err := decodeBase64URL(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	var claims searchTokenClaims
+	err = json.Unmarshal(claimsData, &claims)
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if claims.Audience != searchTokenAudience || claims.Subject == "" || len(claims.Catalogs) == 0 {
+		return nil, errors.New("not a search token")
+	}
+	expires := time.Unix(claims.Expires, 0)
+	if !now.Before(expires) {
+		return nil, errors.New("token has expired")
+	}
+	token := &SearchToken{
+		ID:        claims.ID,
+		Account:   claims.Subject,
+		Catalogs:  claims.Catalogs,
+		RateLimit: claims.RateLimit,
+		Expires:   expires,
+	}
+	return token, nil
+}
+
+// SearchTokenAuth accepts search tokens as bearer tokens.
+type SearchTokenAuth struct {
+	Keys *SearchTokenKeys
+}
+
+func (a *SearchTokenAuth) Authenticate(r *http.Request) (principal *Principal, err error) {
+	header := r.Header.Get("Authorization")
+	headerParts := strings.SplitN(header, " ", 2)
+	if strings.ToLower(headerParts[0]) != "bearer" || len(headerParts) != 2 {
+		return nil, ErrNotAuthorized
+	}
+	token, err := a.Keys.Verify(strings.TrimSpace(headerParts[1]), time.Now())
+	if err != nil {
+		return nil, errors.WithMessage(ErrNotAuthorized, err.Error())
+	}
+	return token.Principal(), nil
+}
+
+// Principal returns the principal allowed to search in the token's catalogs.
+func (t *SearchToken) Principal() *Principal {
+	principal := NewPrincipal(t.Account)
+	principal.Scopes = []string{ScopeSearch}
+	principal.Catalogs = t.Catalogs
+	principal.TokenID = t.ID
+	principal.RateLimit = t.RateLimit
+	return principal
+}
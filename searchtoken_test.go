@@ -0,0 +1,105 @@
+package priv
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+const testSearchTokenSecret = "0123456789abcdef0123456789abcdef"
+
+func TestParseSearchTokenKeys(t *testing.T) {
+	keys, err := ParseSearchTokenKeys("k2:" + testSearchTokenSecret + ", k1:" + testSearchTokenSecret)
+	require.NoError(t, err)
+	if assert.Len(t, keys.Keys, 2) {
+		assert.Equal(t, "k2", keys.Keys[0].ID)
+		assert.Equal(t, []byte(testSearchTokenSecret), keys.Keys[0].Secret)
+		assert.Equal(t, "k1", keys.Keys[1].ID)
+	}
+
+	_, err = ParseSearchTokenKeys("")
+	assert.Error(t, err)
+	_, err = ParseSearchTokenKeys("k1")
+	assert.Error(t, err)
+	_, err = ParseSearchTokenKeys("k1:short")
+	assert.Error(t, err)
+}
+
+func TestSearchTokenKeys_SignVerify(t *testing.T) {
+	oldKeys, err := ParseSearchTokenKeys("k1:" + testSearchTokenSecret)
+	require.NoError(t, err)
+
+	token, err := NewSearchToken("acc1", []string{"cat1"}, 10, time.Minute)
+	require.NoError(t, err)
+	signedToken, err := oldKeys.Sign(token)
+	require.NoError(t, err)
+
+	verifiedToken, err := oldKeys.Verify(signedToken, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, token, verifiedToken)
+
+	_, err = oldKeys.Verify(signedToken, token.Expires)
+	assert.EqualError(t, err, "token has expired")
+
+	_, err = oldKeys.Verify(signedToken+"x", time.Now())
+	assert.Error(t, err)
+
+	rotatedKeys, err := ParseSearchTokenKeys("k2:" + testSearchTokenSecret + "xx,k1:" + testSearchTokenSecret)
+	require.NoError(t, err)
+	_, err = rotatedKeys.Verify(signedToken, time.Now())
+	assert.NoError(t, err)
+
+	newSignedToken, err := rotatedKeys.Sign(token)
+	require.NoError(t, err)
+	_, err = oldKeys.Verify(newSignedToken, time.Now())
+	assert.EqualError(t, err, "unknown signing key")
+
+	newKeys, err := ParseSearchTokenKeys("k2:" + testSearchTokenSecret + "xx")
+	require.NoError(t, err)
+	_, err = newKeys.Verify(signedToken, time.Now())
+	assert.EqualError(t, err, "unknown signing key")
+}
+
+func TestSearchTokenAuth_Authenticate(t *testing.T) {
+	keys, err := ParseSearchTokenKeys("k1:" + testSearchTokenSecret)
+	require.NoError(t, err)
+
+	token, err := NewSearchToken("acc1", []string{"cat1", "cat2"}, 10, time.Minute)
+	require.NoError(t, err)
+	signedToken, err := keys.Sign(token)
+	require.NoError(t, err)
+
+	auth := &SearchTokenAuth{Keys: keys}
+
+	{
+		r := makeTestRequest(t)
+		r.Header.Set("Authorization", "Bearer "+signedToken)
+		principal, err := auth.Authenticate(r)
+		require.NoError(t, err)
+		assert.Equal(t, "acc1", principal.Account)
+		assert.Equal(t, token.ID, principal.TokenID)
+		assert.Equal(t, 10, principal.RateLimit)
+		assert.True(t, principal.HasScope(ScopeSearch))
+		assert.False(t, principal.HasScope(ScopeCatalogRead))
+		assert.True(t, principal.CanAccessCatalog("cat2"))
+		assert.False(t, principal.CanAccessCatalog("cat3"))
+	}
+
+	{
+		r := makeTestRequest(t)
+		r.Header.Set("Authorization", "Bearer xxx")
+		principal, err := auth.Authenticate(r)
+		assert.Equal(t, ErrNotAuthorized, errors.Cause(err))
+		assert.Nil(t, principal)
+	}
+
+	{
+		r := makeTestRequest(t)
+		r.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+		principal, err := auth.Authenticate(r)
+		assert.Equal(t, ErrNotAuthorized, err)
+		assert.Nil(t, principal)
+	}
+}
@@ -2,42 +2,89 @@ package priv
 
 import (
 	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// CacheTTL is used for cached entries while the service is receiving change
+// notifications, so that entries are evicted as soon as they become stale.
+const CacheTTL = time.Hour
+
+// ShortCacheTTL is used for cached entries while change notifications are not
+// being received, e.g. when the listener connection is down.
+const ShortCacheTTL = time.Second * 10
+
 type Service interface {
 	GetAccount(externalID string) (Account, error)
 	Status() bool
+	CreateAPIKey(externalAccountID string, name string, permissions Permissions) (*APIKey, error)
+	ListAPIKeys(externalAccountID string) ([]APIKey, error)
+	RotateAPIKey(externalAccountID string, id int) (*APIKey, error)
+	RevokeAPIKey(externalAccountID string, id int) error
+	ValidateAPIKey(key string) (*Principal, error)
+	StartAccountPurge(externalID string, policy PurgePolicy) (*AccountPurge, error)
+	GetAccountPurge(externalID string) (*AccountPurge, error)
 }
 
 type ServiceImpl struct {
-	db *sql.DB
+	db              *sql.DB
+	Cache           Cache
+	Replicas        *ReplicaSet
+	Layout          string          // storage layout of new catalogs, DefaultLayout if empty
+	Partition       *Partition      // part of the tracks searched by this node, all tracks if nil
+	DefaultLimits   Limits          // limits of accounts without custom limits
+	Usage           *UsageMeter     // usage is not metered if nil
+	PurgeReportKey  *PurgeReportKey // accounts can't be purged if nil
+	shards          map[int]*sql.DB
+	listening       int32
+	memoryIndexes   map[int]*MemoryIndex
+	memoryIndexesMu sync.Mutex
 }
 
-func NewService(db *sql.DB) Service {
+func NewService(db *sql.DB) *ServiceImpl {
 	return &ServiceImpl{db: db}
 }
 
 func (s *ServiceImpl) GetAccount(externalID string) (Account, error) {
+	cacheKey := accountCacheKey(externalID)
+	if s.Cache != nil {
+		id, found := s.Cache.Get(cacheKey)
+		if found {
+			return &AccountImpl{db: s.db, service: s, id: id.(int)}, nil
+		}
+	}
+
 	tx, err := s.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
-	query := `INSERT INTO account (external_id) VALUES ($1) ON CONFLICT (external_id) DO UPDATE SET external_id=EXCLUDED.external_id RETURNING id`
+	query := `INSERT INTO account (external_id) VALUES ($1) ON CONFLICT (external_id) DO UPDATE SET external_id=EXCLUDED.external_id RETURNING id, deleted IS NOT NULL`
 	row := tx.QueryRow(query, externalID)
 	var id int
-	err = row.Scan(&id)
+	var deleted bool
+	err = row.Scan(&id, &deleted)
 	if err != nil {
 		return nil, err
 	}
+	if deleted {
+		return nil, ErrAccountDeleted
+	}
 
 	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
 
-	return &AccountImpl{db: s.db, id: id}, nil
+	if s.Cache != nil {
+		s.Cache.Set(cacheKey, id, s.cacheTTL())
+	}
+
+	return &AccountImpl{db: s.db, service: s, id: id}, nil
 }
 
 func (s *ServiceImpl) Status() bool {
@@ -47,3 +94,89 @@ func (s *ServiceImpl) Status() bool {
 	}
 	return true
 }
+
+// readDB returns the database that should be used for read-only queries.
+func (s *ServiceImpl) readDB() *sql.DB {
+	if s.Replicas != nil {
+		return s.Replicas.Reader()
+	}
+	return s.db
+}
+
+func (s *ServiceImpl) newCatalogLayout() string {
+	if s.Layout == "" {
+		return DefaultLayout
+	}
+	return s.Layout
+}
+
+func accountCacheKey(externalID string) string {
+	return fmt.Sprintf("account:%s", externalID)
+}
+
+func catalogCacheKey(accountID int, name string) string {
+	return fmt.Sprintf("catalog:%d:%s", accountID, name)
+}
+
+func (s *ServiceImpl) cacheTTL() time.Duration {
+	if atomic.LoadInt32(&s.listening) == 1 {
+		return CacheTTL
+	}
+	return ShortCacheTTL
+}
+
+func (s *ServiceImpl) setListening(listening bool) {
+	var value int32
+	if listening {
+		value = 1
+	}
+	old := atomic.SwapInt32(&s.listening, value)
+	if old != value {
+		// Either we could have missed some notifications or the cached entries
+		// were created with a short TTL, start from scratch in both cases.
+		s.invalidateAll()
+	}
+}
+
+func (s *ServiceImpl) invalidateAll() {
+	if s.Cache != nil {
+		s.Cache.Flush()
+	}
+	// Memory indexes could have missed track changes, they are loaded again on first use.
+	s.dropAllMemoryIndexes()
+}
+
+// handleChange updates the local state after a change was made, either by this
+// instance or by another instance sharing the same database.
+func (s *ServiceImpl) handleChange(event *ChangeEvent) {
+	switch event.Type {
+	case ChangeCatalogUpdated, ChangeCatalogDeleted:
+		if s.Cache != nil {
+			s.Cache.Delete(catalogCacheKey(event.AccountID, event.Catalog))
+			s.Cache.Delete(stopListCacheKey(event.CatalogID))
+		}
+		// The index will be loaded again on first use, if it's still enabled.
+		s.dropMemoryIndex(event.CatalogID)
+	case ChangeTrackUpdated, ChangeTrackDeleted:
+		idx := s.existingMemoryIndex(event.CatalogID)
+		if idx != nil {
+			err := idx.TrackChanged(idx.db, event.TrackID)
+			if err != nil {
+				log.Printf("Failed to update memory index for catalog_id=%v: %v", event.CatalogID, err)
+				s.dropMemoryIndex(event.CatalogID)
+			}
+		}
+	case ChangeAccountUpdated:
+		if s.Cache != nil {
+			s.Cache.Delete(accountLimitsCacheKey(event.AccountID))
+		}
+	case ChangeAccountDeleted:
+		if s.Cache != nil {
+			s.Cache.Delete(accountCacheKey(event.Account))
+			s.Cache.Delete(accountLimitsCacheKey(event.AccountID))
+		}
+	case ChangeCatalogCreated:
+	default:
+		log.Printf("Ignoring unknown change type %q", event.Type)
+	}
+}
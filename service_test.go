@@ -3,13 +3,16 @@ package priv
 import (
 	"database/sql"
 	_ "github.com/lib/pq"
+	"github.com/patrickmn/go-cache"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 var testDB *sql.DB
 
-func connectToDB(t *testing.T) *sql.DB {
+func connectToDB(t testing.TB) *sql.DB {
 	if testDB != nil {
 		return testDB
 	}
@@ -36,3 +39,48 @@ func TestService_GetAccount(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, account)
 }
+
+func TestService_GetAccount_Cached(t *testing.T) {
+	db := connectToDB(t)
+	service := NewService(db)
+	service.Cache = cache.New(time.Minute, time.Minute)
+	account1, err := service.GetAccount("test1")
+	require.NoError(t, err)
+	account2, err := service.GetAccount("test1")
+	require.NoError(t, err)
+	assert.Equal(t, account1.(*AccountImpl).id, account2.(*AccountImpl).id)
+}
+
+func TestService_HandleChange_CatalogDeleted(t *testing.T) {
+	service := NewService(nil)
+	service.Cache = cache.New(time.Minute, time.Minute)
+	service.Cache.Set(catalogCacheKey(1, "cat1"), 10, time.Minute)
+	service.Cache.Set(catalogCacheKey(1, "cat2"), 11, time.Minute)
+
+	service.handleChange(&ChangeEvent{Type: ChangeCatalogDeleted, AccountID: 1, CatalogID: 10, Catalog: "cat1"})
+
+	_, found := service.Cache.Get(catalogCacheKey(1, "cat1"))
+	assert.False(t, found)
+	_, found = service.Cache.Get(catalogCacheKey(1, "cat2"))
+	assert.True(t, found)
+}
+
+func TestService_SetListening(t *testing.T) {
+	service := NewService(nil)
+	service.Cache = cache.New(time.Minute, time.Minute)
+	assert.Equal(t, ShortCacheTTL, service.cacheTTL())
+
+	service.Cache.Set(catalogCacheKey(1, "cat1"), 10, time.Minute)
+	service.memoryIndexes = map[int]*MemoryIndex{10: NewMemoryIndex(10)}
+	service.setListening(true)
+	assert.Equal(t, CacheTTL, service.cacheTTL())
+	_, found := service.Cache.Get(catalogCacheKey(1, "cat1"))
+	assert.False(t, found, "cache should be flushed after connecting")
+	assert.Nil(t, service.existingMemoryIndex(10), "memory indexes could have missed changes and should be dropped")
+
+	service.Cache.Set(catalogCacheKey(1, "cat1"), 10, time.Minute)
+	service.setListening(false)
+	assert.Equal(t, ShortCacheTTL, service.cacheTTL())
+	_, found = service.Cache.Get(catalogCacheKey(1, "cat1"))
+	assert.False(t, found, "cache should be flushed after disconnecting")
+}
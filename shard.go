@@ -0,0 +1,498 @@
+package priv
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// CentralShardID is the shard of catalogs stored in the central database, next to the account and catalog registry.
+const CentralShardID = 0
+
+// MoveBatchSize is the number of tracks copied in one transaction while moving a catalog between shards or layouts.
+const MoveBatchSize = 1000
+
+// catalogLockNamespace is the first key of advisory locks taken on catalog IDs.
+const catalogLockNamespace = 1
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// AddShard registers a database that can hold catalog tables. New catalogs are placed on the registered
+// shard with the fewest catalogs, the central database only keeps catalogs that were created before.
+func (s *ServiceImpl) AddShard(shardID int, db *sql.DB) {
+	if s.shards == nil {
+		s.shards = make(map[int]*sql.DB)
+	}
+	s.shards[shardID] = db
+}
+
+func (s *ServiceImpl) shardDB(shardID int) (*sql.DB, error) {
+	if shardID == CentralShardID {
+		return s.db, nil
+	}
+	db, exists := s.shards[shardID]
+	if !exists {
+		return nil, errors.Errorf("unknown shard %d", shardID)
+	}
+	return db, nil
+}
+
+// shardReadDB returns the database that should be used for read-only queries on the shard.
+func (s *ServiceImpl) shardReadDB(shardID int) (*sql.DB, error) {
+	if shardID == CentralShardID {
+		return s.readDB(), nil
+	}
+	return s.shardDB(shardID)
+}
+
+// newCatalogShard returns the shard on which a new catalog should be created.
+func (s *ServiceImpl) newCatalogShard(tx *sql.Tx) (int, error) {
+	if len(s.shards) == 0 {
+		return CentralShardID, nil
+	}
+
+	shardIDs := make([]int, 0, len(s.shards))
+	numCatalogs := make(map[int]int)
+	for shardID := range s.shards {
+		shardIDs = append(shardIDs, shardID)
+		numCatalogs[shardID] = 0
+	}
+	sort.Ints(shardIDs)
+
+	rows, err := tx.Query("SELECT shard_id, count(*) FROM catalog GROUP BY shard_id")
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to count catalogs")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var shardID, count int
+		err = rows.Scan(&shardID, &count)
+		if err != nil {
+			return 0, errors.WithMessage(err, "failed to count catalogs")
+		}
+		numCatalogs[shardID] = count
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to count catalogs")
+	}
+
+	best := shardIDs[0]
+	for _, shardID := range shardIDs[1:] {
+		if numCatalogs[shardID] < numCatalogs[best] {
+			best = shardID
+		}
+	}
+	return best, nil
+}
+
+// shardedTx is a transaction on the central database, which holds the catalog registry and delivers change
+// notifications, paired with a transaction on the catalog's shard. Both are the same transaction for
+// catalogs stored in the central database.
+type shardedTx struct {
+	tx      *sql.Tx
+	shardTx *sql.Tx
+}
+
+// withShard opens a transaction on the shard to go with the transaction on the central database.
+func (s *ServiceImpl) withShard(tx *sql.Tx, shardID int) (*shardedTx, error) {
+	if shardID == CentralShardID {
+		return &shardedTx{tx: tx, shardTx: tx}, nil
+	}
+	db, err := s.shardDB(shardID)
+	if err != nil {
+		return nil, err
+	}
+	shardTx, err := db.Begin()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open shard transaction")
+	}
+	return &shardedTx{tx: tx, shardTx: shardTx}, nil
+}
+
+func (t *shardedTx) Rollback() {
+	if t.shardTx != t.tx {
+		t.shardTx.Rollback()
+	}
+	t.tx.Rollback()
+}
+
+// Commit commits the shard transaction first, so that the catalog registry never refers to uncommitted tables.
+func (t *shardedTx) Commit() error {
+	if t.shardTx != t.tx {
+		err := t.shardTx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return t.tx.Commit()
+}
+
+// beginWrite opens transactions for modifying tracks of the catalog. Tracks are not modified while the
+// catalog is being moved to another shard or its new index is swapped in. If the catalog was moved,
+// reindexed or converted to a different index type or layout in the meantime, the transactions are opened with the new settings.
+func (c *CatalogImpl) beginWrite() (*shardedTx, error) {
+	for {
+		tx, err := c.db.Begin()
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to open transaction")
+		}
+		stx, err := c.service().withShard(tx, c.settings.ShardID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		_, err = stx.shardTx.Exec("SELECT pg_advisory_xact_lock_shared($1, $2)", catalogLockNamespace, c.id)
+		if err != nil {
+			stx.Rollback()
+			return nil, errors.WithMessage(err, "failed to lock catalog")
+		}
+
+		var settings CatalogSettings
+		err = stx.tx.QueryRow("SELECT "+catalogSettingsColumns+" FROM catalog WHERE id = $1", c.id).Scan(settings.scanDest()...)
+		if err != nil {
+			stx.Rollback()
+			return nil, errors.WithMessage(err, "failed to get catalog")
+		}
+		if settings.ShardID == c.settings.ShardID && settings.IndexGeneration == c.settings.IndexGeneration && settings.IndexType == c.settings.IndexType && settings.Layout == c.settings.Layout {
+			return stx, nil
+		}
+
+		stx.Rollback()
+		c.settings = settings
+	}
+}
+
+// catalogMove copies a catalog's tracks between shards or storage layouts. The index is rebuilt from the fingerprints
+// in the destination tables.
+type catalogMove struct {
+	src    catalogTables
+	dst    catalogTables
+	params IndexParams
+	index  fingerprintIndex
+	stop   stopList
+}
+
+const moveTrackColumns = "id, external_id, fingerprint, fingerprint_sha1, fingerprint_version, duration, metadata"
+
+// copyTracks copies the tracks returned by the query, which must select moveTrackColumns ordered by ID. It returns
+// the number of copied tracks and the ID of the last one.
+func (m *catalogMove) copyTracks(src queryer, dst *sql.Tx, query string, args ...interface{}) (int, int, error) {
+	rows, err := src.Query(query, args...)
+	if err != nil {
+		return 0, 0, errors.WithMessage(err, "failed to fetch tracks")
+	}
+	defer rows.Close()
+
+	insertQuery := fmt.Sprintf("INSERT INTO %s (%s%s) VALUES (%s$1, $2, $3, $4, $5, $6, $7)",
+		m.dst.name("track"), m.dst.insertColumns(), moveTrackColumns, m.dst.insertValues())
+
+	numTracks, lastID := 0, 0
+	for rows.Next() {
+		var id, fingerprintVersion int
+		var externalID string
+		var fingerprint, fingerprintSHA1 []byte
+		var duration float64
+		var metadata *[]byte
+		err = rows.Scan(&id, &externalID, &fingerprint, &fingerprintSHA1, &fingerprintVersion, &duration, &metadata)
+		if err != nil {
+			return 0, 0, errors.WithMessage(err, "failed to fetch tracks")
+		}
+		fp, err := chromaprint.ParseFingerprint(fingerprint)
+		if err != nil {
+			return 0, 0, errors.WithMessage(err, "failed to parse fingerprint")
+		}
+		_, err = dst.Exec(insertQuery, id, externalID, fingerprint, fingerprintSHA1, fingerprintVersion, duration, metadata)
+		if err != nil {
+			return 0, 0, errors.WithMessage(err, "failed to insert track")
+		}
+		err = m.index.insertTrack(dst, id, m.params.extractQuery(fp), m.stop)
+		if err != nil {
+			return 0, 0, err
+		}
+		numTracks++
+		lastID = id
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, 0, errors.WithMessage(err, "failed to fetch tracks")
+	}
+	return numTracks, lastID, nil
+}
+
+func trackIDs(q queryer, tables catalogTables) (map[int]bool, error) {
+	rows, err := q.Query("SELECT t.id FROM " + tables.from("track", "t"))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch track IDs")
+	}
+	defer rows.Close()
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to fetch track IDs")
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// catchUp makes the destination tables an exact copy of the source tables, which must not be modified in the meantime.
+func (m *catalogMove) catchUp(src *sql.Tx, dst *sql.Tx) error {
+	srcIDs, err := trackIDs(src, m.src)
+	if err != nil {
+		return err
+	}
+	dstIDs, err := trackIDs(dst, m.dst)
+	if err != nil {
+		return err
+	}
+
+	var missing []int
+	for id := range srcIDs {
+		if !dstIDs[id] {
+			missing = append(missing, id)
+		}
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id = any($1::int[]) ORDER BY id", moveTrackColumns, m.src.from("track", "t"))
+	_, _, err = m.copyTracks(src, dst, query, pq.Array(missing))
+	if err != nil {
+		return err
+	}
+
+	// Updated tracks get a new ID, so their old versions are removed here.
+	for id := range dstIDs {
+		if !srcIDs[id] {
+			_, err = dst.Exec(fmt.Sprintf("DELETE FROM %s WHERE %sid = $1", m.dst.name("track"), m.dst.where()), id)
+			if err != nil {
+				return errors.WithMessage(err, "failed to delete track")
+			}
+			err = m.index.deleteTrack(dst, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return updateTrackSequence(dst, m.dst)
+}
+
+// copyBatches copies the catalog's tracks in batches, each in its own transaction, so that the catalog stays
+// available. The progress function, if set, is called with the number of tracks copied so far after each batch.
+func (m *catalogMove) copyBatches(srcDB, dstDB *sql.DB, progress func(numCopied int) error) error {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id > $1 ORDER BY id LIMIT %d", moveTrackColumns, m.src.from("track", "t"), MoveBatchSize)
+	numCopied, lastID := 0, 0
+	for {
+		dstTx, err := dstDB.Begin()
+		if err != nil {
+			return errors.WithMessage(err, "failed to open shard transaction")
+		}
+		numTracks, batchLastID, err := m.copyTracks(srcDB, dstTx, query, lastID)
+		if err != nil {
+			dstTx.Rollback()
+			return err
+		}
+		err = dstTx.Commit()
+		if err != nil {
+			return errors.WithMessage(err, "commit failed")
+		}
+		numCopied += numTracks
+		if progress != nil {
+			err = progress(numCopied)
+			if err != nil {
+				return err
+			}
+		}
+		if numTracks < MoveBatchSize {
+			return nil
+		}
+		lastID = batchLastID
+	}
+}
+
+// MoveCatalog relocates the catalog to another shard. Tracks are copied while the catalog stays available,
+// only the final catch-up blocks modifications. Settings of the catalog can't be changed during the move.
+func (s *ServiceImpl) MoveCatalog(catalogID int, shardID int) error {
+	dstDB, err := s.shardDB(shardID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	// The catalog can't be changed in any other way until the move is finished. The row is not locked with
+	// FOR UPDATE, because the transaction stays open for the whole copy and that would also block inserts of
+	// rows referencing the catalog.
+	event := &ChangeEvent{Type: ChangeCatalogUpdated, CatalogID: catalogID}
+	var srcShardID, generation int
+	var layout, indexType string
+	m := &catalogMove{}
+	err = tx.QueryRow("SELECT account_id, name, shard_id, layout, index_type, index_generation, "+indexParamsColumns+" FROM catalog WHERE id = $1 FOR NO KEY UPDATE", catalogID).
+		Scan(append([]interface{}{&event.AccountID, &event.Catalog, &srcShardID, &layout, &indexType, &generation}, m.params.scanDest()...)...)
+	if err != nil {
+		return errors.WithMessage(err, "failed to get catalog")
+	}
+	if srcShardID == shardID {
+		return nil
+	}
+	srcDB, err := s.shardDB(srcShardID)
+	if err != nil {
+		return err
+	}
+
+	m.src, err = newCatalogTables(layout, catalogID)
+	if err != nil {
+		return err
+	}
+	m.dst = m.src
+	m.index, err = newFingerprintIndex(indexType, m.dst.index(generation), m.params)
+	if err != nil {
+		return err
+	}
+	stopValues, err := loadStopList(tx, catalogID)
+	if err != nil {
+		return err
+	}
+	m.stop = newStopList(stopValues)
+
+	started := time.Now()
+
+	err = m.createTables(dstDB)
+	if err != nil {
+		return err
+	}
+	moved := false
+	defer func() {
+		if !moved {
+			err := dropCatalogTables(dstDB, m.dst, m.index)
+			if err != nil {
+				log.Printf("Failed to clean up catalog_id=%v on shard %v: %v", catalogID, shardID, err)
+			}
+		}
+	}()
+
+	err = m.copyBatches(srcDB, dstDB, nil)
+	if err != nil {
+		return err
+	}
+
+	srcTx, err := srcDB.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer srcTx.Rollback()
+
+	// Wait for running modifications to finish and block new ones until the catalog is moved.
+	_, err = srcTx.Exec("SELECT pg_advisory_xact_lock($1, $2)", catalogLockNamespace, catalogID)
+	if err != nil {
+		return errors.WithMessage(err, "failed to lock catalog")
+	}
+
+	dstTx, err := dstDB.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer dstTx.Rollback()
+
+	err = m.catchUp(srcTx, dstTx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE catalog SET shard_id = $1 WHERE id = $2", shardID, catalogID)
+	if err != nil {
+		return errors.WithMessage(err, "failed to update catalog")
+	}
+
+	err = notifyChange(tx, event)
+	if err != nil {
+		return err
+	}
+
+	err = dstTx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+	moved = true
+
+	s.handleChange(event)
+	log.Printf("Moved catalog_id=%v from shard %v to shard %v in %v", catalogID, srcShardID, shardID, time.Since(started))
+
+	err = m.index.dropTables(srcTx)
+	if err != nil {
+		return err
+	}
+	err = m.src.dropTable(srcTx, "track")
+	if err != nil {
+		return errors.WithMessage(err, "failed to drop track table")
+	}
+	err = srcTx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+	return nil
+}
+
+// createTables creates the destination tables. Leftovers of a failed move are removed first.
+func (m *catalogMove) createTables(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer tx.Rollback()
+
+	err = m.index.dropTables(tx)
+	if err != nil {
+		return err
+	}
+	err = m.dst.dropTable(tx, "track")
+	if err != nil {
+		return errors.WithMessage(err, "failed to drop track table")
+	}
+	err = m.dst.createTable(tx, "track")
+	if err != nil {
+		return errors.WithMessage(err, "failed to create track table")
+	}
+	err = m.index.createTables(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dropCatalogTables drops the track table and the index of a catalog.
+func dropCatalogTables(db *sql.DB, tables catalogTables, index fingerprintIndex) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open shard transaction")
+	}
+	defer tx.Rollback()
+
+	err = index.dropTables(tx)
+	if err != nil {
+		return err
+	}
+	err = tables.dropTable(tx, "track")
+	if err != nil {
+		return errors.WithMessage(err, "failed to drop track table")
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,92 @@
+package priv
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+func TestService_ShardDB(t *testing.T) {
+	db := &sql.DB{}
+	shard := &sql.DB{}
+	service := NewService(db)
+	service.AddShard(1, shard)
+
+	shardDB, err := service.shardDB(CentralShardID)
+	assert.NoError(t, err)
+	assert.Equal(t, db, shardDB)
+
+	shardDB, err = service.shardDB(1)
+	assert.NoError(t, err)
+	assert.Equal(t, shard, shardDB)
+
+	_, err = service.shardDB(2)
+	assert.Error(t, err)
+}
+
+func TestService_MoveCatalog(t *testing.T) {
+	shardURLs, err := ParseShardDatabaseEnv(true)
+	require.NoError(t, err)
+	shardURL, exists := shardURLs[1]
+	if !exists {
+		t.Skip("shard 1 is not configured")
+	}
+	shardDB, err := sql.Open("postgres", shardURL)
+	require.NoError(t, err)
+	defer shardDB.Close()
+
+	service := NewService(connectToDB(t))
+	account, err := service.GetAccount(fmt.Sprintf("test:%s", t.Name()))
+	require.NoError(t, err)
+	catalog := account.Repository().Catalog(fmt.Sprintf("cat_%d", rand.Uint32()))
+
+	masterFP := loadTestFingerprint(t, "calibre_sunrise")
+	_, err = catalog.CreateTrack("t1", masterFP, 0, Metadata{"name": "Track 1"}, false)
+	require.NoError(t, err)
+	_, err = catalog.CreateTrack("t2", loadTestFingerprint(t, "radio1_3_calibre_sunshine"), 0, nil, false)
+	require.NoError(t, err)
+	err = catalog.DeleteTrack("t2")
+	require.NoError(t, err)
+
+	settings, err := catalog.Settings()
+	require.NoError(t, err)
+	assert.Equal(t, CentralShardID, settings.ShardID)
+
+	service.AddShard(1, shardDB)
+	queryFP := loadTestFingerprint(t, "radio1_3_calibre_sunshine")
+	for _, shardID := range []int{1, CentralShardID} {
+		err = service.MoveCatalog(catalog.(*CatalogImpl).id, shardID)
+		require.NoError(t, err)
+
+		catalog := account.Repository().Catalog(catalog.Name())
+		settings, err := catalog.Settings()
+		require.NoError(t, err)
+		assert.Equal(t, shardID, settings.ShardID)
+
+		results, err := catalog.Search(queryFP, &SearchOptions{Stream: true})
+		require.NoError(t, err)
+		if assert.Len(t, results.Results, 1, "shard %d", shardID) {
+			assert.Equal(t, "t1", results.Results[0].ID)
+			assert.Equal(t, Metadata{"name": "Track 1"}, results.Results[0].Metadata)
+		}
+
+		stats, err := catalog.Stats()
+		require.NoError(t, err)
+		assert.Equal(t, 1, stats.NumTracks)
+	}
+
+	// Tracks written through a stale catalog are routed to the new shard.
+	err = service.MoveCatalog(catalog.(*CatalogImpl).id, 1)
+	require.NoError(t, err)
+	_, err = catalog.CreateTrack("t3", queryFP, 0, nil, true)
+	require.NoError(t, err)
+	stats, err := account.Repository().Catalog(catalog.Name()).Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.NumTracks)
+
+	err = catalog.DeleteCatalog()
+	require.NoError(t, err)
+}
@@ -1,2 +1,3 @@
 CREATE EXTENSION intarray;
 CREATE EXTENSION pgcrypto;
+CREATE EXTENSION btree_gin;
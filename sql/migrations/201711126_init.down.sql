@@ -1,8 +1,4 @@
-BEGIN;
-
 DROP TABLE track_index_tpl;
 DROP TABLE track_tpl;
 DROP TABLE catalog;
 DROP TABLE account;
-
-COMMIT;
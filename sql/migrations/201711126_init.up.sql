@@ -1,5 +1,3 @@
-BEGIN;
-
 CREATE TABLE account (
     id          serial PRIMARY KEY,
     external_id text NOT NULL
@@ -39,5 +37,3 @@ CREATE TABLE track_index_tpl (
 
 CREATE INDEX track_index_tpl_idx_values
     ON track_index_tpl USING GIN (values gin__int_ops);
-
-COMMIT;
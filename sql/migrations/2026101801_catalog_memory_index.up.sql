@@ -0,0 +1 @@
+ALTER TABLE catalog ADD COLUMN memory_index boolean NOT NULL DEFAULT false;
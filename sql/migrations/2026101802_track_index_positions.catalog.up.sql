@@ -0,0 +1,3 @@
+{{if eq .IndexType "gin"}}{{range .Segments}}
+ALTER TABLE track_index_{{$.CatalogID}}_{{.}}{{$.IndexSuffix}} ADD COLUMN positions int4 [];
+{{end}}{{end}}
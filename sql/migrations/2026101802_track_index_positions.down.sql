@@ -0,0 +1 @@
+ALTER TABLE track_index_tpl DROP COLUMN positions;
@@ -0,0 +1 @@
+ALTER TABLE track_index_tpl ADD COLUMN positions int4 [];
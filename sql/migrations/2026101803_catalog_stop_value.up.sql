@@ -0,0 +1,6 @@
+CREATE TABLE catalog_stop_value (
+    catalog_id int NOT NULL REFERENCES catalog (id) ON DELETE CASCADE,
+    value      int NOT NULL,
+    num_tracks int NOT NULL,
+    PRIMARY KEY (catalog_id, value)
+);
@@ -0,0 +1,11 @@
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM catalog WHERE index_type <> 'gin') THEN
+        RAISE EXCEPTION 'all catalogs must be converted to the gin index type first';
+    END IF;
+END
+$$;
+
+DROP TABLE track_hash_tpl;
+
+ALTER TABLE catalog DROP COLUMN index_type;
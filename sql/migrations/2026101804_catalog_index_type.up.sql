@@ -0,0 +1,12 @@
+ALTER TABLE catalog ADD COLUMN index_type text NOT NULL DEFAULT 'gin';
+
+CREATE TABLE track_hash_tpl (
+    hash     int4 NOT NULL,
+    track_id int  NOT NULL,
+    pos      int  NOT NULL
+);
+
+CREATE INDEX track_hash_tpl_idx_hash
+    ON track_hash_tpl (hash, track_id, pos);
+CREATE INDEX track_hash_tpl_idx_track_id
+    ON track_hash_tpl (track_id);
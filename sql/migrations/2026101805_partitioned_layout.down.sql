@@ -0,0 +1,13 @@
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM catalog WHERE layout <> 'table_per_catalog') THEN
+        RAISE EXCEPTION 'all catalogs must be converted to the table_per_catalog layout first';
+    END IF;
+END
+$$;
+
+DROP TABLE track_hash;
+DROP TABLE track_index;
+DROP TABLE track;
+
+ALTER TABLE catalog DROP COLUMN layout;
@@ -0,0 +1,52 @@
+CREATE EXTENSION IF NOT EXISTS btree_gin;
+
+ALTER TABLE catalog ADD COLUMN layout text NOT NULL DEFAULT 'table_per_catalog';
+
+CREATE TABLE track (
+    catalog_id       int   NOT NULL,
+    id               serial,
+    external_id      text  NOT NULL,
+    fingerprint      bytea NOT NULL,
+    fingerprint_sha1 bytea NOT NULL,
+    metadata         jsonb,
+    PRIMARY KEY (catalog_id, id)
+) PARTITION BY HASH (catalog_id);
+
+CREATE UNIQUE INDEX track_idx_external_id
+    ON track (catalog_id, external_id);
+CREATE INDEX track_idx_data_sha1
+    ON track (catalog_id, fingerprint_sha1);
+
+CREATE TABLE track_index (
+    catalog_id int     NOT NULL,
+    track_id   int     NOT NULL,
+    segment    int     NOT NULL,
+    values     int4 [] NOT NULL,
+    positions  int4 [],
+    PRIMARY KEY (catalog_id, track_id, segment)
+) PARTITION BY HASH (catalog_id);
+
+CREATE INDEX track_index_idx_values
+    ON track_index USING GIN (catalog_id, values gin__int_ops);
+
+CREATE TABLE track_hash (
+    catalog_id int  NOT NULL,
+    hash       int4 NOT NULL,
+    track_id   int  NOT NULL,
+    pos        int  NOT NULL
+) PARTITION BY HASH (catalog_id);
+
+CREATE INDEX track_hash_idx_hash
+    ON track_hash (catalog_id, hash, track_id, pos);
+CREATE INDEX track_hash_idx_track_id
+    ON track_hash (catalog_id, track_id);
+
+DO $$
+BEGIN
+    FOR i IN 0..15 LOOP
+        EXECUTE format('CREATE TABLE track_p%s PARTITION OF track FOR VALUES WITH (MODULUS 16, REMAINDER %s)', i, i);
+        EXECUTE format('CREATE TABLE track_index_p%s PARTITION OF track_index FOR VALUES WITH (MODULUS 16, REMAINDER %s)', i, i);
+        EXECUTE format('CREATE TABLE track_hash_p%s PARTITION OF track_hash FOR VALUES WITH (MODULUS 16, REMAINDER %s)', i, i);
+    END LOOP;
+END
+$$;
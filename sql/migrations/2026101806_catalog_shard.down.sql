@@ -0,0 +1,9 @@
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM catalog WHERE shard_id <> 0) THEN
+        RAISE EXCEPTION 'all catalogs must be moved to the central database first';
+    END IF;
+END
+$$;
+
+ALTER TABLE catalog DROP COLUMN shard_id;
@@ -0,0 +1 @@
+ALTER TABLE catalog ADD COLUMN shard_id int NOT NULL DEFAULT 0;
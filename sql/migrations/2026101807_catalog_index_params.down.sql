@@ -0,0 +1,29 @@
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM catalog WHERE index_generation <> 0 OR index_query_bits <> 26 OR index_segments <> 16 OR index_values_per_segment <> 128) THEN
+        RAISE EXCEPTION 'all catalogs must be reindexed with the default parameters first';
+    END IF;
+END
+$$;
+
+DROP INDEX track_hash_idx_hash;
+DROP INDEX track_hash_idx_track_id;
+ALTER TABLE track_hash DROP COLUMN generation;
+CREATE INDEX track_hash_idx_hash
+    ON track_hash (catalog_id, hash, track_id, pos);
+CREATE INDEX track_hash_idx_track_id
+    ON track_hash (catalog_id, track_id);
+
+DROP INDEX track_index_idx_values;
+ALTER TABLE track_index DROP CONSTRAINT track_index_pkey;
+ALTER TABLE track_index DROP COLUMN generation;
+ALTER TABLE track_index ADD PRIMARY KEY (catalog_id, track_id, segment);
+CREATE INDEX track_index_idx_values
+    ON track_index USING GIN (catalog_id, values gin__int_ops);
+
+DROP TABLE catalog_reindex;
+
+ALTER TABLE catalog DROP COLUMN index_generation;
+ALTER TABLE catalog DROP COLUMN index_values_per_segment;
+ALTER TABLE catalog DROP COLUMN index_segments;
+ALTER TABLE catalog DROP COLUMN index_query_bits;
@@ -0,0 +1,30 @@
+ALTER TABLE catalog ADD COLUMN index_query_bits int NOT NULL DEFAULT 26;
+ALTER TABLE catalog ADD COLUMN index_segments int NOT NULL DEFAULT 16;
+ALTER TABLE catalog ADD COLUMN index_values_per_segment int NOT NULL DEFAULT 128;
+ALTER TABLE catalog ADD COLUMN index_generation int NOT NULL DEFAULT 0;
+
+CREATE TABLE catalog_reindex (
+    catalog_id         int         NOT NULL PRIMARY KEY REFERENCES catalog (id) ON DELETE CASCADE,
+    query_bits         int         NOT NULL,
+    segments           int         NOT NULL,
+    values_per_segment int         NOT NULL,
+    num_tracks         int         NOT NULL,
+    num_indexed        int         NOT NULL DEFAULT 0,
+    started            timestamptz NOT NULL DEFAULT now(),
+    updated            timestamptz NOT NULL DEFAULT now()
+);
+
+ALTER TABLE track_index ADD COLUMN generation int NOT NULL DEFAULT 0;
+ALTER TABLE track_index DROP CONSTRAINT track_index_pkey;
+ALTER TABLE track_index ADD PRIMARY KEY (catalog_id, generation, track_id, segment);
+DROP INDEX track_index_idx_values;
+CREATE INDEX track_index_idx_values
+    ON track_index USING GIN (catalog_id, generation, values gin__int_ops);
+
+ALTER TABLE track_hash ADD COLUMN generation int NOT NULL DEFAULT 0;
+DROP INDEX track_hash_idx_hash;
+DROP INDEX track_hash_idx_track_id;
+CREATE INDEX track_hash_idx_hash
+    ON track_hash (catalog_id, generation, hash, track_id, pos);
+CREATE INDEX track_hash_idx_track_id
+    ON track_hash (catalog_id, generation, track_id);
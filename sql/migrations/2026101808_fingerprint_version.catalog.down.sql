@@ -0,0 +1 @@
+ALTER TABLE track_{{.CatalogID}} DROP COLUMN fingerprint_version;
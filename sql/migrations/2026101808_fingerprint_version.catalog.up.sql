@@ -0,0 +1,2 @@
+ALTER TABLE track_{{.CatalogID}} ADD COLUMN fingerprint_version int NOT NULL DEFAULT 1;
+UPDATE track_{{.CatalogID}} SET fingerprint_version = get_byte(fingerprint, 0) WHERE get_byte(fingerprint, 0) <> 1;
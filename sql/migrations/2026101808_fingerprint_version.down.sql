@@ -0,0 +1,5 @@
+ALTER TABLE track DROP COLUMN fingerprint_version;
+
+ALTER TABLE track_tpl DROP COLUMN fingerprint_version;
+
+ALTER TABLE catalog DROP COLUMN fingerprint_versions;
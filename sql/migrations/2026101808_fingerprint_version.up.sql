@@ -0,0 +1,6 @@
+ALTER TABLE catalog ADD COLUMN fingerprint_versions int[];
+
+ALTER TABLE track_tpl ADD COLUMN fingerprint_version int NOT NULL DEFAULT 1;
+
+ALTER TABLE track ADD COLUMN fingerprint_version int NOT NULL DEFAULT 1;
+UPDATE track SET fingerprint_version = get_byte(fingerprint, 0) WHERE get_byte(fingerprint, 0) <> 1;
@@ -0,0 +1,6 @@
+ALTER TABLE track_{{.CatalogID}} ADD COLUMN duration double precision;
+UPDATE track_{{.CatalogID}} SET duration = CASE
+    WHEN (get_byte(fingerprint, 1) * 65536 + get_byte(fingerprint, 2) * 256 + get_byte(fingerprint, 3)) = 0 THEN 0
+    ELSE (get_byte(fingerprint, 1) * 65536 + get_byte(fingerprint, 2) * 256 + get_byte(fingerprint, 3)) * 0.123809 + 2.60009
+END;
+ALTER TABLE track_{{.CatalogID}} ALTER COLUMN duration SET NOT NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE track DROP COLUMN duration;
+
+ALTER TABLE track_tpl DROP COLUMN duration;
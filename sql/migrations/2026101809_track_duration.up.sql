@@ -0,0 +1,10 @@
+ALTER TABLE track_tpl ADD COLUMN duration double precision NOT NULL;
+
+-- The duration of existing tracks is derived from the number of hashes, which is stored in the fingerprint header.
+-- The formula matches FingerprintConfigs[1].Duration, there are no tracks with other versions.
+ALTER TABLE track ADD COLUMN duration double precision;
+UPDATE track SET duration = CASE
+    WHEN (get_byte(fingerprint, 1) * 65536 + get_byte(fingerprint, 2) * 256 + get_byte(fingerprint, 3)) = 0 THEN 0
+    ELSE (get_byte(fingerprint, 1) * 65536 + get_byte(fingerprint, 2) * 256 + get_byte(fingerprint, 3)) * 0.123809 + 2.60009
+END;
+ALTER TABLE track ALTER COLUMN duration SET NOT NULL;
@@ -0,0 +1,15 @@
+CREATE TABLE api_key (
+    id         serial      PRIMARY KEY,
+    account_id int         NOT NULL REFERENCES account (id),
+    name       text        NOT NULL DEFAULT '',
+    key_prefix text        NOT NULL,
+    key_hash   bytea       NOT NULL,
+    created    timestamptz NOT NULL DEFAULT now(),
+    last_used  timestamptz,
+    revoked    timestamptz
+);
+
+CREATE UNIQUE INDEX api_key_idx_key_hash
+    ON api_key (key_hash);
+CREATE INDEX api_key_idx_account_id
+    ON api_key (account_id);
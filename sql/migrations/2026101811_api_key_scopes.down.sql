@@ -0,0 +1,2 @@
+ALTER TABLE api_key DROP COLUMN catalogs;
+ALTER TABLE api_key DROP COLUMN scopes;
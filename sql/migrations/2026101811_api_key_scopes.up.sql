@@ -0,0 +1,2 @@
+ALTER TABLE api_key ADD COLUMN scopes text[];
+ALTER TABLE api_key ADD COLUMN catalogs text[];
@@ -0,0 +1,5 @@
+ALTER TABLE account DROP COLUMN max_tracks;
+ALTER TABLE account DROP COLUMN max_tracks_per_catalog;
+ALTER TABLE account DROP COLUMN max_catalogs;
+ALTER TABLE account DROP COLUMN write_rate_limit;
+ALTER TABLE account DROP COLUMN search_rate_limit;
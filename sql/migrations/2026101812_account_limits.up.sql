@@ -0,0 +1,5 @@
+ALTER TABLE account ADD COLUMN search_rate_limit int;
+ALTER TABLE account ADD COLUMN write_rate_limit int;
+ALTER TABLE account ADD COLUMN max_catalogs int;
+ALTER TABLE account ADD COLUMN max_tracks_per_catalog int;
+ALTER TABLE account ADD COLUMN max_tracks int;
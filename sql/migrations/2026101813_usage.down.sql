@@ -0,0 +1,2 @@
+DROP TABLE usage_flush;
+DROP TABLE usage;
@@ -0,0 +1,13 @@
+CREATE TABLE usage (
+    account_id int         NOT NULL REFERENCES account (id),
+    day        date        NOT NULL,
+    metric     text        NOT NULL,
+    value      bigint      NOT NULL,
+    updated    timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (account_id, day, metric)
+);
+
+CREATE TABLE usage_flush (
+    id      text        PRIMARY KEY,
+    created timestamptz NOT NULL DEFAULT now()
+);
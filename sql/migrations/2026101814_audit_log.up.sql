@@ -0,0 +1,16 @@
+CREATE TABLE audit_log (
+    id         bigserial   PRIMARY KEY,
+    account_id int         NOT NULL REFERENCES account (id),
+    created    timestamptz NOT NULL DEFAULT now(),
+    principal  text        NOT NULL,
+    ip         text        NOT NULL DEFAULT '',
+    request_id text        NOT NULL DEFAULT '',
+    action     text        NOT NULL,
+    catalog    text        NOT NULL DEFAULT '',
+    object     text        NOT NULL DEFAULT ''
+);
+
+CREATE INDEX audit_log_idx_account_id
+    ON audit_log (account_id, id);
+CREATE INDEX audit_log_idx_created
+    ON audit_log (created);
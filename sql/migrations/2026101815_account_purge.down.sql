@@ -0,0 +1,2 @@
+DROP TABLE account_purge;
+ALTER TABLE account DROP COLUMN deleted;
@@ -0,0 +1,19 @@
+ALTER TABLE account ADD COLUMN deleted timestamptz;
+
+CREATE TABLE account_purge (
+    account_id        int         PRIMARY KEY,
+    external_id       text        NOT NULL,
+    keep_usage        boolean     NOT NULL DEFAULT false,
+    keep_audit_log    boolean     NOT NULL DEFAULT false,
+    started           timestamptz NOT NULL DEFAULT now(),
+    finished          timestamptz,
+    catalogs          int         NOT NULL DEFAULT 0,
+    tracks            bigint      NOT NULL DEFAULT 0,
+    api_keys          bigint      NOT NULL DEFAULT 0,
+    usage_records     bigint      NOT NULL DEFAULT 0,
+    audit_log_entries bigint      NOT NULL DEFAULT 0,
+    report            text
+);
+
+CREATE INDEX account_purge_idx_external_id
+    ON account_purge (external_id);
@@ -0,0 +1 @@
+DROP TABLE catalog_track_count;
@@ -0,0 +1,8 @@
+CREATE TABLE catalog_track_count (
+    catalog_id int    PRIMARY KEY,
+    account_id int    NOT NULL,
+    tracks     bigint NOT NULL
+);
+
+CREATE INDEX catalog_track_count_idx_account_id
+    ON catalog_track_count (account_id);
@@ -0,0 +1 @@
+ALTER TABLE catalog_reindex DROP COLUMN index_type;
@@ -0,0 +1,5 @@
+ALTER TABLE catalog_reindex ADD COLUMN index_type text;
+
+UPDATE catalog_reindex r SET index_type = c.index_type FROM catalog c WHERE c.id = r.catalog_id;
+
+ALTER TABLE catalog_reindex ALTER COLUMN index_type SET NOT NULL;
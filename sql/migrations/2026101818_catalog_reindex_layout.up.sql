@@ -0,0 +1,5 @@
+ALTER TABLE catalog_reindex ADD COLUMN layout text;
+
+UPDATE catalog_reindex r SET layout = c.layout FROM catalog c WHERE c.id = r.catalog_id;
+
+ALTER TABLE catalog_reindex ALTER COLUMN layout SET NOT NULL;
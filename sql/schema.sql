@@ -1,28 +1,141 @@
 BEGIN;
 
 CREATE TABLE account (
-    id          serial PRIMARY KEY,
-    external_id text NOT NULL
+    id                     serial PRIMARY KEY,
+    external_id            text NOT NULL,
+    search_rate_limit      int,
+    write_rate_limit       int,
+    max_catalogs           int,
+    max_tracks_per_catalog int,
+    max_tracks             int,
+    deleted                timestamptz
 );
 
 CREATE UNIQUE INDEX account_idx_external_id
     ON account (external_id);
 
+CREATE TABLE api_key (
+    id         serial      PRIMARY KEY,
+    account_id int         NOT NULL REFERENCES account (id),
+    name       text        NOT NULL DEFAULT '',
+    key_prefix text        NOT NULL,
+    key_hash   bytea       NOT NULL,
+    created    timestamptz NOT NULL DEFAULT now(),
+    last_used  timestamptz,
+    revoked    timestamptz,
+    scopes     text[],
+    catalogs   text[]
+);
+
+CREATE UNIQUE INDEX api_key_idx_key_hash
+    ON api_key (key_hash);
+CREATE INDEX api_key_idx_account_id
+    ON api_key (account_id);
+
+CREATE TABLE usage (
+    account_id int         NOT NULL REFERENCES account (id),
+    day        date        NOT NULL,
+    metric     text        NOT NULL,
+    value      bigint      NOT NULL,
+    updated    timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (account_id, day, metric)
+);
+
+CREATE TABLE usage_flush (
+    id      text        PRIMARY KEY,
+    created timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE audit_log (
+    id         bigserial   PRIMARY KEY,
+    account_id int         NOT NULL REFERENCES account (id),
+    created    timestamptz NOT NULL DEFAULT now(),
+    principal  text        NOT NULL,
+    ip         text        NOT NULL DEFAULT '',
+    request_id text        NOT NULL DEFAULT '',
+    action     text        NOT NULL,
+    catalog    text        NOT NULL DEFAULT '',
+    object     text        NOT NULL DEFAULT ''
+);
+
+CREATE INDEX audit_log_idx_account_id
+    ON audit_log (account_id, id);
+CREATE INDEX audit_log_idx_created
+    ON audit_log (created);
+
+CREATE TABLE account_purge (
+    account_id        int         PRIMARY KEY,
+    external_id       text        NOT NULL,
+    keep_usage        boolean     NOT NULL DEFAULT false,
+    keep_audit_log    boolean     NOT NULL DEFAULT false,
+    started           timestamptz NOT NULL DEFAULT now(),
+    finished          timestamptz,
+    catalogs          int         NOT NULL DEFAULT 0,
+    tracks            bigint      NOT NULL DEFAULT 0,
+    api_keys          bigint      NOT NULL DEFAULT 0,
+    usage_records     bigint      NOT NULL DEFAULT 0,
+    audit_log_entries bigint      NOT NULL DEFAULT 0,
+    report            text
+);
+
+CREATE INDEX account_purge_idx_external_id
+    ON account_purge (external_id);
+
 CREATE TABLE catalog (
-    id         serial PRIMARY KEY,
-    account_id int  NOT NULL REFERENCES account (id),
-    name       text NOT NULL
+    id                       serial PRIMARY KEY,
+    account_id               int     NOT NULL REFERENCES account (id),
+    name                     text    NOT NULL,
+    memory_index             boolean NOT NULL DEFAULT false,
+    index_type               text    NOT NULL DEFAULT 'gin',
+    layout                   text    NOT NULL DEFAULT 'table_per_catalog',
+    shard_id                 int     NOT NULL DEFAULT 0,
+    index_query_bits         int     NOT NULL DEFAULT 26,
+    index_segments           int     NOT NULL DEFAULT 16,
+    index_values_per_segment int     NOT NULL DEFAULT 128,
+    index_generation         int     NOT NULL DEFAULT 0,
+    fingerprint_versions     int[]
 );
 
 CREATE UNIQUE INDEX catalog_idx_account_id_name
     ON catalog (account_id, name);
 
+CREATE TABLE catalog_stop_value (
+    catalog_id int NOT NULL REFERENCES catalog (id) ON DELETE CASCADE,
+    value      int NOT NULL,
+    num_tracks int NOT NULL,
+    PRIMARY KEY (catalog_id, value)
+);
+
+CREATE TABLE catalog_reindex (
+    catalog_id         int         NOT NULL PRIMARY KEY REFERENCES catalog (id) ON DELETE CASCADE,
+    query_bits         int         NOT NULL,
+    segments           int         NOT NULL,
+    values_per_segment int         NOT NULL,
+    num_tracks         int         NOT NULL,
+    num_indexed        int         NOT NULL DEFAULT 0,
+    started            timestamptz NOT NULL DEFAULT now(),
+    updated            timestamptz NOT NULL DEFAULT now(),
+    index_type         text        NOT NULL,
+    layout             text        NOT NULL
+);
+
+CREATE TABLE catalog_track_count (
+    catalog_id int    PRIMARY KEY,
+    account_id int    NOT NULL,
+    tracks     bigint NOT NULL
+);
+
+CREATE INDEX catalog_track_count_idx_account_id
+    ON catalog_track_count (account_id);
+
 CREATE TABLE track_tpl (
-    id               serial PRIMARY KEY,
-    external_id      text  NOT NULL,
-    fingerprint      bytea NOT NULL,
-    fingerprint_sha1 bytea NOT NULL,
-    metadata         jsonb
+    id                  serial PRIMARY KEY,
+    external_id         text  NOT NULL,
+    fingerprint         bytea NOT NULL,
+    fingerprint_sha1    bytea NOT NULL,
+    metadata            jsonb,
+    fingerprint_version int   NOT NULL DEFAULT 1,
+    duration            double precision NOT NULL
 );
 
 CREATE UNIQUE INDEX track_tpl_idx_external_id
@@ -31,13 +144,105 @@ CREATE INDEX track_tpl_idx_data_sha1
     ON track_tpl (fingerprint_sha1);
 
 CREATE TABLE track_index_tpl (
-    track_id int     NOT NULL,
-    segment  int     NOT NULL,
-    values   int4 [] NOT NULL,
+    track_id  int     NOT NULL,
+    segment   int     NOT NULL,
+    values    int4 [] NOT NULL,
+    positions int4 [],
     PRIMARY KEY (track_id, segment)
 );
 
 CREATE INDEX track_index_tpl_idx_values
     ON track_index_tpl USING GIN (values gin__int_ops);
 
+CREATE TABLE track_hash_tpl (
+    hash     int4 NOT NULL,
+    track_id int  NOT NULL,
+    pos      int  NOT NULL
+);
+
+CREATE INDEX track_hash_tpl_idx_hash
+    ON track_hash_tpl (hash, track_id, pos);
+CREATE INDEX track_hash_tpl_idx_track_id
+    ON track_hash_tpl (track_id);
+
+CREATE TABLE track (
+    catalog_id          int   NOT NULL,
+    id                  serial,
+    external_id         text  NOT NULL,
+    fingerprint         bytea NOT NULL,
+    fingerprint_sha1    bytea NOT NULL,
+    metadata            jsonb,
+    fingerprint_version int   NOT NULL DEFAULT 1,
+    duration            double precision NOT NULL,
+    PRIMARY KEY (catalog_id, id)
+) PARTITION BY HASH (catalog_id);
+
+CREATE UNIQUE INDEX track_idx_external_id
+    ON track (catalog_id, external_id);
+CREATE INDEX track_idx_data_sha1
+    ON track (catalog_id, fingerprint_sha1);
+
+CREATE TABLE track_index (
+    catalog_id int     NOT NULL,
+    generation int     NOT NULL DEFAULT 0,
+    track_id   int     NOT NULL,
+    segment    int     NOT NULL,
+    values     int4 [] NOT NULL,
+    positions  int4 [],
+    PRIMARY KEY (catalog_id, generation, track_id, segment)
+) PARTITION BY HASH (catalog_id);
+
+CREATE INDEX track_index_idx_values
+    ON track_index USING GIN (catalog_id, generation, values gin__int_ops);
+
+CREATE TABLE track_hash (
+    catalog_id int  NOT NULL,
+    generation int  NOT NULL DEFAULT 0,
+    hash       int4 NOT NULL,
+    track_id   int  NOT NULL,
+    pos        int  NOT NULL
+) PARTITION BY HASH (catalog_id);
+
+CREATE INDEX track_hash_idx_hash
+    ON track_hash (catalog_id, generation, hash, track_id, pos);
+CREATE INDEX track_hash_idx_track_id
+    ON track_hash (catalog_id, generation, track_id);
+
+DO $$
+BEGIN
+    FOR i IN 0..15 LOOP
+        EXECUTE format('CREATE TABLE track_p%s PARTITION OF track FOR VALUES WITH (MODULUS 16, REMAINDER %s)', i, i);
+        EXECUTE format('CREATE TABLE track_index_p%s PARTITION OF track_index FOR VALUES WITH (MODULUS 16, REMAINDER %s)', i, i);
+        EXECUTE format('CREATE TABLE track_hash_p%s PARTITION OF track_hash FOR VALUES WITH (MODULUS 16, REMAINDER %s)', i, i);
+    END LOOP;
+END
+$$;
+
+CREATE TABLE schema_migrations (
+    version    bigint      PRIMARY KEY,
+    name       text        NOT NULL,
+    applied_at timestamptz NOT NULL DEFAULT now()
+);
+
+INSERT INTO schema_migrations (version, name) VALUES
+    (201711126, 'init'),
+    (2026101801, 'catalog_memory_index'),
+    (2026101802, 'track_index_positions'),
+    (2026101803, 'catalog_stop_value'),
+    (2026101804, 'catalog_index_type'),
+    (2026101805, 'partitioned_layout'),
+    (2026101806, 'catalog_shard'),
+    (2026101807, 'catalog_index_params'),
+    (2026101808, 'fingerprint_version'),
+    (2026101809, 'track_duration'),
+    (2026101810, 'api_key'),
+    (2026101811, 'api_key_scopes'),
+    (2026101812, 'account_limits'),
+    (2026101813, 'usage'),
+    (2026101814, 'audit_log'),
+    (2026101815, 'account_purge'),
+    (2026101816, 'catalog_track_count'),
+    (2026101817, 'catalog_reindex_index_type'),
+    (2026101818, 'catalog_reindex_layout');
+
 COMMIT;
@@ -0,0 +1,278 @@
+package priv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"log"
+)
+
+// StopListMinTracks is the minimum number of tracks a value must appear in to be considered for the stop list.
+const StopListMinTracks = 100
+
+// StopListMinFraction is the minimum fraction of the catalog's tracks a value must appear in to be considered for the stop list.
+const StopListMinFraction = 0.05
+
+// MaxStopListSize is the maximum number of values in the stop list of a catalog.
+const MaxStopListSize = 1000
+
+// StopValue is a query value that appears in too many tracks to be useful for searching,
+// e.g. because it's produced by silence or digital noise.
+type StopValue struct {
+	Value     int32
+	NumTracks int
+}
+
+type stopList map[int32]bool
+
+func stopListCacheKey(catalogID int) string {
+	return fmt.Sprintf("stop_list:%d", catalogID)
+}
+
+func (c *CatalogImpl) StopList() ([]StopValue, error) {
+	db := c.service().readDB()
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	exists, err := c.checkCatalog(tx, db == c.db)
+	if !exists {
+		return nil, err
+	}
+
+	return loadStopList(tx, c.id)
+}
+
+func loadStopList(q queryer, catalogID int) ([]StopValue, error) {
+	rows, err := q.Query("SELECT value, num_tracks FROM catalog_stop_value WHERE catalog_id = $1 ORDER BY num_tracks DESC, value", catalogID)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch stop list")
+	}
+	defer rows.Close()
+
+	values := []StopValue{}
+	for rows.Next() {
+		var value StopValue
+		err = rows.Scan(&value.Value, &value.NumTracks)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to fetch stop list")
+		}
+		values = append(values, value)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch stop list")
+	}
+	return values, nil
+}
+
+func newStopList(values []StopValue) stopList {
+	stop := make(stopList, len(values))
+	for _, value := range values {
+		stop[value.Value] = true
+	}
+	return stop
+}
+
+// stopList returns the set of values that should be neither indexed nor searched for. The stop list
+// is stored in the central database, so tx must not be a shard transaction.
+func (c *CatalogImpl) stopList(tx *sql.Tx) (stopList, error) {
+	cache := c.service().Cache
+	cacheKey := stopListCacheKey(c.id)
+	if cache != nil {
+		cached, found := cache.Get(cacheKey)
+		if found {
+			return cached.(stopList), nil
+		}
+	}
+
+	values, err := loadStopList(tx, c.id)
+	if err != nil {
+		return nil, err
+	}
+	stop := newStopList(values)
+
+	if cache != nil {
+		cache.Set(cacheKey, stop, c.service().cacheTTL())
+	}
+	return stop, nil
+}
+
+// UpdateStopList recomputes the stop list from the frequency of values in the index. Values that
+// are already on the stop list are no longer indexed, so their frequency is counted in the fingerprints
+// of the tracks, and they are dropped if they are no longer frequent enough.
+func (c *CatalogImpl) UpdateStopList() ([]StopValue, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	exists, err := c.checkCatalog(tx, true)
+	if !exists {
+		return nil, err
+	}
+
+	stx, err := c.service().withShard(tx, c.settings.ShardID)
+	if err != nil {
+		return nil, err
+	}
+	defer stx.Rollback()
+
+	var numTracks int
+	err = stx.shardTx.QueryRow("SELECT count(*) FROM " + c.tables().from("track", "t")).Scan(&numTracks)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to count tracks")
+	}
+
+	minTracks := int(float64(numTracks) * StopListMinFraction)
+	if minTracks < StopListMinTracks {
+		minTracks = StopListMinTracks
+	}
+
+	idx, err := c.index()
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT value, count(DISTINCT track_id) AS num_tracks FROM (" + idx.valuesQuery() + ") v " +
+		"GROUP BY value HAVING count(DISTINCT track_id) >= $1"
+
+	stop := make(map[int32]int)
+	rows, err := stx.shardTx.Query(query, minTracks)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to compute value frequencies")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value StopValue
+		err = rows.Scan(&value.Value, &value.NumTracks)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to compute value frequencies")
+		}
+		stop[value.Value] = value.NumTracks
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to compute value frequencies")
+	}
+
+	oldValues, err := loadStopList(tx, c.id)
+	if err != nil {
+		return nil, err
+	}
+	oldCounts, err := c.countTrackValues(stx.shardTx, newStopList(oldValues))
+	if err != nil {
+		return nil, err
+	}
+	for value, count := range oldCounts {
+		if count >= minTracks {
+			stop[value] = count
+		} else {
+			delete(stop, value)
+		}
+	}
+
+	values := make([]int32, 0, len(stop))
+	counts := make([]int32, 0, len(stop))
+	for value, count := range stop {
+		values = append(values, value)
+		counts = append(counts, int32(count))
+	}
+
+	_, err = tx.Exec("DELETE FROM catalog_stop_value WHERE catalog_id = $1", c.id)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to delete stop list")
+	}
+
+	_, err = tx.Exec("INSERT INTO catalog_stop_value (catalog_id, value, num_tracks) "+
+		"SELECT $1, v.value, v.num_tracks FROM unnest($2::int[], $3::int[]) AS v(value, num_tracks) "+
+		"ORDER BY v.num_tracks DESC, v.value LIMIT $4", c.id, pq.Array(values), pq.Array(counts), MaxStopListSize)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to insert stop list")
+	}
+
+	result, err := loadStopList(tx, c.id)
+	if err != nil {
+		return nil, err
+	}
+
+	event := c.newChangeEvent(ChangeCatalogUpdated)
+	err = notifyChange(tx, event)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stx.Commit()
+	if err != nil {
+		return nil, errors.WithMessage(err, "commit failed")
+	}
+
+	c.service().handleChange(event)
+	log.Printf("Updated stop list of catalog name=%v account_id=%v values=%v", c.name, c.repo.account.id, len(result))
+	catalogActionCount.WithLabelValues("update_stop_list").Inc()
+	return result, nil
+}
+
+// removeStopValues drops stop values from the query.
+func removeStopValues(segmentHashes [][]queryHash, stop stopList) {
+	if len(stop) == 0 {
+		return
+	}
+	for segment, hashes := range segmentHashes {
+		filtered := make([]queryHash, 0, len(hashes))
+		for _, h := range hashes {
+			if !stop[h.Value] {
+				filtered = append(filtered, h)
+			}
+		}
+		segmentHashes[segment] = filtered
+	}
+}
+
+// countTrackValues returns the number of tracks whose fingerprints contain each of the values.
+func (c *CatalogImpl) countTrackValues(tx *sql.Tx, values stopList) (map[int32]int, error) {
+	counts := make(map[int32]int, len(values))
+	if len(values) == 0 {
+		return counts, nil
+	}
+	for value := range values {
+		counts[value] = 0
+	}
+
+	rows, err := tx.Query("SELECT t.fingerprint FROM " + c.tables().from("track", "t"))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch tracks")
+	}
+	defer rows.Close()
+	seen := make(map[int32]bool)
+	for rows.Next() {
+		var fingerprint []byte
+		err = rows.Scan(&fingerprint)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to fetch tracks")
+		}
+		fp, err := chromaprint.ParseFingerprint(fingerprint)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to parse fingerprint")
+		}
+		for value := range seen {
+			delete(seen, value)
+		}
+		for _, value := range c.settings.IndexParams.extractQuery(fp) {
+			if values[value] && !seen[value] {
+				seen[value] = true
+				counts[value]++
+			}
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch tracks")
+	}
+	return counts, nil
+}
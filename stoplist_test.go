@@ -0,0 +1,14 @@
+package priv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRemoveStopValues(t *testing.T) {
+	segmentHashes := DefaultIndexParams.segmentQueries([]int32{1, 2, 3, 2}, true)
+	removeStopValues(segmentHashes, stopList{2: true})
+	for segment := 0; segment < NumIndexSegments; segment++ {
+		assert.Equal(t, []queryHash{{1, 0}, {3, 2}}, segmentHashes[segment])
+	}
+}
@@ -0,0 +1,337 @@
+package priv
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultUsageFlushInterval = time.Minute
+const DefaultUsageStorageInterval = time.Hour
+
+// usageFlushRetention is how long IDs of flushed batches are kept, a batch can't be retried after that.
+const usageFlushRetention = time.Hour * 24 * 7
+
+// Usage metrics, searches are counted as usageSearchPrefix + search type.
+const (
+	UsageTracksAdded   = "tracks_added"
+	UsageTracksDeleted = "tracks_deleted"
+	UsageTracks        = "tracks"
+	UsageStorageBytes  = "storage_bytes"
+	usageSearchPrefix  = "search:"
+)
+
+const usageDayFormat = "2006-01-02"
+
+type usageKey struct {
+	accountID int
+	day       string
+	metric    string
+}
+
+type usageBatch struct {
+	id     string
+	counts map[usageKey]int64
+}
+
+// UsageMeter counts what each account uses per day, for billing. Counts are kept in memory
+// and periodically added to the usage table. Each batch of counts is flushed with a unique ID,
+// which is stored in the same transaction, so a batch that is retried after a commit failed
+// in an unknown state is not counted twice.
+type UsageMeter struct {
+	service *ServiceImpl
+	now     func() time.Time
+	mu      sync.Mutex
+	counts  map[usageKey]int64
+	flushMu sync.Mutex
+	pending *usageBatch
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewUsageMeter(service *ServiceImpl) *UsageMeter {
+	return &UsageMeter{service: service, now: time.Now, counts: make(map[usageKey]int64)}
+}
+
+// Add counts usage of the account today. It does nothing if the meter is nil.
+func (m *UsageMeter) Add(accountID int, metric string, n int64) {
+	if m == nil {
+		return
+	}
+	key := usageKey{accountID: accountID, day: m.now().UTC().Format(usageDayFormat), metric: metric}
+	m.mu.Lock()
+	m.counts[key] += n
+	m.mu.Unlock()
+}
+
+// Flush adds the counts to the usage table. If that fails, the counts are flushed again
+// in the same batch next time.
+func (m *UsageMeter) Flush() error {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+
+	if m.pending == nil {
+		m.mu.Lock()
+		if len(m.counts) > 0 {
+			m.pending = &usageBatch{id: uuid.NewV4().String(), counts: m.counts}
+			m.counts = make(map[usageKey]int64)
+		}
+		m.mu.Unlock()
+		if m.pending == nil {
+			return nil
+		}
+	}
+
+	err := m.flushBatch(m.pending)
+	if err != nil {
+		return err
+	}
+	m.pending = nil
+	return nil
+}
+
+func (m *UsageMeter) flushBatch(batch *usageBatch) error {
+	tx, err := m.service.db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO usage_flush (id) VALUES ($1) ON CONFLICT DO NOTHING", batch.id)
+	if err != nil {
+		return errors.WithMessage(err, "failed to insert usage batch")
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithMessage(err, "failed to insert usage batch")
+	}
+	if inserted == 0 {
+		log.Printf("Usage batch %s was already flushed", batch.id)
+		return nil
+	}
+
+	// Counts of deleted accounts are dropped. The account is locked, so that it can't be marked as deleted
+	// until the counts are committed and its usage is purged after them.
+	for key, value := range batch.counts {
+		_, err = tx.Exec(`
+			INSERT INTO usage (account_id, day, metric, value) SELECT $1, $2, $3, $4 FROM account WHERE id = $1 AND deleted IS NULL FOR KEY SHARE
+			ON CONFLICT (account_id, day, metric) DO UPDATE SET value = usage.value + EXCLUDED.value, updated = now()`,
+			key.accountID, key.day, key.metric, value)
+		if err != nil {
+			return errors.WithMessage(err, "failed to update usage")
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM usage_flush WHERE created < now() - $1 * interval '1 second'", usageFlushRetention.Seconds())
+	if err != nil {
+		return errors.WithMessage(err, "failed to delete old usage batches")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+	return nil
+}
+
+// UpdateStorage records how many tracks each account has and how much storage they use.
+// The storage is measured at most once per interval, even if there are several API nodes.
+func (m *UsageMeter) UpdateStorage(interval time.Duration) error {
+	s := m.service
+	now := m.now()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open transaction")
+	}
+	defer tx.Rollback()
+
+	// Concurrent transactions inserting the same ID wait for this one to finish and then skip the update.
+	batchID := fmt.Sprintf("storage:%d", now.Truncate(interval).Unix())
+	result, err := tx.Exec("INSERT INTO usage_flush (id) VALUES ($1) ON CONFLICT DO NOTHING", batchID)
+	if err != nil {
+		return errors.WithMessage(err, "failed to insert usage batch")
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithMessage(err, "failed to insert usage batch")
+	}
+	if inserted == 0 {
+		return nil
+	}
+
+	type catalogInfo struct {
+		id, accountID, shardID int
+		layout                 string
+	}
+	var catalogs []catalogInfo
+	rows, err := tx.Query("SELECT id, account_id, shard_id, layout FROM catalog")
+	if err != nil {
+		return errors.WithMessage(err, "failed to fetch catalogs")
+	}
+	for rows.Next() {
+		var catalog catalogInfo
+		err = rows.Scan(&catalog.id, &catalog.accountID, &catalog.shardID, &catalog.layout)
+		if err != nil {
+			rows.Close()
+			return errors.WithMessage(err, "failed to fetch catalogs")
+		}
+		catalogs = append(catalogs, catalog)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return errors.WithMessage(err, "failed to fetch catalogs")
+	}
+
+	tracks := make(map[int]int64)
+	storageBytes := make(map[int]int64)
+	for _, catalog := range catalogs {
+		tables, err := newCatalogTables(catalog.layout, catalog.id)
+		if err != nil {
+			return err
+		}
+		db, err := s.shardReadDB(catalog.shardID)
+		if err != nil {
+			return err
+		}
+		var count, size int64
+		query := fmt.Sprintf("SELECT count(*), coalesce(sum(pg_column_size(t.*)), 0) FROM %s", tables.from("track", "t"))
+		err = db.QueryRow(query).Scan(&count, &size)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("failed to measure storage of catalog %d", catalog.id))
+		}
+		tracks[catalog.accountID] += count
+		storageBytes[catalog.accountID] += size
+	}
+
+	day := now.UTC().Format(usageDayFormat)
+	for accountID := range tracks {
+		for metric, value := range map[string]int64{UsageTracks: tracks[accountID], UsageStorageBytes: storageBytes[accountID]} {
+			_, err = tx.Exec(`
+				INSERT INTO usage (account_id, day, metric, value) SELECT $1, $2, $3, $4 FROM account WHERE id = $1 AND deleted IS NULL FOR KEY SHARE
+				ON CONFLICT (account_id, day, metric) DO UPDATE SET value = EXCLUDED.value, updated = now()`,
+				accountID, day, metric, value)
+			if err != nil {
+				return errors.WithMessage(err, "failed to update usage")
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit failed")
+	}
+	log.Printf("Updated storage usage of %d accounts", len(tracks))
+	return nil
+}
+
+// Start periodically flushes the counts and measures storage in the background.
+// Storage is not measured if storageInterval is zero.
+func (m *UsageMeter) Start(flushInterval time.Duration, storageInterval time.Duration) {
+	m.quit = make(chan struct{})
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		flushTicker := time.NewTicker(flushInterval)
+		defer flushTicker.Stop()
+		var storageTick <-chan time.Time
+		if storageInterval > 0 {
+			storageTicker := time.NewTicker(storageInterval)
+			defer storageTicker.Stop()
+			storageTick = storageTicker.C
+		}
+		for {
+			select {
+			case <-flushTicker.C:
+				err := m.Flush()
+				if err != nil {
+					log.Printf("Failed to flush usage: %v", err)
+				}
+			case <-storageTick:
+				err := m.UpdateStorage(storageInterval)
+				if err != nil {
+					log.Printf("Failed to update storage usage: %v", err)
+				}
+			case <-m.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the background updates and flushes the remaining counts.
+func (m *UsageMeter) Close() error {
+	if m.quit != nil {
+		close(m.quit)
+		m.wg.Wait()
+		m.quit = nil
+	}
+	return m.Flush()
+}
+
+// DailyUsage is what an account used in one day. Tracks and StorageBytes are the last
+// measured values of the day.
+type DailyUsage struct {
+	Date          string           `json:"date"`
+	Searches      map[string]int64 `json:"searches"`
+	TracksAdded   int64            `json:"tracks_added"`
+	TracksDeleted int64            `json:"tracks_deleted"`
+	Tracks        int64            `json:"tracks"`
+	StorageBytes  int64            `json:"storage_bytes"`
+}
+
+// Usage returns the account's flushed usage between the two dates, inclusive. Days without any usage are omitted.
+func (account *AccountImpl) Usage(from time.Time, to time.Time) ([]DailyUsage, error) {
+	query := "SELECT day, metric, value FROM usage WHERE account_id = $1 AND day BETWEEN $2 AND $3"
+	rows, err := account.service.readDB().Query(query, account.id, from.Format(usageDayFormat), to.Format(usageDayFormat))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch usage")
+	}
+	defer rows.Close()
+
+	days := make(map[string]*DailyUsage)
+	for rows.Next() {
+		var day time.Time
+		var metric string
+		var value int64
+		err = rows.Scan(&day, &metric, &value)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to fetch usage")
+		}
+		date := day.Format(usageDayFormat)
+		usage, exists := days[date]
+		if !exists {
+			usage = &DailyUsage{Date: date, Searches: make(map[string]int64)}
+			days[date] = usage
+		}
+		switch {
+		case strings.HasPrefix(metric, usageSearchPrefix):
+			usage.Searches[strings.TrimPrefix(metric, usageSearchPrefix)] = value
+		case metric == UsageTracksAdded:
+			usage.TracksAdded = value
+		case metric == UsageTracksDeleted:
+			usage.TracksDeleted = value
+		case metric == UsageTracks:
+			usage.Tracks = value
+		case metric == UsageStorageBytes:
+			usage.StorageBytes = value
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to fetch usage")
+	}
+
+	result := make([]DailyUsage, 0, len(days))
+	for _, usage := range days {
+		result = append(result, *usage)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date < result[j].Date })
+	return result, nil
+}
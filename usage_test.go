@@ -0,0 +1,162 @@
+package priv
+
+import (
+	"github.com/acoustid/go-acoustid/chromaprint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func getTestUsageMeter(t *testing.T, account Account, now time.Time) *UsageMeter {
+	accountImpl := account.(*AccountImpl)
+	_, err := accountImpl.db.Exec("DELETE FROM usage WHERE account_id = $1", accountImpl.id)
+	require.NoError(t, err)
+	meter := NewUsageMeter(accountImpl.service)
+	meter.now = func() time.Time { return now }
+	accountImpl.service.Usage = meter
+	return meter
+}
+
+func TestUsageMeter_Add(t *testing.T) {
+	var meter *UsageMeter
+	meter.Add(1, UsageTracksAdded, 1)
+
+	meter = NewUsageMeter(nil)
+	meter.now = func() time.Time { return time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC) }
+	meter.Add(1, UsageTracksAdded, 1)
+	meter.Add(1, UsageTracksAdded, 2)
+	meter.Add(2, UsageTracksAdded, 1)
+	assert.Equal(t, map[usageKey]int64{
+		{accountID: 1, day: "2026-10-18", metric: UsageTracksAdded}: 3,
+		{accountID: 2, day: "2026-10-18", metric: UsageTracksAdded}: 1,
+	}, meter.counts)
+}
+
+func TestUsageMeter_Flush(t *testing.T) {
+	account := getTestAccount(t, connectToDB(t))
+	accountID := account.(*AccountImpl).id
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	meter := getTestUsageMeter(t, account, day.Add(time.Hour))
+
+	meter.Add(accountID, usageSearchPrefix+"normal", 2)
+	meter.Add(accountID, UsageTracksAdded, 1)
+	require.NoError(t, meter.Flush())
+	meter.Add(accountID, usageSearchPrefix+"normal", 1)
+	require.NoError(t, meter.Flush())
+	require.NoError(t, meter.Flush())
+
+	usage, err := account.Usage(day, day)
+	require.NoError(t, err)
+	assert.Equal(t, []DailyUsage{{Date: "2026-10-18", Searches: map[string]int64{"normal": 3}, TracksAdded: 1}}, usage)
+
+	usage, err = account.Usage(day.AddDate(0, 0, 1), day.AddDate(0, 0, 2))
+	require.NoError(t, err)
+	assert.Empty(t, usage)
+}
+
+func TestUsageMeter_Flush_DeletedAccount(t *testing.T) {
+	account := getTestAccount(t, connectToDB(t))
+	accountImpl := account.(*AccountImpl)
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	meter := getTestUsageMeter(t, account, day)
+
+	meter.Add(accountImpl.id, UsageTracksAdded, 1)
+	_, err := accountImpl.db.Exec("UPDATE account SET deleted = now() WHERE id = $1", accountImpl.id)
+	require.NoError(t, err)
+	defer accountImpl.db.Exec("UPDATE account SET deleted = NULL WHERE id = $1", accountImpl.id)
+	require.NoError(t, meter.Flush())
+	assert.Nil(t, meter.pending, "counts of a deleted account should be dropped, not retried")
+
+	var count int
+	require.NoError(t, accountImpl.db.QueryRow("SELECT count(*) FROM usage WHERE account_id = $1", accountImpl.id).Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestUsageMeter_Flush_Retry(t *testing.T) {
+	account := getTestAccount(t, connectToDB(t))
+	accountID := account.(*AccountImpl).id
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	meter := getTestUsageMeter(t, account, day)
+
+	batch := &usageBatch{id: "test:" + t.Name() + ":" + time.Now().String(), counts: map[usageKey]int64{
+		{accountID: accountID, day: "2026-10-18", metric: UsageTracksDeleted}: 2,
+	}}
+	require.NoError(t, meter.flushBatch(batch))
+	require.NoError(t, meter.flushBatch(batch), "a batch flushed again should not be counted")
+
+	usage, err := account.Usage(day, day)
+	require.NoError(t, err)
+	assert.Equal(t, []DailyUsage{{Date: "2026-10-18", Searches: map[string]int64{}, TracksDeleted: 2}}, usage)
+}
+
+func TestUsageMeter_Catalog(t *testing.T) {
+	account := getTestAccount(t, connectToDB(t))
+	now := time.Now()
+	meter := getTestUsageMeter(t, account, now)
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+
+	catalog := account.Repository().Catalog("cat1")
+	for _, id := range []string{"fp1", "fp2", "fp1"} {
+		_, err = catalog.CreateTrack(id, fp, 0, nil, true)
+		require.NoError(t, err)
+	}
+	require.NoError(t, catalog.DeleteTrack("fp2"))
+	_, err = catalog.Search(fp, &SearchOptions{Stream: true})
+	require.NoError(t, err)
+
+	require.NoError(t, meter.Flush())
+	require.NoError(t, meter.UpdateStorage(time.Nanosecond))
+
+	usage, err := account.Usage(now, now)
+	require.NoError(t, err)
+	require.Len(t, usage, 1)
+	assert.Equal(t, map[string]int64{"stream": 1}, usage[0].Searches)
+	assert.Equal(t, int64(2), usage[0].TracksAdded, "replaced track should not count")
+	assert.Equal(t, int64(1), usage[0].TracksDeleted)
+	assert.Equal(t, int64(1), usage[0].Tracks)
+	assert.True(t, usage[0].StorageBytes > 0)
+
+	_, err = catalog.CreateTrack("fp3", fp, 0, nil, true)
+	require.NoError(t, err)
+	require.NoError(t, meter.UpdateStorage(time.Nanosecond))
+
+	usage, err = account.Usage(now, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage[0].Tracks, "storage should be measured once per interval")
+}
+
+func TestUsageMeter_Search_Partition(t *testing.T) {
+	account := getTestAccount(t, connectToDB(t))
+	now := time.Now()
+	meter := getTestUsageMeter(t, account, now)
+
+	fp, err := chromaprint.ParseFingerprintString(TestFingerprint)
+	require.NoError(t, err)
+
+	catalog := account.Repository().Catalog("cat1")
+	service := account.(*AccountImpl).service
+	defer func() { service.Partition = nil }()
+
+	// Only the first round of a search split across nodes is counted, on the first node.
+	for index := 0; index < 2; index++ {
+		service.Partition = &Partition{Index: index, Count: 2}
+		for _, opts := range []*SearchOptions{{Hits: true}, {Hits: true, Thorough: true}, {Candidates: []int{1}}} {
+			_, err = catalog.Search(fp, opts)
+			require.NoError(t, err)
+		}
+	}
+
+	// Searches on the public endpoint of a node are always counted.
+	_, err = catalog.Search(fp, &SearchOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, meter.Flush())
+
+	usage, err := account.Usage(now, now)
+	require.NoError(t, err)
+	require.Len(t, usage, 1)
+	assert.Equal(t, map[string]int64{"normal": 2}, usage[0].Searches)
+}
@@ -1,6 +1,9 @@
 package priv
 
-import "strings"
+import (
+	"strings"
+	"time"
+)
 
 func IsValidCatalogName(name string) bool {
 	if strings.HasPrefix(name, "_") {
@@ -15,3 +18,8 @@ func IsValidTrackID(name string) bool {
 	}
 	return true
 }
+
+// secondsToDuration converts a number of seconds, as stored in the database or sent in API requests, to a duration.
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}